@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/archiver"
+	"github.com/iwvelando/imessage-archiver/internal/config"
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+)
+
+// runBackfill archives a range of past days, by default the whole history
+// in chat.db, in chunks so that an interrupted backfill can be resumed.
+func runBackfill(args []string) int {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	var configPath, fromDay, toDay string
+	var chunkDays int
+	fs.StringVar(&configPath, "config", "", "Path to configuration file")
+	fs.StringVar(&fromDay, "from", "", "First day to archive, YYYY-MM-DD (default: the day of the oldest message)")
+	fs.StringVar(&toDay, "to", "", "Last day to archive, YYYY-MM-DD (default: yesterday)")
+	fs.IntVar(&chunkDays, "chunk-days", archiver.DefaultChunkDays, "Days to export and upload at a time")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	_ = fs.Parse(args)
+
+	from, to, err := parseRange(fromDay, toDay, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	if chunkDays <= 0 {
+		fmt.Fprintf(os.Stderr, "-chunk-days must be positive\n")
+		return 2
+	}
+
+	configPath, err = resolveConfigPath(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting home directory: %v\n", err)
+		return 1
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		return 1
+	}
+	log := logger.New(cfg.LoggingLevel)
+
+	arch := archiver.New(cfg, log)
+	ctx, stop := handleSignals(arch, log)
+	defer stop()
+	return runStatus(arch.Backfill(ctx, from, to, chunkDays), "Backfill", log)
+}
+
+// parseRange parses the YYYY-MM-DD bounds of a backfill as local days. An
+// empty bound is returned as the zero time. -to must be a day before the one
+// containing now, as messages are still arriving for today.
+func parseRange(fromDay, toDay string, now time.Time) (time.Time, time.Time, error) {
+	var from, to time.Time
+	var err error
+	if fromDay != "" {
+		if from, err = time.ParseInLocation("2006-01-02", fromDay, time.Local); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid -from %q, expected YYYY-MM-DD", fromDay)
+		}
+	}
+	if toDay != "" {
+		if to, err = time.ParseInLocation("2006-01-02", toDay, time.Local); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid -to %q, expected YYYY-MM-DD", toDay)
+		}
+		now = now.In(time.Local)
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+		if !to.Before(today) {
+			return time.Time{}, time.Time{}, fmt.Errorf("-to %s is not before today, the last day that can be archived is yesterday", toDay)
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("-to %s is before -from %s", toDay, fromDay)
+	}
+	return from, to, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	now := time.Date(2024, 3, 15, 10, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name     string
+		from, to string
+		wantFrom string
+		wantTo   string
+		wantErr  bool
+	}{
+		{name: "empty", wantFrom: "", wantTo: ""},
+		{name: "range", from: "2024-01-01", to: "2024-01-31", wantFrom: "2024-01-01", wantTo: "2024-01-31"},
+		{name: "to yesterday", from: "2024-03-01", to: "2024-03-14", wantFrom: "2024-03-01", wantTo: "2024-03-14"},
+		{name: "to today", from: "2024-03-01", to: "2024-03-15", wantErr: true},
+		{name: "to in the future", to: "2025-01-01", wantErr: true},
+		{name: "to before from", from: "2024-02-01", to: "2024-01-31", wantErr: true},
+		{name: "invalid from", from: "2024-1-1", wantErr: true},
+		{name: "invalid to", to: "yesterday", wantErr: true},
+	}
+
+	format := func(day time.Time) string {
+		if day.IsZero() {
+			return ""
+		}
+		return day.Format("2006-01-02")
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to, err := parseRange(tt.from, tt.to, now)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error, got %s to %s", format(from), format(to))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRange failed: %v", err)
+			}
+			if format(from) != tt.wantFrom || format(to) != tt.wantTo {
+				t.Errorf("Expected %q to %q, got %q to %q", tt.wantFrom, tt.wantTo, format(from), format(to))
+			}
+		})
+	}
+}
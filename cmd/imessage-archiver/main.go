@@ -1,36 +1,99 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/iwvelando/imessage-archiver/internal/archiver"
 	"github.com/iwvelando/imessage-archiver/internal/config"
 	"github.com/iwvelando/imessage-archiver/internal/logger"
 )
 
+const usage = `Usage:
+  imessage-archiver [-config path]            Archive missing days to the remote server
+  imessage-archiver [-config path] -from YYYY-MM-DD [-to YYYY-MM-DD]
+                                              Archive the days of a range instead of days_to_check
+  imessage-archiver backfill [-config path] [-from YYYY-MM-DD] [-to YYYY-MM-DD] [-chunk-days n]
+                                              Archive the whole history in chat.db, resumably
+  imessage-archiver verify [-config path | -path dir]
+                                              Check an archive against its manifests
+  imessage-archiver restore [-config path] [-destination name] [-identity file]
+                            [-passphrase-file file] -out dir YYYY-MM-DD...
+                                              Download, extract, decrypt and check archived days
+  imessage-archiver extract [-identity file] [-passphrase-file file] -out dir file
+                                              Unpack a packaged (.tar.zst, .tar.zst.age) or
+                                              encrypted (.tar.age) day already on disk
+  imessage-archiver keygen [-out file]        Create an age identity for encryption.recipients
+  imessage-archiver prune [-config path] [-destination name] [-dry-run]
+                                              Remove what the retention policy no longer keeps
+`
+
 func main() {
-	var configPath string
-	flag.StringVar(&configPath, "config", "", "Path to configuration file")
-	flag.Parse()
-
-	// Default config path if not provided
-	if configPath == "" {
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error getting home directory: %v\n", err)
-			os.Exit(1)
+	// Without a subcommand the archiver runs, as it always has
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		switch os.Args[1] {
+		case "verify":
+			os.Exit(runVerify(os.Args[2:]))
+		case "restore":
+			os.Exit(runRestore(os.Args[2:]))
+		case "extract", "decrypt":
+			os.Exit(runExtract(os.Args[1], os.Args[2:]))
+		case "keygen":
+			os.Exit(runKeygen(os.Args[2:]))
+		case "prune":
+			os.Exit(runPrune(os.Args[2:]))
+		case "backfill":
+			os.Exit(runBackfill(os.Args[2:]))
+		case "help":
+			fmt.Print(usage)
+			os.Exit(0)
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n%s", os.Args[1], usage)
+			os.Exit(2)
 		}
-		configPath = filepath.Join(homeDir, ".config", "imessage-archiver", "config.yaml")
+	}
+
+	os.Exit(runArchive(os.Args[1:]))
+}
+
+func runArchive(args []string) int {
+	fs := flag.NewFlagSet("imessage-archiver", flag.ExitOnError)
+	var configPath, fromDay, toDay string
+	fs.StringVar(&configPath, "config", "", "Path to configuration file")
+	fs.StringVar(&fromDay, "from", "", "First day of a range to archive instead of days_to_check, YYYY-MM-DD")
+	fs.StringVar(&toDay, "to", "", "Last day of the range, YYYY-MM-DD (default: yesterday)")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	_ = fs.Parse(args)
+
+	from, to, err := parseRange(fromDay, toDay, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	if from.IsZero() && !to.IsZero() {
+		fmt.Fprintf(os.Stderr, "-to needs -from (use backfill to start at the oldest message)\n")
+		return 2
+	}
+
+	configPath, err = resolveConfigPath(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting home directory: %v\n", err)
+		return 1
 	}
 
 	// Load configuration
 	cfg, err := config.Load(configPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
-		os.Exit(1)
+		return 1
 	}
 
 	// Initialize logger with configured level
@@ -41,10 +104,82 @@ func main() {
 
 	// Create an instance of the Archiver
 	arch := archiver.New(cfg, log)
+	ctx, stop := handleSignals(arch, log)
+	defer stop()
+
+	// A range is archived like a backfill, chunk by chunk
+	if !from.IsZero() {
+		return runStatus(arch.Backfill(ctx, from, to, archiver.DefaultChunkDays), "Archiving process", log)
+	}
 
 	// Run the archiving process with fault tolerance
-	if err := arch.Run(); err != nil {
-		log.Error(fmt.Sprintf("Archiving process failed: %v", err))
-		os.Exit(1)
+	return runStatus(arch.Run(ctx), "Archiving process", log)
+}
+
+// exitPartialSuccess is the exit status of a run that archived some days
+// while others failed (see continue_on_error). Other failures exit with 1.
+const exitPartialSuccess = 3
+
+// runStatus logs the failure, if any, of the archiving run named what and
+// returns the exit status for it.
+func runStatus(err error, what string, log *logger.Logger) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, archiver.ErrPartialSuccess):
+		log.Warn(fmt.Sprintf("%s partially succeeded: %v", what, err))
+		return exitPartialSuccess
+	default:
+		log.Error(fmt.Sprintf("%s failed: %v", what, err))
+		return 1
+	}
+}
+
+// handleSignals stops arch at the next day boundary on the first SIGINT or
+// SIGTERM, and cancels the returned context on the second one, which kills
+// running exports and transfers. Either way the run returns, so its
+// deferred cleanup happens and the next run can resume. A third signal is
+// no longer handled and terminates the process. The returned function stops
+// handling signals.
+func handleSignals(arch *archiver.Archiver, log *logger.Logger) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-sigChan:
+			log.Info(fmt.Sprintf("Received signal %v, stopping after the current day (send it again to stop now)", sig))
+			arch.Stop()
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case sig := <-sigChan:
+			log.Info(fmt.Sprintf("Received signal %v again, stopping now", sig))
+			cancel()
+			// A third signal terminates the process the default way, in
+			// case a step does not return once cancelled
+			signal.Stop(sigChan)
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigChan)
+		cancel()
+	}
+}
+
+// resolveConfigPath returns configPath, or the default config location
+// ~/.config/imessage-archiver/config.yaml if it is empty.
+func resolveConfigPath(configPath string) (string, error) {
+	if configPath != "" {
+		return configPath, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
 	}
+	return filepath.Join(homeDir, ".config", "imessage-archiver", "config.yaml"), nil
 }
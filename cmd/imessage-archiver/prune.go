@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/config"
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+	"github.com/iwvelando/imessage-archiver/internal/prune"
+	"github.com/iwvelando/imessage-archiver/internal/transport"
+)
+
+// runPrune applies the retention policy to every destination, or to the one
+// named with -destination. With -dry-run it only lists what would go.
+func runPrune(args []string) int {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	var configPath, destinationName string
+	var dryRun bool
+	fs.StringVar(&configPath, "config", "", "Path to configuration file")
+	fs.StringVar(&destinationName, "destination", "", "Destination to prune (default: all of them)")
+	fs.BoolVar(&dryRun, "dry-run", false, "List what would be removed without removing it")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	_ = fs.Parse(args)
+
+	configPath, err := resolveConfigPath(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting home directory: %v\n", err)
+		return 1
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		return 1
+	}
+	if !cfg.Retention.Enabled() {
+		fmt.Fprintf(os.Stderr, "No retention configured, nothing to prune\n")
+		return 1
+	}
+	log := logger.New(cfg.LoggingLevel)
+
+	destinations := cfg.ArchiveDestinations()
+	if destinationName != "" {
+		destination, ok := findDestination(cfg, destinationName)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown destination: %s\n", destinationName)
+			return 1
+		}
+		destinations = []config.Destination{destination}
+	}
+
+	status := 0
+	now := time.Now()
+	for _, d := range destinations {
+		if err := pruneDestination(d, cfg.Retention, now, dryRun, log); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to prune %s: %v\n", d.Name, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// pruneDestination plans and, unless dryRun is set, applies the retention
+// policy to one destination.
+func pruneDestination(d config.Destination, policy config.RetentionConfig, now time.Time, dryRun bool, log *logger.Logger) error {
+	t := transport.New(d, log)
+	if closer, ok := t.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	result, err := prune.Plan(context.Background(), t, policy, now)
+	if err != nil {
+		return err
+	}
+	for _, note := range result.Kept {
+		fmt.Printf("%s: %s\n", d.Name, note)
+	}
+
+	for _, a := range result.Actions {
+		if dryRun {
+			fmt.Printf("%s: would %s\n", d.Name, a)
+			continue
+		}
+		if err := prune.Apply(context.Background(), t, a); err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s\n", d.Name, a)
+	}
+
+	verb := "Pruned"
+	if dryRun {
+		verb = "Would prune"
+	}
+	fmt.Printf("%s %d items from %s\n", verb, len(result.Actions), d.Name)
+	return nil
+}
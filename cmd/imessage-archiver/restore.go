@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"filippo.io/age"
+
+	"github.com/iwvelando/imessage-archiver/internal/config"
+	"github.com/iwvelando/imessage-archiver/internal/encryption"
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+	"github.com/iwvelando/imessage-archiver/internal/packaging"
+	"github.com/iwvelando/imessage-archiver/internal/restore"
+	"github.com/iwvelando/imessage-archiver/internal/transport"
+)
+
+// runRestore downloads archived days from a destination into -out, one
+// YYYY/MM/DD directory per day, extracting and decrypting them if needed.
+func runRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	var configPath, destinationName, identityFile, passphraseFile, outDir string
+	fs.StringVar(&configPath, "config", "", "Path to configuration file")
+	fs.StringVar(&destinationName, "destination", "", "Destination to restore from (default: the first one)")
+	fs.StringVar(&identityFile, "identity", "", "age identity file to decrypt with")
+	fs.StringVar(&passphraseFile, "passphrase-file", "", "File holding the passphrase to decrypt with")
+	fs.StringVar(&outDir, "out", "", "Directory to restore into")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	_ = fs.Parse(args)
+
+	if outDir == "" || fs.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "restore needs -out and at least one YYYY-MM-DD day\n\n%s", usage)
+		return 2
+	}
+	for _, day := range fs.Args() {
+		if _, err := time.Parse("2006-01-02", day); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid day %q, expected YYYY-MM-DD\n", day)
+			return 2
+		}
+	}
+
+	configPath, err := resolveConfigPath(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting home directory: %v\n", err)
+		return 1
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		return 1
+	}
+	log := logger.New(cfg.LoggingLevel)
+
+	destination, ok := findDestination(cfg, destinationName)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown destination: %s\n", destinationName)
+		return 1
+	}
+
+	// Unencrypted days restore without an identity
+	var identities []age.Identity
+	if identityFile != "" || passphraseFile != "" {
+		if identities, err = encryption.Identities(identityFile, passphraseFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading identities: %v\n", err)
+			return 1
+		}
+	}
+
+	t := transport.New(destination, log)
+	if closer, ok := t.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	status := 0
+	for _, day := range fs.Args() {
+		dayDir := filepath.Join(outDir, filepath.FromSlash(transport.DayPath(day)))
+		if err := restore.Day(context.Background(), t, day, dayDir, identities); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to restore %s: %v\n", day, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("Restored %s to %s\n", day, dayDir)
+	}
+	return status
+}
+
+// findDestination returns the destination called name, or the first one if
+// name is empty.
+func findDestination(cfg *config.Config, name string) (config.Destination, bool) {
+	destinations := cfg.ArchiveDestinations()
+	if name == "" {
+		return destinations[0], true
+	}
+	for _, d := range destinations {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return config.Destination{}, false
+}
+
+// runExtract unpacks a packaged or encrypted day that is already on this
+// machine, e.g. read straight off the backup host. It also runs as decrypt,
+// the name it had before packaging was added.
+func runExtract(name string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	var identityFile, passphraseFile, outDir string
+	fs.StringVar(&identityFile, "identity", "", "age identity file to decrypt with")
+	fs.StringVar(&passphraseFile, "passphrase-file", "", "File holding the passphrase to decrypt with")
+	fs.StringVar(&outDir, "out", "", "Directory to unpack into")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	_ = fs.Parse(args)
+
+	if outDir == "" || fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "%s needs -out and one .tar.zst, .tar.zst.age or .tar.age file\n\n%s", name, usage)
+		return 2
+	}
+
+	// Unencrypted packages extract without an identity
+	var identities []age.Identity
+	if identityFile != "" || passphraseFile != "" {
+		var err error
+		if identities, err = encryption.Identities(identityFile, passphraseFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading identities: %v\n", err)
+			return 1
+		}
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening archive: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	if err := packaging.Extract(f, fs.Arg(0), identities, outDir); err != nil {
+		fmt.Fprintf(os.Stderr, "Extraction failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Unpacked %s to %s\n", fs.Arg(0), outDir)
+	return 0
+}
+
+// runKeygen creates an age identity. The identity file must be kept off the
+// backup host; its public key goes into encryption.recipients.
+func runKeygen(args []string) int {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	var outPath string
+	fs.StringVar(&outPath, "out", "", "File to write the identity to (default: standard output)")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	_ = fs.Parse(args)
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error generating identity: %v\n", err)
+		return 1
+	}
+	content := fmt.Sprintf("# created: %s\n# public key: %s\n%s\n",
+		time.Now().Format(time.RFC3339), identity.Recipient(), identity)
+
+	if outPath == "" {
+		fmt.Print(content)
+	} else {
+		// Never overwrite an existing identity, archives may depend on it
+		f, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating identity file: %v\n", err)
+			return 1
+		}
+		if _, err := f.WriteString(content); err != nil {
+			f.Close()
+			fmt.Fprintf(os.Stderr, "Error writing identity file: %v\n", err)
+			return 1
+		}
+		if err := f.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing identity file: %v\n", err)
+			return 1
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Public key: %s\n", identity.Recipient())
+	return 0
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/iwvelando/imessage-archiver/internal/config"
+	"github.com/iwvelando/imessage-archiver/internal/verify"
+)
+
+// runVerify audits an archive tree against its day manifests. It is meant to
+// run on the backup host, so -path avoids needing a full archiver config.
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	var configPath, archivePath string
+	fs.StringVar(&configPath, "config", "", "Path to configuration file (uses the remote_archive_path of the first local destination)")
+	fs.StringVar(&archivePath, "path", "", "Archive directory to verify")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	_ = fs.Parse(args)
+
+	if archivePath == "" {
+		configPath, err := resolveConfigPath(configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting home directory: %v\n", err)
+			return 1
+		}
+		cfg, err := config.Load(configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+			return 1
+		}
+		archivePath, err = verifyPath(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+
+	report, err := verify.Archive(archivePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Verification failed: %v\n", err)
+		return 1
+	}
+
+	report.WriteSummary(os.Stdout)
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
+
+// verifyPath picks the archive directory to audit from the configuration.
+// Only a local destination is a directory on this machine; the paths of the
+// others are on the server, or not paths at all for s3.
+func verifyPath(cfg *config.Config) (string, error) {
+	for _, d := range cfg.ArchiveDestinations() {
+		if d.Type == config.DestinationLocal {
+			return d.RemoteArchivePath, nil
+		}
+	}
+	return "", errors.New("no local destination in the configuration; run verify on the backup host with -path <archive directory>")
+}
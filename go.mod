@@ -1,5 +1,20 @@
 module github.com/iwvelando/imessage-archiver
 
-go 1.24
+go 1.24.0
 
-require gopkg.in/yaml.v2 v2.4.0
+require (
+	filippo.io/age v1.2.1
+	github.com/klauspost/compress v1.18.0
+	github.com/mattn/go-sqlite3 v1.14.33
+	github.com/pkg/sftp v1.13.10
+	golang.org/x/crypto v0.45.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
+)
+
+// pkg/sftp only uses the Walker of kr/fs, which this revision already provides.
+replace github.com/kr/fs => github.com/kr/fs v0.0.0-20131111012553-2788f0dbd169
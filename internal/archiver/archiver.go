@@ -1,42 +1,198 @@
 package archiver
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
-	"os/exec"
-	"os/signal"
+	"path"
 	"path/filepath"
-	"strings"
-	"syscall"
+	"slices"
+	"sort"
+	"sync/atomic"
 	"time"
 
+	"filippo.io/age"
+
+	"github.com/iwvelando/imessage-archiver/internal/attachstore"
+	"github.com/iwvelando/imessage-archiver/internal/chatdb"
 	"github.com/iwvelando/imessage-archiver/internal/config"
+	"github.com/iwvelando/imessage-archiver/internal/encryption"
 	"github.com/iwvelando/imessage-archiver/internal/logger"
+	"github.com/iwvelando/imessage-archiver/internal/manifest"
+	"github.com/iwvelando/imessage-archiver/internal/runlock"
+	"github.com/iwvelando/imessage-archiver/internal/state"
+	"github.com/iwvelando/imessage-archiver/internal/transport"
+	"github.com/iwvelando/imessage-archiver/internal/version"
 )
 
 type Archiver struct {
-	config *config.Config
-	logger *logger.Logger
+	config       *config.Config
+	logger       *logger.Logger
+	exporter     Exporter
+	destinations []*destination
+
+	// pendingWatermark is the newest chat.db message seen when the run
+	// started; it is persisted only once the run succeeds.
+	pendingWatermark *state.Watermark
+
+	// dateRange, when set, replaces the days_to_check window (see Backfill)
+	dateRange *dateRange
+
+	// journal records the progress of the current run for resuming it
+	journal *state.Journal
+
+	// stopping is set by Stop, and shared with the copies made by withLogger
+	stopping *atomic.Bool
+
+	// results holds the outcome of each day of the current run
+	results map[string]*DayResult
+
+	// runLock is held while a run or backfill is in progress
+	runLock *runlock.Lock
+}
+
+// ErrStopped is returned by a run that Stop ended early.
+var ErrStopped = errors.New("stopped before finishing")
+
+// destination is an archive destination and what the current run knows
+// about it.
+type destination struct {
+	name      string
+	transport transport.Transport
+
+	// pending holds the days (YYYY-MM-DD) this run uploads to the
+	// destination. A nil map means every exported day.
+	pending map[string]bool
+	// uploaded and err record the outcome of the upload for the summary
+	uploaded []string
+	err      error
+
+	// lock keeps runs from other Macs away while this run uses it
+	lock *runlock.RemoteLock
 }
 
 func New(cfg *config.Config, log *logger.Logger) *Archiver {
+	var destinations []*destination
+	for _, d := range cfg.ArchiveDestinations() {
+		destinations = append(destinations, &destination{
+			name:      d.Name,
+			transport: transport.New(d, log),
+		})
+	}
+
 	return &Archiver{
-		config: cfg,
-		logger: log,
+		config:       cfg,
+		logger:       log,
+		exporter:     newExporter(cfg, log),
+		destinations: destinations,
+		stopping:     new(atomic.Bool),
+	}
+}
+
+// schedule marks date for upload to the given destinations.
+func schedule(date time.Time, destinations ...*destination) {
+	for _, d := range destinations {
+		if d.pending == nil {
+			d.pending = make(map[string]bool)
+		}
+		d.pending[date.Format("2006-01-02")] = true
+	}
+}
+
+// Stop asks the archiver to stop at the next day boundary: the day being
+// exported or prepared is finished, the remaining days are left for the next
+// run, and Run returns ErrStopped. Stop is safe to call from another
+// goroutine, such as a signal handler, and lasts for the life of the
+// archiver.
+func (a *Archiver) Stop() {
+	a.stopping.Store(true)
+}
+
+// interrupted returns why the run has to end before the next day, or nil.
+func (a *Archiver) interrupted(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if a.stopping.Load() {
+		return ErrStopped
+	}
+	return nil
+}
+
+// Run archives every day the destinations are missing. Cancelling ctx
+// aborts the run at once: running exports and transfers are killed and
+// their day is redone by the next run. Use Stop to end the run gracefully.
+// With continue_on_error set, failed days do not stop the others and a run
+// that archived some of its days returns ErrPartialSuccess. Either way the
+// run ends with a summary of every day, also available from Results.
+//
+// Runs do not overlap: a run waits up to lock_timeout for another run on
+// this Mac, or one from another Mac using the same destinations, to finish.
+func (a *Archiver) Run(ctx context.Context) error {
+	a.results = make(map[string]*DayResult)
+	unlock, err := a.lockRun(ctx)
+	if err != nil {
+		return err
 	}
+	defer unlock()
+
+	err = a.run(ctx)
+	a.logDays(err)
+	return err
 }
 
-func (a *Archiver) Run() error {
+func (a *Archiver) run(ctx context.Context) error {
 	a.logger.Info("Starting iMessage archival process")
 
+	// Nothing carries over from an earlier run of this archiver
+	a.pendingWatermark = nil
+	for _, d := range a.destinations {
+		d.pending, d.uploaded, d.err = nil, nil, nil
+	}
+
+	// Transports that keep a connection open, such as sftp, hold it for the run
+	for _, d := range a.destinations {
+		if closer, ok := d.transport.(io.Closer); ok {
+			defer closer.Close()
+		}
+	}
+
+	// A run from another Mac would replace the uploads staged by this one
+	unlockDestinations, err := a.lockDestinations(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlockDestinations()
+
+	// Check the encryption settings before exporting anything
+	var recipients []age.Recipient
+	if a.config.Encryption.Enabled() {
+		var err error
+		recipients, err = encryption.Recipients(a.config.Encryption.Recipients, a.config.Encryption.PassphraseFile)
+		if err != nil {
+			return fmt.Errorf("failed to set up encryption: %w", err)
+		}
+	}
+
 	// Find the date range to process
-	datesToProcess, err := a.findMissingArchives()
+	datesToProcess, err := a.findMissingArchives(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to find missing archives: %w", err)
 	}
 
+	// Resume the work of an interrupted run, or start afresh
+	localRootDir, err := a.openJournal()
+	if err != nil {
+		return err
+	}
+
 	if len(datesToProcess) == 0 {
 		a.logger.Info("No missing archives found within the specified range")
+		a.finishJournal(localRootDir)
+		a.saveWatermark()
 		return nil
 	}
 
@@ -47,141 +203,351 @@ func (a *Archiver) Run() error {
 	}
 
 	a.logger.Info(fmt.Sprintf("Found %d dates to archive: %v", len(datesToProcess), dateStrings))
+	for _, day := range dateStrings {
+		a.setResult(day, DaySkipped, nil)
+	}
 
 	// Create a temporary local root directory for all exports
-	localRootDir := filepath.Join(os.TempDir(), "imessage-batch-export")
 	if err := os.MkdirAll(localRootDir, 0755); err != nil {
 		return fmt.Errorf("failed to create local root directory: %w", err)
 	}
+	if err := a.dropStaleDays(localRootDir, dateStrings); err != nil {
+		return err
+	}
 
-	// Set up signal handling for cleanup on interrupt
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	// The work directory is kept for the next run to resume unless the run
+	// completes or there is no journal to resume it from
+	completed := false
+	defer func() {
+		if completed || a.config.StateDir == "" {
+			a.finishJournal(localRootDir)
+			return
+		}
+		a.logger.Info(fmt.Sprintf("Keeping %s for the next run to resume", localRootDir))
+	}()
 
-	// Cleanup function that will be called on defer or signal
-	cleanupFunc := func() {
-		a.cleanup(localRootDir)
+	if a.config.UploadMode == config.UploadModeStreaming {
+		err = a.streamDays(ctx, datesToProcess, localRootDir, recipients)
+	} else {
+		err = a.batchDays(ctx, datesToProcess, localRootDir, recipients)
+	}
+	if err != nil {
+		return err
+	}
+	if err := a.partialFailure(); err != nil {
+		return err
 	}
-	defer cleanupFunc()
+	completed = true
 
-	// Handle signals in a goroutine
-	go func() {
-		sig := <-sigChan
-		a.logger.Info(fmt.Sprintf("Received signal %v, cleaning up and exiting...", sig))
-		cleanupFunc()
-		os.Exit(1)
-	}()
+	a.saveWatermark()
 
+	a.logger.Info("iMessage Archiver completed successfully")
+	return nil
+}
+
+// batchDays exports and prepares every day, then uploads them all in one
+// batch.
+func (a *Archiver) batchDays(ctx context.Context, dates []time.Time, localRootDir string, recipients []age.Recipient) error {
 	// Process each date and build local directory structure
-	hasDataToSync := false
-	for _, targetDate := range datesToProcess {
-		if err := a.processDateLocally(targetDate, localRootDir); err != nil {
-			a.logger.Error(fmt.Sprintf("Failed to process date %s: %v", targetDate.Format("2006-01-02"), err))
-			return fmt.Errorf("failed to process date %s: %w", targetDate.Format("2006-01-02"), err)
-		}
-		hasDataToSync = true
+	if err := a.exportDays(ctx, dates, localRootDir, nil); err != nil {
+		return err
 	}
 
-	// Perform single batch sync if we have data to sync
-	if hasDataToSync {
-		if err := a.batchSyncToRemote(localRootDir); err != nil {
-			a.logger.Error(fmt.Sprintf("Failed to sync batch to remote server: %v", err))
-			return fmt.Errorf("batch sync failed: %w", err)
-		}
+	if err := a.prepareDays(ctx, localRootDir, recipients); err != nil {
+		return err
 	}
 
-	a.logger.Info("iMessage Archiver completed successfully")
+	// Perform single batch sync of every day that had messages. Each upload
+	// replaces the remote copy of that day, so days re-exported because their
+	// content changed do not keep stale files around.
+	err := a.batchSyncToRemote(ctx, localRootDir)
+	a.logSummary()
+	// With continue_on_error, failed uploads count against their days
+	if err != nil && (!a.config.ContinueOnError || a.interrupted(ctx) != nil || a.countResults(DayFailed) == 0) {
+		return fmt.Errorf("batch sync failed: %w", err)
+	}
 	return nil
 }
 
-func (a *Archiver) findMissingArchives() ([]time.Time, error) {
+// findMissingArchives returns the days to export, newest first, and records
+// in each destination which of them it needs. A day is exported once even
+// when several destinations lack it.
+func (a *Archiver) findMissingArchives(ctx context.Context) ([]time.Time, error) {
 	a.logger.Debug("Finding missing archives to process")
 
 	var missingDates []time.Time
-	today := time.Now()
 
-	// Get the remote directory structure in one query
-	remoteArchives, err := a.getRemoteArchiveStructure()
+	// Get the directory structure of every destination in one query each
+	remoteArchives, err := a.getRemoteArchiveStructure(ctx)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if err != nil {
+		// Fall back to checking all dates at destinations that could not be listed
 		a.logger.Warn(fmt.Sprintf("Failed to get remote archive structure: %v", err))
-		// Fallback to checking all dates if remote query fails
-		for i := 1; i <= a.config.DaysToCheck; i++ {
-			checkDate := today.AddDate(0, 0, -i)
+	}
+
+	// Check each day going back up to days_to_check, or in the backfill range
+	archivedDates := make(map[*destination][]time.Time)
+	for _, checkDate := range a.candidateDates(ctx) {
+		dateStr := checkDate.Format("2006-01-02")
+
+		missing := false
+		for _, d := range a.destinations {
+			archived, listed := remoteArchives[d.name]
+			if !listed || !archived[dateStr] {
+				a.logger.Debug(fmt.Sprintf("Missing archive for date %s at %s", dateStr, d.name))
+				schedule(checkDate, d)
+				missing = true
+			} else {
+				a.logger.Debug(fmt.Sprintf("Archive exists for date %s at %s", dateStr, d.name))
+				archivedDates[d] = append(archivedDates[d], checkDate)
+			}
+		}
+		if missing {
 			missingDates = append(missingDates, checkDate)
 		}
+	}
+
+	// Re-export archived days whose content changed since they were uploaded
+	scheduled := make(map[string]bool, len(missingDates))
+	for _, date := range missingDates {
+		scheduled[date.Format("2006-01-02")] = true
+	}
+	for _, d := range a.destinations {
+		for _, date := range a.findChangedArchives(ctx, d, archivedDates[d]) {
+			schedule(date, d)
+			if !scheduled[date.Format("2006-01-02")] {
+				scheduled[date.Format("2006-01-02")] = true
+				missingDates = append(missingDates, date)
+			}
+		}
+	}
+
+	// Days with late-arriving messages go to every destination. A backfill
+	// covers a fixed range and leaves the watermark to regular runs.
+	if a.dateRange != nil {
 		return missingDates, nil
 	}
+	dates := a.addWatermarkDates(ctx, missingDates)
+	for _, date := range dates[len(missingDates):] {
+		schedule(date, a.destinations...)
+	}
+	return dates, nil
+}
 
-	// Check each day going back up to days_to_check
-	for i := 1; i <= a.config.DaysToCheck; i++ {
-		checkDate := today.AddDate(0, 0, -i)
-		dateStr := checkDate.Format("2006-01-02")
+// findChangedArchives compares the fingerprint stored in each archived day's
+// remote manifest with the current chat.db content and returns the days that
+// have to be re-exported because of edits, unsends or late-arriving messages.
+func (a *Archiver) findChangedArchives(ctx context.Context, d *destination, dates []time.Time) []time.Time {
+	if len(dates) == 0 {
+		return nil
+	}
 
-		if !remoteArchives[dateStr] {
-			a.logger.Debug(fmt.Sprintf("Missing archive for date: %s", dateStr))
-			missingDates = append(missingDates, checkDate)
-		} else {
-			a.logger.Debug(fmt.Sprintf("Archive exists for date: %s", dateStr))
+	remoteManifests, err := a.getRemoteManifests(ctx, d, dates)
+	if err != nil {
+		a.logger.Warn(fmt.Sprintf("Change detection unavailable at %s, failed to read remote manifests: %v", d.name, err))
+		return nil
+	}
+
+	return a.compareFingerprints(ctx, dates, remoteManifests)
+}
+
+// compareFingerprints returns the dates whose remote manifest fingerprint no
+// longer matches chat.db. Days without a fingerprint (e.g. archived by older
+// versions) are left alone.
+func (a *Archiver) compareFingerprints(ctx context.Context, dates []time.Time, remoteManifests map[string]*manifest.Manifest) []time.Time {
+	reader, err := chatdb.Open(ctx, a.config.DatabasePath())
+	if err != nil {
+		a.logger.Warn(fmt.Sprintf("Change detection unavailable: %v", err))
+		return nil
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			a.logger.Warn(fmt.Sprintf("Failed to close chat database: %v", err))
+		}
+	}()
+
+	var changed []time.Time
+	for _, date := range dates {
+		dateStr := date.Format("2006-01-02")
+
+		remote := remoteManifests[dateStr]
+		if remote == nil || remote.Fingerprint == nil {
+			a.logger.Debug(fmt.Sprintf("No fingerprint in remote manifest for %s, skipping change detection", dateStr))
+			continue
 		}
+
+		start := startOfDay(date)
+		current, err := reader.Fingerprint(ctx, start, start.AddDate(0, 0, 1))
+		if err != nil {
+			a.logger.Warn(fmt.Sprintf("Failed to fingerprint %s: %v", dateStr, err))
+			continue
+		}
+
+		if current.Equal(*remote.Fingerprint) {
+			a.logger.Debug(fmt.Sprintf("Archive for %s is up to date", dateStr))
+			continue
+		}
+
+		a.logger.Info(fmt.Sprintf("Archive for %s changed since upload (archived: %d messages, max ROWID %d; now: %d messages, max ROWID %d), re-exporting",
+			dateStr, remote.Fingerprint.MessageCount, remote.Fingerprint.MaxROWID, current.MessageCount, current.MaxROWID))
+		changed = append(changed, date)
 	}
 
-	return missingDates, nil
+	return changed
 }
 
-// getRemoteArchiveStructure retrieves the entire remote directory structure
-// in a single SSH command and returns a map of existing archive dates
-func (a *Archiver) getRemoteArchiveStructure() (map[string]bool, error) {
-	a.logger.Debug("Retrieving remote archive structure")
-
-	// Use find command to get all directories in the archive path that match the date pattern
-	// This finds directories 3 levels deep (year/month/day) and extracts the full date path
-	cmd := exec.Command("ssh",
-		"-i", a.config.SSHPrivateKeyPath,
-		"-o", "ConnectTimeout=30",
-		"-o", "ServerAliveInterval=60",
-		"-o", "ServerAliveCountMax=3",
-		fmt.Sprintf("%s@%s", a.config.RemoteUser, a.config.RemoteHost),
-		fmt.Sprintf("find %s -type d -mindepth 3 -maxdepth 3 -path '*/[0-9][0-9][0-9][0-9]/[0-9][0-9]/[0-9][0-9]' 2>/dev/null | while read dir; do if [ -n \"$(ls -A \"$dir\" 2>/dev/null)\" ]; then echo \"$dir\"; fi; done", a.config.RemoteArchivePath),
-	)
-
-	output, err := cmd.CombinedOutput()
+// getRemoteManifests reads the manifest of each given day from the
+// destination. Days without a readable manifest are omitted.
+func (a *Archiver) getRemoteManifests(ctx context.Context, d *destination, dates []time.Time) (map[string]*manifest.Manifest, error) {
+	a.logger.Debug(fmt.Sprintf("Retrieving remote manifests for %d archived dates from %s", len(dates), d.name))
+
+	manifests := make(map[string]*manifest.Manifest)
+	for _, date := range dates {
+		dateStr := date.Format("2006-01-02")
+
+		data, err := d.transport.ReadFile(ctx, path.Join(transport.DayPath(dateStr), manifest.FileName))
+		if errors.Is(err, fs.ErrNotExist) {
+			// The day may be packaged
+			data, err = d.transport.ReadFile(ctx, transport.PackageManifestPath(dateStr))
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read remote manifest for %s: %w", dateStr, err)
+		}
+
+		m, err := manifest.Parse(data)
+		if err != nil {
+			a.logger.Warn(fmt.Sprintf("Ignoring unreadable remote manifest for %s: %v", dateStr, err))
+			continue
+		}
+		manifests[dateStr] = m
+	}
+
+	return manifests, nil
+}
+
+// addWatermarkDates appends every day that received messages in chat.db since
+// the last successful run, regardless of how old the day is, so messages that
+// sync in late from another device are archived into the correct day. Without
+// a readable chat.db or a saved watermark, gap detection alone decides.
+func (a *Archiver) addWatermarkDates(ctx context.Context, dates []time.Time) []time.Time {
+	if a.config.StateDir == "" {
+		return dates
+	}
+
+	reader, err := chatdb.Open(ctx, a.config.DatabasePath())
+	if err != nil {
+		a.logger.Warn(fmt.Sprintf("Incremental detection unavailable, relying on gap detection only: %v", err))
+		return dates
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			a.logger.Warn(fmt.Sprintf("Failed to close chat database: %v", err))
+		}
+	}()
+
+	latestROWID, latestDate, err := reader.LatestMessage(ctx)
 	if err != nil {
-		a.logger.Debug(fmt.Sprintf("Remote structure query output: %s", string(output)))
-		return nil, fmt.Errorf("failed to query remote archive structure: %w", err)
+		a.logger.Warn(fmt.Sprintf("Failed to read latest message from chat database: %v", err))
+		return dates
 	}
+	a.pendingWatermark = &state.Watermark{MaxROWID: latestROWID, MaxDate: latestDate}
 
-	// Parse the output to build a map of existing archives
-	archives := make(map[string]bool)
-	outputStr := strings.TrimSpace(string(output))
+	watermark, err := state.LoadWatermark(a.config.StateDir)
+	if err != nil {
+		a.logger.Warn(fmt.Sprintf("Failed to load message watermark: %v", err))
+		return dates
+	}
+	if watermark == nil {
+		a.logger.Debug("No message watermark saved yet, relying on gap detection")
+		return dates
+	}
+	if latestROWID < watermark.MaxROWID {
+		a.logger.Warn(fmt.Sprintf("Chat database latest ROWID %d is below saved watermark %d; the database may have been rebuilt", latestROWID, watermark.MaxROWID))
+		return dates
+	}
+	if latestROWID == watermark.MaxROWID {
+		a.logger.Debug(fmt.Sprintf("No new messages since watermark ROWID %d", watermark.MaxROWID))
+		return dates
+	}
 
-	if outputStr != "" {
-		lines := strings.Split(outputStr, "\n")
-		for _, line := range lines {
-			line = strings.TrimSpace(line)
-			if line == "" {
-				continue
-			}
+	days, err := reader.DaysWithMessagesAfter(ctx, watermark.MaxROWID, time.Local)
+	if err != nil {
+		a.logger.Warn(fmt.Sprintf("Failed to find days with new messages: %v", err))
+		return dates
+	}
 
-			// Extract date from path like /backups/imessages/2024/06/07
-			// Remove the base path and convert to YYYY-MM-DD format
-			relativePath := strings.TrimPrefix(line, a.config.RemoteArchivePath)
-			relativePath = strings.TrimPrefix(relativePath, "/")
-
-			// Split into year/month/day components
-			parts := strings.Split(relativePath, "/")
-			if len(parts) == 3 {
-				dateStr := fmt.Sprintf("%s-%s-%s", parts[0], parts[1], parts[2])
-				archives[dateStr] = true
-				a.logger.Debug(fmt.Sprintf("Found existing archive: %s", dateStr))
-			}
+	scheduled := make(map[string]bool, len(dates))
+	for _, date := range dates {
+		scheduled[date.Format("2006-01-02")] = true
+	}
+
+	// Like gap detection, only completed days are archived: today is picked
+	// up once it is over, and later days can only come from a wrong clock
+	today := startOfDay(time.Now().In(time.Local))
+
+	// Newest first, matching the order of gap detection
+	for i := len(days) - 1; i >= 0; i-- {
+		dateStr := days[i].Format("2006-01-02")
+		if scheduled[dateStr] || !days[i].Before(today) {
+			continue
 		}
+		a.logger.Info(fmt.Sprintf("New messages arrived since the last run for date: %s", dateStr))
+		scheduled[dateStr] = true
+		dates = append(dates, days[i])
 	}
 
-	a.logger.Debug(fmt.Sprintf("Retrieved %d existing archives from remote", len(archives)))
-	return archives, nil
+	return dates
 }
 
-func (a *Archiver) processDateLocally(targetDate time.Time, localRootDir string) error {
+// saveWatermark persists the watermark captured at the start of the run.
+func (a *Archiver) saveWatermark() {
+	if a.pendingWatermark == nil {
+		return
+	}
+
+	a.pendingWatermark.UpdatedAt = time.Now()
+	if err := state.SaveWatermark(a.config.StateDir, a.pendingWatermark); err != nil {
+		a.logger.Warn(fmt.Sprintf("Failed to save message watermark: %v", err))
+		return
+	}
+	a.logger.Debug(fmt.Sprintf("Saved message watermark at ROWID %d", a.pendingWatermark.MaxROWID))
+}
+
+// getRemoteArchiveStructure lists the days already archived at each
+// destination and returns them as sets of YYYY-MM-DD dates keyed by
+// destination name. Destinations that could not be listed are left out and
+// reported in the error.
+func (a *Archiver) getRemoteArchiveStructure(ctx context.Context) (map[string]map[string]bool, error) {
+	structure := make(map[string]map[string]bool, len(a.destinations))
+	var errs []error
+
+	for _, d := range a.destinations {
+		a.logger.Debug(fmt.Sprintf("Retrieving archive structure from %s (%s)", d.name, d.transport.Name()))
+
+		days, err := d.transport.ListDays(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", d.name, err))
+			continue
+		}
+
+		archives := make(map[string]bool, len(days))
+		for _, day := range days {
+			archives[day] = true
+			a.logger.Debug(fmt.Sprintf("Found existing archive at %s: %s", d.name, day))
+		}
+		a.logger.Debug(fmt.Sprintf("Retrieved %d existing archives from %s", len(archives), d.name))
+		structure[d.name] = archives
+	}
+
+	return structure, errors.Join(errs...)
+}
+
+func (a *Archiver) processDateLocally(ctx context.Context, targetDate time.Time, localRootDir string) error {
 	dateStr := targetDate.Format("2006-01-02")
 	a.logger.Info(fmt.Sprintf("Archiving messages for date: %s", dateStr))
 
@@ -195,16 +561,25 @@ func (a *Archiver) processDateLocally(targetDate time.Time, localRootDir string)
 		return fmt.Errorf("failed to create local export directory: %w", err)
 	}
 
+	// Fingerprint before exporting so messages arriving mid-export make the
+	// stored fingerprint stale rather than silently missing from the archive
+	fingerprint := a.dayFingerprint(ctx, targetDate)
+
 	// Export messages for the target date
-	if err := a.exportMessages(targetDate, localExportDir); err != nil {
+	result, err := a.exportMessages(ctx, targetDate, localExportDir)
+	if err != nil {
 		a.logger.Error(fmt.Sprintf("Failed to export messages: %v", err))
 		return fmt.Errorf("message export failed: %w", err)
 	}
 
-	// Check if there are any messages to archive
-	isEmpty, err := a.isDirectoryEmpty(localExportDir)
-	if err != nil {
-		return fmt.Errorf("failed to check export directory: %w", err)
+	// Check if there are any messages to archive, trusting the exporter's
+	// count when it reports one
+	isEmpty := result.Messages == 0
+	if result.Messages < 0 {
+		isEmpty, err = a.isDirectoryEmpty(localExportDir)
+		if err != nil {
+			return fmt.Errorf("failed to check export directory: %w", err)
+		}
 	}
 
 	if isEmpty {
@@ -216,70 +591,73 @@ func (a *Archiver) processDateLocally(targetDate time.Time, localRootDir string)
 		return nil
 	}
 
-	a.logger.Info(fmt.Sprintf("Successfully processed messages for %s locally", dateStr))
-	return nil
-}
-
-// exportMessages exports messages for a specific date using imessage-exporter
-func (a *Archiver) exportMessages(date time.Time, outputDir string) error {
-	startDate := date.Format("2006-01-02")
-	endDate := date.AddDate(0, 0, 1).Format("2006-01-02")
-
-	a.logger.Debug(fmt.Sprintf("Exporting messages from %s to %s (exclusive) to %s", startDate, endDate, outputDir))
-
-	args := []string{
-		"--format", a.config.ExportFormat,
-		"--copy-method", a.config.CopyMethod,
-		"--export-path", outputDir,
-		"--start-date", startDate,
-		"--end-date", endDate,
-		"--no-lazy",
+	files, err := manifest.ScanFiles(localExportDir)
+	if err != nil {
+		return fmt.Errorf("failed to checksum export for %s: %w", dateStr, err)
 	}
 
-	// Add custom database path if specified (for testing)
-	if a.config.TestDatabasePath != "" {
-		args = append([]string{"--db-path", a.config.TestDatabasePath}, args...)
+	dayManifest := &manifest.Manifest{
+		Date:            dateStr,
+		CreatedAt:       time.Now().UTC(),
+		ExportFormat:    a.config.ExportFormat,
+		Exporter:        a.exporter.Name(),
+		ExporterVersion: a.exporter.Version(ctx),
+		ArchiverVersion: version.Version,
+		Fingerprint:     fingerprint,
+		Files:           files,
 	}
-
-	cmd := exec.Command("imessage-exporter", args...)
-
-	// Enhanced logging for debugging
-	a.logger.Debug(fmt.Sprintf("Running command: %s", cmd.String()))
-
-	output, err := cmd.CombinedOutput() // Capture both stdout and stderr
-
-	// Always log the output for debugging purposes, especially for launch agent issues
-	if len(output) > 0 {
-		a.logger.Debug(fmt.Sprintf("imessage-exporter output:\n%s", string(output)))
-	} else {
-		a.logger.Debug("imessage-exporter produced no output")
+	if err := manifest.Write(localExportDir, dayManifest); err != nil {
+		return fmt.Errorf("failed to write manifest for %s: %w", dateStr, err)
 	}
 
-	// Check for critical errors in the output even if command didn't return an error code
-	outputStr := string(output)
-	if strings.Contains(outputStr, "Unable to read from chat database") ||
-		strings.Contains(outputStr, "unable to open database file") ||
-		strings.Contains(outputStr, "Full Disk Access") {
+	a.logger.Info(fmt.Sprintf("Successfully processed messages for %s locally", dateStr))
+	return nil
+}
 
-		// Provide context-appropriate error message
-		return fmt.Errorf("imessage-exporter failed due to insufficient permissions. "+
-			"Full Disk Access must be granted to the imessage-exporter binary. "+
-			"Go to System Settings > Privacy & Security > Full Disk Access and add the imessage-exporter binary. "+
-			"Original error: %s", strings.TrimSpace(outputStr))
+// dayFingerprint returns the chat.db fingerprint of the day containing date,
+// or nil if chat.db cannot be read by this process.
+func (a *Archiver) dayFingerprint(ctx context.Context, date time.Time) *chatdb.Fingerprint {
+	reader, err := chatdb.Open(ctx, a.config.DatabasePath())
+	if err != nil {
+		a.logger.Debug(fmt.Sprintf("Skipping fingerprint for %s: %v", date.Format("2006-01-02"), err))
+		return nil
 	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			a.logger.Warn(fmt.Sprintf("Failed to close chat database: %v", err))
+		}
+	}()
 
-	if strings.Contains(outputStr, "Invalid configuration") {
-		return fmt.Errorf("imessage-exporter configuration error: %s", outputStr)
+	start := startOfDay(date)
+	fingerprint, err := reader.Fingerprint(ctx, start, start.AddDate(0, 0, 1))
+	if err != nil {
+		a.logger.Warn(fmt.Sprintf("Failed to fingerprint %s: %v", date.Format("2006-01-02"), err))
+		return nil
 	}
+	return &fingerprint
+}
+
+// startOfDay returns midnight at the start of t's day in t's location.
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// exportMessages exports messages for a specific date using the configured exporter
+func (a *Archiver) exportMessages(ctx context.Context, date time.Time, outputDir string) (*ExportResult, error) {
+	a.logger.Debug(fmt.Sprintf("Exporting messages for %s with %s exporter", date.Format("2006-01-02"), a.exporter.Name()))
 
+	start := startOfDay(date)
+	result, err := a.exporter.Export(ctx, start, start.AddDate(0, 0, 1), outputDir)
 	if err != nil {
-		// Log the error along with any output that might have been produced
-		a.logger.Error(fmt.Sprintf("imessage-exporter command failed: %v", err))
-		return fmt.Errorf("imessage-exporter failed: %w. Output: %s", err, string(output))
+		return nil, err
 	}
 
-	a.logger.Debug("Message export completed successfully")
-	return nil
+	if result.Messages >= 0 {
+		a.logger.Debug(fmt.Sprintf("Exported %d messages and %d attachments into %d files", result.Messages, result.Attachments, len(result.Files)))
+	} else {
+		a.logger.Debug(fmt.Sprintf("Exported %d attachments into %d files", result.Attachments, len(result.Files)))
+	}
+	return result, nil
 }
 
 func (a *Archiver) isDirectoryEmpty(dir string) (bool, error) {
@@ -405,27 +783,185 @@ func (a *Archiver) isDirectoryEmpty(dir string) (bool, error) {
 	return isEmpty, nil
 }
 
-func (a *Archiver) batchSyncToRemote(localRootDir string) error {
-	a.logger.Debug("Starting batch sync to remote server")
+// batchSyncToRemote uploads the exported days each destination needs. A
+// failing destination does not stop the others; the error joins the
+// failures of all destinations. A stopped run does not start uploading to
+// the next destination. Days every destination received are recorded as
+// succeeded, days a destination failed to receive as failed.
+func (a *Archiver) batchSyncToRemote(ctx context.Context, localRootDir string) error {
+	a.logger.Debug("Starting batch sync to remote destinations")
 
-	cmd := exec.Command("rsync",
-		"-avz",
-		"--timeout=300",
-		"-e", fmt.Sprintf("ssh -i %s -o ConnectTimeout=30 -o ServerAliveInterval=60 -o ServerAliveCountMax=3", a.config.SSHPrivateKeyPath),
-		localRootDir+"/",
-		fmt.Sprintf("%s@%s:%s/", a.config.RemoteUser, a.config.RemoteHost, a.config.RemoteArchivePath),
-	)
-
-	output, err := cmd.CombinedOutput()
+	days, err := localDays(localRootDir)
 	if err != nil {
-		a.logger.Debug(fmt.Sprintf("Rsync output: %s", string(output)))
-		return fmt.Errorf("batch rsync failed: %w", err)
+		return err
+	}
+
+	var errs []error
+	failures := make(map[string][]error)
+	unfinished := make(map[string]bool)
+	for i, d := range a.destinations {
+		if err := a.interrupted(ctx); err != nil {
+			errs = append(errs, err)
+			for _, rest := range a.destinations[i:] {
+				for _, day := range a.daysToUpload(rest, days) {
+					unfinished[day] = true
+				}
+			}
+			break
+		}
+
+		upload := a.daysToUpload(d, days)
+		failed := func(err error) {
+			d.err = err
+			errs = append(errs, fmt.Errorf("%s: %w", d.name, err))
+			for _, day := range upload {
+				if a.interrupted(ctx) != nil {
+					unfinished[day] = true
+				} else {
+					failures[day] = append(failures[day], fmt.Errorf("%s: %w", d.name, err))
+				}
+			}
+		}
+
+		if err := a.uploadTo(ctx, d, localRootDir, upload); err != nil {
+			failed(err)
+		}
+	}
+
+	for _, day := range days {
+		switch {
+		case len(failures[day]) > 0:
+			a.setResult(day, DayFailed, errors.Join(failures[day]...))
+		case !unfinished[day]:
+			a.setResult(day, DaySucceeded, nil)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
 	}
 
 	a.logger.Debug("Batch sync completed successfully")
 	return nil
 }
 
+// uploadTo uploads days and the attachments they reference to d, and
+// records them as uploaded.
+func (a *Archiver) uploadTo(ctx context.Context, d *destination, localRootDir string, days []string) error {
+	if d.lock != nil {
+		if err := d.lock.Renew(ctx); err != nil {
+			a.logger.Error(err.Error())
+			return err
+		}
+	}
+
+	// Attachments go first so every published day finds its blobs
+	blobs, err := localBlobs(localRootDir, days)
+	if err != nil {
+		return err
+	}
+	if len(blobs) > 0 {
+		a.logger.Debug(fmt.Sprintf("Uploading %d attachments to %s", len(blobs), d.name))
+		if err := d.transport.UploadBlobs(ctx, localRootDir, blobs); err != nil {
+			a.logger.Error(fmt.Sprintf("Failed to upload attachments to %s: %v", d.name, err))
+			return err
+		}
+	}
+
+	a.logger.Debug(fmt.Sprintf("Uploading %d days to %s", len(days), d.name))
+	if err := d.transport.Upload(ctx, localRootDir, days); err != nil {
+		a.logger.Error(fmt.Sprintf("Failed to sync batch to %s: %v", d.name, err))
+		return err
+	}
+	d.uploaded = append(d.uploaded, days...)
+	a.journal.MarkUploaded(d.name, days)
+	a.saveJournal()
+	return nil
+}
+
+// daysToUpload returns the days of days that d needs, leaving out those an
+// earlier attempt of this run already uploaded to it.
+func (a *Archiver) daysToUpload(d *destination, days []string) []string {
+	var upload []string
+	for _, day := range days {
+		if progress := a.journal.Day(day); progress != nil && slices.Contains(progress.Uploaded, d.name) {
+			continue
+		}
+		if d.pending == nil || d.pending[day] {
+			upload = append(upload, day)
+		}
+	}
+	return upload
+}
+
+// logSummary reports the upload result of every destination.
+func (a *Archiver) logSummary() {
+	for _, d := range a.destinations {
+		if d.err != nil {
+			a.logger.Error(fmt.Sprintf("Destination %s: upload failed: %v", d.name, d.err))
+			continue
+		}
+		a.logger.Info(fmt.Sprintf("Destination %s: uploaded %d days %v", d.name, len(d.uploaded), d.uploaded))
+	}
+}
+
+// localDays returns the YYYY-MM-DD days exported under localRootDir, as day
+// directories or packages.
+func localDays(localRootDir string) ([]string, error) {
+	dirs, err := filepath.Glob(filepath.Join(localRootDir, "[0-9][0-9][0-9][0-9]", "[0-9][0-9]", "[0-9][0-9]"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list exported days: %w", err)
+	}
+
+	var days []string
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(localRootDir, dir)
+		if err != nil {
+			return nil, err
+		}
+		if day, ok := transport.ParseDayPath(filepath.ToSlash(rel)); ok {
+			days = append(days, day)
+		}
+	}
+
+	manifests, err := filepath.Glob(filepath.Join(localRootDir, "[0-9][0-9][0-9][0-9]", "[0-9][0-9]", "*"+transport.PackageManifestSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list packaged days: %w", err)
+	}
+	for _, p := range manifests {
+		rel, err := filepath.Rel(localRootDir, p)
+		if err != nil {
+			return nil, err
+		}
+		if day, ok := transport.ParsePackageManifestPath(filepath.ToSlash(rel)); ok && !slices.Contains(days, day) {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// localBlobs returns the attachment store paths the given exported days
+// reference.
+func localBlobs(localRootDir string, days []string) ([]string, error) {
+	var blobs []string
+	for _, day := range days {
+		m, err := manifest.Read(filepath.Join(localRootDir, filepath.FromSlash(transport.DayPath(day))))
+		if errors.Is(err, fs.ErrNotExist) {
+			m, err = manifest.ReadFile(filepath.Join(localRootDir, filepath.FromSlash(transport.PackageManifestPath(day))))
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			// Nothing to reference without a manifest
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest of %s: %w", day, err)
+		}
+		blobs = append(blobs, attachstore.Blobs(m)...)
+	}
+	slices.Sort(blobs)
+	return slices.Compact(blobs), nil
+}
+
 func (a *Archiver) cleanup(dir string) {
 	if err := os.RemoveAll(dir); err != nil {
 		a.logger.Warn(fmt.Sprintf("Failed to cleanup temporary directory %s: %v", dir, err))
@@ -1,14 +1,28 @@
 package archiver
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 	"time"
 
+	"filippo.io/age"
+
+	"github.com/iwvelando/imessage-archiver/internal/chatdb"
 	"github.com/iwvelando/imessage-archiver/internal/config"
+	"github.com/iwvelando/imessage-archiver/internal/encryption"
 	"github.com/iwvelando/imessage-archiver/internal/logger"
+	"github.com/iwvelando/imessage-archiver/internal/manifest"
+	"github.com/iwvelando/imessage-archiver/internal/restore"
+	"github.com/iwvelando/imessage-archiver/internal/state"
+	"github.com/iwvelando/imessage-archiver/internal/transport"
+	"github.com/iwvelando/imessage-archiver/internal/version"
 )
 
 // getTestDatabasePath returns the path to the test database
@@ -72,7 +86,7 @@ func TestArchiver_Run(t *testing.T) {
 
 	// Test that Run method exists and can be called
 	// This will fail due to missing SSH config, but we're testing the flow
-	err := archiver.Run()
+	err := archiver.Run(context.Background())
 
 	// We expect an error in test environment due to invalid SSH config
 	if err == nil {
@@ -95,7 +109,7 @@ func TestArchiver_findMissingArchives_Fallback(t *testing.T) {
 	archiver := New(cfg, log)
 
 	// This should fall back to checking all dates when remote query fails
-	missingDates, err := archiver.findMissingArchives()
+	missingDates, err := archiver.findMissingArchives(context.Background())
 
 	if err != nil {
 		t.Fatalf("Expected findMissingArchives to handle remote failure gracefully, got error: %v", err)
@@ -169,7 +183,7 @@ func TestArchiver_processDateLocally_EmptyExport(t *testing.T) {
 	// Test that processDateLocally detects empty export and cleans up
 	// Note: This will fail at the exportMessages step in a real test environment
 	// but we can test the directory creation logic
-	err = archiver.processDateLocally(targetDate, tempRoot)
+	err = archiver.processDateLocally(context.Background(), targetDate, tempRoot)
 
 	// In a real environment, this would fail due to missing imessage-exporter
 	// The test validates that the function handles the flow correctly
@@ -206,7 +220,7 @@ func TestArchiver_processDateLocally_DirectoryCreation(t *testing.T) {
 	targetDate := time.Date(2023, 12, 25, 0, 0, 0, 0, time.UTC)
 
 	// Test directory creation regardless of whether imessage-exporter works
-	err = archiver.processDateLocally(targetDate, tempRoot)
+	err = archiver.processDateLocally(context.Background(), targetDate, tempRoot)
 
 	// Verify correct directory structure was created
 	expectedPath := filepath.Join(tempRoot, "2023", "12", "25")
@@ -439,7 +453,7 @@ func TestArchiver_exportMessages_InvalidConfig(t *testing.T) {
 	targetDate := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
 
 	// Test exportMessages function - may succeed or fail depending on environment
-	err = archiver.exportMessages(targetDate, tempDir)
+	_, err = archiver.exportMessages(context.Background(), targetDate, tempDir)
 
 	if err != nil {
 		// Verify error contains helpful information
@@ -480,7 +494,7 @@ func TestArchiver_exportMessages_WithValidDatabase(t *testing.T) {
 	targetDate := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
 
 	// Test exportMessages function with valid database
-	err = archiver.exportMessages(targetDate, tempDir)
+	_, err = archiver.exportMessages(context.Background(), targetDate, tempDir)
 
 	if err != nil {
 		// If it fails, make sure it's not due to database issues
@@ -539,7 +553,7 @@ func TestArchiver_TestDatabasePathExists(t *testing.T) {
 		}()
 
 		targetDate := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
-		err = archiver.exportMessages(targetDate, tempDir)
+		_, err = archiver.exportMessages(context.Background(), targetDate, tempDir)
 
 		if err == nil {
 			t.Logf("Test database validation succeeded - imessage-exporter can read the database")
@@ -573,7 +587,7 @@ func TestArchiver_batchSyncToRemote_InvalidConfig(t *testing.T) {
 	}()
 
 	// This should fail due to invalid SSH configuration
-	err = archiver.batchSyncToRemote(tempDir)
+	err = archiver.batchSyncToRemote(context.Background(), tempDir)
 	if err == nil {
 		t.Error("Expected batchSyncToRemote to fail with invalid config")
 	}
@@ -594,7 +608,7 @@ func TestArchiver_getRemoteArchiveStructure(t *testing.T) {
 	// Test case 1: SSH command fails
 	t.Run("ssh command fails", func(t *testing.T) {
 		// This will fail because the SSH key and host don't exist
-		_, err := archiver.getRemoteArchiveStructure()
+		_, err := archiver.getRemoteArchiveStructure(context.Background())
 		if err == nil {
 			t.Error("Expected error when SSH command fails, got nil")
 		}
@@ -614,7 +628,7 @@ func TestArchiver_findMissingArchives(t *testing.T) {
 	archiver := New(cfg, log)
 
 	t.Run("falls back to all dates when remote query fails", func(t *testing.T) {
-		dates, err := archiver.findMissingArchives()
+		dates, err := archiver.findMissingArchives(context.Background())
 		if err != nil {
 			t.Fatalf("Expected no error in fallback mode, got: %v", err)
 		}
@@ -662,7 +676,7 @@ func TestArchiver_processDateLocally(t *testing.T) {
 	t.Run("creates proper directory structure", func(t *testing.T) {
 		// This may succeed or fail depending on imessage-exporter availability
 		// But we can test that it creates the directory structure correctly
-		err := archiver.processDateLocally(testDate, tempDir)
+		err := archiver.processDateLocally(context.Background(), testDate, tempDir)
 
 		// Check that directory structure was created
 		expectedDir := filepath.Join(tempDir, "2024", "01", "15")
@@ -699,7 +713,7 @@ func TestArchiver_exportMessages(t *testing.T) {
 	testDate := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
 
 	t.Run("handles imessage-exporter execution", func(t *testing.T) {
-		err := archiver.exportMessages(testDate, tempDir)
+		_, err := archiver.exportMessages(context.Background(), testDate, tempDir)
 
 		if err != nil {
 			// Verify error contains helpful information
@@ -736,7 +750,7 @@ func TestArchiver_batchSyncToRemote(t *testing.T) {
 	}()
 
 	t.Run("fails when rsync command fails", func(t *testing.T) {
-		err := archiver.batchSyncToRemote(tempDir)
+		err := archiver.batchSyncToRemote(context.Background(), tempDir)
 		if err == nil {
 			t.Error("Expected error when rsync fails, got nil")
 		}
@@ -753,3 +767,486 @@ func TestDatabaseRequired(t *testing.T) {
 	// If we get here, the database exists
 	t.Logf("Database requirement check passed - database exists")
 }
+
+func newWatermarkTestArchiver(t *testing.T) *Archiver {
+	t.Helper()
+	checkTestDatabaseExists(t)
+
+	cfg := &config.Config{
+		LoggingLevel:     "debug",
+		TestDatabasePath: getTestDatabasePath(),
+		StateDir:         t.TempDir(),
+	}
+	return New(cfg, logger.New("debug"))
+}
+
+func TestArchiver_addWatermarkDates_NoWatermark(t *testing.T) {
+	archiver := newWatermarkTestArchiver(t)
+
+	dates := archiver.addWatermarkDates(context.Background(), nil)
+	if len(dates) != 0 {
+		t.Errorf("Expected no extra dates without a saved watermark, got %v", dates)
+	}
+
+	if archiver.pendingWatermark == nil || archiver.pendingWatermark.MaxROWID != 2 {
+		t.Errorf("Expected pending watermark at ROWID 2, got %+v", archiver.pendingWatermark)
+	}
+}
+
+func TestArchiver_addWatermarkDates_NewMessages(t *testing.T) {
+	archiver := newWatermarkTestArchiver(t)
+
+	// Pretend only the first message was archived by a previous run
+	if err := state.SaveWatermark(archiver.config.StateDir, &state.Watermark{MaxROWID: 1}); err != nil {
+		t.Fatalf("Failed to save watermark: %v", err)
+	}
+
+	existing := []time.Time{time.Now().AddDate(0, 0, -1)}
+	dates := archiver.addWatermarkDates(context.Background(), existing)
+
+	if len(dates) != 2 {
+		t.Fatalf("Expected the day of the new message to be added, got %v", dates)
+	}
+	if !dates[0].Equal(existing[0]) {
+		t.Errorf("Expected gap-detected dates to keep their position, got %v", dates)
+	}
+
+	messageDay := time.Date(2024, 1, 1, 14, 30, 0, 0, time.UTC).In(time.Local).Format("2006-01-02")
+	if got := dates[1].Format("2006-01-02"); got != messageDay {
+		t.Errorf("Expected added date %s, got %s", messageDay, got)
+	}
+}
+
+func TestArchiver_addWatermarkDates_UpToDate(t *testing.T) {
+	archiver := newWatermarkTestArchiver(t)
+
+	if err := state.SaveWatermark(archiver.config.StateDir, &state.Watermark{MaxROWID: 2}); err != nil {
+		t.Fatalf("Failed to save watermark: %v", err)
+	}
+
+	dates := archiver.addWatermarkDates(context.Background(), nil)
+	if len(dates) != 0 {
+		t.Errorf("Expected no extra dates when the watermark is current, got %v", dates)
+	}
+}
+
+func TestArchiver_addWatermarkDates_SkipsUnfinishedDays(t *testing.T) {
+	archiver := newWatermarkTestArchiver(t)
+
+	// A copy of the test database with messages from today and, as with a
+	// wrong clock, tomorrow
+	data, err := os.ReadFile(getTestDatabasePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(t.TempDir(), "chat.db")
+	if err := os.WriteFile(dbPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, date := range []time.Time{now, now.AddDate(0, 0, 1)} {
+		if _, err := db.Exec(`INSERT INTO message (guid, text, date) VALUES (?, 'late', ?)`, fmt.Sprintf("LATE%d", i), chatdb.ToAppleTime(date)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	archiver.config.TestDatabasePath = dbPath
+
+	if err := state.SaveWatermark(archiver.config.StateDir, &state.Watermark{MaxROWID: 1}); err != nil {
+		t.Fatalf("Failed to save watermark: %v", err)
+	}
+
+	dates := archiver.addWatermarkDates(context.Background(), nil)
+	messageDay := time.Date(2024, 1, 1, 14, 30, 0, 0, time.UTC).In(time.Local).Format("2006-01-02")
+	if len(dates) != 1 || dates[0].Format("2006-01-02") != messageDay {
+		t.Errorf("Expected only %s, not today or later, got %v", messageDay, dates)
+	}
+}
+
+func TestArchiver_saveWatermark(t *testing.T) {
+	archiver := newWatermarkTestArchiver(t)
+	archiver.addWatermarkDates(context.Background(), nil)
+	archiver.saveWatermark()
+
+	watermark, err := state.LoadWatermark(archiver.config.StateDir)
+	if err != nil {
+		t.Fatalf("LoadWatermark failed: %v", err)
+	}
+	if watermark == nil || watermark.MaxROWID != 2 {
+		t.Errorf("Expected saved watermark at ROWID 2, got %+v", watermark)
+	}
+	if watermark != nil && watermark.UpdatedAt.IsZero() {
+		t.Error("Expected UpdatedAt to be set")
+	}
+}
+
+func TestArchiver_getRemoteManifests(t *testing.T) {
+	archiver := New(&config.Config{LoggingLevel: "debug"}, logger.New("debug"))
+	memory := transport.NewMemory()
+	dest := &destination{name: "memory", transport: memory}
+
+	if err := memory.WriteFile(context.Background(), "2024/01/01/manifest.json", []byte(`{"date":"2024-01-01","fingerprint":{"message_count":2,"max_rowid":2}}`)); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := memory.WriteFile(context.Background(), "2024/01/02/manifest.json", []byte("not json")); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	dates := []time.Time{
+		time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC),
+	}
+	manifests, err := archiver.getRemoteManifests(context.Background(), dest, dates)
+	if err != nil {
+		t.Fatalf("getRemoteManifests failed: %v", err)
+	}
+
+	if len(manifests) != 1 {
+		t.Fatalf("Expected 1 parsed manifest, got %d", len(manifests))
+	}
+	m := manifests["2024-01-01"]
+	if m == nil || m.Fingerprint == nil || m.Fingerprint.MessageCount != 2 {
+		t.Errorf("Expected manifest for 2024-01-01 with 2 messages, got %+v", m)
+	}
+}
+
+func TestArchiver_compareFingerprints(t *testing.T) {
+	checkTestDatabaseExists(t)
+
+	cfg := &config.Config{
+		LoggingLevel:     "debug",
+		TestDatabasePath: getTestDatabasePath(),
+	}
+	archiver := New(cfg, logger.New("debug"))
+
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	emptyDay := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	legacyDay := time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)
+
+	remote := map[string]*manifest.Manifest{
+		// Uploaded before the second message arrived
+		"2024-01-01": {Date: "2024-01-01", Fingerprint: &chatdb.Fingerprint{MessageCount: 1, MaxROWID: 1}},
+		// Still matches chat.db
+		"2024-01-02": {Date: "2024-01-02", Fingerprint: &chatdb.Fingerprint{}},
+		// Archived before fingerprints existed
+		"2024-01-03": {Date: "2024-01-03"},
+	}
+
+	changed := archiver.compareFingerprints(context.Background(), []time.Time{day, emptyDay, legacyDay}, remote)
+
+	if len(changed) != 1 || !changed[0].Equal(day) {
+		t.Fatalf("Expected only 2024-01-01 to be detected as changed, got %v", changed)
+	}
+}
+
+func TestArchiver_processDateLocally_WritesManifest(t *testing.T) {
+	checkTestDatabaseExists(t)
+
+	tempRoot := t.TempDir()
+	exporter := &fakeExporter{
+		files:    map[string]string{"messages.jsonl": "{}\n"},
+		messages: 2,
+	}
+	archiver := newTestArchiverWithExporter(exporter)
+	archiver.config.TestDatabasePath = getTestDatabasePath()
+
+	targetDate := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := archiver.processDateLocally(context.Background(), targetDate, tempRoot); err != nil {
+		t.Fatalf("processDateLocally failed: %v", err)
+	}
+
+	m, err := manifest.Read(filepath.Join(tempRoot, "2024", "01", "01"))
+	if err != nil {
+		t.Fatalf("Expected manifest to be written: %v", err)
+	}
+	if m.Date != "2024-01-01" {
+		t.Errorf("Expected manifest date 2024-01-01, got %s", m.Date)
+	}
+	if m.Fingerprint == nil || m.Fingerprint.MessageCount != 2 || m.Fingerprint.MaxROWID != 2 {
+		t.Errorf("Expected fingerprint with 2 messages and max ROWID 2, got %+v", m.Fingerprint)
+	}
+	if m.ExportFormat != "txt" || m.Exporter != "fake" || m.ExporterVersion != "1.0.0" {
+		t.Errorf("Expected export format and exporter version to be recorded, got %+v", m)
+	}
+	if m.ArchiverVersion != version.Version {
+		t.Errorf("Expected archiver version %s, got %s", version.Version, m.ArchiverVersion)
+	}
+	if len(m.Files) != 1 || m.Files[0].Path != "messages.jsonl" || m.Files[0].Size != 3 {
+		t.Errorf("Expected checksum entry for messages.jsonl, got %+v", m.Files)
+	}
+}
+
+func TestArchiver_Run_UploadsThroughTransport(t *testing.T) {
+	exporter := &fakeExporter{
+		files:    map[string]string{"messages.jsonl": "{}\n"},
+		messages: 1,
+	}
+	archiver := newTestArchiverWithExporter(exporter)
+	archiver.config.DaysToCheck = 2
+	memory := transport.NewMemory()
+	archiver.destinations = []*destination{{name: "memory", transport: memory}}
+
+	// Yesterday is already archived, with a stale file that must survive
+	// because the day is not re-exported
+	yesterday := time.Now().AddDate(0, 0, -1)
+	stale := transport.DayPath(yesterday.Format("2006-01-02")) + "/old.txt"
+	if err := memory.WriteFile(context.Background(), stale, []byte("old")); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	if err := archiver.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if len(exporter.calls) != 1 {
+		t.Fatalf("Expected only the missing day to be exported, got %v", exporter.calls)
+	}
+
+	dayBefore := transport.DayPath(time.Now().AddDate(0, 0, -2).Format("2006-01-02"))
+	expected := []string{dayBefore + "/manifest.json", dayBefore + "/messages.jsonl", stale}
+	sort.Strings(expected)
+	if files := memory.Files(); strings.Join(files, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected destination files %v, got %v", expected, files)
+	}
+}
+
+func TestArchiver_Run_Encrypted(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := &fakeExporter{
+		files:    map[string]string{"+15555550123.txt": "hello\n"},
+		messages: 1,
+	}
+	archiver := newTestArchiverWithExporter(exporter)
+	archiver.config.DaysToCheck = 1
+	archiver.config.Encryption.Recipients = []string{identity.Recipient().String()}
+	memory := transport.NewMemory()
+	archiver.destinations = []*destination{{name: "memory", transport: memory}}
+
+	if err := archiver.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	day := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	dayPath := transport.DayPath(day)
+	expected := []string{dayPath + "/" + encryption.FileName, dayPath + "/manifest.json"}
+	if files := memory.Files(); strings.Join(files, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected only ciphertext and the public manifest, got %v", files)
+	}
+
+	restored := t.TempDir()
+	if err := restore.Day(context.Background(), memory, day, restored, []age.Identity{identity}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(restored, "+15555550123.txt")); err != nil || string(data) != "hello\n" {
+		t.Errorf("Expected the restored export, got %q, %v", data, err)
+	}
+}
+
+func TestArchiver_Run_Packaged(t *testing.T) {
+	exporter := &fakeExporter{
+		files:    map[string]string{"+15555550123.txt": "hello\n"},
+		messages: 1,
+	}
+	archiver := newTestArchiverWithExporter(exporter)
+	archiver.config.DaysToCheck = 1
+	archiver.config.Packaging = config.PackagingTarZst
+	memory := transport.NewMemory()
+	archiver.destinations = []*destination{{name: "memory", transport: memory}}
+
+	if err := archiver.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	day := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	expected := []string{transport.PackageManifestPath(day), transport.PackagePath(day, "tar.zst")}
+	if files := memory.Files(); strings.Join(files, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected only the package and its manifest, got %v", files)
+	}
+
+	// The packaged day counts as archived
+	if err := archiver.Run(context.Background()); err != nil {
+		t.Fatalf("Second run failed: %v", err)
+	}
+	if len(exporter.calls) != 1 {
+		t.Errorf("Expected the packaged day not to be exported again, got %v", exporter.calls)
+	}
+
+	restored := t.TempDir()
+	if err := restore.Day(context.Background(), memory, day, restored, nil); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(restored, "+15555550123.txt")); err != nil || string(data) != "hello\n" {
+		t.Errorf("Expected the restored export, got %q, %v", data, err)
+	}
+}
+
+func TestArchiver_Run_DedupeAttachments(t *testing.T) {
+	exporter := &fakeExporter{
+		files:    map[string]string{"+15555550123.txt": "hello\n", "attachments/photo.jpg": "jpeg"},
+		messages: 1,
+	}
+	archiver := newTestArchiverWithExporter(exporter)
+	archiver.config.DaysToCheck = 2
+	archiver.config.DedupeAttachments = true
+	memory := transport.NewMemory()
+	archiver.destinations = []*destination{{name: "memory", transport: memory}}
+
+	if err := archiver.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	// The photo sent on both days is stored once
+	var blobs []string
+	for _, name := range memory.Files() {
+		if strings.HasPrefix(name, "attachments/") {
+			blobs = append(blobs, name)
+		} else if strings.Contains(name, "/attachments/") {
+			t.Errorf("Expected no attachments inside day directories, got %s", name)
+		}
+	}
+	if len(blobs) != 1 {
+		t.Fatalf("Expected one stored attachment, got %v", blobs)
+	}
+
+	for _, day := range []string{time.Now().AddDate(0, 0, -1).Format("2006-01-02"), time.Now().AddDate(0, 0, -2).Format("2006-01-02")} {
+		restored := t.TempDir()
+		if err := restore.Day(context.Background(), memory, day, restored, nil); err != nil {
+			t.Fatalf("Restore of %s failed: %v", day, err)
+		}
+		if data, err := os.ReadFile(filepath.Join(restored, "attachments", "photo.jpg")); err != nil || string(data) != "jpeg" {
+			t.Errorf("Expected the attachment back in %s, got %q, %v", day, data, err)
+		}
+	}
+}
+
+// failingTransport is a destination whose uploads always fail.
+type failingTransport struct {
+	*transport.Memory
+}
+
+func (f failingTransport) Upload(context.Context, string, []string) error {
+	return errors.New("destination unreachable")
+}
+
+func TestArchiver_Run_MultipleDestinations(t *testing.T) {
+	exporter := &fakeExporter{
+		files:    map[string]string{"messages.jsonl": "{}\n"},
+		messages: 1,
+	}
+	archiver := newTestArchiverWithExporter(exporter)
+	archiver.config.DaysToCheck = 2
+
+	yesterday := transport.DayPath(time.Now().AddDate(0, 0, -1).Format("2006-01-02"))
+	dayBefore := transport.DayPath(time.Now().AddDate(0, 0, -2).Format("2006-01-02"))
+
+	// The primary already has yesterday, the offsite copy has nothing
+	primary := transport.NewMemory()
+	if err := primary.WriteFile(context.Background(), yesterday+"/old.txt", []byte("old")); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	offsite := transport.NewMemory()
+	archiver.destinations = []*destination{
+		{name: "primary", transport: primary},
+		{name: "broken", transport: failingTransport{transport.NewMemory()}},
+		{name: "offsite", transport: offsite},
+	}
+
+	err := archiver.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("Expected the failing destination to be reported, got %v", err)
+	}
+
+	if len(exporter.calls) != 2 {
+		t.Fatalf("Expected each missing day to be exported once, got %v", exporter.calls)
+	}
+
+	expected := []string{dayBefore + "/manifest.json", dayBefore + "/messages.jsonl", yesterday + "/old.txt"}
+	sort.Strings(expected)
+	if files := primary.Files(); strings.Join(files, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected primary to receive only the day it lacked, got %v", files)
+	}
+
+	expected = []string{dayBefore + "/manifest.json", dayBefore + "/messages.jsonl", yesterday + "/manifest.json", yesterday + "/messages.jsonl"}
+	sort.Strings(expected)
+	if files := offsite.Files(); strings.Join(files, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected offsite to receive both days despite the failing destination, got %v", files)
+	}
+
+	if archiver.destinations[1].err == nil || len(archiver.destinations[2].uploaded) != 2 {
+		t.Errorf("Expected per-destination results to be recorded, got %+v", archiver.destinations)
+	}
+}
+
+func TestArchiver_Run_StopsAtDayBoundary(t *testing.T) {
+	stateDir := t.TempDir()
+	exporter := &fakeExporter{
+		files:    map[string]string{"messages.jsonl": "{}\n"},
+		messages: 1,
+	}
+	archiver := newTestArchiverWithExporter(exporter)
+	archiver.config.DaysToCheck = 3
+	archiver.config.StateDir = stateDir
+	memory := transport.NewMemory()
+	archiver.destinations = []*destination{{name: "memory", transport: memory}}
+
+	// A stop during the first export lets that day finish and skips the rest
+	exporter.onExport = archiver.Stop
+	err := archiver.Run(context.Background())
+	if !errors.Is(err, ErrStopped) {
+		t.Fatalf("Expected the run to stop, got %v", err)
+	}
+	if len(exporter.calls) != 1 {
+		t.Errorf("Expected only the day in progress to be exported, got %v", exporter.calls)
+	}
+	if days, _ := memory.ListDays(context.Background()); len(days) != 0 {
+		t.Errorf("Expected nothing to be uploaded, got %v", days)
+	}
+
+	// The next run picks up the remaining days
+	exporter.onExport = nil
+	exporter.calls = nil
+	next := newTestArchiverWithExporter(exporter)
+	next.config.DaysToCheck = 3
+	next.config.StateDir = stateDir
+	next.destinations = []*destination{{name: "memory", transport: memory}}
+	if err := next.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(exporter.calls) != 2 {
+		t.Errorf("Expected the two remaining days to be exported, got %v", exporter.calls)
+	}
+	if days, err := memory.ListDays(context.Background()); err != nil || len(days) != 3 {
+		t.Errorf("Expected all three days to be archived, got %v, %v", days, err)
+	}
+}
+
+func TestArchiver_Run_Cancelled(t *testing.T) {
+	exporter := &fakeExporter{
+		files:    map[string]string{"messages.jsonl": "{}\n"},
+		messages: 1,
+	}
+	archiver := newTestArchiverWithExporter(exporter)
+	archiver.config.DaysToCheck = 2
+	memory := transport.NewMemory()
+	archiver.destinations = []*destination{{name: "memory", transport: memory}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := archiver.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the run to be cancelled, got %v", err)
+	}
+	if len(exporter.calls) != 0 {
+		t.Errorf("Expected nothing to be exported, got %v", exporter.calls)
+	}
+	if dirs := workDirs(t); len(dirs) != 0 {
+		t.Errorf("Expected the work directory to be cleaned up without a state_dir, got %v", dirs)
+	}
+}
@@ -0,0 +1,172 @@
+package archiver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/chatdb"
+)
+
+// DefaultChunkDays is how many calendar days a backfill exports and uploads
+// at a time.
+const DefaultChunkDays = 30
+
+// dateRange is an inclusive range of days, each at midnight local time.
+type dateRange struct {
+	from, to time.Time
+}
+
+// candidateDates returns the days gap detection checks, newest first: the
+// days_to_check days before today, or the days of the backfill range that
+// have messages.
+func (a *Archiver) candidateDates(ctx context.Context) []time.Time {
+	var dates []time.Time
+	if a.dateRange == nil {
+		today := time.Now()
+		for i := 1; i <= a.config.DaysToCheck; i++ {
+			dates = append(dates, today.AddDate(0, 0, -i))
+		}
+		return dates
+	}
+
+	days, err := a.daysWithMessages(ctx, a.dateRange.from, a.dateRange.to.AddDate(0, 0, 1))
+	if err != nil {
+		// Every day is exported; empty ones are skipped after the export
+		a.logger.Warn(fmt.Sprintf("Checking every day from %s to %s, failed to find days with messages: %v",
+			a.dateRange.from.Format("2006-01-02"), a.dateRange.to.Format("2006-01-02"), err))
+		for day := a.dateRange.to; !day.Before(a.dateRange.from); day = day.AddDate(0, 0, -1) {
+			dates = append(dates, day)
+		}
+		return dates
+	}
+
+	for i := len(days) - 1; i >= 0; i-- {
+		dates = append(dates, days[i])
+	}
+	return dates
+}
+
+// daysWithMessages returns the days in [start, end) that have messages in
+// chat.db, oldest first.
+func (a *Archiver) daysWithMessages(ctx context.Context, start, end time.Time) ([]time.Time, error) {
+	reader, err := chatdb.Open(ctx, a.config.DatabasePath())
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			a.logger.Warn(fmt.Sprintf("Failed to close chat database: %v", err))
+		}
+	}()
+
+	return reader.DaysWithMessages(ctx, start, end, time.Local)
+}
+
+// earliestMessageDay returns the day of the oldest message in chat.db.
+func (a *Archiver) earliestMessageDay(ctx context.Context) (time.Time, error) {
+	reader, err := chatdb.Open(ctx, a.config.DatabasePath())
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			a.logger.Warn(fmt.Sprintf("Failed to close chat database: %v", err))
+		}
+	}()
+
+	earliest, err := reader.EarliestMessage(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if earliest.IsZero() {
+		return time.Time{}, fmt.Errorf("the chat database contains no messages")
+	}
+	return startOfDay(earliest.In(time.Local)), nil
+}
+
+// Backfill archives the days from from to to, inclusive, that have messages,
+// oldest first and chunkDays calendar days at a time. Each chunk is exported
+// and uploaded before the next one starts, so an interrupted backfill loses
+// at most one chunk, and running it again skips the days every destination
+// already has. A zero from starts at the oldest message in chat.db and a
+// zero to ends yesterday. Cancelling ctx or calling Stop ends the backfill
+// like it ends Run. With continue_on_error set, a chunk with failed days
+// does not stop the backfill, which then returns ErrPartialSuccess.
+func (a *Archiver) Backfill(ctx context.Context, from, to time.Time, chunkDays int) error {
+	if from.IsZero() {
+		earliest, err := a.earliestMessageDay(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to find the oldest message (set a start date instead): %w", err)
+		}
+		from = earliest
+	}
+	if to.IsZero() {
+		to = time.Now().AddDate(0, 0, -1)
+	}
+	from, to = startOfDay(from), startOfDay(to)
+	if to.Before(from) {
+		return fmt.Errorf("nothing to backfill: %s is after %s", from.Format("2006-01-02"), to.Format("2006-01-02"))
+	}
+	if chunkDays <= 0 {
+		chunkDays = DefaultChunkDays
+	}
+
+	// The chunks run under one run lock, so no other run slips in between
+	unlock, err := a.lockRun(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer func() { a.dateRange = nil }()
+
+	total := daysBetween(from, to) + 1
+	a.logger.Info(fmt.Sprintf("Backfilling %d days from %s to %s", total, from.Format("2006-01-02"), to.Format("2006-01-02")))
+
+	started := time.Now()
+	done := 0
+	partial := false
+	for start := from; !start.After(to); start = start.AddDate(0, 0, chunkDays) {
+		end := start.AddDate(0, 0, chunkDays-1)
+		if end.After(to) {
+			end = to
+		}
+
+		a.dateRange = &dateRange{from: start, to: end}
+		err := a.Run(ctx)
+		if errors.Is(err, ErrPartialSuccess) {
+			a.logger.Warn(fmt.Sprintf("Continuing the backfill, %s to %s was archived in part: %v",
+				start.Format("2006-01-02"), end.Format("2006-01-02"), err))
+			partial = true
+		} else if err != nil {
+			return fmt.Errorf("backfill stopped at %s to %s, run it again to resume: %w", start.Format("2006-01-02"), end.Format("2006-01-02"), err)
+		}
+
+		done += daysBetween(start, end) + 1
+		a.logger.Info(fmt.Sprintf("Backfill progress: %d of %d days (%d%%) done through %s%s",
+			done, total, done*100/total, end.Format("2006-01-02"), remaining(time.Since(started), done, total)))
+	}
+
+	if partial {
+		return fmt.Errorf("%w: run the backfill again to retry the failed days", ErrPartialSuccess)
+	}
+	a.logger.Info("Backfill completed successfully")
+	return nil
+}
+
+// daysBetween returns the number of calendar days from from to to, both at
+// midnight, regardless of daylight saving changes in between.
+func daysBetween(from, to time.Time) int {
+	return int(math.Round(to.Sub(from).Hours() / 24))
+}
+
+// remaining estimates the time left from the pace so far.
+func remaining(elapsed time.Duration, done, total int) string {
+	if done == 0 || done >= total {
+		return ""
+	}
+	left := elapsed / time.Duration(done) * time.Duration(total-done)
+	return fmt.Sprintf(", about %s left", left.Round(time.Second))
+}
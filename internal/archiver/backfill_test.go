@@ -0,0 +1,103 @@
+package archiver
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/transport"
+)
+
+func TestArchiver_Backfill_FromEarliestMessage(t *testing.T) {
+	checkTestDatabaseExists(t)
+	exporter := &fakeExporter{
+		files:    map[string]string{"messages.jsonl": "{}\n"},
+		messages: 1,
+	}
+	archiver := newTestArchiverWithExporter(exporter)
+	archiver.config.TestDatabasePath = getTestDatabasePath()
+	memory := transport.NewMemory()
+	archiver.destinations = []*destination{{name: "memory", transport: memory}}
+
+	// Only the day with messages in the test database is exported, from
+	// wherever it falls in local time
+	earliest, err := archiver.earliestMessageDay(context.Background())
+	if err != nil {
+		t.Fatalf("earliestMessageDay failed: %v", err)
+	}
+	if err := archiver.Backfill(context.Background(), time.Time{}, earliest.AddDate(0, 0, 40), 7); err != nil {
+		t.Fatalf("Backfill failed: %v", err)
+	}
+	if len(exporter.calls) != 1 || !exporter.calls[0].Equal(earliest) {
+		t.Errorf("Expected only %v to be exported, got %v", earliest, exporter.calls)
+	}
+	days, err := memory.ListDays(context.Background())
+	if err != nil || strings.Join(days, ",") != earliest.Format("2006-01-02") {
+		t.Errorf("Expected the day to be archived, got %v, %v", days, err)
+	}
+	if archiver.dateRange != nil {
+		t.Error("Expected the backfill range to be cleared afterwards")
+	}
+}
+
+func TestArchiver_Backfill_Resumes(t *testing.T) {
+	exporter := &fakeExporter{
+		files:    map[string]string{"messages.jsonl": "{}\n"},
+		messages: 1,
+	}
+	archiver := newTestArchiverWithExporter(exporter)
+	memory := transport.NewMemory()
+	failing := &destination{name: "memory", transport: failingTransport{memory}}
+	archiver.destinations = []*destination{failing}
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	to := time.Date(2024, 1, 5, 0, 0, 0, 0, time.Local)
+
+	// Without chat.db every calendar day in the range is exported; the first
+	// chunk fails to upload and stops the backfill
+	err := archiver.Backfill(context.Background(), from, to, 2)
+	if err == nil || !strings.Contains(err.Error(), "2024-01-01 to 2024-01-02") {
+		t.Fatalf("Expected the failing chunk to be reported, got %v", err)
+	}
+	if len(exporter.calls) != 2 {
+		t.Fatalf("Expected the backfill to stop after the first chunk, got %v", exporter.calls)
+	}
+
+	// Running again resumes with the chunk that failed
+	failing.transport = memory
+	exporter.calls = nil
+	if err := archiver.Backfill(context.Background(), from, to, 2); err != nil {
+		t.Fatalf("Backfill failed: %v", err)
+	}
+	days, err := memory.ListDays(context.Background())
+	if err != nil || strings.Join(days, ",") != "2024-01-01,2024-01-02,2024-01-03,2024-01-04,2024-01-05" {
+		t.Errorf("Expected every day of the range to be archived, got %v, %v", days, err)
+	}
+
+	// Once complete, nothing is exported again
+	exporter.calls = nil
+	if err := archiver.Backfill(context.Background(), from, to, 2); err != nil {
+		t.Fatalf("Backfill failed: %v", err)
+	}
+	if len(exporter.calls) != 0 {
+		t.Errorf("Expected archived days to be skipped, got %v", exporter.calls)
+	}
+}
+
+func TestArchiver_Backfill_InvalidRange(t *testing.T) {
+	archiver := newTestArchiverWithExporter(&fakeExporter{})
+	from := time.Date(2024, 2, 1, 0, 0, 0, 0, time.Local)
+	if err := archiver.Backfill(context.Background(), from, from.AddDate(0, 0, -1), 0); err == nil {
+		t.Error("Expected an end before the start to be rejected")
+	}
+}
+
+func TestDaysBetween(t *testing.T) {
+	// Spans a daylight saving change in most zones that have one
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)
+	to := time.Date(2024, 4, 1, 0, 0, 0, 0, time.Local)
+	if got := daysBetween(from, to); got != 31 {
+		t.Errorf("daysBetween = %d; expected 31", got)
+	}
+}
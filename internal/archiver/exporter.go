@@ -0,0 +1,81 @@
+package archiver
+
+import (
+	"context"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/config"
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+)
+
+// Exporter exports the messages in a date range into a local directory.
+// Implementations must not depend on anything outside outputDir so the
+// archiver can process several dates independently, and must be safe to
+// call from several goroutines at once.
+type Exporter interface {
+	// Name identifies the backend in logs.
+	Name() string
+
+	// Version reports the backend version recorded in day manifests.
+	// Cancelling ctx abandons the query.
+	Version(ctx context.Context) string
+
+	// Export writes all messages dated in [start, end) into outputDir,
+	// which already exists. Cancelling ctx abandons the export, leaving
+	// outputDir incomplete.
+	Export(ctx context.Context, start, end time.Time, outputDir string) (*ExportResult, error)
+}
+
+// ExportResult summarizes what an Exporter produced.
+type ExportResult struct {
+	// Messages is the number of exported messages, or -1 if the backend
+	// cannot determine it.
+	Messages int
+	// Attachments is the number of attachment files written.
+	Attachments int
+	// Files lists every produced artifact relative to the output directory.
+	Files []string
+}
+
+// semaphore caps how many of something run at once, such as attachment
+// copies across exports running in parallel. A nil semaphore does not
+// limit them.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// acquire waits for a free slot, or returns the error of ctx.
+func (s semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the slot taken by acquire.
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// newExporter returns the backend selected by cfg.Exporter.
+func newExporter(cfg *config.Config, log *logger.Logger) Exporter {
+	switch cfg.Exporter {
+	case config.ExporterNative:
+		return newNativeExporter(cfg, log)
+	default:
+		// imessage-exporter is also the default for configs built without Load
+		return newIMessageExporterBackend(cfg, log)
+	}
+}
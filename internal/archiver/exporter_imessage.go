@@ -0,0 +1,165 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/config"
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+)
+
+// imessageExporterBackend exports messages by running the imessage-exporter
+// CLI as a subprocess.
+type imessageExporterBackend struct {
+	config *config.Config
+	logger *logger.Logger
+	copies semaphore
+
+	versionOnce sync.Once
+	version     string
+}
+
+func newIMessageExporterBackend(cfg *config.Config, log *logger.Logger) *imessageExporterBackend {
+	return &imessageExporterBackend{
+		config: cfg,
+		logger: log,
+		copies: newSemaphore(cfg.CopyConcurrency),
+	}
+}
+
+func (e *imessageExporterBackend) Name() string {
+	return config.ExporterIMessageExporter
+}
+
+// Version returns the output of `imessage-exporter --version`, queried once
+// per run, or "unknown" if it cannot be determined.
+func (e *imessageExporterBackend) Version(ctx context.Context) string {
+	e.versionOnce.Do(func() {
+		e.version = "unknown"
+		output, err := exec.CommandContext(ctx, "imessage-exporter", "--version").Output()
+		if err != nil {
+			e.logger.Debug(fmt.Sprintf("Failed to query imessage-exporter version: %v", err))
+			return
+		}
+		if v := strings.TrimSpace(string(output)); v != "" {
+			// Output is "imessage-exporter X.Y.Z"; keep only the version
+			fields := strings.Fields(v)
+			e.version = fields[len(fields)-1]
+		}
+	})
+	return e.version
+}
+
+// Export exports messages in [start, end) using imessage-exporter
+func (e *imessageExporterBackend) Export(ctx context.Context, start, end time.Time, outputDir string) (*ExportResult, error) {
+	startDate := start.Format("2006-01-02")
+	endDate := end.Format("2006-01-02")
+
+	e.logger.Debug(fmt.Sprintf("Exporting messages from %s to %s (exclusive) to %s", startDate, endDate, outputDir))
+
+	args := []string{
+		"--format", e.config.ExportFormat,
+		"--copy-method", e.config.CopyMethod,
+		"--export-path", outputDir,
+		"--start-date", startDate,
+		"--end-date", endDate,
+		"--no-lazy",
+	}
+
+	// Add custom database path if specified (chat_db_path or for testing)
+	if e.config.TestDatabasePath != "" || (e.config.ChatDBPath != "" && e.config.ChatDBPath != config.DefaultChatDBPath) {
+		args = append([]string{"--db-path", e.config.DatabasePath()}, args...)
+	}
+
+	// imessage-exporter copies attachments as it goes, so the whole export
+	// counts as copying unless copying is disabled
+	if e.config.CopyMethod != "disabled" {
+		if err := e.copies.acquire(ctx); err != nil {
+			return nil, err
+		}
+		defer e.copies.release()
+	}
+
+	cmd := exec.CommandContext(ctx, "imessage-exporter", args...)
+
+	// Enhanced logging for debugging
+	e.logger.Debug(fmt.Sprintf("Running command: %s", cmd.String()))
+
+	output, err := cmd.CombinedOutput() // Capture both stdout and stderr
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("imessage-exporter stopped: %w", ctx.Err())
+	}
+
+	// Always log the output for debugging purposes, especially for launch agent issues
+	if len(output) > 0 {
+		e.logger.Debug(fmt.Sprintf("imessage-exporter output:\n%s", string(output)))
+	} else {
+		e.logger.Debug("imessage-exporter produced no output")
+	}
+
+	// Check for critical errors in the output even if command didn't return an error code
+	outputStr := string(output)
+	if strings.Contains(outputStr, "Unable to read from chat database") ||
+		strings.Contains(outputStr, "unable to open database file") ||
+		strings.Contains(outputStr, "Full Disk Access") {
+
+		// Provide context-appropriate error message
+		return nil, fmt.Errorf("imessage-exporter failed due to insufficient permissions. "+
+			"Full Disk Access must be granted to the imessage-exporter binary. "+
+			"Go to System Settings > Privacy & Security > Full Disk Access and add the imessage-exporter binary. "+
+			"Original error: %s", strings.TrimSpace(outputStr))
+	}
+
+	if strings.Contains(outputStr, "Invalid configuration") {
+		return nil, fmt.Errorf("imessage-exporter configuration error: %s", outputStr)
+	}
+
+	if err != nil {
+		// Log the error along with any output that might have been produced
+		e.logger.Error(fmt.Sprintf("imessage-exporter command failed: %v", err))
+		return nil, fmt.Errorf("imessage-exporter failed: %w. Output: %s", err, string(output))
+	}
+
+	result, err := collectExportResult(outputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	e.logger.Debug("Message export completed successfully")
+	return result, nil
+}
+
+// collectExportResult lists the files an external exporter left in outputDir.
+// Message counts are not reported by imessage-exporter, so Messages is -1.
+func collectExportResult(outputDir string) (*ExportResult, error) {
+	result := &ExportResult{Messages: -1}
+
+	err := filepath.WalkDir(outputDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(outputDir, path)
+		if err != nil {
+			return err
+		}
+		result.Files = append(result.Files, filepath.ToSlash(rel))
+		if strings.HasPrefix(filepath.ToSlash(rel), "attachments/") {
+			result.Attachments++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list exported files in %s: %w", outputDir, err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,394 @@
+package archiver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/chatdb"
+	"github.com/iwvelando/imessage-archiver/internal/config"
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+	"github.com/iwvelando/imessage-archiver/internal/version"
+)
+
+// nativeExporter reads chat.db directly and writes structured exports
+// without any external tools.
+type nativeExporter struct {
+	config *config.Config
+	logger *logger.Logger
+	copies semaphore
+}
+
+func newNativeExporter(cfg *config.Config, log *logger.Logger) *nativeExporter {
+	return &nativeExporter{
+		config: cfg,
+		logger: log,
+		copies: newSemaphore(cfg.CopyConcurrency),
+	}
+}
+
+func (e *nativeExporter) Name() string {
+	return config.ExporterNative
+}
+
+// Version returns the archiver version since the native exporter is built in.
+func (e *nativeExporter) Version(ctx context.Context) string {
+	return version.Version
+}
+
+// messageRecord is the JSON representation of a single exported message.
+type messageRecord struct {
+	GUID                 string             `json:"guid"`
+	ChatIdentifier       string             `json:"chat_identifier"`
+	Sender               string             `json:"sender,omitempty"` // Empty for messages sent by the archive owner
+	IsFromMe             bool               `json:"is_from_me"`
+	Timestamp            string             `json:"timestamp"`
+	EditedAt             string             `json:"edited_at,omitempty"`
+	Unsent               bool               `json:"unsent,omitempty"`
+	Text                 string             `json:"text"`
+	Service              string             `json:"service"`
+	Attachments          []attachmentRecord `json:"attachments,omitempty"`
+	ReplyToGUID          string             `json:"reply_to_guid,omitempty"`
+	ThreadOriginatorGUID string             `json:"thread_originator_guid,omitempty"`
+}
+
+// attachmentRecord references an attachment from a messageRecord.
+type attachmentRecord struct {
+	GUID     string `json:"guid"`
+	Name     string `json:"name"`
+	MimeType string `json:"mime_type,omitempty"`
+	Path     string `json:"path,omitempty"`    // Location within the day directory, if copied
+	Missing  bool   `json:"missing,omitempty"` // Source file was not on disk (e.g. not downloaded from iCloud)
+}
+
+// Export writes messages in [start, end) into outputDir in the configured format
+func (e *nativeExporter) Export(ctx context.Context, start, end time.Time, outputDir string) (*ExportResult, error) {
+	e.logger.Debug(fmt.Sprintf("Reading messages from %s between %s and %s (exclusive)",
+		e.config.DatabasePath(), start.Format("2006-01-02"), end.Format("2006-01-02")))
+
+	reader, err := chatdb.Open(ctx, e.config.DatabasePath())
+	if err != nil {
+		return nil, fmt.Errorf("native exporter failed to open chat database: %w", err)
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			e.logger.Warn(fmt.Sprintf("Failed to close chat database: %v", err))
+		}
+	}()
+
+	messages, err := reader.Messages(ctx, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("native exporter failed to read messages: %w", err)
+	}
+
+	result := &ExportResult{Messages: len(messages)}
+	if len(messages) == 0 {
+		e.logger.Debug("No messages in range, nothing to export")
+		return result, nil
+	}
+
+	attachments, err := e.copyAttachments(ctx, messages, outputDir, result)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.config.ExportFormat {
+	case "json", "jsonl":
+		err = e.writeJSON(messages, attachments, start.Location(), outputDir, result)
+	case "markdown":
+		err = e.writeMarkdown(messages, attachments, start, outputDir, result)
+	default:
+		err = fmt.Errorf("native exporter does not support export format %q", e.config.ExportFormat)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	e.logger.Debug(fmt.Sprintf("Native export wrote %d messages to %s", len(messages), outputDir))
+	return result, nil
+}
+
+// copyAttachments copies attachment files into outputDir/attachments unless
+// copying is disabled, and returns the resulting records keyed by GUID.
+func (e *nativeExporter) copyAttachments(ctx context.Context, messages []chatdb.Message, outputDir string, result *ExportResult) (map[string]attachmentRecord, error) {
+	records := make(map[string]attachmentRecord)
+
+	for _, m := range messages {
+		for _, a := range m.Attachments {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if _, seen := records[a.GUID]; seen {
+				continue
+			}
+
+			name := a.TransferName
+			if name == "" {
+				name = filepath.Base(a.Filename)
+			}
+			record := attachmentRecord{
+				GUID:     a.GUID,
+				Name:     name,
+				MimeType: a.MimeType,
+			}
+
+			if e.config.CopyMethod != "disabled" {
+				rel := filepath.ToSlash(filepath.Join("attachments", a.GUID+"_"+sanitizeFileName(name)))
+				if err := e.copies.acquire(ctx); err != nil {
+					return nil, err
+				}
+				err := copyFile(a.Filename, filepath.Join(outputDir, filepath.FromSlash(rel)))
+				e.copies.release()
+				switch {
+				case err == nil:
+					record.Path = rel
+					result.Attachments++
+					result.Files = append(result.Files, rel)
+				case errors.Is(err, os.ErrNotExist):
+					e.logger.Debug(fmt.Sprintf("Attachment %s not found on disk at %s", a.GUID, a.Filename))
+					record.Missing = true
+				default:
+					return nil, fmt.Errorf("failed to copy attachment %s: %w", a.GUID, err)
+				}
+			}
+
+			records[a.GUID] = record
+		}
+	}
+
+	return records, nil
+}
+
+// writeJSON writes messages as a JSON array (json) or one object per line (jsonl)
+func (e *nativeExporter) writeJSON(messages []chatdb.Message, attachments map[string]attachmentRecord, loc *time.Location, outputDir string, result *ExportResult) error {
+	name := "messages." + e.config.ExportFormat
+	f, err := os.Create(filepath.Join(outputDir, name))
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+
+	w := bufio.NewWriter(f)
+	if err := encodeRecords(w, messages, attachments, loc, e.config.ExportFormat == "jsonl"); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", name, err)
+	}
+
+	result.Files = append(result.Files, name)
+	return nil
+}
+
+func encodeRecords(w io.Writer, messages []chatdb.Message, attachments map[string]attachmentRecord, loc *time.Location, lines bool) error {
+	records := make([]messageRecord, 0, len(messages))
+	for _, m := range messages {
+		records = append(records, newMessageRecord(m, attachments, loc))
+	}
+
+	if !lines {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	}
+
+	enc := json.NewEncoder(w)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newMessageRecord(m chatdb.Message, attachments map[string]attachmentRecord, loc *time.Location) messageRecord {
+	record := messageRecord{
+		GUID:                 m.GUID,
+		ChatIdentifier:       m.ChatIdentifier,
+		IsFromMe:             m.IsFromMe,
+		Timestamp:            m.Date.In(loc).Format(time.RFC3339),
+		Unsent:               m.IsUnsent,
+		Text:                 m.Text,
+		Service:              m.Service,
+		ReplyToGUID:          m.ReplyToGUID,
+		ThreadOriginatorGUID: m.ThreadOriginatorGUID,
+	}
+	if !m.IsFromMe {
+		record.Sender = m.Handle
+	}
+	if !m.DateEdited.IsZero() {
+		record.EditedAt = m.DateEdited.In(loc).Format(time.RFC3339)
+	}
+	for _, a := range m.Attachments {
+		record.Attachments = append(record.Attachments, attachments[a.GUID])
+	}
+	return record
+}
+
+// writeMarkdown writes one Markdown file per chat, named after the chat
+// identifier, with a participant header and inline attachment links.
+func (e *nativeExporter) writeMarkdown(messages []chatdb.Message, attachments map[string]attachmentRecord, day time.Time, outputDir string, result *ExportResult) error {
+	// Group messages by chat, preserving first-seen order
+	var chatOrder []string
+	chats := make(map[string][]chatdb.Message)
+	for _, m := range messages {
+		if _, ok := chats[m.ChatGUID]; !ok {
+			chatOrder = append(chatOrder, m.ChatGUID)
+		}
+		chats[m.ChatGUID] = append(chats[m.ChatGUID], m)
+	}
+
+	usedNames := make(map[string]bool)
+	for _, chatGUID := range chatOrder {
+		chatMessages := chats[chatGUID]
+
+		base := "orphaned"
+		if chatGUID != "" {
+			base = sanitizeFileName(chatMessages[0].ChatIdentifier)
+		}
+		name := base + ".md"
+		for i := 2; usedNames[name]; i++ {
+			name = fmt.Sprintf("%s-%d.md", base, i)
+		}
+		usedNames[name] = true
+
+		content := renderMarkdownChat(chatMessages, attachments, day)
+		if err := os.WriteFile(filepath.Join(outputDir, name), []byte(content), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+		result.Files = append(result.Files, name)
+	}
+
+	return nil
+}
+
+func renderMarkdownChat(messages []chatdb.Message, attachments map[string]attachmentRecord, day time.Time) string {
+	var b strings.Builder
+	loc := day.Location()
+	first := messages[0]
+
+	title := first.ChatDisplayName
+	if title == "" {
+		title = first.ChatIdentifier
+	}
+	if title == "" {
+		title = "Messages without a chat"
+	}
+
+	// Participants are everyone who sent a message plus the archive owner
+	var participants []string
+	seen := make(map[string]bool)
+	for _, m := range messages {
+		name := markdownSender(m)
+		if !seen[name] {
+			seen[name] = true
+			participants = append(participants, name)
+		}
+	}
+
+	fmt.Fprintf(&b, "# %s\n\n", escapeMarkdown(title))
+	if first.ChatIdentifier != "" {
+		fmt.Fprintf(&b, "- **Chat:** %s\n", escapeMarkdown(first.ChatIdentifier))
+	}
+	fmt.Fprintf(&b, "- **Date:** %s\n", day.Format("2006-01-02"))
+	fmt.Fprintf(&b, "- **Participants:** %s\n", escapeMarkdown(strings.Join(participants, ", ")))
+
+	for _, m := range messages {
+		fmt.Fprintf(&b, "\n### %s · %s\n\n", m.Date.In(loc).Format("15:04:05"), escapeMarkdown(markdownSender(m)))
+
+		switch {
+		case m.IsUnsent:
+			b.WriteString("_Message unsent_\n")
+		case m.Text != "":
+			b.WriteString(m.Text)
+			b.WriteString("\n")
+		}
+		if !m.DateEdited.IsZero() {
+			fmt.Fprintf(&b, "\n_Edited %s_\n", m.DateEdited.In(loc).Format("2006-01-02 15:04:05"))
+		}
+
+		for _, a := range m.Attachments {
+			record := attachments[a.GUID]
+			switch {
+			case record.Path == "":
+				fmt.Fprintf(&b, "\n_Attachment not available: %s_\n", escapeMarkdown(record.Name))
+			case strings.HasPrefix(record.MimeType, "image/"):
+				fmt.Fprintf(&b, "\n![%s](<%s>)\n", escapeMarkdown(record.Name), record.Path)
+			default:
+				fmt.Fprintf(&b, "\n[%s](<%s>)\n", escapeMarkdown(record.Name), record.Path)
+			}
+		}
+	}
+
+	return b.String()
+}
+
+func markdownSender(m chatdb.Message) string {
+	if m.IsFromMe {
+		return "Me"
+	}
+	if m.Handle == "" {
+		return "Unknown"
+	}
+	return m.Handle
+}
+
+// escapeMarkdown escapes characters that would otherwise be interpreted as
+// Markdown formatting in headers and link text.
+func escapeMarkdown(s string) string {
+	replacer := strings.NewReplacer(
+		"\\", "\\\\",
+		"*", "\\*",
+		"_", "\\_",
+		"[", "\\[",
+		"]", "\\]",
+		"#", "\\#",
+		"`", "\\`",
+	)
+	return replacer.Replace(s)
+}
+
+// sanitizeFileName replaces path separators and other characters that are
+// unsafe in archive file names.
+func sanitizeFileName(name string) string {
+	replacer := strings.NewReplacer("/", "_", "\\", "_", ":", "_", "\x00", "_")
+	name = replacer.Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return "file"
+	}
+	return name
+}
+
+// copyFile copies src to dst, creating dst's parent directories as needed.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
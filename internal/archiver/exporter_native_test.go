@@ -0,0 +1,242 @@
+package archiver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/chatdb"
+	"github.com/iwvelando/imessage-archiver/internal/config"
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+)
+
+func newTestNativeExporter(format string) *nativeExporter {
+	cfg := &config.Config{
+		LoggingLevel:     "debug",
+		Exporter:         config.ExporterNative,
+		ExportFormat:     format,
+		CopyMethod:       "basic",
+		TestDatabasePath: getTestDatabasePath(),
+	}
+	return newNativeExporter(cfg, logger.New("debug"))
+}
+
+func TestNativeExporter_JSONL(t *testing.T) {
+	checkTestDatabaseExists(t)
+
+	outputDir := t.TempDir()
+	exporter := newTestNativeExporter("jsonl")
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	result, err := exporter.Export(context.Background(), start, start.AddDate(0, 0, 1), outputDir)
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	if result.Messages != 2 {
+		t.Errorf("Expected 2 messages, got %d", result.Messages)
+	}
+	if len(result.Files) != 1 || result.Files[0] != "messages.jsonl" {
+		t.Errorf("Expected only messages.jsonl to be produced, got %v", result.Files)
+	}
+
+	f, err := os.Open(filepath.Join(outputDir, "messages.jsonl"))
+	if err != nil {
+		t.Fatalf("Failed to open messages.jsonl: %v", err)
+	}
+	defer f.Close()
+
+	var records []messageRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record messageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Failed to parse line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Failed to read messages.jsonl: %v", err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+
+	first := records[0]
+	if first.GUID != "MSG1" {
+		t.Errorf("Expected GUID MSG1, got %s", first.GUID)
+	}
+	if first.ChatIdentifier != "CHAT1" {
+		t.Errorf("Expected chat identifier CHAT1, got %s", first.ChatIdentifier)
+	}
+	if first.Sender != "+10005551234" {
+		t.Errorf("Expected sender +10005551234, got %s", first.Sender)
+	}
+	if first.Timestamp != "2024-01-01T12:00:00Z" {
+		t.Errorf("Expected RFC3339 timestamp 2024-01-01T12:00:00Z, got %s", first.Timestamp)
+	}
+	if first.Text == "" {
+		t.Error("Expected text to be populated")
+	}
+}
+
+func TestNativeExporter_JSON(t *testing.T) {
+	checkTestDatabaseExists(t)
+
+	outputDir := t.TempDir()
+	exporter := newTestNativeExporter("json")
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := exporter.Export(context.Background(), start, start.AddDate(0, 0, 1), outputDir); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(outputDir, "messages.json"))
+	if err != nil {
+		t.Fatalf("Failed to read messages.json: %v", err)
+	}
+
+	var records []messageRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		t.Fatalf("messages.json is not a JSON array of records: %v", err)
+	}
+	if len(records) != 2 {
+		t.Errorf("Expected 2 records, got %d", len(records))
+	}
+}
+
+func TestNativeExporter_NoMessages(t *testing.T) {
+	checkTestDatabaseExists(t)
+
+	outputDir := t.TempDir()
+	exporter := newTestNativeExporter("jsonl")
+
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	result, err := exporter.Export(context.Background(), start, start.AddDate(0, 0, 1), outputDir)
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	if result.Messages != 0 {
+		t.Errorf("Expected 0 messages, got %d", result.Messages)
+	}
+
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		t.Fatalf("Failed to read output directory: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected no files for an empty day, got %d", len(entries))
+	}
+}
+
+func TestNativeExporter_MissingDatabase(t *testing.T) {
+	exporter := newTestNativeExporter("jsonl")
+	exporter.config.TestDatabasePath = "/nonexistent/chat.db"
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := exporter.Export(context.Background(), start, start.AddDate(0, 0, 1), t.TempDir()); err == nil {
+		t.Error("Expected error for missing database, got nil")
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := map[string]string{
+		"IMG_0001.HEIC": "IMG_0001.HEIC",
+		"a/b:c":         "a_b_c",
+		"..":            "file",
+		"":              "file",
+	}
+	for input, expected := range tests {
+		if got := sanitizeFileName(input); got != expected {
+			t.Errorf("sanitizeFileName(%q) = %q, expected %q", input, got, expected)
+		}
+	}
+}
+
+func TestNativeExporter_Markdown(t *testing.T) {
+	checkTestDatabaseExists(t)
+
+	outputDir := t.TempDir()
+	exporter := newTestNativeExporter("markdown")
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	result, err := exporter.Export(context.Background(), start, start.AddDate(0, 0, 1), outputDir)
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	if len(result.Files) != 1 || result.Files[0] != "CHAT1.md" {
+		t.Fatalf("Expected one file per chat (CHAT1.md), got %v", result.Files)
+	}
+
+	data, err := os.ReadFile(filepath.Join(outputDir, "CHAT1.md"))
+	if err != nil {
+		t.Fatalf("Failed to read CHAT1.md: %v", err)
+	}
+	content := string(data)
+
+	for _, expected := range []string{
+		"# Test Chat\n",
+		"- **Date:** 2024-01-01\n",
+		"- **Participants:** +10005551234\n",
+		"### 12:00:00 · +10005551234\n",
+		"Lorem ipsum",
+	} {
+		if !strings.Contains(content, expected) {
+			t.Errorf("Expected markdown to contain %q, got:\n%s", expected, content)
+		}
+	}
+}
+
+func TestRenderMarkdownChat_Attachments(t *testing.T) {
+	day := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	messages := []chatdb.Message{
+		{
+			GUID:           "A",
+			ChatGUID:       "iMessage;-;friend@example.com",
+			ChatIdentifier: "friend@example.com",
+			Handle:         "friend@example.com",
+			Date:           day.Add(9 * time.Hour),
+			Text:           "look at this",
+			Attachments: []chatdb.Attachment{
+				{GUID: "IMG"},
+				{GUID: "DOC"},
+				{GUID: "GONE"},
+			},
+		},
+		{
+			GUID:           "B",
+			ChatGUID:       "iMessage;-;friend@example.com",
+			ChatIdentifier: "friend@example.com",
+			IsFromMe:       true,
+			Date:           day.Add(10 * time.Hour),
+			Text:           "nice",
+		},
+	}
+	attachments := map[string]attachmentRecord{
+		"IMG":  {GUID: "IMG", Name: "photo.jpg", MimeType: "image/jpeg", Path: "attachments/IMG_photo.jpg"},
+		"DOC":  {GUID: "DOC", Name: "notes.pdf", MimeType: "application/pdf", Path: "attachments/DOC_notes.pdf"},
+		"GONE": {GUID: "GONE", Name: "video.mov", Missing: true},
+	}
+
+	content := renderMarkdownChat(messages, attachments, day)
+
+	for _, expected := range []string{
+		"- **Participants:** friend@example.com, Me\n",
+		"![photo.jpg](<attachments/IMG_photo.jpg>)",
+		"[notes.pdf](<attachments/DOC_notes.pdf>)",
+		"_Attachment not available: video.mov_",
+		"### 10:00:00 · Me\n",
+	} {
+		if !strings.Contains(content, expected) {
+			t.Errorf("Expected markdown to contain %q, got:\n%s", expected, content)
+		}
+	}
+}
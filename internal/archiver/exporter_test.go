@@ -0,0 +1,158 @@
+package archiver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/config"
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+)
+
+// fakeExporter writes a fixed set of files and records the ranges it was asked for
+type fakeExporter struct {
+	mu       sync.Mutex
+	files    map[string]string // relative path -> content
+	messages int
+	err      error
+	calls    []time.Time
+	// onExport, if set, runs after each export, e.g. to stop the run
+	onExport func()
+}
+
+func (f *fakeExporter) Name() string {
+	return "fake"
+}
+
+func (f *fakeExporter) Version(ctx context.Context) string {
+	return "1.0.0"
+}
+
+func (f *fakeExporter) Export(ctx context.Context, start, end time.Time, outputDir string) (*ExportResult, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, start)
+	f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	result := &ExportResult{Messages: f.messages}
+	for rel, content := range f.files {
+		path := filepath.Join(outputDir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			return nil, err
+		}
+		result.Files = append(result.Files, rel)
+	}
+	if f.onExport != nil {
+		f.onExport()
+	}
+	return result, nil
+}
+
+func newTestArchiverWithExporter(exporter Exporter) *Archiver {
+	cfg := &config.Config{
+		LoggingLevel: "debug",
+		ExportFormat: "txt",
+		CopyMethod:   "basic",
+	}
+	archiver := New(cfg, logger.New("debug"))
+	archiver.exporter = exporter
+	return archiver
+}
+
+func TestNewExporter_DefaultsToIMessageExporter(t *testing.T) {
+	cfg := &config.Config{LoggingLevel: "debug"}
+	exporter := newExporter(cfg, logger.New("debug"))
+
+	if exporter.Name() != config.ExporterIMessageExporter {
+		t.Errorf("Expected default exporter %s, got %s", config.ExporterIMessageExporter, exporter.Name())
+	}
+}
+
+func TestArchiver_processDateLocally_UsesExporter(t *testing.T) {
+	tempRoot := t.TempDir()
+	exporter := &fakeExporter{
+		files:    map[string]string{"+10005551234.txt": "hello"},
+		messages: 1,
+	}
+	archiver := newTestArchiverWithExporter(exporter)
+
+	targetDate := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := archiver.processDateLocally(context.Background(), targetDate, tempRoot); err != nil {
+		t.Fatalf("processDateLocally failed: %v", err)
+	}
+
+	if len(exporter.calls) != 1 || !exporter.calls[0].Equal(targetDate) {
+		t.Errorf("Expected exporter to be called once for %v, got %v", targetDate, exporter.calls)
+	}
+
+	exported := filepath.Join(tempRoot, "2024", "01", "01", "+10005551234.txt")
+	if _, err := os.Stat(exported); err != nil {
+		t.Errorf("Expected exported file at %s: %v", exported, err)
+	}
+}
+
+func TestArchiver_processDateLocally_ExporterReportsNoMessages(t *testing.T) {
+	tempRoot := t.TempDir()
+	exporter := &fakeExporter{
+		files:    map[string]string{"orphaned.txt": ""},
+		messages: 0,
+	}
+	archiver := newTestArchiverWithExporter(exporter)
+
+	targetDate := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	if err := archiver.processDateLocally(context.Background(), targetDate, tempRoot); err != nil {
+		t.Fatalf("processDateLocally failed: %v", err)
+	}
+
+	dayDir := filepath.Join(tempRoot, "2024", "01", "02")
+	if _, err := os.Stat(dayDir); !os.IsNotExist(err) {
+		t.Errorf("Expected empty day directory %s to be removed", dayDir)
+	}
+}
+
+func TestArchiver_processDateLocally_ExporterError(t *testing.T) {
+	exporter := &fakeExporter{err: errors.New("boom")}
+	archiver := newTestArchiverWithExporter(exporter)
+
+	err := archiver.processDateLocally(context.Background(), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), t.TempDir())
+	if err == nil {
+		t.Fatal("Expected exporter error to be propagated")
+	}
+}
+
+func TestCollectExportResult(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tempDir, "attachments"), 0755); err != nil {
+		t.Fatalf("Failed to create attachments directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "chat.html"), []byte("<html></html>"), 0644); err != nil {
+		t.Fatalf("Failed to write chat file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "attachments", "image.jpg"), []byte("jpg"), 0644); err != nil {
+		t.Fatalf("Failed to write attachment: %v", err)
+	}
+
+	result, err := collectExportResult(tempDir)
+	if err != nil {
+		t.Fatalf("collectExportResult failed: %v", err)
+	}
+
+	if result.Messages != -1 {
+		t.Errorf("Expected unknown message count (-1), got %d", result.Messages)
+	}
+	if result.Attachments != 1 {
+		t.Errorf("Expected 1 attachment, got %d", result.Attachments)
+	}
+	if len(result.Files) != 2 {
+		t.Errorf("Expected 2 files, got %v", result.Files)
+	}
+}
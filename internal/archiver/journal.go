@@ -0,0 +1,287 @@
+package archiver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+
+	"github.com/iwvelando/imessage-archiver/internal/attachstore"
+	"github.com/iwvelando/imessage-archiver/internal/chatdb"
+	"github.com/iwvelando/imessage-archiver/internal/config"
+	"github.com/iwvelando/imessage-archiver/internal/encryption"
+	"github.com/iwvelando/imessage-archiver/internal/manifest"
+	"github.com/iwvelando/imessage-archiver/internal/packaging"
+	"github.com/iwvelando/imessage-archiver/internal/state"
+	"github.com/iwvelando/imessage-archiver/internal/transport"
+)
+
+// workDirPattern names the directory in the system temporary directory
+// where a run exports days before uploading them. Each run gets its own.
+const workDirPattern = "imessage-batch-export-*"
+
+// journalSettings describes the configuration that shapes the exported and
+// prepared days, so a run only reuses work done with the same settings.
+func (a *Archiver) journalSettings() string {
+	return strings.Join([]string{
+		"exporter=" + a.exporter.Name(),
+		"format=" + a.config.ExportFormat,
+		"packaging=" + a.config.Packaging,
+		"recipients=" + strings.Join(a.config.Encryption.Recipients, ","),
+		"passphrase_file=" + a.config.Encryption.PassphraseFile,
+		fmt.Sprintf("dedupe_attachments=%t", a.config.DedupeAttachments),
+	}, ";")
+}
+
+// openJournal resumes the journal of an interrupted run, or starts a new one
+// in a new work directory, and returns the work directory.
+func (a *Archiver) openJournal() (string, error) {
+	settings := a.journalSettings()
+	if a.config.StateDir != "" {
+		journal, err := state.LoadJournal(a.config.StateDir)
+		if err != nil {
+			a.logger.Warn(fmt.Sprintf("Starting afresh, failed to load the journal of the last run: %v", err))
+		}
+		if journal != nil {
+			if _, err := os.Stat(journal.WorkDir); err == nil && journal.Settings == settings {
+				a.logger.Info(fmt.Sprintf("Resuming the run started at %s from %s",
+					journal.StartedAt.Local().Format(time.RFC3339), journal.WorkDir))
+				if journal.RunID == "" {
+					journal.RunID = transport.NewRunID()
+				}
+				a.journal = journal
+				a.resumeStaging()
+				return journal.WorkDir, nil
+			}
+			a.logger.Info("Discarding the work of the last run, the configuration changed since")
+			a.cleanup(journal.WorkDir)
+		}
+	}
+
+	workDir, err := os.MkdirTemp("", workDirPattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to create work directory: %w", err)
+	}
+	a.journal = state.NewJournal(workDir, settings)
+	a.journal.RunID = transport.NewRunID()
+	a.resumeStaging()
+	return workDir, nil
+}
+
+// resumeStaging has the destinations stage under the run ID of the
+// journal, so a resumed run continues the uploads it staged before.
+func (a *Archiver) resumeStaging() {
+	for _, d := range a.destinations {
+		if resumable, ok := d.transport.(transport.Resumable); ok {
+			resumable.SetRunID(a.journal.RunID)
+		}
+	}
+}
+
+// saveJournal persists the journal, if there is a state directory to keep
+// it in. A run whose progress cannot be saved carries on; the next run only
+// redoes more work.
+func (a *Archiver) saveJournal() {
+	if a.config.StateDir == "" {
+		return
+	}
+	if err := state.SaveJournal(a.config.StateDir, a.journal); err != nil {
+		a.logger.Warn(fmt.Sprintf("Failed to save the run journal: %v", err))
+	}
+}
+
+// finishJournal removes the work directory and the journal of a run that
+// has nothing left to resume.
+func (a *Archiver) finishJournal(workDir string) {
+	a.cleanup(workDir)
+	if a.config.StateDir == "" {
+		return
+	}
+	if err := state.RemoveJournal(a.config.StateDir); err != nil {
+		a.logger.Warn(err.Error())
+	}
+}
+
+// dropStaleDays removes the work of an earlier run on days this run does
+// not handle, e.g. because every destination has them by now.
+func (a *Archiver) dropStaleDays(localRootDir string, days []string) error {
+	keep := make(map[string]bool, len(days))
+	for _, day := range days {
+		keep[day] = true
+	}
+
+	exported, err := localDays(localRootDir)
+	if err != nil {
+		return err
+	}
+	for _, day := range exported {
+		if !keep[day] {
+			if err := removeLocalDay(localRootDir, day); err != nil {
+				return err
+			}
+		}
+	}
+	for day := range a.journal.Days {
+		if !keep[day] {
+			a.journal.Forget(day)
+		}
+	}
+	return nil
+}
+
+// reuseExport reports whether an earlier attempt of this run already
+// exported day from the chat.db content with the given fingerprint.
+func (a *Archiver) reuseExport(day, localRootDir string, fingerprint *chatdb.Fingerprint) bool {
+	progress := a.journal.Day(day)
+	if progress == nil {
+		return false
+	}
+	switch progress.Stage {
+	case state.DayEmpty, state.DayExported, state.DayPrepared:
+	default:
+		return false
+	}
+
+	// Days whose content changed since are exported again
+	if (progress.Fingerprint == nil) != (fingerprint == nil) ||
+		(fingerprint != nil && !progress.Fingerprint.Equal(*fingerprint)) {
+		return false
+	}
+
+	if progress.Stage != state.DayEmpty {
+		exported, err := localDays(localRootDir)
+		if err != nil || !slices.Contains(exported, day) {
+			return false
+		}
+	}
+	a.logger.Info(fmt.Sprintf("Reusing the %s export of %s from the interrupted run", progress.Stage, day))
+	return true
+}
+
+// exportDay exports targetDate into localRootDir afresh and returns the
+// journal progress of the day. It runs in parallel with other days, so it
+// leaves recording the progress to the caller.
+func (a *Archiver) exportDay(ctx context.Context, targetDate time.Time, localRootDir string, fingerprint *chatdb.Fingerprint) (*state.JournalDay, error) {
+	day := targetDate.Format("2006-01-02")
+	if err := removeLocalDay(localRootDir, day); err != nil {
+		return nil, err
+	}
+
+	if err := a.processDateLocally(ctx, targetDate, localRootDir); err != nil {
+		return nil, err
+	}
+
+	// The manifest holds the fingerprint the day was exported from
+	m, err := manifest.Read(filepath.Join(localRootDir, filepath.FromSlash(transport.DayPath(day))))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return &state.JournalDay{Stage: state.DayEmpty, Fingerprint: fingerprint}, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read manifest of %s: %w", day, err)
+	default:
+		return &state.JournalDay{Stage: state.DayExported, Fingerprint: m.Fingerprint}, nil
+	}
+}
+
+// prepareDays brings every exported day into the form it is uploaded in,
+// skipping days an earlier attempt of this run already prepared. With
+// continue_on_error, a day that fails is dropped and the others go on.
+func (a *Archiver) prepareDays(ctx context.Context, localRootDir string, recipients []age.Recipient) error {
+	days, err := localDays(localRootDir)
+	if err != nil {
+		return err
+	}
+
+	for _, day := range days {
+		if err := a.interrupted(ctx); err != nil {
+			return err
+		}
+		if err := a.prepareExportedDay(localRootDir, day, recipients); err != nil {
+			if err := a.dropFailedDay(localRootDir, day, err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// prepareExportedDay prepares day unless an earlier attempt of this run
+// already did, and records its progress in the journal.
+func (a *Archiver) prepareExportedDay(localRootDir, day string, recipients []age.Recipient) error {
+	if progress := a.journal.Day(day); progress != nil && progress.Stage == state.DayPrepared {
+		return nil
+	}
+	a.journal.SetStage(day, state.DayPreparing, nil)
+	a.saveJournal()
+	if err := a.prepareDay(localRootDir, day, recipients); err != nil {
+		return err
+	}
+	a.journal.SetStage(day, state.DayPrepared, nil)
+	a.saveJournal()
+	return nil
+}
+
+// dropFailedDay records that day failed to prepare. Without
+// continue_on_error the failure ends the run and is returned; otherwise the
+// day is removed, so it is neither uploaded nor reused, and the run goes on.
+func (a *Archiver) dropFailedDay(localRootDir, day string, err error) error {
+	a.setResult(day, DayFailed, err)
+	if !a.config.ContinueOnError {
+		return err
+	}
+	a.logger.Error(fmt.Sprintf("Failed to prepare %s: %v", day, err))
+	a.journal.Forget(day)
+	a.saveJournal()
+	return removeLocalDay(localRootDir, day)
+}
+
+// prepareDay moves the attachments of an exported day into the
+// content-addressed store, then packages or encrypts the day as configured.
+// Only ciphertext leaves this machine when encryption is enabled.
+func (a *Archiver) prepareDay(localRootDir, day string, recipients []age.Recipient) error {
+	dayDir := filepath.Join(localRootDir, filepath.FromSlash(transport.DayPath(day)))
+
+	// Attachments leave the day before it is packaged
+	if a.config.DedupeAttachments {
+		if err := attachstore.Collect(localRootDir, dayDir); err != nil {
+			return err
+		}
+	}
+
+	if a.config.Packaging == config.PackagingTarZst {
+		if err := packaging.PackageDay(localRootDir, day, recipients); err != nil {
+			return fmt.Errorf("failed to package %s: %w", day, err)
+		}
+		a.logger.Debug(fmt.Sprintf("Packaged %s", day))
+	} else if recipients != nil {
+		if err := encryption.SealDay(dayDir, recipients); err != nil {
+			return fmt.Errorf("failed to encrypt %s: %w", day, err)
+		}
+		a.logger.Debug(fmt.Sprintf("Encrypted %s", day))
+	}
+	return nil
+}
+
+// removeLocalDay removes day from localRootDir in every layout it may have
+// been left in. Stored attachments stay, other days may reference them.
+func removeLocalDay(localRootDir, day string) error {
+	paths := []string{
+		transport.DayPath(day),
+		transport.PackageManifestPath(day),
+		transport.PackagePath(day, packaging.Extension(false)),
+		transport.PackagePath(day, packaging.Extension(true)),
+	}
+	for _, p := range paths {
+		if err := os.RemoveAll(filepath.Join(localRootDir, filepath.FromSlash(p))); err != nil {
+			return fmt.Errorf("failed to remove the earlier export of %s: %w", day, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package archiver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/state"
+	"github.com/iwvelando/imessage-archiver/internal/transport"
+)
+
+func TestArchiver_Run_ResumesInterruptedRun(t *testing.T) {
+	exporter := &fakeExporter{
+		files:    map[string]string{"messages.jsonl": "{}\n"},
+		messages: 1,
+	}
+	archiver := newTestArchiverWithExporter(exporter)
+	archiver.config.DaysToCheck = 2
+	archiver.config.StateDir = t.TempDir()
+
+	nas := transport.NewMemory()
+	offsite := transport.NewMemory()
+	failing := &destination{name: "offsite", transport: failingTransport{offsite}}
+	archiver.destinations = []*destination{{name: "nas", transport: nas}, failing}
+
+	// The failing destination leaves the run unfinished, with its work kept
+	if err := archiver.Run(context.Background()); err == nil {
+		t.Fatal("Expected the failing destination to fail the run")
+	}
+	journal, err := state.LoadJournal(archiver.config.StateDir)
+	if err != nil || journal == nil {
+		t.Fatalf("Expected the journal to be kept, got %v", err)
+	}
+	if _, err := os.Stat(journal.WorkDir); err != nil {
+		t.Fatalf("Expected the work directory to be kept: %v", err)
+	}
+	yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	if day := journal.Day(yesterday); day == nil || day.Stage != state.DayPrepared || strings.Join(day.Uploaded, ",") != "nas" {
+		t.Errorf("Expected %s to be prepared and uploaded to nas, got %+v", yesterday, day)
+	}
+
+	// The next run uploads the exported days without exporting them again
+	failing.transport = offsite
+	exporter.calls = nil
+	if err := archiver.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(exporter.calls) != 0 {
+		t.Errorf("Expected the exported days to be reused, got %v", exporter.calls)
+	}
+	if days, err := offsite.ListDays(context.Background()); err != nil || len(days) != 2 {
+		t.Errorf("Expected both days at offsite, got %v, %v", days, err)
+	}
+	if len(archiver.destinations[0].uploaded) != 0 {
+		t.Errorf("Expected nothing to be uploaded to nas again, got %v", archiver.destinations[0].uploaded)
+	}
+
+	// A completed run leaves nothing to resume
+	if journal, err := state.LoadJournal(archiver.config.StateDir); err != nil || journal != nil {
+		t.Errorf("Expected the journal to be removed, got %+v, %v", journal, err)
+	}
+	if _, err := os.Stat(journal.WorkDir); !os.IsNotExist(err) {
+		t.Errorf("Expected the work directory to be removed, got %v", err)
+	}
+}
+
+// stagingRecorder records the run IDs a run stages under.
+type stagingRecorder struct {
+	*transport.Memory
+	runIDs []string
+}
+
+func (s *stagingRecorder) SetRunID(runID string) {
+	s.runIDs = append(s.runIDs, runID)
+}
+
+func TestArchiver_Run_ResumesStagedUploads(t *testing.T) {
+	exporter := &fakeExporter{
+		files:    map[string]string{"messages.jsonl": "{}\n"},
+		messages: 1,
+	}
+	archiver := newTestArchiverWithExporter(exporter)
+	archiver.config.DaysToCheck = 1
+	archiver.config.StateDir = t.TempDir()
+
+	recorder := &stagingRecorder{Memory: transport.NewMemory()}
+	offsite := transport.NewMemory()
+	failing := &destination{name: "offsite", transport: failingTransport{offsite}}
+	archiver.destinations = []*destination{{name: "nas", transport: recorder}, failing}
+
+	if err := archiver.Run(context.Background()); err == nil {
+		t.Fatal("Expected the failing destination to fail the run")
+	}
+	journal, err := state.LoadJournal(archiver.config.StateDir)
+	if err != nil || journal == nil || journal.RunID == "" {
+		t.Fatalf("Expected the journal to record the run ID, got %+v, %v", journal, err)
+	}
+
+	// The resumed run stages under the same run ID, a new one under another
+	failing.transport = offsite
+	for i := 0; i < 2; i++ {
+		if err := archiver.Run(context.Background()); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+	}
+	if len(recorder.runIDs) != 3 || recorder.runIDs[0] != journal.RunID || recorder.runIDs[1] != journal.RunID || recorder.runIDs[2] == journal.RunID {
+		t.Errorf("Expected the resumed run to reuse %s and the next one not to, got %v", journal.RunID, recorder.runIDs)
+	}
+}
+
+func TestArchiver_Run_DiscardsWorkOfOtherSettings(t *testing.T) {
+	exporter := &fakeExporter{
+		files:    map[string]string{"messages.jsonl": "{}\n"},
+		messages: 1,
+	}
+	archiver := newTestArchiverWithExporter(exporter)
+	archiver.config.DaysToCheck = 1
+	archiver.config.StateDir = t.TempDir()
+	memory := transport.NewMemory()
+	failing := &destination{name: "memory", transport: failingTransport{memory}}
+	archiver.destinations = []*destination{failing}
+
+	if err := archiver.Run(context.Background()); err == nil {
+		t.Fatal("Expected the failing destination to fail the run")
+	}
+
+	// Days exported in another format are exported again
+	archiver.config.ExportFormat = "json"
+	failing.transport = memory
+	exporter.calls = nil
+	if err := archiver.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(exporter.calls) != 1 {
+		t.Errorf("Expected the day to be exported again, got %v", exporter.calls)
+	}
+}
+
+// workDirs returns the work directories runs left in the system temporary
+// directory.
+func workDirs(t *testing.T) []string {
+	t.Helper()
+	dirs, err := filepath.Glob(filepath.Join(os.TempDir(), workDirPattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dirs
+}
@@ -0,0 +1,77 @@
+package archiver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/iwvelando/imessage-archiver/internal/runlock"
+)
+
+// lockFile is the run lock in the state directory, or in the system
+// temporary directory without one.
+func (a *Archiver) lockFile() string {
+	if a.config.StateDir == "" {
+		return filepath.Join(os.TempDir(), "imessage-archiver.lock")
+	}
+	return filepath.Join(a.config.StateDir, "run.lock")
+}
+
+// lockRun takes the run lock, waiting up to lock_timeout for another run on
+// this Mac to finish, and returns the function that releases it. An
+// archiver that holds the lock already, as it does for the runs of a
+// backfill, keeps it.
+func (a *Archiver) lockRun(ctx context.Context) (func(), error) {
+	if a.runLock != nil {
+		return func() {}, nil
+	}
+	lock, err := runlock.Acquire(ctx, a.lockFile(), runlock.NewOwner(), a.config.LockTimeout, a.logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take the run lock: %w", err)
+	}
+	a.runLock = lock
+	return func() {
+		if err := lock.Release(); err != nil {
+			a.logger.Warn(err.Error())
+		}
+		a.runLock = nil
+	}, nil
+}
+
+// lockDestinations takes the lock of every destination, so runs from other
+// Macs do not upload to them at the same time, and returns the function
+// that releases the locks. A destination held by another run fails the run;
+// one whose lock cannot be checked, e.g. because it is unreachable, is used
+// without it and fails when uploading instead.
+func (a *Archiver) lockDestinations(ctx context.Context) (func(), error) {
+	unlock := func() {
+		// Release the locks of a cancelled run too, so the next run does not
+		// have to wait for them to go stale
+		releaseCtx := context.WithoutCancel(ctx)
+		for _, d := range a.destinations {
+			if d.lock == nil {
+				continue
+			}
+			if err := d.lock.Release(releaseCtx); err != nil {
+				a.logger.Warn(err.Error())
+			}
+			d.lock = nil
+		}
+	}
+
+	for _, d := range a.destinations {
+		lock, err := runlock.AcquireRemote(ctx, d.transport, d.name, runlock.NewOwner(), a.config.LockTimeout, a.logger)
+		switch {
+		case err != nil && (errors.Is(err, runlock.ErrLocked) || ctx.Err() != nil):
+			unlock()
+			return nil, fmt.Errorf("failed to lock %s: %w", d.name, err)
+		case err != nil:
+			a.logger.Warn(fmt.Sprintf("Continuing without the lock of %s: %v", d.name, err))
+		default:
+			d.lock = lock
+		}
+	}
+	return unlock, nil
+}
@@ -0,0 +1,70 @@
+package archiver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/iwvelando/imessage-archiver/internal/runlock"
+	"github.com/iwvelando/imessage-archiver/internal/transport"
+)
+
+func TestArchiver_Run_Locked(t *testing.T) {
+	exporter := &fakeExporter{
+		files:    map[string]string{"messages.jsonl": "{}\n"},
+		messages: 1,
+	}
+	archiver := newTestArchiverWithExporter(exporter)
+	archiver.config.DaysToCheck = 1
+	archiver.config.StateDir = t.TempDir()
+	memory := transport.NewMemory()
+	archiver.destinations = []*destination{{name: "memory", transport: memory}}
+
+	// Another run on this Mac, alive since it is this process
+	other, err := runlock.Acquire(context.Background(), archiver.lockFile(), runlock.NewOwner(), 0, archiver.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := archiver.Run(context.Background()); !errors.Is(err, runlock.ErrLocked) {
+		t.Fatalf("Expected the run lock to be held, got %v", err)
+	}
+	if len(exporter.calls) != 0 {
+		t.Errorf("Expected nothing to be exported, got %v", exporter.calls)
+	}
+	if err := other.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another Mac uploading to the destination
+	owner := runlock.NewOwner()
+	owner.Host = "another-mac"
+	data, _ := json.Marshal(owner)
+	if err := memory.WriteFile(context.Background(), runlock.RemoteFile, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := archiver.Run(context.Background()); !errors.Is(err, runlock.ErrLocked) {
+		t.Fatalf("Expected the destination lock to be held, got %v", err)
+	}
+	if len(exporter.calls) != 0 {
+		t.Errorf("Expected nothing to be exported, got %v", exporter.calls)
+	}
+
+	// Once it is gone, the run goes ahead and leaves no locks behind
+	if err := memory.Delete(context.Background(), runlock.RemoteFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := archiver.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if days, err := memory.ListDays(context.Background()); err != nil || len(days) != 1 {
+		t.Errorf("Expected the day to be archived, got %v, %v", days, err)
+	}
+	if _, err := memory.ReadFile(context.Background(), runlock.RemoteFile); err == nil {
+		t.Error("Expected the destination lock to be released")
+	}
+	if _, err := os.Stat(archiver.lockFile()); !os.IsNotExist(err) {
+		t.Errorf("Expected the run lock to be released, got %v", err)
+	}
+}
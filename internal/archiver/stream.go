@@ -0,0 +1,67 @@
+package archiver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"filippo.io/age"
+)
+
+// streamDays exports the days and uploads each one as soon as it is
+// exported, while the next days export, instead of in one batch at the end.
+// Days are protected as they go, and the work directory holds only a few
+// days at a time; stored attachments stay until the run ends.
+func (a *Archiver) streamDays(ctx context.Context, dates []time.Time, localRootDir string, recipients []age.Recipient) error {
+	err := a.exportDays(ctx, dates, localRootDir, func(ctx context.Context, day string) error {
+		return a.streamDay(ctx, localRootDir, day, recipients)
+	})
+	a.logSummary()
+	return err
+}
+
+// streamDay prepares an exported day and uploads it to every destination
+// that needs it, then removes the local copy, so a streaming run only keeps
+// the days in flight on disk. It returns an error only when the run has to
+// end: when it is interrupted, or a day fails without continue_on_error.
+// Otherwise a day that fails to upload is recorded and kept for the next
+// run to resume.
+func (a *Archiver) streamDay(ctx context.Context, localRootDir, day string, recipients []age.Recipient) error {
+	if err := a.interrupted(ctx); err != nil {
+		return err
+	}
+	if err := a.prepareExportedDay(localRootDir, day, recipients); err != nil {
+		return a.dropFailedDay(localRootDir, day, err)
+	}
+
+	var errs []error
+	for _, d := range a.destinations {
+		if err := a.interrupted(ctx); err != nil {
+			return err
+		}
+		upload := a.daysToUpload(d, []string{day})
+		if len(upload) == 0 {
+			continue
+		}
+		if err := a.uploadTo(ctx, d, localRootDir, upload); err != nil {
+			if err := a.interrupted(ctx); err != nil {
+				return err
+			}
+			d.err = err
+			errs = append(errs, fmt.Errorf("%s: %w", d.name, err))
+		}
+	}
+	if len(errs) > 0 {
+		err := errors.Join(errs...)
+		a.setResult(day, DayFailed, err)
+		if !a.config.ContinueOnError {
+			return fmt.Errorf("failed to upload %s: %w", day, err)
+		}
+		return nil
+	}
+
+	a.setResult(day, DaySucceeded, nil)
+	a.logger.Info(fmt.Sprintf("Uploaded %s, removing the local copy", day))
+	return removeLocalDay(localRootDir, day)
+}
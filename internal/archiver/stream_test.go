@@ -0,0 +1,101 @@
+package archiver
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/iwvelando/imessage-archiver/internal/config"
+	"github.com/iwvelando/imessage-archiver/internal/transport"
+)
+
+// watchingTransport records, for each upload, the days it was given, how
+// many days were exported by then and how many the work directory held.
+type watchingTransport struct {
+	*transport.Memory
+	exporter *pacedExporter
+
+	mu      sync.Mutex
+	batches [][]string
+	exports []int
+	onDisk  []int
+}
+
+func (w *watchingTransport) Upload(ctx context.Context, localRoot string, days []string) error {
+	exported, err := localDays(localRoot)
+	if err != nil {
+		return err
+	}
+	w.exporter.mu.Lock()
+	exports := w.exporter.exports
+	w.exporter.mu.Unlock()
+
+	w.mu.Lock()
+	w.batches = append(w.batches, days)
+	w.exports = append(w.exports, exports)
+	w.onDisk = append(w.onDisk, len(exported))
+	w.mu.Unlock()
+	return w.Memory.Upload(ctx, localRoot, days)
+}
+
+func TestArchiver_Run_Streaming(t *testing.T) {
+	exporter := &pacedExporter{}
+	archiver := newTestArchiverWithExporter(exporter)
+	archiver.config.DaysToCheck = 6
+	archiver.config.UploadMode = config.UploadModeStreaming
+	archiver.config.Concurrency = 3
+	memory := transport.NewMemory()
+	watching := &watchingTransport{Memory: memory, exporter: exporter}
+	archiver.destinations = []*destination{{name: "memory", transport: watching}}
+
+	if err := archiver.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if days, err := memory.ListDays(context.Background()); err != nil || len(days) != 6 {
+		t.Errorf("Expected all six days to be archived, got %v, %v", days, err)
+	}
+
+	// Each day is uploaded on its own, before the last day is exported, and
+	// the work directory never holds more than the day being uploaded and
+	// the three being exported
+	if len(watching.batches) != 6 {
+		t.Fatalf("Expected one upload per day, got %v", watching.batches)
+	}
+	for i, batch := range watching.batches {
+		if len(batch) != 1 {
+			t.Errorf("Expected upload %d to hold one day, got %v", i, batch)
+		}
+		if watching.onDisk[i] > 4 {
+			t.Errorf("Expected at most four days on disk, got %d during upload %d", watching.onDisk[i], i)
+		}
+	}
+	if watching.exports[0] == 6 {
+		t.Error("Expected the first day to be uploaded while later days were still exporting")
+	}
+	for _, r := range archiver.Results() {
+		if r.Status != DaySucceeded {
+			t.Errorf("%s: expected succeeded, got %s: %v", r.Day, r.Status, r.Err)
+		}
+	}
+}
+
+func TestArchiver_Run_StreamingFailFast(t *testing.T) {
+	exporter := &pacedExporter{}
+	archiver := newTestArchiverWithExporter(exporter)
+	archiver.config.DaysToCheck = 6
+	archiver.config.UploadMode = config.UploadModeStreaming
+	archiver.destinations = []*destination{{name: "broken", transport: failingTransport{transport.NewMemory()}}}
+
+	// The first failed upload ends the run instead of exporting every day
+	err := archiver.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "destination unreachable") {
+		t.Fatalf("Expected the failed upload to be reported, got %v", err)
+	}
+	if exporter.exports >= 6 {
+		t.Errorf("Expected the run to stop exporting, got %d exports", exporter.exports)
+	}
+	if failed := archiver.countResults(DayFailed); failed != 1 {
+		t.Errorf("Expected one failed day, got %d: %v", failed, archiver.Results())
+	}
+}
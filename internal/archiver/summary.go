@@ -0,0 +1,106 @@
+package archiver
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// DayStatus is the outcome of one day of a run.
+type DayStatus string
+
+const (
+	// DaySucceeded means every destination that needed the day has it.
+	DaySucceeded DayStatus = "succeeded"
+	// DayEmpty means the day had no messages to archive.
+	DayEmpty DayStatus = "empty"
+	// DayFailed means the day could not be exported, prepared or uploaded.
+	DayFailed DayStatus = "failed"
+	// DaySkipped means the run ended before the day was done, e.g. because
+	// it was stopped or another day failed; the next run picks it up.
+	DaySkipped DayStatus = "skipped"
+)
+
+// DayResult is the outcome of one day, with the reason for failed and
+// skipped days.
+type DayResult struct {
+	Day    string
+	Status DayStatus
+	Err    error
+}
+
+// ErrPartialSuccess is returned by a run with continue_on_error set when
+// some days failed while the others were archived.
+var ErrPartialSuccess = errors.New("some days failed")
+
+// setResult records the outcome of day in the current run.
+func (a *Archiver) setResult(day string, status DayStatus, err error) {
+	if a.results == nil {
+		a.results = make(map[string]*DayResult)
+	}
+	a.results[day] = &DayResult{Day: day, Status: status, Err: err}
+}
+
+// Results returns the outcome of every day the last run handled, oldest
+// first.
+func (a *Archiver) Results() []DayResult {
+	results := make([]DayResult, 0, len(a.results))
+	for _, day := range slices.Sorted(maps.Keys(a.results)) {
+		results = append(results, *a.results[day])
+	}
+	return results
+}
+
+// countResults returns how many days of the current run ended with status.
+func (a *Archiver) countResults(status DayStatus) int {
+	n := 0
+	for _, r := range a.results {
+		if r.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// partialFailure returns the error of a run whose days did not all succeed
+// although it got to the end, or nil.
+func (a *Archiver) partialFailure() error {
+	failed := a.countResults(DayFailed)
+	switch {
+	case failed == 0:
+		return nil
+	case failed == len(a.results)-a.countResults(DayEmpty):
+		return fmt.Errorf("all %d days with messages failed", failed)
+	default:
+		return fmt.Errorf("%w: %d of %d days failed", ErrPartialSuccess, failed, len(a.results))
+	}
+}
+
+// logDays reports the outcome of every day of the run. Days still marked
+// skipped take the reason the run ended with.
+func (a *Archiver) logDays(runErr error) {
+	if len(a.results) == 0 {
+		return
+	}
+	for _, r := range a.results {
+		if r.Status == DaySkipped && r.Err == nil {
+			r.Err = runErr
+		}
+	}
+
+	a.logger.Info(fmt.Sprintf("Run summary: %d succeeded, %d empty, %d failed, %d skipped",
+		a.countResults(DaySucceeded), a.countResults(DayEmpty), a.countResults(DayFailed), a.countResults(DaySkipped)))
+	for _, r := range a.Results() {
+		switch {
+		case r.Status == DayFailed:
+			a.logger.Error(fmt.Sprintf("  %s: %s: %v", r.Day, r.Status, r.Err))
+		case r.Status == DaySkipped && r.Err != nil:
+			a.logger.Warn(fmt.Sprintf("  %s: %s: %v", r.Day, r.Status, r.Err))
+		case r.Status == DaySkipped:
+			a.logger.Warn(fmt.Sprintf("  %s: %s", r.Day, r.Status))
+		default:
+			a.logger.Info(fmt.Sprintf("  %s: %s", r.Day, r.Status))
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package archiver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/transport"
+)
+
+func TestArchiver_Run_ContinueOnError(t *testing.T) {
+	failing := time.Now().AddDate(0, 0, -2).Format("2006-01-02")
+	empty := time.Now().AddDate(0, 0, -3).Format("2006-01-02")
+	exporter := &pacedExporter{fail: map[string]bool{failing: true}, empty: map[string]bool{empty: true}}
+	archiver := newTestArchiverWithExporter(exporter)
+	archiver.config.DaysToCheck = 5
+	archiver.config.Concurrency = 2
+	archiver.config.ContinueOnError = true
+	memory := transport.NewMemory()
+	archiver.destinations = []*destination{{name: "memory", transport: memory}}
+
+	err := archiver.Run(context.Background())
+	if !errors.Is(err, ErrPartialSuccess) {
+		t.Fatalf("Expected ErrPartialSuccess, got %v", err)
+	}
+
+	// Every day but the failed and the empty one is uploaded
+	days, err := memory.ListDays(context.Background())
+	if err != nil || len(days) != 3 || strings.Contains(strings.Join(days, ","), failing) {
+		t.Errorf("Expected the three other days to be archived, got %v, %v", days, err)
+	}
+
+	results := archiver.Results()
+	if len(results) != 5 {
+		t.Fatalf("Expected a result for each of the five days, got %v", results)
+	}
+	for _, r := range results {
+		expected := DaySucceeded
+		switch r.Day {
+		case failing:
+			expected = DayFailed
+			if r.Err == nil || !strings.Contains(r.Err.Error(), "export exploded") {
+				t.Errorf("Expected the reason of the failure, got %v", r.Err)
+			}
+		case empty:
+			expected = DayEmpty
+		}
+		if r.Status != expected {
+			t.Errorf("%s: expected %s, got %s", r.Day, expected, r.Status)
+		}
+	}
+}
+
+func TestArchiver_Run_ContinueOnErrorUploadFailure(t *testing.T) {
+	archiver := newTestArchiverWithExporter(&pacedExporter{})
+	archiver.config.DaysToCheck = 2
+	archiver.config.ContinueOnError = true
+	memory := transport.NewMemory()
+	archiver.destinations = []*destination{
+		{name: "broken", transport: failingTransport{transport.NewMemory()}},
+		{name: "memory", transport: memory},
+	}
+
+	// Days a destination fails to receive are failed, even if another one
+	// has them; with no day archived everywhere the run is not partial
+	err := archiver.Run(context.Background())
+	if err == nil || errors.Is(err, ErrPartialSuccess) {
+		t.Fatalf("Expected the run to fail, got %v", err)
+	}
+	if days, err := memory.ListDays(context.Background()); err != nil || len(days) != 2 {
+		t.Errorf("Expected the working destination to be uploaded to, got %v, %v", days, err)
+	}
+	for _, r := range archiver.Results() {
+		if r.Status != DayFailed || r.Err == nil || !strings.Contains(r.Err.Error(), "broken: destination unreachable") {
+			t.Errorf("%s: expected to fail because of the broken destination, got %s: %v", r.Day, r.Status, r.Err)
+		}
+	}
+}
+
+func TestArchiver_Run_FailFastSkipsRemainingDays(t *testing.T) {
+	failing := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	archiver := newTestArchiverWithExporter(&pacedExporter{fail: map[string]bool{failing: true}})
+	archiver.config.DaysToCheck = 3
+	archiver.destinations = []*destination{{name: "memory", transport: transport.NewMemory()}}
+
+	if err := archiver.Run(context.Background()); err == nil {
+		t.Fatal("Expected the run to fail")
+	}
+	for _, r := range archiver.Results() {
+		expected := DaySkipped
+		if r.Day == failing {
+			expected = DayFailed
+		}
+		if r.Status != expected || r.Err == nil {
+			t.Errorf("%s: expected %s with a reason, got %s: %v", r.Day, expected, r.Status, r.Err)
+		}
+	}
+}
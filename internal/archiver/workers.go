@@ -0,0 +1,172 @@
+package archiver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/chatdb"
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+	"github.com/iwvelando/imessage-archiver/internal/state"
+)
+
+// dayJob is a day waiting to be exported by exportDays.
+type dayJob struct {
+	date        time.Time
+	fingerprint *chatdb.Fingerprint
+	log         *logger.Logger
+	done        chan dayResult
+}
+
+type dayResult struct {
+	progress *state.JournalDay
+	err      error
+	// held is set if the day took a place in the backlog
+	held bool
+}
+
+// streamFunc uploads an exported day in a streaming run, see streamDay.
+type streamFunc func(ctx context.Context, day string) error
+
+// exportDays exports the given days, except those an interrupted run
+// already exported, up to concurrency days at a time. With more than one
+// at a time, each day's log lines are held back and written in date order.
+// The first failure cancels the other days and is returned once they
+// stopped, unless continue_on_error is set: then failed days are only
+// recorded. Stop lets the running days finish and starts no new ones.
+//
+// A non-nil stream is handed each exported day, in date order, while the
+// next days export; days reused from an interrupted run go first. Days
+// exported but not yet streamed are limited to one more than run at once,
+// which bounds the disk space a streaming run needs.
+func (a *Archiver) exportDays(ctx context.Context, dates []time.Time, localRootDir string, stream streamFunc) error {
+	workers := max(a.config.Concurrency, 1)
+
+	var jobs []*dayJob
+	for _, date := range dates {
+		fingerprint := a.dayFingerprint(ctx, date)
+		if a.reuseExport(date.Format("2006-01-02"), localRootDir, fingerprint) {
+			if a.journal.Day(date.Format("2006-01-02")).Stage == state.DayEmpty {
+				a.setResult(date.Format("2006-01-02"), DayEmpty, nil)
+			} else if stream != nil {
+				if err := stream(ctx, date.Format("2006-01-02")); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		// Recorded before exporting, so a killed export is not taken for
+		// an earlier, complete one
+		a.journal.Forget(date.Format("2006-01-02"))
+
+		log := a.logger
+		if workers > 1 {
+			log = a.logger.Buffered()
+		}
+		jobs = append(jobs, &dayJob{date: date, fingerprint: fingerprint, log: log, done: make(chan dayResult, 1)})
+	}
+	a.saveJournal()
+	if len(jobs) == 0 {
+		return nil
+	}
+	if workers > 1 {
+		a.logger.Info(fmt.Sprintf("Exporting %d days, %d at a time", len(jobs), min(workers, len(jobs))))
+	}
+
+	var backlog semaphore
+	if stream != nil {
+		backlog = newSemaphore(workers + 1)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	go a.dispatchDays(ctx, cancel, jobs, workers, backlog, localRootDir)
+
+	// Results are taken in date order, so logs and the journal follow it
+	var stopped error
+	for _, job := range jobs {
+		result := <-job.done
+		job.log.Flush()
+		day := job.date.Format("2006-01-02")
+		switch {
+		case result.err == nil:
+			a.journal.Days[day] = result.progress
+			a.saveJournal()
+			if result.progress.Stage == state.DayEmpty {
+				a.setResult(day, DayEmpty, nil)
+			} else if stream != nil {
+				if err := stream(ctx, day); errors.Is(err, ErrStopped) {
+					stopped = err
+				} else if err != nil {
+					cancel(err)
+				}
+			}
+		case errors.Is(result.err, ErrStopped):
+			stopped = result.err
+		case errors.Is(result.err, context.Canceled), errors.Is(result.err, context.DeadlineExceeded):
+			// Cancelled along with the run, or because of another day
+		default:
+			a.logger.Error(fmt.Sprintf("Failed to process date %s: %v", day, result.err))
+			a.setResult(day, DayFailed, result.err)
+			if a.config.ContinueOnError {
+				// A partial export must not be uploaded with the other days
+				if err := removeLocalDay(localRootDir, day); err != nil {
+					return err
+				}
+			}
+		}
+		if result.held {
+			backlog.release()
+		}
+	}
+
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+	return stopped
+}
+
+// dispatchDays starts the export of each job in order once fewer than
+// workers are running and the backlog has room, and cancels ctx with the
+// first failure unless continue_on_error is set.
+func (a *Archiver) dispatchDays(ctx context.Context, cancel context.CancelCauseFunc, jobs []*dayJob, workers int, backlog semaphore, localRootDir string) {
+	slots := make(chan struct{}, workers)
+	for i, job := range jobs {
+		err := backlog.acquire(ctx)
+		if err == nil {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+			}
+			if err = a.interrupted(ctx); err != nil {
+				backlog.release()
+			}
+		}
+		if err != nil {
+			// Days not started are left for the next run
+			for _, rest := range jobs[i:] {
+				rest.done <- dayResult{err: err}
+			}
+			return
+		}
+
+		go func() {
+			defer func() { <-slots }()
+			progress, err := a.withLogger(job.log).exportDay(ctx, job.date, localRootDir, job.fingerprint)
+			if err != nil && !a.config.ContinueOnError {
+				cancel(fmt.Errorf("failed to process date %s: %w", job.date.Format("2006-01-02"), err))
+			}
+			job.done <- dayResult{progress: progress, err: err, held: true}
+		}()
+	}
+}
+
+// withLogger returns a copy of a that logs to log, for work on one day that
+// runs alongside other days.
+func (a *Archiver) withLogger(log *logger.Logger) *Archiver {
+	day := *a
+	day.logger = log
+	return &day
+}
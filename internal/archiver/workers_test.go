@@ -0,0 +1,126 @@
+package archiver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/transport"
+)
+
+// pacedExporter takes a while per day, records how many days it exported at
+// once, fails the days listed in fail and finds no messages on those listed
+// in empty.
+type pacedExporter struct {
+	fail  map[string]bool
+	empty map[string]bool
+
+	mu      sync.Mutex
+	active  int
+	peak    int
+	exports int
+}
+
+func (p *pacedExporter) Name() string                       { return "paced" }
+func (p *pacedExporter) Version(ctx context.Context) string { return "1.0.0" }
+
+func (p *pacedExporter) Export(ctx context.Context, start, end time.Time, outputDir string) (*ExportResult, error) {
+	p.mu.Lock()
+	p.active++
+	p.exports++
+	p.peak = max(p.peak, p.active)
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.active--
+		p.mu.Unlock()
+	}()
+
+	select {
+	case <-time.After(20 * time.Millisecond):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if p.fail[start.Format("2006-01-02")] {
+		return nil, errors.New("export exploded")
+	}
+	if p.empty[start.Format("2006-01-02")] {
+		return &ExportResult{}, nil
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, "messages.jsonl"), []byte("{}\n"), 0644); err != nil {
+		return nil, err
+	}
+	return &ExportResult{Messages: 1, Files: []string{"messages.jsonl"}}, nil
+}
+
+func TestArchiver_Run_Concurrency(t *testing.T) {
+	exporter := &pacedExporter{}
+	archiver := newTestArchiverWithExporter(exporter)
+	archiver.config.DaysToCheck = 6
+	archiver.config.Concurrency = 3
+	memory := transport.NewMemory()
+	archiver.destinations = []*destination{{name: "memory", transport: memory}}
+
+	if err := archiver.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if exporter.peak < 2 || exporter.peak > 3 {
+		t.Errorf("Expected up to 3 days to be exported at once, got %d", exporter.peak)
+	}
+	if days, err := memory.ListDays(context.Background()); err != nil || len(days) != 6 {
+		t.Errorf("Expected all six days to be archived, got %v, %v", days, err)
+	}
+}
+
+func TestArchiver_Run_ConcurrencyFailFast(t *testing.T) {
+	failing := time.Now().AddDate(0, 0, -2).Format("2006-01-02")
+	exporter := &pacedExporter{fail: map[string]bool{failing: true}}
+	archiver := newTestArchiverWithExporter(exporter)
+	archiver.config.DaysToCheck = 8
+	archiver.config.Concurrency = 2
+	memory := transport.NewMemory()
+	archiver.destinations = []*destination{{name: "memory", transport: memory}}
+
+	err := archiver.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), failing) || !strings.Contains(err.Error(), "export exploded") {
+		t.Fatalf("Expected the failing day to be reported, got %v", err)
+	}
+	if exporter.exports >= 8 {
+		t.Errorf("Expected the failure to stop the remaining days, got %d exports", exporter.exports)
+	}
+	if days, _ := memory.ListDays(context.Background()); len(days) != 0 {
+		t.Errorf("Expected nothing to be uploaded, got %v", days)
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	slots := newSemaphore(1)
+	if err := slots.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+
+	// A full set of slots waits until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := slots.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected acquire to wait for a free slot, got %v", err)
+	}
+	slots.release()
+	if err := slots.acquire(context.Background()); err != nil {
+		t.Errorf("Expected the released slot to be free, got %v", err)
+	}
+
+	// No limit at all
+	var unlimited semaphore
+	for i := 0; i < 3; i++ {
+		if err := unlimited.acquire(context.Background()); err != nil {
+			t.Fatalf("acquire failed: %v", err)
+		}
+	}
+	unlimited.release()
+}
@@ -0,0 +1,141 @@
+// Package attachstore keeps attachments in a content-addressed store below
+// the archive root, so a file sent or forwarded on many days is stored and
+// uploaded once. Days reference their attachments by checksum in their
+// manifest.
+package attachstore
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/iwvelando/imessage-archiver/internal/manifest"
+)
+
+// Dir is the directory below the archive root that holds the store, and
+// the directory of a day export that Collect moves into it.
+const Dir = "attachments"
+
+// maxExtLen bounds the extension kept on stored files.
+const maxExtLen = 16
+
+// Path returns the store path of an attachment,
+// attachments/ab/cd/<sha256><ext>, keeping the lower-cased extension of its
+// original name so stored files open with the right application.
+func Path(a manifest.Attachment) string {
+	sum := strings.ToLower(a.SHA256)
+	return path.Join(Dir, sum[:2], sum[2:4], sum+extension(a.Path))
+}
+
+// extension returns the extension of name if it is short and alphanumeric.
+func extension(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if len(ext) < 2 || len(ext) > maxExtLen {
+		return ""
+	}
+	for _, r := range ext[1:] {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return ""
+		}
+	}
+	return ext
+}
+
+// Valid reports whether a, read from a manifest, has a well-formed checksum
+// and a path inside the day directory.
+func Valid(a manifest.Attachment) bool {
+	if len(a.SHA256) != 64 {
+		return false
+	}
+	if _, err := hex.DecodeString(a.SHA256); err != nil {
+		return false
+	}
+	return fs.ValidPath(a.Path) && a.Path != manifest.FileName
+}
+
+// Blobs returns the store paths of the attachments m references, sorted and
+// without duplicates.
+func Blobs(m *manifest.Manifest) []string {
+	var blobs []string
+	for _, a := range m.Attachments {
+		blobs = append(blobs, Path(a))
+	}
+	slices.Sort(blobs)
+	return slices.Compact(blobs)
+}
+
+// Collect moves the files below dayDir/attachments into the store below
+// root and records them as attachments in the day's manifest instead of
+// files. A file the store already holds is not kept twice.
+func Collect(root, dayDir string) error {
+	m, err := manifest.Read(dayDir)
+	if err != nil {
+		return err
+	}
+
+	attachmentsDir := filepath.Join(dayDir, Dir)
+	if _, err := os.Stat(attachmentsDir); os.IsNotExist(err) {
+		return nil
+	}
+
+	byPath := make(map[string]manifest.File, len(m.Files))
+	for _, f := range m.Files {
+		byPath[f.Path] = f
+	}
+
+	err = filepath.WalkDir(attachmentsDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dayDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		f, ok := byPath[rel]
+		if !ok {
+			return fmt.Errorf("%s is not in the manifest", rel)
+		}
+		a := manifest.Attachment{Path: f.Path, Size: f.Size, SHA256: f.SHA256}
+
+		dst := filepath.Join(root, filepath.FromSlash(Path(a)))
+		if _, err := os.Stat(dst); err == nil {
+			// Stored for an earlier day of this run
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+		} else {
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(p, dst); err != nil {
+				return err
+			}
+		}
+
+		m.Attachments = append(m.Attachments, a)
+		delete(byPath, rel)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to move attachments of %s into the store: %w", m.Date, err)
+	}
+	if err := os.RemoveAll(attachmentsDir); err != nil {
+		return err
+	}
+
+	files := m.Files[:0]
+	for _, f := range m.Files {
+		if _, ok := byPath[f.Path]; ok {
+			files = append(files, f)
+		}
+	}
+	m.Files = files
+	return manifest.Write(dayDir, m)
+}
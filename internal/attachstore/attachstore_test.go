@@ -0,0 +1,143 @@
+package attachstore
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/iwvelando/imessage-archiver/internal/manifest"
+)
+
+const jpegSum = "41e5787e9f28562d07b891b1816b492309d646c0f2829743fa4963a9f9cc1d61"
+
+// writeDay creates a day export below root with the given files and a
+// manifest listing them.
+func writeDay(t *testing.T, root, dayPath, date string, files map[string]string) string {
+	t.Helper()
+	dayDir := filepath.Join(root, filepath.FromSlash(dayPath))
+	for name, content := range files {
+		p := filepath.Join(dayDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scanned, err := manifest.ScanFiles(dayDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.Write(dayDir, &manifest.Manifest{Date: date, Files: scanned}); err != nil {
+		t.Fatal(err)
+	}
+	return dayDir
+}
+
+func TestPath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"attachments/IMG_0001.JPG", "attachments/41/e5/" + jpegSum + ".jpg"},
+		{"attachments/voice memo", "attachments/41/e5/" + jpegSum},
+		{"attachments/odd.j pg", "attachments/41/e5/" + jpegSum},
+		{"attachments/long.abcdefghijklmnopq", "attachments/41/e5/" + jpegSum},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Path(manifest.Attachment{Path: tt.name, SHA256: strings.ToUpper(jpegSum)})
+			if got != tt.want {
+				t.Errorf("Path(%q) = %q; expected %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		name string
+		a    manifest.Attachment
+		want bool
+	}{
+		{"valid", manifest.Attachment{Path: "attachments/a.jpg", SHA256: jpegSum}, true},
+		{"short checksum", manifest.Attachment{Path: "attachments/a.jpg", SHA256: "41e5"}, false},
+		{"not hex", manifest.Attachment{Path: "attachments/a.jpg", SHA256: strings.Repeat("z", 64)}, false},
+		{"escapes day", manifest.Attachment{Path: "../a.jpg", SHA256: jpegSum}, false},
+		{"absolute", manifest.Attachment{Path: "/etc/passwd", SHA256: jpegSum}, false},
+		{"manifest", manifest.Attachment{Path: manifest.FileName, SHA256: jpegSum}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Valid(tt.a); got != tt.want {
+				t.Errorf("Valid(%+v) = %v; expected %v", tt.a, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollect(t *testing.T) {
+	root := t.TempDir()
+	first := writeDay(t, root, "2024/01/01", "2024-01-01", map[string]string{
+		"chat.txt":              "hello",
+		"attachments/photo.jpg": "jpeg",
+	})
+	second := writeDay(t, root, "2024/01/02", "2024-01-02", map[string]string{
+		"chat.txt":                "again",
+		"attachments/forward.JPG": "jpeg",
+	})
+
+	for _, dayDir := range []string{first, second} {
+		if err := Collect(root, dayDir); err != nil {
+			t.Fatalf("Collect failed: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dayDir, Dir)); !os.IsNotExist(err) {
+			t.Errorf("Expected the attachments directory of %s to be removed, got %v", dayDir, err)
+		}
+
+		m, err := manifest.Read(dayDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Files) != 1 || m.Files[0].Path != "chat.txt" {
+			t.Errorf("Expected only the message file to remain in the manifest, got %+v", m.Files)
+		}
+		if len(m.Attachments) != 1 || m.Attachments[0].SHA256 != jpegSum {
+			t.Errorf("Expected the attachment in the manifest, got %+v", m.Attachments)
+		}
+		if blobs := Blobs(m); len(blobs) != 1 || blobs[0] != "attachments/41/e5/"+jpegSum+".jpg" {
+			t.Errorf("Unexpected blobs %v", blobs)
+		}
+	}
+
+	// The same content sent on both days is stored once
+	var stored []string
+	_ = filepath.WalkDir(filepath.Join(root, Dir), func(p string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			stored = append(stored, p)
+		}
+		return err
+	})
+	if len(stored) != 1 {
+		t.Errorf("Expected one stored file, got %v", stored)
+	}
+}
+
+func TestCollect_NoAttachments(t *testing.T) {
+	root := t.TempDir()
+	dayDir := writeDay(t, root, "2024/01/01", "2024-01-01", map[string]string{"chat.txt": "hello"})
+
+	if err := Collect(root, dayDir); err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+	m, err := manifest.Read(dayDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 1 || len(m.Attachments) != 0 {
+		t.Errorf("Expected the manifest to be unchanged, got %+v", m)
+	}
+}
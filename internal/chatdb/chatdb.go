@@ -0,0 +1,595 @@
+// Package chatdb reads messages directly from the macOS Messages database
+// (chat.db) without shelling out to external tools.
+package chatdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrAccessDenied is returned when chat.db exists but cannot be read, which on
+// macOS almost always means Full Disk Access has not been granted.
+var ErrAccessDenied = errors.New("access to chat database denied: grant Full Disk Access to the imessage-archiver binary " +
+	"in System Settings > Privacy & Security > Full Disk Access")
+
+// appleEpoch is the reference date used by Core Data timestamps in chat.db.
+var appleEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Attachment describes a file attached to a message.
+type Attachment struct {
+	GUID         string
+	Filename     string // Absolute path to the attachment on disk, with "~" expanded
+	TransferName string // Original file name as sent
+	MimeType     string
+	UTI          string
+	TotalBytes   int64
+	IsSticker    bool
+}
+
+// Message is a single row of the message table joined with its chat, sender
+// handle and attachments.
+type Message struct {
+	ROWID                int64
+	GUID                 string
+	ChatGUID             string
+	ChatIdentifier       string
+	ChatDisplayName      string
+	Handle               string // Sender handle (phone number or email); for messages from me, the other party in 1:1 chats
+	IsFromMe             bool
+	Date                 time.Time
+	DateEdited           time.Time // Zero if the message was never edited
+	IsUnsent             bool
+	Text                 string
+	Service              string
+	ReplyToGUID          string
+	ThreadOriginatorGUID string
+	Attachments          []Attachment
+}
+
+// Fingerprint summarizes the messages of a date range. Two fingerprints of
+// the same range differ when messages were added, edited, unsent or gained
+// attachments in between.
+type Fingerprint struct {
+	MessageCount    int       `json:"message_count"`
+	MaxROWID        int64     `json:"max_rowid"`
+	EditedCount     int       `json:"edited_count"`
+	UnsentCount     int       `json:"unsent_count"`
+	LastEdited      time.Time `json:"last_edited,omitempty"`
+	AttachmentCount int       `json:"attachment_count"`
+}
+
+// Equal reports whether f and other describe the same content.
+func (f Fingerprint) Equal(other Fingerprint) bool {
+	return f.MessageCount == other.MessageCount &&
+		f.MaxROWID == other.MaxROWID &&
+		f.EditedCount == other.EditedCount &&
+		f.UnsentCount == other.UnsentCount &&
+		f.LastEdited.Equal(other.LastEdited) &&
+		f.AttachmentCount == other.AttachmentCount
+}
+
+// Reader provides read-only access to a chat.db file.
+type Reader struct {
+	db      *sql.DB
+	path    string
+	columns map[string]bool // Optional message columns present in this schema version
+	seconds bool            // Message dates are stored in seconds, as before macOS 10.13
+}
+
+// Open opens the chat.db at path in read-only mode. A leading "~/" is
+// expanded to the user's home directory. ctx bounds the schema queries run
+// while opening it.
+func Open(ctx context.Context, path string) (*Reader, error) {
+	expanded, err := expandHome(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Probe the file directly first so permission problems surface as a
+	// typed error instead of an opaque SQLite "unable to open" message.
+	f, err := os.Open(expanded)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return nil, fmt.Errorf("%w: %s", ErrAccessDenied, expanded)
+		}
+		return nil, fmt.Errorf("failed to open chat database %s: %w", expanded, err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close chat database %s: %w", expanded, err)
+	}
+
+	// The path is escaped so characters such as '?' or '#' in it are not
+	// taken for URI parameters, which would drop the read-only mode
+	absolute, err := filepath.Abs(expanded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve chat database path %s: %w", expanded, err)
+	}
+	dsn := &url.URL{Scheme: "file", Path: absolute, RawQuery: "mode=ro&_query_only=1"}
+	db, err := sql.Open("sqlite3", dsn.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open chat database %s: %w", expanded, err)
+	}
+
+	r := &Reader{db: db, path: expanded}
+	if err := r.loadColumns(ctx); err != nil {
+		_ = db.Close()
+		return nil, classifyError(err, expanded)
+	}
+	if err := r.detectDateUnit(ctx); err != nil {
+		_ = db.Close()
+		return nil, classifyError(err, expanded)
+	}
+
+	return r, nil
+}
+
+// Path returns the resolved path of the underlying database file.
+func (r *Reader) Path() string {
+	return r.path
+}
+
+// Close releases the underlying database handle.
+func (r *Reader) Close() error {
+	return r.db.Close()
+}
+
+// loadColumns records which optional message columns exist, since older
+// macOS releases predate editing, unsending and threaded replies.
+func (r *Reader) loadColumns(ctx context.Context) error {
+	rows, err := r.db.QueryContext(ctx, "PRAGMA table_info(message)")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	r.columns = make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		r.columns[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(r.columns) == 0 {
+		return fmt.Errorf("message table not found in %s", r.path)
+	}
+	return nil
+}
+
+// detectDateUnit checks whether message dates are stored in seconds rather
+// than nanoseconds, the same way FromAppleTime tells them apart, so range
+// queries compare against dates in the database's own unit.
+func (r *Reader) detectDateUnit(ctx context.Context) error {
+	var date int64
+	err := r.db.QueryRowContext(ctx, `SELECT date FROM message WHERE date != 0 ORDER BY ROWID DESC LIMIT 1`).Scan(&date)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.seconds = isAppleSeconds(date)
+	return nil
+}
+
+// appleTime converts t to a chat.db timestamp in the unit of this database.
+func (r *Reader) appleTime(t time.Time) int64 {
+	if r.seconds {
+		return int64(t.Sub(appleEpoch) / time.Second)
+	}
+	return ToAppleTime(t)
+}
+
+// optionalColumn returns the qualified column name if it exists, or a NULL
+// literal so queries work against older schemas.
+func (r *Reader) optionalColumn(name string) string {
+	if r.columns[name] {
+		return "m." + name
+	}
+	return "NULL"
+}
+
+// MessagesForDay returns all messages sent or received on the calendar day
+// containing day, in day's location.
+func (r *Reader) MessagesForDay(ctx context.Context, day time.Time) ([]Message, error) {
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	return r.Messages(ctx, start, start.AddDate(0, 0, 1))
+}
+
+// Messages returns all messages with a date in [start, end), ordered by date.
+func (r *Reader) Messages(ctx context.Context, start, end time.Time) ([]Message, error) {
+	var messages []Message
+	err := r.ForEachMessage(ctx, start, end, func(m Message) error {
+		messages = append(messages, m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// ForEachMessage streams every message with a date in [start, end) to fn in
+// date order. Iteration stops at the first error returned by fn.
+func (r *Reader) ForEachMessage(ctx context.Context, start, end time.Time, fn func(Message) error) error {
+	attachments, err := r.attachmentsBetween(ctx, start, end)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT
+			m.ROWID,
+			m.guid,
+			COALESCE(c.guid, ''),
+			COALESCE(c.chat_identifier, ''),
+			COALESCE(c.display_name, ''),
+			COALESCE(h.id, ''),
+			COALESCE(m.is_from_me, 0),
+			COALESCE(m.date, 0),
+			COALESCE(%s, 0),
+			COALESCE(%s, 0),
+			COALESCE(m.text, ''),
+			m.attributedBody,
+			COALESCE(m.service, ''),
+			COALESCE(%s, ''),
+			COALESCE(%s, '')
+		FROM message m
+		LEFT JOIN handle h ON h.ROWID = m.handle_id
+		-- A message can be joined to several chats; take the first, so it is
+		-- returned once
+		LEFT JOIN chat c ON c.ROWID = (
+			SELECT MIN(cmj.chat_id) FROM chat_message_join cmj WHERE cmj.message_id = m.ROWID)
+		WHERE m.date >= ? AND m.date < ?
+		ORDER BY m.date, m.ROWID`,
+		r.optionalColumn("date_edited"),
+		r.optionalColumn("date_retracted"),
+		r.optionalColumn("reply_to_guid"),
+		r.optionalColumn("thread_originator_guid"),
+	)
+
+	rows, err := r.db.QueryContext(ctx, query, r.appleTime(start), r.appleTime(end))
+	if err != nil {
+		return classifyError(err, r.path)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			m              Message
+			isFromMe       int64
+			date           int64
+			dateEdited     int64
+			dateRetracted  int64
+			attributedBody []byte
+		)
+		if err := rows.Scan(
+			&m.ROWID,
+			&m.GUID,
+			&m.ChatGUID,
+			&m.ChatIdentifier,
+			&m.ChatDisplayName,
+			&m.Handle,
+			&isFromMe,
+			&date,
+			&dateEdited,
+			&dateRetracted,
+			&m.Text,
+			&attributedBody,
+			&m.Service,
+			&m.ReplyToGUID,
+			&m.ThreadOriginatorGUID,
+		); err != nil {
+			return fmt.Errorf("failed to scan message row: %w", err)
+		}
+
+		m.IsFromMe = isFromMe != 0
+		m.Date = FromAppleTime(date)
+		if dateEdited != 0 {
+			m.DateEdited = FromAppleTime(dateEdited)
+		}
+		m.IsUnsent = dateRetracted != 0
+		if m.Text == "" && len(attributedBody) > 0 {
+			m.Text = textFromAttributedBody(attributedBody)
+		}
+		m.Attachments = attachments[m.ROWID]
+
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return classifyError(err, r.path)
+	}
+	return nil
+}
+
+// Fingerprint computes the Fingerprint of all messages with a date in
+// [start, end).
+func (r *Reader) Fingerprint(ctx context.Context, start, end time.Time) (Fingerprint, error) {
+	query := fmt.Sprintf(`
+		SELECT
+			COUNT(*),
+			COALESCE(MAX(m.ROWID), 0),
+			COALESCE(SUM(CASE WHEN COALESCE(%[1]s, 0) != 0 THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN COALESCE(%[2]s, 0) != 0 THEN 1 ELSE 0 END), 0),
+			COALESCE(MAX(%[1]s), 0),
+			(SELECT COUNT(*)
+				FROM message_attachment_join maj
+				JOIN message am ON am.ROWID = maj.message_id
+				WHERE am.date >= ? AND am.date < ?)
+		FROM message m
+		WHERE m.date >= ? AND m.date < ?`,
+		r.optionalColumn("date_edited"),
+		r.optionalColumn("date_retracted"),
+	)
+
+	var (
+		f          Fingerprint
+		lastEdited int64
+	)
+	startApple, endApple := r.appleTime(start), r.appleTime(end)
+	err := r.db.QueryRowContext(ctx, query, startApple, endApple, startApple, endApple).Scan(
+		&f.MessageCount,
+		&f.MaxROWID,
+		&f.EditedCount,
+		&f.UnsentCount,
+		&lastEdited,
+		&f.AttachmentCount,
+	)
+	if err != nil {
+		return Fingerprint{}, classifyError(err, r.path)
+	}
+	if lastEdited != 0 {
+		f.LastEdited = FromAppleTime(lastEdited).UTC()
+	}
+	return f, nil
+}
+
+// LatestMessage returns the ROWID and date of the newest message in the
+// database, or zero values if it contains no messages.
+func (r *Reader) LatestMessage(ctx context.Context) (int64, time.Time, error) {
+	var (
+		rowid int64
+		date  int64
+	)
+	err := r.db.QueryRowContext(ctx, `SELECT ROWID, COALESCE(date, 0) FROM message ORDER BY ROWID DESC LIMIT 1`).Scan(&rowid, &date)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, time.Time{}, nil
+	}
+	if err != nil {
+		return 0, time.Time{}, classifyError(err, r.path)
+	}
+	return rowid, FromAppleTime(date), nil
+}
+
+// EarliestMessage returns the date of the oldest message in the database, or
+// the zero time if it contains no messages.
+func (r *Reader) EarliestMessage(ctx context.Context) (time.Time, error) {
+	var date int64
+	err := r.db.QueryRowContext(ctx, `SELECT COALESCE(MIN(date), 0) FROM message WHERE date > 0`).Scan(&date)
+	if err != nil {
+		return time.Time{}, classifyError(err, r.path)
+	}
+	if date == 0 {
+		return time.Time{}, nil
+	}
+	return FromAppleTime(date), nil
+}
+
+// DaysWithMessages returns the distinct calendar days in loc, oldest first,
+// containing messages with a date in [start, end).
+func (r *Reader) DaysWithMessages(ctx context.Context, start, end time.Time, loc *time.Location) ([]time.Time, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT MIN(date), MAX(date) FROM message WHERE date >= ? AND date < ? GROUP BY `+localDay(start.In(loc))+` ORDER BY 1`, r.appleTime(start), r.appleTime(end))
+	if err != nil {
+		return nil, classifyError(err, r.path)
+	}
+	defer rows.Close()
+
+	return r.distinctDays(rows, loc)
+}
+
+// DaysWithMessagesAfter returns the distinct calendar days in loc, oldest
+// first, containing messages whose ROWID is greater than rowid. This finds
+// days affected by messages that arrived after rowid was recorded, even if
+// they are dated far in the past (e.g. iCloud backfill).
+func (r *Reader) DaysWithMessagesAfter(ctx context.Context, rowid int64, loc *time.Location) ([]time.Time, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT MIN(date), MAX(date) FROM message WHERE ROWID > ? AND date IS NOT NULL GROUP BY `+localDay(time.Now().In(loc))+` ORDER BY 1`, rowid)
+	if err != nil {
+		return nil, classifyError(err, r.path)
+	}
+	defer rows.Close()
+
+	return r.distinctDays(rows, loc)
+}
+
+// localDay returns an SQL expression numbering the day a message date falls
+// on, counted in the UTC offset of ref, so queries return one row per day
+// instead of one per message. Where the offset differs from ref, e.g. across
+// a DST change, such a day overlaps two local days, and the oldest and newest
+// date in it still name both. Like FromAppleTime, it tells seconds from
+// nanoseconds by magnitude.
+func localDay(ref time.Time) string {
+	_, offset := ref.Zone()
+	return fmt.Sprintf(`(CASE WHEN date > -1000000000000 AND date < 1000000000000 THEN date ELSE date / 1000000000 END + %d) / 86400`,
+		appleEpoch.Unix()+int64(offset))
+}
+
+// distinctDays reads the oldest and newest message date of each group
+// selected by localDay, in ascending order, and returns the calendar days in
+// loc they fall on.
+func (r *Reader) distinctDays(rows *sql.Rows, loc *time.Location) ([]time.Time, error) {
+	var days []time.Time
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var first, last int64
+		if err := rows.Scan(&first, &last); err != nil {
+			return nil, fmt.Errorf("failed to scan message date: %w", err)
+		}
+		for _, date := range []int64{first, last} {
+			t := FromAppleTime(date).In(loc)
+			day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+			key := day.Format("2006-01-02")
+			if !seen[key] {
+				seen[key] = true
+				days = append(days, day)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, classifyError(err, r.path)
+	}
+	return days, nil
+}
+
+// attachmentsBetween loads attachments for all messages in [start, end),
+// keyed by message ROWID.
+func (r *Reader) attachmentsBetween(ctx context.Context, start, end time.Time) (map[int64][]Attachment, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT
+			maj.message_id,
+			a.guid,
+			COALESCE(a.filename, ''),
+			COALESCE(a.transfer_name, ''),
+			COALESCE(a.mime_type, ''),
+			COALESCE(a.uti, ''),
+			COALESCE(a.total_bytes, 0),
+			COALESCE(a.is_sticker, 0)
+		FROM message_attachment_join maj
+		JOIN attachment a ON a.ROWID = maj.attachment_id
+		JOIN message m ON m.ROWID = maj.message_id
+		WHERE m.date >= ? AND m.date < ?
+		ORDER BY maj.message_id, a.ROWID`,
+		r.appleTime(start), r.appleTime(end),
+	)
+	if err != nil {
+		return nil, classifyError(err, r.path)
+	}
+	defer rows.Close()
+
+	attachments := make(map[int64][]Attachment)
+	for rows.Next() {
+		var (
+			messageID int64
+			a         Attachment
+			isSticker int64
+		)
+		if err := rows.Scan(&messageID, &a.GUID, &a.Filename, &a.TransferName, &a.MimeType, &a.UTI, &a.TotalBytes, &isSticker); err != nil {
+			return nil, fmt.Errorf("failed to scan attachment row: %w", err)
+		}
+		a.IsSticker = isSticker != 0
+		if expanded, err := expandHome(a.Filename); err == nil {
+			a.Filename = expanded
+		}
+		attachments[messageID] = append(attachments[messageID], a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, classifyError(err, r.path)
+	}
+	return attachments, nil
+}
+
+// FromAppleTime converts a chat.db timestamp to a time.Time. Modern
+// databases store nanoseconds since 2001-01-01 UTC; databases created before
+// macOS 10.13 store seconds.
+func FromAppleTime(v int64) time.Time {
+	if isAppleSeconds(v) {
+		return appleEpoch.Add(time.Duration(v) * time.Second)
+	}
+	return appleEpoch.Add(time.Duration(v))
+}
+
+// ToAppleTime converts t to nanoseconds since 2001-01-01 UTC.
+func ToAppleTime(t time.Time) int64 {
+	return t.Sub(appleEpoch).Nanoseconds()
+}
+
+// isAppleSeconds reports whether the chat.db timestamp v is in seconds. In
+// nanoseconds, such small values would all fall within 20 minutes of the
+// epoch.
+func isAppleSeconds(v int64) bool {
+	return v > -1e12 && v < 1e12
+}
+
+// textFromAttributedBody extracts the plain string from an NSAttributedString
+// typedstream blob. Recent macOS versions leave message.text NULL and only
+// populate attributedBody.
+func textFromAttributedBody(body []byte) string {
+	marker := []byte("NSString")
+	idx := strings.Index(string(body), string(marker))
+	if idx < 0 {
+		return ""
+	}
+	// The class name is followed by a small header ending in '+' and then a
+	// length-prefixed UTF-8 string.
+	rest := body[idx+len(marker):]
+	plus := strings.IndexByte(string(rest), '+')
+	if plus < 0 || plus+1 >= len(rest) {
+		return ""
+	}
+	rest = rest[plus+1:]
+
+	length := int(rest[0])
+	rest = rest[1:]
+	switch length {
+	case 0x81: // 16-bit little-endian length
+		if len(rest) < 2 {
+			return ""
+		}
+		length = int(rest[0]) | int(rest[1])<<8
+		rest = rest[2:]
+	case 0x82: // 32-bit little-endian length
+		if len(rest) < 4 {
+			return ""
+		}
+		length = int(rest[0]) | int(rest[1])<<8 | int(rest[2])<<16 | int(rest[3])<<24
+		rest = rest[4:]
+	}
+	if length > len(rest) {
+		return ""
+	}
+	return string(rest[:length])
+}
+
+// classifyError maps SQLite open and permission failures to ErrAccessDenied.
+func classifyError(err error, path string) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code {
+		case sqlite3.ErrCantOpen, sqlite3.ErrPerm, sqlite3.ErrAuth:
+			return fmt.Errorf("%w: %s: %v", ErrAccessDenied, path, err)
+		}
+	}
+	return fmt.Errorf("chat database query failed: %w", err)
+}
+
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user home directory: %w", err)
+	}
+	return filepath.Join(homeDir, path[2:]), nil
+}
@@ -0,0 +1,482 @@
+package chatdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getTestDatabasePath returns the path to the shared test database
+func getTestDatabasePath() string {
+	currentDir, _ := os.Getwd()
+	return filepath.Join(currentDir, "..", "archiver", "testdata", "chat.db")
+}
+
+func openTestDatabase(t *testing.T) *Reader {
+	t.Helper()
+	testDbPath := getTestDatabasePath()
+	if _, err := os.Stat(testDbPath); os.IsNotExist(err) {
+		t.Fatalf("Test database not found at %s. Run 'make generate-test-db' to create it.", testDbPath)
+	}
+
+	reader, err := Open(context.Background(), testDbPath)
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := reader.Close(); err != nil {
+			t.Logf("Failed to close test database: %v", err)
+		}
+	})
+	return reader
+}
+
+// copyTestDatabase copies the test database to a file named name in a
+// temporary directory and runs the statements against the copy.
+func copyTestDatabase(t *testing.T, name string, statements ...string) string {
+	t.Helper()
+	data, err := os.ReadFile(getTestDatabasePath())
+	if err != nil {
+		t.Fatalf("Failed to read test database: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("Failed to run %q: %v", statement, err)
+		}
+	}
+	return path
+}
+
+func TestOpen_NonexistentDatabase(t *testing.T) {
+	_, err := Open(context.Background(), "/nonexistent/chat.db")
+	if err == nil {
+		t.Fatal("Expected error opening nonexistent database, got nil")
+	}
+	if errors.Is(err, ErrAccessDenied) {
+		t.Errorf("Expected a not-found error, got access denied: %v", err)
+	}
+}
+
+func TestOpen_PermissionDenied(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("File permissions are not enforced for root")
+	}
+
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "chat.db")
+	if err := os.WriteFile(dbPath, []byte{}, 0000); err != nil {
+		t.Fatalf("Failed to create unreadable file: %v", err)
+	}
+
+	_, err := Open(context.Background(), dbPath)
+	if !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("Expected ErrAccessDenied, got: %v", err)
+	}
+}
+
+func TestOpen_PathWithURICharacters(t *testing.T) {
+	path := copyTestDatabase(t, filepath.Join("50% off?#1", "chat.db"))
+
+	reader, err := Open(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer reader.Close()
+
+	messages, err := reader.MessagesForDay(context.Background(), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d (%v)", len(messages), err)
+	}
+	if _, err := reader.db.Exec(`DELETE FROM message`); err == nil {
+		t.Error("Expected the database to be opened read-only")
+	}
+}
+
+func TestReader_MessagesForDay(t *testing.T) {
+	reader := openTestDatabase(t)
+
+	messages, err := reader.MessagesForDay(context.Background(), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("MessagesForDay failed: %v", err)
+	}
+
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages on 2024-01-01, got %d", len(messages))
+	}
+
+	first := messages[0]
+	if first.GUID != "MSG1" {
+		t.Errorf("Expected first message GUID MSG1, got %s", first.GUID)
+	}
+	if first.Handle != "+10005551234" {
+		t.Errorf("Expected handle +10005551234, got %s", first.Handle)
+	}
+	if first.ChatIdentifier != "CHAT1" {
+		t.Errorf("Expected chat identifier CHAT1, got %s", first.ChatIdentifier)
+	}
+	if first.IsFromMe {
+		t.Error("Expected first message not to be from me")
+	}
+	expectedDate := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if !first.Date.Equal(expectedDate) {
+		t.Errorf("Expected date %v, got %v", expectedDate, first.Date)
+	}
+	if first.Text == "" {
+		t.Error("Expected message text to be populated")
+	}
+
+	if messages[1].GUID != "MSG2" {
+		t.Errorf("Expected second message GUID MSG2, got %s", messages[1].GUID)
+	}
+}
+
+func TestReader_MessagesForDay_Empty(t *testing.T) {
+	reader := openTestDatabase(t)
+
+	messages, err := reader.MessagesForDay(context.Background(), time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("MessagesForDay failed: %v", err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("Expected no messages on 2024-01-02, got %d", len(messages))
+	}
+}
+
+func TestReader_ForEachMessage_StopsOnError(t *testing.T) {
+	reader := openTestDatabase(t)
+
+	stop := errors.New("stop")
+	count := 0
+	err := reader.ForEachMessage(
+		context.Background(),
+		time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		func(Message) error {
+			count++
+			return stop
+		},
+	)
+	if !errors.Is(err, stop) {
+		t.Errorf("Expected callback error to be returned, got: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected iteration to stop after 1 message, got %d", count)
+	}
+}
+
+func TestReader_MessageInSeveralChats(t *testing.T) {
+	path := copyTestDatabase(t, "chat.db",
+		`INSERT INTO chat (guid, display_name, style, chat_identifier) VALUES ('CHAT2', 'Other Chat', 0, 'CHAT2')`,
+		`INSERT INTO chat_message_join (chat_id, message_id) VALUES ((SELECT ROWID FROM chat WHERE guid = 'CHAT2'), 1)`,
+	)
+	reader, err := Open(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer reader.Close()
+
+	messages, err := reader.MessagesForDay(context.Background(), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("MessagesForDay failed: %v", err)
+	}
+	if len(messages) != 2 || messages[0].GUID != "MSG1" || messages[1].GUID != "MSG2" {
+		t.Fatalf("Expected each message once, got %d messages", len(messages))
+	}
+	if messages[0].ChatIdentifier != "CHAT1" {
+		t.Errorf("Expected the first chat of the message, got %s", messages[0].ChatIdentifier)
+	}
+}
+
+func TestReader_CanceledContext(t *testing.T) {
+	reader := openTestDatabase(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := reader.MessagesForDay(ctx, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected reading messages to stop with the context, got %v", err)
+	}
+	if _, err := reader.DaysWithMessagesAfter(ctx, 0, time.UTC); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected listing days to stop with the context, got %v", err)
+	}
+}
+
+func TestReader_SecondsDates(t *testing.T) {
+	// Databases created before macOS 10.13 store seconds
+	path := copyTestDatabase(t, "chat.db", `UPDATE message SET date = date / 1000000000`)
+	reader, err := Open(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer reader.Close()
+
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	messages, err := reader.MessagesForDay(context.Background(), day)
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("Expected 2 messages on 2024-01-01, got %d (%v)", len(messages), err)
+	}
+	if !messages[0].Date.Equal(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected noon, got %v", messages[0].Date)
+	}
+	f, err := reader.Fingerprint(context.Background(), day, day.AddDate(0, 0, 1))
+	if err != nil || f.MessageCount != 2 {
+		t.Errorf("Expected a fingerprint of 2 messages, got %+v (%v)", f, err)
+	}
+	days, err := reader.DaysWithMessages(context.Background(), day, day.AddDate(0, 0, 1), time.UTC)
+	if err != nil || len(days) != 1 {
+		t.Errorf("Expected one day with messages, got %v (%v)", days, err)
+	}
+}
+
+func TestAppleTimeConversion(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    int64
+		expected time.Time
+	}{
+		{
+			name:     "nanoseconds",
+			value:    725803200000000000,
+			expected: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "legacy seconds",
+			value:    725803200,
+			expected: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "epoch",
+			value:    0,
+			expected: time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := FromAppleTime(tt.value)
+			if !got.Equal(tt.expected) {
+				t.Errorf("FromAppleTime(%d) = %v, expected %v", tt.value, got, tt.expected)
+			}
+		})
+	}
+
+	roundTrip := time.Date(2024, 6, 7, 8, 9, 10, 0, time.UTC)
+	if got := FromAppleTime(ToAppleTime(roundTrip)); !got.Equal(roundTrip) {
+		t.Errorf("Round trip of %v produced %v", roundTrip, got)
+	}
+}
+
+func TestTextFromAttributedBody(t *testing.T) {
+	body := append([]byte("\x04\x0bstreamtyped\x81\xe8\x03\x84\x01@\x84\x84\x84\x12NSAttributedString\x00\x84\x84\x08NSObject\x00\x85\x92\x84\x84\x84\x08NSString\x01\x94\x84\x01+\x05"), []byte("hello\x86\x84")...)
+
+	if got := textFromAttributedBody(body); got != "hello" {
+		t.Errorf("Expected 'hello', got %q", got)
+	}
+
+	if got := textFromAttributedBody([]byte("no marker here")); got != "" {
+		t.Errorf("Expected empty string for blob without NSString, got %q", got)
+	}
+}
+
+func TestReader_LatestMessage(t *testing.T) {
+	reader := openTestDatabase(t)
+
+	rowid, date, err := reader.LatestMessage(context.Background())
+	if err != nil {
+		t.Fatalf("LatestMessage failed: %v", err)
+	}
+	if rowid != 2 {
+		t.Errorf("Expected latest ROWID 2, got %d", rowid)
+	}
+	if date.Format("2006-01-02") != "2024-01-01" {
+		t.Errorf("Expected latest message on 2024-01-01, got %v", date)
+	}
+}
+
+func TestReader_DaysWithMessagesAfter(t *testing.T) {
+	reader := openTestDatabase(t)
+
+	days, err := reader.DaysWithMessagesAfter(context.Background(), 0, time.UTC)
+	if err != nil {
+		t.Fatalf("DaysWithMessagesAfter failed: %v", err)
+	}
+	if len(days) != 1 || days[0].Format("2006-01-02") != "2024-01-01" {
+		t.Errorf("Expected [2024-01-01], got %v", days)
+	}
+
+	days, err = reader.DaysWithMessagesAfter(context.Background(), 2, time.UTC)
+	if err != nil {
+		t.Fatalf("DaysWithMessagesAfter failed: %v", err)
+	}
+	if len(days) != 0 {
+		t.Errorf("Expected no days after the latest ROWID, got %v", days)
+	}
+
+	// Both messages fall on 2024-01-01 in UTC but on 2024-01-02 in a far eastern zone
+	loc := time.FixedZone("UTC+14", 14*60*60)
+	days, err = reader.DaysWithMessagesAfter(context.Background(), 0, loc)
+	if err != nil {
+		t.Fatalf("DaysWithMessagesAfter failed: %v", err)
+	}
+	if len(days) != 1 || days[0].Format("2006-01-02") != "2024-01-02" {
+		t.Errorf("Expected days to be computed in the given location, got %v", days)
+	}
+}
+
+func TestReader_DaysWithMessages_DSTChange(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("Time zone database not available: %v", err)
+	}
+	// Clocks go forward on 2024-03-10, so a day counted in EST ends an hour
+	// into the next local day
+	var statements []string
+	for i, local := range []time.Time{
+		time.Date(2024, 3, 9, 23, 30, 0, 0, loc),
+		time.Date(2024, 3, 10, 0, 30, 0, 0, loc),
+		time.Date(2024, 3, 10, 12, 0, 0, 0, loc),
+		time.Date(2024, 3, 10, 12, 0, 1, 0, loc),
+		time.Date(2024, 3, 10, 23, 30, 0, 0, loc),
+		time.Date(2024, 3, 11, 0, 30, 0, 0, loc),
+	} {
+		statements = append(statements, fmt.Sprintf(`INSERT INTO message (guid, text, date) VALUES ('DST%d', 'dst', %d)`, i, ToAppleTime(local)))
+	}
+	reader, err := Open(context.Background(), copyTestDatabase(t, "chat.db", statements...))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer reader.Close()
+
+	expected := "2024-03-09,2024-03-10,2024-03-11"
+	format := func(days []time.Time) string {
+		var dates []string
+		for _, day := range days {
+			dates = append(dates, day.Format("2006-01-02"))
+		}
+		return strings.Join(dates, ",")
+	}
+
+	days, err := reader.DaysWithMessages(context.Background(), time.Date(2024, 3, 9, 0, 0, 0, 0, loc), time.Date(2024, 3, 12, 0, 0, 0, 0, loc), loc)
+	if err != nil {
+		t.Fatalf("DaysWithMessages failed: %v", err)
+	}
+	if got := format(days); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+
+	days, err = reader.DaysWithMessagesAfter(context.Background(), 2, loc)
+	if err != nil {
+		t.Fatalf("DaysWithMessagesAfter failed: %v", err)
+	}
+	if got := format(days); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+}
+
+func TestReader_Fingerprint(t *testing.T) {
+	reader := openTestDatabase(t)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f, err := reader.Fingerprint(context.Background(), start, start.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatalf("Fingerprint failed: %v", err)
+	}
+
+	expected := Fingerprint{MessageCount: 2, MaxROWID: 2}
+	if !f.Equal(expected) {
+		t.Errorf("Expected fingerprint %+v, got %+v", expected, f)
+	}
+
+	empty, err := reader.Fingerprint(context.Background(), start.AddDate(0, 0, 1), start.AddDate(0, 0, 2))
+	if err != nil {
+		t.Fatalf("Fingerprint failed: %v", err)
+	}
+	if !empty.Equal(Fingerprint{}) {
+		t.Errorf("Expected zero fingerprint for a day without messages, got %+v", empty)
+	}
+}
+
+func TestFingerprint_Equal(t *testing.T) {
+	base := Fingerprint{MessageCount: 3, MaxROWID: 10, AttachmentCount: 1}
+
+	edited := base
+	edited.EditedCount = 1
+	if base.Equal(edited) {
+		t.Error("Expected fingerprints with different edit counts to differ")
+	}
+
+	reedited := edited
+	reedited.LastEdited = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if edited.Equal(reedited) {
+		t.Error("Expected fingerprints with different last edit times to differ")
+	}
+
+	if !base.Equal(base) {
+		t.Error("Expected a fingerprint to equal itself")
+	}
+}
+
+func TestReader_EarliestMessage(t *testing.T) {
+	reader := openTestDatabase(t)
+
+	date, err := reader.EarliestMessage(context.Background())
+	if err != nil {
+		t.Fatalf("EarliestMessage failed: %v", err)
+	}
+	if date.UTC().Format("2006-01-02") != "2024-01-01" {
+		t.Errorf("Expected the earliest message on 2024-01-01, got %v", date)
+	}
+}
+
+func TestReader_DaysWithMessages(t *testing.T) {
+	reader := openTestDatabase(t)
+
+	tests := []struct {
+		name     string
+		start    string
+		end      string
+		expected int
+	}{
+		{"containing day", "2024-01-01", "2024-01-02", 1},
+		{"whole year", "2023-06-01", "2024-06-01", 1},
+		{"before", "2023-01-01", "2024-01-01", 0},
+		{"after", "2024-01-02", "2024-02-01", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, _ := time.Parse("2006-01-02", tt.start)
+			end, _ := time.Parse("2006-01-02", tt.end)
+			days, err := reader.DaysWithMessages(context.Background(), start, end, time.UTC)
+			if err != nil {
+				t.Fatalf("DaysWithMessages failed: %v", err)
+			}
+			if len(days) != tt.expected {
+				t.Errorf("Expected %d days, got %v", tt.expected, days)
+			}
+			for _, day := range days {
+				if day.Format("2006-01-02") != "2024-01-01" {
+					t.Errorf("Unexpected day %v", day)
+				}
+			}
+		})
+	}
+}
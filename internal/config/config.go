@@ -5,24 +5,172 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"filippo.io/age"
 	"gopkg.in/yaml.v2"
 )
 
+// Supported values for the exporter setting.
+const (
+	ExporterIMessageExporter = "imessage-exporter"
+	ExporterNative           = "native"
+)
+
+// Supported values for the destination_type setting.
+const (
+	DestinationSSH   = "ssh"
+	DestinationLocal = "local"
+	DestinationS3    = "s3"
+	DestinationSFTP  = "sftp"
+)
+
+// Packaging modes
+const (
+	PackagingNone   = "none"
+	PackagingTarZst = "tar.zst"
+)
+
+// Upload modes
+const (
+	// UploadModeBatch uploads every day in one batch once all are exported
+	UploadModeBatch = "batch"
+	// UploadModeStreaming uploads each day as soon as it is exported and
+	// removes the local copy once every destination has it
+	UploadModeStreaming = "streaming"
+)
+
+// DefaultS3Region is used when s3.region is not set.
+const DefaultS3Region = "us-east-1"
+
+// DefaultKnownHostsPath is the known_hosts file used to verify sftp servers.
+const DefaultKnownHostsPath = "~/.ssh/known_hosts"
+
+// DefaultChatDBPath is the location of the Messages database on macOS.
+const DefaultChatDBPath = "~/Library/Messages/chat.db"
+
+// MaxConcurrency is the most days that can be exported at once.
+const MaxConcurrency = 16
+
+// DefaultCopyConcurrency is how many exports copy attachments at once unless
+// copy_concurrency says otherwise.
+const DefaultCopyConcurrency = 2
+
+// DefaultLockTimeout is how long a run waits for an overlapping run to
+// finish unless lock_timeout says otherwise.
+const DefaultLockTimeout = 10 * time.Minute
+
+// DefaultStateDir is where run bookkeeping such as the message watermark is kept.
+const DefaultStateDir = "~/.local/state/imessage-archiver"
+
+// exporterFormats lists the export formats each exporter backend can produce.
+var exporterFormats = map[string][]string{
+	ExporterIMessageExporter: {"txt", "html"},
+	ExporterNative:           {"json", "jsonl", "markdown"},
+}
+
 type Config struct {
+	DestinationType   string `yaml:"destination_type,omitempty"`
 	RemoteUser        string `yaml:"remote_user"`
 	SSHPrivateKeyPath string `yaml:"ssh_private_key_path"`
 	RemoteHost        string `yaml:"remote_host"`
+	KnownHostsPath    string `yaml:"known_hosts_path,omitempty"`
 	LoggingLevel      string `yaml:"logging_level"`
 	RemoteArchivePath string `yaml:"remote_archive_path"`
+	ChatDBPath        string `yaml:"chat_db_path,omitempty"`
+	Exporter          string `yaml:"exporter,omitempty"`
 	ExportFormat      string `yaml:"export_format,omitempty"`
 	CopyMethod        string `yaml:"copy_method,omitempty"`
+	Packaging         string `yaml:"packaging,omitempty"`
+	UploadMode        string `yaml:"upload_mode,omitempty"`
+	DedupeAttachments bool   `yaml:"dedupe_attachments,omitempty"`
 	DaysToCheck       int    `yaml:"days_to_check,omitempty"`
+	StateDir          string `yaml:"state_dir,omitempty"`
+
+	// Concurrency is how many days are exported at once
+	Concurrency int `yaml:"concurrency,omitempty"`
+	// CopyConcurrency caps how many of those exports copy attachments at
+	// the same time, since they compete for the same disk
+	CopyConcurrency int `yaml:"copy_concurrency,omitempty"`
+	// ContinueOnError keeps a run going past days that fail, so the other
+	// days are still uploaded
+	ContinueOnError bool `yaml:"continue_on_error,omitempty"`
+	// LockTimeout is how long a run waits for another run holding the run
+	// lock or a destination lock, e.g. "30m"
+	LockTimeout time.Duration `yaml:"lock_timeout,omitempty"`
+
+	// S3 configures the s3 destination type
+	S3 S3Config `yaml:"s3,omitempty"`
+
+	// Encryption configures client-side encryption of each archived day
+	Encryption EncryptionConfig `yaml:"encryption,omitempty"`
+
+	// Retention says how long archived days are kept by the prune command
+	Retention RetentionConfig `yaml:"retention,omitempty"`
+
+	// Destinations lists every place archives are written to. When empty,
+	// the top-level destination settings above describe the only one.
+	Destinations []Destination `yaml:"destinations,omitempty"`
 
 	// Test database path (for unit tests)
 	TestDatabasePath string `yaml:"test_database_path,omitempty"`
 }
 
+// Destination is one place archives are written to.
+type Destination struct {
+	// Name identifies the destination in logs and the run summary. It
+	// defaults to the type.
+	Name              string   `yaml:"name,omitempty"`
+	Type              string   `yaml:"type,omitempty"`
+	RemoteUser        string   `yaml:"remote_user,omitempty"`
+	SSHPrivateKeyPath string   `yaml:"ssh_private_key_path,omitempty"`
+	RemoteHost        string   `yaml:"remote_host,omitempty"`
+	KnownHostsPath    string   `yaml:"known_hosts_path,omitempty"`
+	RemoteArchivePath string   `yaml:"remote_archive_path,omitempty"`
+	S3                S3Config `yaml:"s3,omitempty"`
+}
+
+// S3Config holds the settings of an S3-compatible bucket.
+type S3Config struct {
+	// Endpoint is the base URL of an S3-compatible service such as MinIO or
+	// Garage. Empty means AWS S3 in Region.
+	Endpoint        string `yaml:"endpoint,omitempty"`
+	Region          string `yaml:"region,omitempty"`
+	Bucket          string `yaml:"bucket"`
+	Prefix          string `yaml:"prefix,omitempty"`
+	AccessKeyID     string `yaml:"access_key_id,omitempty"`
+	SecretAccessKey string `yaml:"secret_access_key,omitempty"`
+}
+
+// EncryptionConfig lists who can decrypt the archives. Each day is packed
+// into one age-encrypted tarball, either to the X25519 recipients or with
+// the passphrase; age does not allow both in the same file.
+type EncryptionConfig struct {
+	// Recipients are age public keys (age1...)
+	Recipients []string `yaml:"recipients,omitempty"`
+	// PassphraseFile holds the passphrase on its first line
+	PassphraseFile string `yaml:"passphrase_file,omitempty"`
+}
+
+// RetentionConfig ages out archived days. Zero keeps them forever.
+type RetentionConfig struct {
+	// KeepDays is how many days back archived days are kept
+	KeepDays int `yaml:"keep_days,omitempty"`
+	// KeepAttachmentsDays is how many days back attachments are kept; older
+	// days keep only their messages
+	KeepAttachmentsDays int `yaml:"keep_attachments_days,omitempty"`
+}
+
+// Enabled reports whether prune removes anything.
+func (r RetentionConfig) Enabled() bool {
+	return r.KeepDays > 0 || r.KeepAttachmentsDays > 0
+}
+
+// Enabled reports whether archives are encrypted before upload.
+func (e EncryptionConfig) Enabled() bool {
+	return len(e.Recipients) > 0 || e.PassphraseFile != ""
+}
+
 func Load(configPath string) (*Config, error) {
 	data, err := os.ReadFile(configPath)
 	if err != nil {
@@ -38,28 +186,63 @@ func Load(configPath string) (*Config, error) {
 	if config.LoggingLevel == "" {
 		config.LoggingLevel = "info"
 	}
+	if config.ChatDBPath == "" {
+		config.ChatDBPath = DefaultChatDBPath
+	}
 	if config.ExportFormat == "" {
 		config.ExportFormat = "txt"
 	}
+	if config.Exporter == "" {
+		// Pick the backend that can produce the requested format
+		config.Exporter = ExporterIMessageExporter
+		if contains(exporterFormats[ExporterNative], config.ExportFormat) {
+			config.Exporter = ExporterNative
+		}
+	}
 	if config.CopyMethod == "" {
 		config.CopyMethod = "basic"
 	}
+	if config.Packaging == "" {
+		config.Packaging = PackagingNone
+	}
+	if config.UploadMode == "" {
+		config.UploadMode = UploadModeBatch
+	}
 	if config.DaysToCheck == 0 {
 		config.DaysToCheck = 7
 	}
-
-	// Validate required fields
-	if config.RemoteUser == "" {
-		return nil, fmt.Errorf("remote_user is required in config")
+	if config.StateDir == "" {
+		config.StateDir = DefaultStateDir
+	}
+	if config.Concurrency == 0 {
+		config.Concurrency = 1
+	}
+	if config.LockTimeout == 0 {
+		config.LockTimeout = DefaultLockTimeout
+	}
+	if config.CopyConcurrency == 0 {
+		config.CopyConcurrency = DefaultCopyConcurrency
+	}
+	config.StateDir, err = expandHome(config.StateDir)
+	if err != nil {
+		return nil, err
 	}
-	if config.SSHPrivateKeyPath == "" {
-		return nil, fmt.Errorf("ssh_private_key_path is required in config")
+	config.Encryption.PassphraseFile, err = expandHome(config.Encryption.PassphraseFile)
+	if err != nil {
+		return nil, err
 	}
-	if config.RemoteHost == "" {
-		return nil, fmt.Errorf("remote_host is required in config")
+
+	if len(config.Destinations) > 0 && config.hasTopLevelDestination() {
+		return nil, fmt.Errorf("invalid configuration: destinations cannot be combined with top-level destination settings")
 	}
-	if config.RemoteArchivePath == "" {
-		return nil, fmt.Errorf("remote_archive_path is required in config")
+	if len(config.Destinations) == 0 {
+		// The top-level settings describe a single destination
+		config.Destinations = config.ArchiveDestinations()
+	}
+	for i := range config.Destinations {
+		if err := config.Destinations[i].setDefaults(); err != nil {
+			return nil, err
+		}
 	}
 
 	if err := config.validate(); err != nil {
@@ -70,31 +253,18 @@ func Load(configPath string) (*Config, error) {
 }
 
 func (c *Config) validate() error {
-	if c.RemoteUser == "" {
-		return fmt.Errorf("remote_user is required")
-	}
-	if c.SSHPrivateKeyPath == "" {
-		return fmt.Errorf("ssh_private_key_path is required")
-	}
-
-	// Expand tilde in SSH key path
-	sshKeyPath := c.SSHPrivateKeyPath
-	if strings.HasPrefix(sshKeyPath, "~/") {
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			return fmt.Errorf("failed to get user home directory: %w", err)
+	names := make(map[string]bool)
+	for _, d := range c.ArchiveDestinations() {
+		if err := d.validate(); err != nil {
+			if len(c.Destinations) > 1 {
+				return fmt.Errorf("destination %s: %w", d.Name, err)
+			}
+			return err
 		}
-		sshKeyPath = filepath.Join(homeDir, sshKeyPath[2:])
-	}
-
-	if _, err := os.Stat(sshKeyPath); os.IsNotExist(err) {
-		return fmt.Errorf("ssh private key file does not exist: %s", c.SSHPrivateKeyPath)
-	}
-	if c.RemoteHost == "" {
-		return fmt.Errorf("remote_host is required")
-	}
-	if c.RemoteArchivePath == "" {
-		return fmt.Errorf("remote_archive_path is required")
+		if names[d.Name] {
+			return fmt.Errorf("duplicate destination name: %s (set a unique name for each destination)", d.Name)
+		}
+		names[d.Name] = true
 	}
 
 	validLogLevels := []string{"debug", "info", "warn", "error"}
@@ -102,9 +272,14 @@ func (c *Config) validate() error {
 		return fmt.Errorf("invalid logging_level: %s (must be one of: %s)", c.LoggingLevel, strings.Join(validLogLevels, ", "))
 	}
 
-	validFormats := []string{"txt", "html"}
+	validExporters := []string{ExporterIMessageExporter, ExporterNative}
+	if !contains(validExporters, c.Exporter) {
+		return fmt.Errorf("invalid exporter: %s (must be one of: %s)", c.Exporter, strings.Join(validExporters, ", "))
+	}
+
+	validFormats := exporterFormats[c.Exporter]
 	if !contains(validFormats, c.ExportFormat) {
-		return fmt.Errorf("invalid export_format: %s (must be one of: %s)", c.ExportFormat, strings.Join(validFormats, ", "))
+		return fmt.Errorf("invalid export_format: %s for exporter %s (must be one of: %s)", c.ExportFormat, c.Exporter, strings.Join(validFormats, ", "))
 	}
 
 	validCopyMethods := []string{"clone", "basic", "full", "disabled"}
@@ -112,9 +287,229 @@ func (c *Config) validate() error {
 		return fmt.Errorf("invalid copy_method: %s (must be one of: %s)", c.CopyMethod, strings.Join(validCopyMethods, ", "))
 	}
 
+	validPackaging := []string{PackagingNone, PackagingTarZst}
+	if !contains(validPackaging, c.Packaging) {
+		return fmt.Errorf("invalid packaging: %s (must be one of: %s)", c.Packaging, strings.Join(validPackaging, ", "))
+	}
+
+	validUploadModes := []string{UploadModeBatch, UploadModeStreaming}
+	if !contains(validUploadModes, c.UploadMode) {
+		return fmt.Errorf("invalid upload_mode: %s (must be one of: %s)", c.UploadMode, strings.Join(validUploadModes, ", "))
+	}
+
+	if c.Concurrency < 1 || c.Concurrency > MaxConcurrency {
+		return fmt.Errorf("invalid concurrency: %d (must be between 1 and %d)", c.Concurrency, MaxConcurrency)
+	}
+	if c.CopyConcurrency < 1 {
+		return fmt.Errorf("invalid copy_concurrency: %d (must be at least 1)", c.CopyConcurrency)
+	}
+	if c.LockTimeout < 0 {
+		return fmt.Errorf("invalid lock_timeout: %s (must not be negative)", c.LockTimeout)
+	}
+
+	if c.DedupeAttachments && c.Encryption.Enabled() {
+		return fmt.Errorf("dedupe_attachments cannot be combined with encryption (the attachment store is not encrypted)")
+	}
+
+	if err := c.Retention.validate(c.DaysToCheck); err != nil {
+		return err
+	}
+
+	return c.Encryption.validate()
+}
+
+// validate checks the retention periods against days_to_check: the archiver
+// re-exports days inside that window that are missing remotely, so pruning
+// them would only make the next run upload them again.
+func (r RetentionConfig) validate(daysToCheck int) error {
+	if r.KeepDays < 0 || r.KeepAttachmentsDays < 0 {
+		return fmt.Errorf("retention periods cannot be negative")
+	}
+	if r.KeepDays > 0 && r.KeepDays <= daysToCheck {
+		return fmt.Errorf("retention.keep_days (%d) must be greater than days_to_check (%d)", r.KeepDays, daysToCheck)
+	}
+	if r.KeepAttachmentsDays > 0 && r.KeepAttachmentsDays <= daysToCheck {
+		return fmt.Errorf("retention.keep_attachments_days (%d) must be greater than days_to_check (%d)", r.KeepAttachmentsDays, daysToCheck)
+	}
+	return nil
+}
+
+func (e EncryptionConfig) validate() error {
+	if len(e.Recipients) > 0 && e.PassphraseFile != "" {
+		return fmt.Errorf("encryption.recipients and encryption.passphrase_file cannot be combined (an age passphrase must be the only recipient of a file)")
+	}
+	for _, recipient := range e.Recipients {
+		if _, err := age.ParseX25519Recipient(recipient); err != nil {
+			return fmt.Errorf("invalid encryption recipient %q: %w", recipient, err)
+		}
+	}
+	if e.PassphraseFile != "" {
+		if _, err := os.Stat(e.PassphraseFile); err != nil {
+			return fmt.Errorf("encryption passphrase file is not readable: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ArchiveDestinations returns the configured destinations. Without a
+// destinations list, the top-level settings describe the only destination.
+func (c *Config) ArchiveDestinations() []Destination {
+	if len(c.Destinations) > 0 {
+		return c.Destinations
+	}
+
+	d := Destination{
+		Name:              c.DestinationType,
+		Type:              c.DestinationType,
+		RemoteUser:        c.RemoteUser,
+		SSHPrivateKeyPath: c.SSHPrivateKeyPath,
+		RemoteHost:        c.RemoteHost,
+		KnownHostsPath:    c.KnownHostsPath,
+		RemoteArchivePath: c.RemoteArchivePath,
+		S3:                c.S3,
+	}
+	if d.Type == "" {
+		// ssh is also the default for configs built without Load
+		d.Type = DestinationSSH
+		d.Name = DestinationSSH
+	}
+	return []Destination{d}
+}
+
+func (c *Config) hasTopLevelDestination() bool {
+	return c.DestinationType != "" || c.RemoteUser != "" || c.SSHPrivateKeyPath != "" || c.RemoteHost != "" ||
+		c.KnownHostsPath != "" || c.RemoteArchivePath != "" || c.S3 != (S3Config{})
+}
+
+// setDefaults fills in defaults and expands paths that are opened locally.
+func (d *Destination) setDefaults() error {
+	var err error
+	if d.Type == "" {
+		d.Type = DestinationSSH
+	}
+	if d.Name == "" {
+		d.Name = d.Type
+	}
+
+	switch d.Type {
+	case DestinationSFTP:
+		// The native client opens these files itself, without a shell to expand "~"
+		if d.KnownHostsPath == "" {
+			d.KnownHostsPath = DefaultKnownHostsPath
+		}
+		if d.KnownHostsPath, err = expandHome(d.KnownHostsPath); err != nil {
+			return err
+		}
+		if d.SSHPrivateKeyPath, err = expandHome(d.SSHPrivateKeyPath); err != nil {
+			return err
+		}
+	case DestinationS3:
+		if d.S3.Region == "" {
+			d.S3.Region = DefaultS3Region
+		}
+		// Fall back to the standard AWS environment variables for credentials
+		if d.S3.AccessKeyID == "" {
+			d.S3.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		}
+		if d.S3.SecretAccessKey == "" {
+			d.S3.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		}
+	case DestinationLocal:
+		// The archive lives on this machine, e.g. a mounted NAS volume
+		if d.RemoteArchivePath, err = expandHome(d.RemoteArchivePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Destination) validate() error {
+	validDestinations := []string{DestinationSSH, DestinationSFTP, DestinationLocal, DestinationS3}
+	if !contains(validDestinations, d.Type) {
+		return fmt.Errorf("invalid destination_type: %s (must be one of: %s)", d.Type, strings.Join(validDestinations, ", "))
+	}
+
+	if d.usesSSH() {
+		if d.RemoteUser == "" {
+			return fmt.Errorf("remote_user is required")
+		}
+		if d.SSHPrivateKeyPath == "" {
+			return fmt.Errorf("ssh_private_key_path is required")
+		}
+
+		// Expand tilde in SSH key path
+		sshKeyPath, err := expandHome(d.SSHPrivateKeyPath)
+		if err != nil {
+			return err
+		}
+
+		if _, err := os.Stat(sshKeyPath); os.IsNotExist(err) {
+			return fmt.Errorf("ssh private key file does not exist: %s", d.SSHPrivateKeyPath)
+		}
+		if d.RemoteHost == "" {
+			return fmt.Errorf("remote_host is required")
+		}
+	}
+	if d.Type == DestinationSFTP {
+		knownHostsPath, err := expandHome(d.KnownHostsPath)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(knownHostsPath); os.IsNotExist(err) {
+			return fmt.Errorf("known_hosts file does not exist: %s (connect once with ssh to record the host key)", d.KnownHostsPath)
+		}
+	}
+	if d.Type == DestinationS3 {
+		if d.S3.Bucket == "" {
+			return fmt.Errorf("s3.bucket is required")
+		}
+		if d.S3.AccessKeyID == "" || d.S3.SecretAccessKey == "" {
+			return fmt.Errorf("s3 credentials are required (s3.access_key_id and s3.secret_access_key, or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY)")
+		}
+		if d.S3.Endpoint != "" && !strings.HasPrefix(d.S3.Endpoint, "http://") && !strings.HasPrefix(d.S3.Endpoint, "https://") {
+			return fmt.Errorf("invalid s3.endpoint: %s (must start with http:// or https://)", d.S3.Endpoint)
+		}
+	} else if d.RemoteArchivePath == "" {
+		return fmt.Errorf("remote_archive_path is required")
+	}
 	return nil
 }
 
+// usesSSH reports whether the destination is reached over ssh and needs the
+// remote_* and ssh_private_key_path settings.
+func (d *Destination) usesSSH() bool {
+	return d.Type == DestinationSSH || d.Type == DestinationSFTP
+}
+
+// DatabasePath returns the chat.db location to read from, with "~"
+// expanded. TestDatabasePath takes precedence so unit tests never touch the
+// real database.
+func (c *Config) DatabasePath() string {
+	path := c.ChatDBPath
+	if c.TestDatabasePath != "" {
+		path = c.TestDatabasePath
+	}
+	if path == "" {
+		path = DefaultChatDBPath
+	}
+	if expanded, err := expandHome(path); err == nil {
+		path = expanded
+	}
+	return path
+}
+
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user home directory: %w", err)
+	}
+	return filepath.Join(homeDir, path[2:]), nil
+}
+
 func contains(slice []string, item string) bool {
 	for _, s := range slice {
 		if s == item {
@@ -2,7 +2,10 @@ package config
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestConfigStruct(t *testing.T) {
@@ -52,3 +55,495 @@ func TestTempFileHandling(t *testing.T) {
 		t.Errorf("Expected file content to be '%s', got: %s", testContent, string(content))
 	}
 }
+
+// writeTestConfig writes a config file referencing a temporary SSH key and returns its path
+func writeTestConfig(t *testing.T, extra string) string {
+	t.Helper()
+	tempDir := t.TempDir()
+
+	keyPath := filepath.Join(tempDir, "id_ed25519")
+	if err := os.WriteFile(keyPath, []byte("fake key"), 0600); err != nil {
+		t.Fatalf("Failed to write fake key: %v", err)
+	}
+
+	content := "remote_user: testuser\n" +
+		"ssh_private_key_path: " + keyPath + "\n" +
+		"remote_host: testhost\n" +
+		"remote_archive_path: /fake/archive\n" + extra
+
+	configPath := filepath.Join(tempDir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return configPath
+}
+
+func TestLoad_Defaults(t *testing.T) {
+	cfg, err := Load(writeTestConfig(t, ""))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if cfg.Exporter != ExporterIMessageExporter {
+		t.Errorf("Expected default exporter %s, got: %s", ExporterIMessageExporter, cfg.Exporter)
+	}
+	if cfg.ExportFormat != "txt" {
+		t.Errorf("Expected default export_format txt, got: %s", cfg.ExportFormat)
+	}
+	if cfg.DaysToCheck != 7 {
+		t.Errorf("Expected default days_to_check 7, got: %d", cfg.DaysToCheck)
+	}
+}
+
+func TestLoad_InvalidExporter(t *testing.T) {
+	_, err := Load(writeTestConfig(t, "exporter: bogus\n"))
+	if err == nil {
+		t.Fatal("Expected error for invalid exporter, got nil")
+	}
+	if !strings.Contains(err.Error(), "invalid exporter") {
+		t.Errorf("Expected invalid exporter error, got: %v", err)
+	}
+}
+
+func TestLoad_StructuredFormatSelectsNativeExporter(t *testing.T) {
+	cfg, err := Load(writeTestConfig(t, "export_format: jsonl\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Exporter != ExporterNative {
+		t.Errorf("Expected exporter %s for jsonl, got: %s", ExporterNative, cfg.Exporter)
+	}
+}
+
+func TestLoad_FormatUnsupportedByExporter(t *testing.T) {
+	_, err := Load(writeTestConfig(t, "exporter: imessage-exporter\nexport_format: json\n"))
+	if err == nil {
+		t.Fatal("Expected error for json with imessage-exporter, got nil")
+	}
+	if !strings.Contains(err.Error(), "invalid export_format") {
+		t.Errorf("Expected invalid export_format error, got: %v", err)
+	}
+}
+
+func TestConfig_DatabasePath(t *testing.T) {
+	cfg := &Config{ChatDBPath: "/data/chat.db"}
+	if got := cfg.DatabasePath(); got != "/data/chat.db" {
+		t.Errorf("Expected /data/chat.db, got: %s", got)
+	}
+
+	cfg.TestDatabasePath = "/test/chat.db"
+	if got := cfg.DatabasePath(); got != "/test/chat.db" {
+		t.Errorf("Expected test database path to take precedence, got: %s", got)
+	}
+}
+
+func TestLoad_LocalDestination(t *testing.T) {
+	tempDir := t.TempDir()
+	configPath := filepath.Join(tempDir, "config.yaml")
+	content := "destination_type: local\n" +
+		"remote_archive_path: /Volumes/NAS/imessages\n"
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	cfg, err := Load(configPath)
+	if err != nil {
+		t.Fatalf("Expected local destination without SSH settings to load, got: %v", err)
+	}
+	if cfg.DestinationType != DestinationLocal {
+		t.Errorf("Expected destination_type local, got: %s", cfg.DestinationType)
+	}
+}
+
+func TestLoad_DestinationType(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "ssh requires remote_user",
+			content: "remote_archive_path: /backups\n",
+			wantErr: "remote_user is required",
+		},
+		{
+			name:    "invalid destination type",
+			content: "destination_type: ftp\nremote_archive_path: /backups\n",
+			wantErr: "invalid destination_type",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configPath, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+
+			_, err := Load(configPath)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoad_S3Destination(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := "destination_type: s3\n" +
+		"s3:\n" +
+		"  endpoint: http://localhost:9000\n" +
+		"  bucket: backups\n" +
+		"  prefix: imessages\n"
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	cfg, err := Load(configPath)
+	if err != nil {
+		t.Fatalf("Expected s3 destination to load, got: %v", err)
+	}
+	s3 := cfg.Destinations[0].S3
+	if s3.Region != DefaultS3Region {
+		t.Errorf("Expected default region %s, got: %s", DefaultS3Region, s3.Region)
+	}
+	if s3.AccessKeyID != "AKID" || s3.SecretAccessKey != "secret" {
+		t.Errorf("Expected credentials from the environment, got: %+v", s3)
+	}
+}
+
+func TestLoad_S3RequiresBucket(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte("destination_type: s3\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	_, err := Load(configPath)
+	if err == nil || !strings.Contains(err.Error(), "s3.bucket is required") {
+		t.Errorf("Expected missing bucket error, got: %v", err)
+	}
+}
+
+func TestLoad_SFTPDestination(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(knownHosts, []byte("testhost ssh-ed25519 AAAA\n"), 0644); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+
+	cfg, err := Load(writeTestConfig(t, "destination_type: sftp\nknown_hosts_path: "+knownHosts+"\n"))
+	if err != nil {
+		t.Fatalf("Expected sftp destination to load, got: %v", err)
+	}
+	if got := cfg.Destinations[0].KnownHostsPath; got != knownHosts {
+		t.Errorf("Expected known_hosts_path %s, got: %s", knownHosts, got)
+	}
+
+	_, err = Load(writeTestConfig(t, "destination_type: sftp\nknown_hosts_path: /nonexistent/known_hosts\n"))
+	if err == nil || !strings.Contains(err.Error(), "known_hosts file does not exist") {
+		t.Errorf("Expected missing known_hosts error, got: %v", err)
+	}
+}
+
+func TestLoad_Destinations(t *testing.T) {
+	tempDir := t.TempDir()
+	keyPath := filepath.Join(tempDir, "id_ed25519")
+	if err := os.WriteFile(keyPath, []byte("fake key"), 0600); err != nil {
+		t.Fatalf("Failed to write fake key: %v", err)
+	}
+	sshDestination := "  - type: ssh\n" +
+		"    remote_user: backup\n" +
+		"    ssh_private_key_path: " + keyPath + "\n" +
+		"    remote_host: backup.example.com\n" +
+		"    remote_archive_path: /backups/imessages\n"
+	localDestination := "  - name: nas\n" +
+		"    type: local\n" +
+		"    remote_archive_path: /Volumes/NAS/imessages\n"
+
+	tests := []struct {
+		name      string
+		content   string
+		wantNames []string
+		wantErr   string
+	}{
+		{
+			name:      "names default to the type",
+			content:   "destinations:\n" + sshDestination + localDestination,
+			wantNames: []string{"ssh", "nas"},
+		},
+		{
+			name:    "duplicate names",
+			content: "destinations:\n" + localDestination + localDestination,
+			wantErr: "duplicate destination name: nas",
+		},
+		{
+			name:    "invalid destination is named",
+			content: "destinations:\n" + localDestination + "  - type: s3\n",
+			wantErr: "destination s3: s3.bucket is required",
+		},
+		{
+			name:    "cannot mix with top-level settings",
+			content: "remote_archive_path: /backups\ndestinations:\n" + localDestination,
+			wantErr: "cannot be combined",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configPath, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+
+			cfg, err := Load(configPath)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Expected error containing %q, got: %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+
+			var names []string
+			for _, d := range cfg.ArchiveDestinations() {
+				names = append(names, d.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.wantNames, ",") {
+				t.Errorf("Expected destinations %v, got %v", tt.wantNames, names)
+			}
+		})
+	}
+}
+
+func TestLoad_Encryption(t *testing.T) {
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	if err := os.WriteFile(passphraseFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatalf("Failed to write passphrase file: %v", err)
+	}
+	recipient := "age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"
+
+	tests := []struct {
+		name        string
+		extra       string
+		wantEnabled bool
+		wantErr     string
+	}{
+		{name: "disabled by default"},
+		{
+			name:        "recipients",
+			extra:       "encryption:\n  recipients:\n    - " + recipient + "\n",
+			wantEnabled: true,
+		},
+		{
+			name:        "passphrase",
+			extra:       "encryption:\n  passphrase_file: " + passphraseFile + "\n",
+			wantEnabled: true,
+		},
+		{
+			name:    "invalid recipient",
+			extra:   "encryption:\n  recipients:\n    - ssh-ed25519 AAAA\n",
+			wantErr: "invalid encryption recipient",
+		},
+		{
+			name:    "recipients and passphrase",
+			extra:   "encryption:\n  recipients:\n    - " + recipient + "\n  passphrase_file: " + passphraseFile + "\n",
+			wantErr: "cannot be combined",
+		},
+		{
+			name:    "missing passphrase file",
+			extra:   "encryption:\n  passphrase_file: /nonexistent/passphrase\n",
+			wantErr: "passphrase file is not readable",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Load(writeTestConfig(t, tt.extra))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Expected error containing %q, got: %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			if cfg.Encryption.Enabled() != tt.wantEnabled {
+				t.Errorf("Expected encryption enabled=%v, got %v", tt.wantEnabled, cfg.Encryption.Enabled())
+			}
+		})
+	}
+}
+
+func TestLoad_Packaging(t *testing.T) {
+	tests := []struct {
+		name    string
+		extra   string
+		want    string
+		wantErr bool
+	}{
+		{name: "default", want: PackagingNone},
+		{name: "tar.zst", extra: "packaging: tar.zst\n", want: PackagingTarZst},
+		{name: "invalid", extra: "packaging: zip\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Load(writeTestConfig(t, tt.extra))
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "invalid packaging") {
+					t.Errorf("Expected an invalid packaging error, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			if cfg.Packaging != tt.want {
+				t.Errorf("Expected packaging %q, got %q", tt.want, cfg.Packaging)
+			}
+		})
+	}
+}
+
+func TestLoad_LockTimeout(t *testing.T) {
+	cfg, err := Load(writeTestConfig(t, ""))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.LockTimeout != DefaultLockTimeout {
+		t.Errorf("Expected lock_timeout %s by default, got %s", DefaultLockTimeout, cfg.LockTimeout)
+	}
+
+	cfg, err = Load(writeTestConfig(t, "lock_timeout: 90s\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.LockTimeout != 90*time.Second {
+		t.Errorf("Expected lock_timeout 90s, got %s", cfg.LockTimeout)
+	}
+
+	if _, err := Load(writeTestConfig(t, "lock_timeout: -1m\n")); err == nil || !strings.Contains(err.Error(), "invalid lock_timeout") {
+		t.Errorf("Expected an invalid lock_timeout error, got %v", err)
+	}
+}
+
+func TestLoad_UploadMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		extra   string
+		want    string
+		wantErr bool
+	}{
+		{name: "default", want: UploadModeBatch},
+		{name: "streaming", extra: "upload_mode: streaming\n", want: UploadModeStreaming},
+		{name: "invalid", extra: "upload_mode: eventually\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Load(writeTestConfig(t, tt.extra))
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "invalid upload_mode") {
+					t.Errorf("Expected an invalid upload_mode error, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			if cfg.UploadMode != tt.want {
+				t.Errorf("Expected upload_mode %q, got %q", tt.want, cfg.UploadMode)
+			}
+		})
+	}
+}
+
+func TestLoad_DedupeAttachments(t *testing.T) {
+	cfg, err := Load(writeTestConfig(t, "dedupe_attachments: true\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if !cfg.DedupeAttachments {
+		t.Error("Expected dedupe_attachments to be enabled")
+	}
+
+	extra := "dedupe_attachments: true\nencryption:\n  recipients:\n    - age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p\n"
+	if _, err := Load(writeTestConfig(t, extra)); err == nil || !strings.Contains(err.Error(), "cannot be combined with encryption") {
+		t.Errorf("Expected dedupe_attachments with encryption to be rejected, got: %v", err)
+	}
+}
+
+func TestLoad_Retention(t *testing.T) {
+	tests := []struct {
+		name    string
+		extra   string
+		wantErr string
+	}{
+		{name: "unset"},
+		{name: "keep days", extra: "retention:\n  keep_days: 365\n  keep_attachments_days: 90\n"},
+		{name: "negative", extra: "retention:\n  keep_days: -1\n", wantErr: "cannot be negative"},
+		{name: "inside days_to_check", extra: "retention:\n  keep_days: 7\n", wantErr: "must be greater than days_to_check"},
+		{name: "attachments inside days_to_check", extra: "days_to_check: 30\nretention:\n  keep_attachments_days: 14\n", wantErr: "must be greater than days_to_check"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Load(writeTestConfig(t, tt.extra))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Expected error containing %q, got: %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			if cfg.Retention.Enabled() != (tt.extra != "") {
+				t.Errorf("Unexpected retention %+v", cfg.Retention)
+			}
+		})
+	}
+}
+
+func TestLoad_Concurrency(t *testing.T) {
+	tests := []struct {
+		name     string
+		extra    string
+		expected int
+		copies   int
+		wantErr  string
+	}{
+		{name: "defaults", expected: 1, copies: DefaultCopyConcurrency},
+		{name: "set", extra: "concurrency: 4\ncopy_concurrency: 1\n", expected: 4, copies: 1},
+		{name: "too many", extra: "concurrency: 17\n", wantErr: "invalid concurrency"},
+		{name: "negative", extra: "concurrency: -2\n", wantErr: "invalid concurrency"},
+		{name: "negative copies", extra: "copy_concurrency: -1\n", wantErr: "invalid copy_concurrency"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Load(writeTestConfig(t, tt.extra))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Expected error containing %q, got: %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			if cfg.Concurrency != tt.expected || cfg.CopyConcurrency != tt.copies {
+				t.Errorf("Expected concurrency %d and copy_concurrency %d, got %d and %d",
+					tt.expected, tt.copies, cfg.Concurrency, cfg.CopyConcurrency)
+			}
+		})
+	}
+}
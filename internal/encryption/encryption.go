@@ -0,0 +1,206 @@
+// Package encryption packs an archived day into a single age-encrypted
+// tarball before upload and unpacks it again on restore.
+package encryption
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+
+	"github.com/iwvelando/imessage-archiver/internal/manifest"
+	"github.com/iwvelando/imessage-archiver/internal/tarball"
+)
+
+// FileName is the encrypted tarball that replaces the files of a day.
+const FileName = "archive.tar.age"
+
+// Method is recorded in the manifest of every encrypted day.
+const Method = "age"
+
+// Recipients returns the age recipients to encrypt to: the given X25519
+// public keys, or a passphrase read from passphraseFile.
+func Recipients(keys []string, passphraseFile string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, key := range keys {
+		r, err := age.ParseX25519Recipient(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %w", key, err)
+		}
+		recipients = append(recipients, r)
+	}
+
+	if passphraseFile != "" {
+		passphrase, err := readPassphrase(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		r, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to use passphrase: %w", err)
+		}
+		recipients = append(recipients, r)
+	}
+
+	if len(recipients) == 0 {
+		return nil, errors.New("no encryption recipients configured")
+	}
+	return recipients, nil
+}
+
+// Identities returns the identities to decrypt with: the private keys in an
+// age identity file, as written by keygen or age-keygen, and the passphrase
+// in passphraseFile. Either may be empty.
+func Identities(identityFile, passphraseFile string) ([]age.Identity, error) {
+	var identities []age.Identity
+
+	if identityFile != "" {
+		f, err := os.Open(identityFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open identity file: %w", err)
+		}
+		defer f.Close()
+
+		parsed, err := age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse identity file %s: %w", identityFile, err)
+		}
+		identities = append(identities, parsed...)
+	}
+
+	if passphraseFile != "" {
+		passphrase, err := readPassphrase(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to use passphrase: %w", err)
+		}
+		identities = append(identities, identity)
+	}
+
+	if len(identities) == 0 {
+		return nil, errors.New("an identity file or passphrase file is required to decrypt")
+	}
+	return identities, nil
+}
+
+// readPassphrase returns the first line of the file at path.
+func readPassphrase(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open passphrase file: %w", err)
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read passphrase file: %w", err)
+	}
+	passphrase := strings.TrimRight(line, "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase file %s is empty", path)
+	}
+	return passphrase, nil
+}
+
+// SealDay replaces the content of dayDir with an encrypted tarball of it and
+// a public manifest. The public manifest keeps the date, fingerprint and
+// checksum of the tarball, so change detection and verify keep working
+// without the key, but not the file names, which contain contact handles.
+//
+// The sealed day is built in a sibling directory and swapped in for the
+// plaintext one, which is only removed once the sealed day is in place.
+func SealDay(dayDir string, recipients []age.Recipient) error {
+	m, err := manifest.Read(dayDir)
+	if err != nil {
+		return err
+	}
+
+	sealedDir := dayDir + ".sealed.tmp"
+	if err := os.RemoveAll(sealedDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(sealedDir, 0755); err != nil {
+		return err
+	}
+	if err := sealInto(sealedDir, dayDir, m, recipients); err != nil {
+		os.RemoveAll(sealedDir)
+		return fmt.Errorf("failed to encrypt %s: %w", m.Date, err)
+	}
+
+	plainDir := dayDir + ".plain.tmp"
+	if err := os.RemoveAll(plainDir); err != nil {
+		return err
+	}
+	if err := os.Rename(dayDir, plainDir); err != nil {
+		os.RemoveAll(sealedDir)
+		return fmt.Errorf("failed to move plaintext export aside: %w", err)
+	}
+	if err := os.Rename(sealedDir, dayDir); err != nil {
+		if restoreErr := os.Rename(plainDir, dayDir); restoreErr != nil {
+			return fmt.Errorf("failed to move encrypted export into place: %w (plaintext export left at %s: %v)", err, plainDir, restoreErr)
+		}
+		os.RemoveAll(sealedDir)
+		return fmt.Errorf("failed to move encrypted export into place: %w", err)
+	}
+	if err := os.RemoveAll(plainDir); err != nil {
+		return fmt.Errorf("failed to remove plaintext export: %w", err)
+	}
+	return nil
+}
+
+// sealInto writes the encrypted tarball of dayDir and its public manifest,
+// built from m, into sealedDir.
+func sealInto(sealedDir, dayDir string, m *manifest.Manifest, recipients []age.Recipient) error {
+	blobPath := filepath.Join(sealedDir, FileName)
+	if err := writeTarball(dayDir, blobPath, recipients); err != nil {
+		return err
+	}
+
+	size, sum, err := manifest.HashFile(blobPath)
+	if err != nil {
+		return err
+	}
+	m.Files = []manifest.File{{Path: FileName, Size: size, SHA256: sum}}
+	m.Encryption = Method
+	return manifest.Write(sealedDir, m)
+}
+
+// writeTarball writes an age-encrypted tarball of dayDir, the manifest
+// included, to dst.
+func writeTarball(dayDir, dst string, recipients []age.Recipient) error {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := age.Encrypt(f, recipients...)
+	if err != nil {
+		return err
+	}
+	if err := tarball.Write(w, dayDir); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Unpack decrypts an encrypted tarball read from r and extracts it into
+// dstDir. Entries that would land outside dstDir are rejected.
+func Unpack(r io.Reader, identities []age.Identity, dstDir string) error {
+	dr, err := age.Decrypt(r, identities...)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt archive: %w", err)
+	}
+	return tarball.Extract(dr, dstDir)
+}
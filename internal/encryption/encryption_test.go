@@ -0,0 +1,199 @@
+package encryption
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+
+	"github.com/iwvelando/imessage-archiver/internal/manifest"
+	"github.com/iwvelando/imessage-archiver/internal/verify"
+)
+
+// writeDay creates a day directory with files and a manifest listing them.
+func writeDay(t *testing.T, dayDir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dayDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scanned, err := manifest.ScanFiles(dayDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.Write(dayDir, &manifest.Manifest{Date: "2024-01-01", Files: scanned}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSealDay_RoundTrip(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	if err := os.WriteFile(passphraseFile, []byte("correct horse battery staple\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		recipients func() ([]age.Recipient, error)
+		identities func() ([]age.Identity, error)
+	}{
+		{
+			name:       "x25519",
+			recipients: func() ([]age.Recipient, error) { return Recipients([]string{identity.Recipient().String()}, "") },
+			identities: func() ([]age.Identity, error) { return []age.Identity{identity}, nil },
+		},
+		{
+			name:       "passphrase",
+			recipients: func() ([]age.Recipient, error) { return Recipients(nil, passphraseFile) },
+			identities: func() ([]age.Identity, error) { return Identities("", passphraseFile) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dayDir := filepath.Join(t.TempDir(), "2024", "01", "01")
+			writeDay(t, dayDir, map[string]string{
+				"+15555550123.txt":      "hello",
+				"attachments/photo.jpg": "jpeg",
+			})
+
+			recipients, err := tt.recipients()
+			if err != nil {
+				t.Fatalf("Recipients failed: %v", err)
+			}
+			if err := SealDay(dayDir, recipients); err != nil {
+				t.Fatalf("SealDay failed: %v", err)
+			}
+
+			// Only the tarball and a public manifest remain
+			entries, _ := os.ReadDir(dayDir)
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			if strings.Join(names, ",") != FileName+","+manifest.FileName {
+				t.Errorf("Expected only the tarball and manifest, got %v", names)
+			}
+			if siblings, _ := os.ReadDir(filepath.Dir(dayDir)); len(siblings) != 1 {
+				t.Errorf("Expected no temporary directories next to the day, got %v", siblings)
+			}
+			public, err := os.ReadFile(filepath.Join(dayDir, manifest.FileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(public, []byte("+15555550123")) {
+				t.Error("Expected the public manifest not to list file names")
+			}
+			if result, err := verify.Day(dayDir, "2024-01-01"); err != nil || !result.OK() {
+				t.Errorf("Expected the sealed day to verify, got %+v, %v", result, err)
+			}
+
+			identities, err := tt.identities()
+			if err != nil {
+				t.Fatalf("Identities failed: %v", err)
+			}
+			blob, err := os.Open(filepath.Join(dayDir, FileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer blob.Close()
+
+			restored := t.TempDir()
+			if err := Unpack(blob, identities, restored); err != nil {
+				t.Fatalf("Unpack failed: %v", err)
+			}
+			data, err := os.ReadFile(filepath.Join(restored, "+15555550123.txt"))
+			if err != nil || string(data) != "hello" {
+				t.Errorf("Expected restored message file, got %q, %v", data, err)
+			}
+			if result, err := verify.Day(restored, "2024-01-01"); err != nil || !result.OK() {
+				t.Errorf("Expected the restored day to verify against its full manifest, got %+v, %v", result, err)
+			}
+		})
+	}
+}
+
+func TestSealDay_FailureKeepsPlaintext(t *testing.T) {
+	dayDir := filepath.Join(t.TempDir(), "2024", "01", "01")
+	writeDay(t, dayDir, map[string]string{"+15555550123.txt": "hello"})
+
+	// age refuses to encrypt without recipients
+	if err := SealDay(dayDir, nil); err == nil {
+		t.Fatal("Expected SealDay to fail without recipients")
+	}
+
+	if result, err := verify.Day(dayDir, "2024-01-01"); err != nil || !result.OK() {
+		t.Errorf("Expected the plaintext day to be left intact, got %+v, %v", result, err)
+	}
+	if siblings, _ := os.ReadDir(filepath.Dir(dayDir)); len(siblings) != 1 {
+		t.Errorf("Expected no temporary directories next to the day, got %v", siblings)
+	}
+}
+
+func TestUnpack_WrongIdentity(t *testing.T) {
+	owner, _ := age.GenerateX25519Identity()
+	other, _ := age.GenerateX25519Identity()
+
+	dayDir := filepath.Join(t.TempDir(), "01")
+	writeDay(t, dayDir, map[string]string{"messages.jsonl": "{}"})
+	if err := SealDay(dayDir, []age.Recipient{owner.Recipient()}); err != nil {
+		t.Fatalf("SealDay failed: %v", err)
+	}
+
+	blob, err := os.Open(filepath.Join(dayDir, FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	if err := Unpack(blob, []age.Identity{other}, t.TempDir()); err == nil {
+		t.Error("Expected decrypting with the wrong identity to fail")
+	}
+}
+
+func TestUnpack_RejectsEscapingPaths(t *testing.T) {
+	identity, _ := age.GenerateX25519Identity()
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, identity.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(w)
+	_ = tw.WriteHeader(&tar.Header{Name: "../escape.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 1})
+	_, _ = tw.Write([]byte("x"))
+	_ = tw.Close()
+	_ = w.Close()
+
+	dst := filepath.Join(t.TempDir(), "out")
+	if err := Unpack(&buf, []age.Identity{identity}, dst); err == nil {
+		t.Error("Expected an entry outside the destination to be rejected")
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dst), "escape.txt")); !os.IsNotExist(err) {
+		t.Error("Expected nothing to be written outside the destination")
+	}
+}
+
+func TestRecipients_Invalid(t *testing.T) {
+	if _, err := Recipients([]string{"not-a-key"}, ""); err == nil {
+		t.Error("Expected an invalid recipient to be rejected")
+	}
+	if _, err := Recipients(nil, ""); err == nil {
+		t.Error("Expected an error without recipients")
+	}
+	if _, err := Identities("", ""); err == nil {
+		t.Error("Expected an error without identities")
+	}
+}
@@ -1,15 +1,20 @@
 package logger
 
 import (
+	"io"
 	"log"
 	"os"
 	"strings"
+	"sync"
 )
 
 type Logger struct {
 	level       LogLevel
 	infoLogger  *log.Logger // For DEBUG and INFO - goes to stdout
 	errorLogger *log.Logger // For WARN and ERROR - goes to stderr
+
+	// buffer holds the output of a logger made by Buffered until Flush
+	buffer *buffer
 }
 
 type LogLevel int
@@ -68,3 +73,62 @@ func (l *Logger) Error(msg string) {
 		l.errorLogger.Printf("[ERROR] %s", msg)
 	}
 }
+
+// Buffered returns a logger at l's level that holds its output until Flush
+// writes it to l's destinations, so work running in parallel can be logged
+// in a predictable order. Lines keep the time they were logged at.
+func (l *Logger) Buffered() *Logger {
+	b := &buffer{stdout: l.infoLogger.Writer(), stderr: l.errorLogger.Writer()}
+	return &Logger{
+		level:       l.level,
+		infoLogger:  log.New(bufferWriter{b, false}, "", log.LstdFlags),
+		errorLogger: log.New(bufferWriter{b, true}, "", log.LstdFlags),
+		buffer:      b,
+	}
+}
+
+// Flush writes out what a logger made by Buffered held back. It does nothing
+// for other loggers.
+func (l *Logger) Flush() {
+	if l.buffer != nil {
+		l.buffer.flush()
+	}
+}
+
+// buffer keeps log lines in the order they were logged, along with the
+// stream each belongs to.
+type buffer struct {
+	mu             sync.Mutex
+	stdout, stderr io.Writer
+	lines          []bufferedLine
+}
+
+type bufferedLine struct {
+	stderr bool
+	text   []byte
+}
+
+type bufferWriter struct {
+	b      *buffer
+	stderr bool
+}
+
+func (w bufferWriter) Write(p []byte) (int, error) {
+	w.b.mu.Lock()
+	defer w.b.mu.Unlock()
+	w.b.lines = append(w.b.lines, bufferedLine{stderr: w.stderr, text: append([]byte(nil), p...)})
+	return len(p), nil
+}
+
+func (b *buffer) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, line := range b.lines {
+		if line.stderr {
+			_, _ = b.stderr.Write(line.text)
+		} else {
+			_, _ = b.stdout.Write(line.text)
+		}
+	}
+	b.lines = nil
+}
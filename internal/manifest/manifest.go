@@ -0,0 +1,165 @@
+// Package manifest reads and writes the manifest.json file stored alongside
+// each archived day.
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/chatdb"
+)
+
+// FileName is the name of the manifest inside each year/month/day directory.
+const FileName = "manifest.json"
+
+// Manifest describes the content of one archived day.
+type Manifest struct {
+	Date            string              `json:"date"` // YYYY-MM-DD
+	CreatedAt       time.Time           `json:"created_at"`
+	ExportFormat    string              `json:"export_format,omitempty"`
+	Exporter        string              `json:"exporter,omitempty"`
+	ExporterVersion string              `json:"exporter_version,omitempty"`
+	ArchiverVersion string              `json:"archiver_version,omitempty"`
+	Fingerprint     *chatdb.Fingerprint `json:"fingerprint,omitempty"`
+	Files           []File              `json:"files,omitempty"`
+
+	// Encryption names the method an encrypted day was sealed with. Files
+	// then lists only the encrypted tarball; the full manifest is inside it.
+	Encryption string `json:"encryption,omitempty"`
+
+	// Packaging names the format of a packaged day, which is stored as one
+	// file next to the other days of its month. Files then lists only that
+	// file, relative to the month directory.
+	Packaging string `json:"packaging,omitempty"`
+
+	// Attachments lists the files of the day that are kept in the archive's
+	// content-addressed attachment store instead of the day directory.
+	Attachments []Attachment `json:"attachments,omitempty"`
+
+	// AttachmentsPruned is set once retention removed the day's attachments.
+	// Files and Attachments then list only what is left.
+	AttachmentsPruned bool `json:"attachments_pruned,omitempty"`
+}
+
+// File records the size and checksum of one archived artifact.
+type File struct {
+	Path   string `json:"path"` // Relative to the day directory, slash-separated
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Attachment records a file of the day that is stored by its checksum.
+type Attachment struct {
+	Path   string `json:"path"` // Where the export references it, relative to the day directory
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ScanFiles hashes every file under dayDir except the manifest itself and
+// returns the entries sorted by path.
+func ScanFiles(dayDir string) ([]File, error) {
+	var files []File
+
+	err := filepath.WalkDir(dayDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dayDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == FileName {
+			return nil
+		}
+
+		size, sum, err := HashFile(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, File{Path: rel, Size: size, SHA256: sum})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan files in %s: %w", dayDir, err)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// HashFile returns the size and hex-encoded SHA-256 of the file at path.
+func HashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Parse decodes a manifest from its JSON encoding.
+func Parse(data []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// Marshal encodes m as stored in manifest files.
+func Marshal(m *Manifest) ([]byte, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// Read loads the manifest from dayDir.
+func Read(dayDir string) (*Manifest, error) {
+	return ReadFile(filepath.Join(dayDir, FileName))
+}
+
+// ReadFile loads the manifest stored at path.
+func ReadFile(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	return Parse(data)
+}
+
+// Write stores m as dayDir/manifest.json.
+func Write(dayDir string, m *Manifest) error {
+	return WriteFile(filepath.Join(dayDir, FileName), m)
+}
+
+// WriteFile stores m at path.
+func WriteFile(path string, m *Manifest) error {
+	data, err := Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
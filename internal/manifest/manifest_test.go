@@ -0,0 +1,86 @@
+package manifest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/chatdb"
+)
+
+func TestWriteRead_RoundTrip(t *testing.T) {
+	dayDir := t.TempDir()
+	written := &Manifest{
+		Date:      "2024-01-01",
+		CreatedAt: time.Date(2024, 1, 2, 16, 0, 0, 0, time.UTC),
+		Fingerprint: &chatdb.Fingerprint{
+			MessageCount:    2,
+			MaxROWID:        2,
+			AttachmentCount: 1,
+		},
+	}
+
+	if err := Write(dayDir, written); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	read, err := Read(dayDir)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	if read.Date != written.Date {
+		t.Errorf("Expected date %s, got %s", written.Date, read.Date)
+	}
+	if read.Fingerprint == nil || !read.Fingerprint.Equal(*written.Fingerprint) {
+		t.Errorf("Expected fingerprint %+v, got %+v", written.Fingerprint, read.Fingerprint)
+	}
+}
+
+func TestRead_Missing(t *testing.T) {
+	if _, err := Read(t.TempDir()); err == nil {
+		t.Error("Expected error reading a missing manifest, got nil")
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	if _, err := Parse([]byte("not json")); err == nil {
+		t.Error("Expected error parsing invalid manifest, got nil")
+	}
+}
+
+func TestScanFiles(t *testing.T) {
+	dayDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dayDir, "attachments"), 0755); err != nil {
+		t.Fatalf("Failed to create attachments directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dayDir, "messages.jsonl"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("Failed to write messages file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dayDir, "attachments", "a.jpg"), []byte{}, 0644); err != nil {
+		t.Fatalf("Failed to write attachment: %v", err)
+	}
+	// An existing manifest must not list itself
+	if err := Write(dayDir, &Manifest{Date: "2024-01-01"}); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	files, err := ScanFiles(dayDir)
+	if err != nil {
+		t.Fatalf("ScanFiles failed: %v", err)
+	}
+
+	expected := []File{
+		{Path: "attachments/a.jpg", Size: 0, SHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{Path: "messages.jsonl", Size: 5, SHA256: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+	}
+	if len(files) != len(expected) {
+		t.Fatalf("Expected %d files, got %+v", len(expected), files)
+	}
+	for i := range expected {
+		if files[i] != expected[i] {
+			t.Errorf("File %d: expected %+v, got %+v", i, expected[i], files[i])
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Package packaging stores an archived day as a single zstd-compressed
+// tarball next to the other days of its month, which keeps the number of
+// files on the destination low, and extracts such packages again.
+package packaging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/iwvelando/imessage-archiver/internal/encryption"
+	"github.com/iwvelando/imessage-archiver/internal/manifest"
+	"github.com/iwvelando/imessage-archiver/internal/tarball"
+	"github.com/iwvelando/imessage-archiver/internal/transport"
+)
+
+// TarZst is the packaging format and the extension of its packages.
+const TarZst = "tar.zst"
+
+// encryptedExt is appended to the extension of an encrypted package.
+const encryptedExt = ".age"
+
+// Extension returns the file extension of a package, without the leading
+// dot, e.g. "tar.zst.age" for an encrypted one.
+func Extension(encrypted bool) string {
+	if encrypted {
+		return TarZst + encryptedExt
+	}
+	return TarZst
+}
+
+// PackageDay replaces the day directory localRoot/YYYY/MM/DD with the package
+// YYYY/MM/YYYY-MM-DD.tar.zst and its public manifest
+// YYYY/MM/YYYY-MM-DD.manifest.json. With recipients the package is
+// encrypted with age after compression and named .tar.zst.age. The full
+// manifest of the day is inside the package; the public one lists only the
+// package, so that file names, which contain contact handles, stay private
+// when the package is encrypted.
+func PackageDay(localRoot, day string, recipients []age.Recipient) error {
+	dayDir := filepath.Join(localRoot, filepath.FromSlash(transport.DayPath(day)))
+	m, err := manifest.Read(dayDir)
+	if err != nil {
+		return err
+	}
+
+	pkgPath := filepath.Join(localRoot, filepath.FromSlash(transport.PackagePath(day, Extension(recipients != nil))))
+	tmpPath := pkgPath + ".tmp"
+	if err := writePackage(dayDir, tmpPath, recipients); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to package %s: %w", day, err)
+	}
+	if err := os.Rename(tmpPath, pkgPath); err != nil {
+		return err
+	}
+
+	size, sum, err := manifest.HashFile(pkgPath)
+	if err != nil {
+		return err
+	}
+	m.Files = []manifest.File{{Path: filepath.Base(pkgPath), Size: size, SHA256: sum}}
+	m.Packaging = TarZst
+	if recipients != nil {
+		m.Encryption = encryption.Method
+	}
+	manifestPath := filepath.Join(localRoot, filepath.FromSlash(transport.PackageManifestPath(day)))
+	if err := manifest.WriteFile(manifestPath, m); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(dayDir); err != nil {
+		return fmt.Errorf("failed to remove unpackaged export: %w", err)
+	}
+	return nil
+}
+
+// writePackage writes a zstd-compressed tarball of dayDir, the manifest
+// included, to dst, encrypting it with age when recipients are given.
+func writePackage(dayDir, dst string, recipients []age.Recipient) error {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	var aw io.WriteCloser
+	if recipients != nil {
+		if aw, err = age.Encrypt(f, recipients...); err != nil {
+			return err
+		}
+		w = aw
+	}
+
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if err := tarball.Write(zw, dayDir); err != nil {
+		zw.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if aw != nil {
+		if err := aw.Close(); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// Extract streams the package or encrypted day tarball read from r into
+// dstDir. The name of the file decides the format: .tar.zst, .tar.zst.age,
+// or .tar.age for a day encrypted without packaging. Identities are only
+// needed for encrypted files. Entries that would land outside dstDir are
+// rejected.
+func Extract(r io.Reader, name string, identities []age.Identity, dstDir string) error {
+	switch {
+	case strings.HasSuffix(name, "."+TarZst+encryptedExt):
+		dr, err := age.Decrypt(r, identities...)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt archive: %w", err)
+		}
+		return extractZst(dr, dstDir)
+	case strings.HasSuffix(name, "."+TarZst):
+		return extractZst(r, dstDir)
+	case strings.HasSuffix(name, ".tar.age"):
+		return encryption.Unpack(r, identities, dstDir)
+	default:
+		return fmt.Errorf("unsupported archive file %s (expected .tar.zst, .tar.zst.age or .tar.age)", path.Base(name))
+	}
+}
+
+func extractZst(r io.Reader, dstDir string) error {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	if err := tarball.Extract(zr, dstDir); err != nil {
+		return fmt.Errorf("failed to extract archive: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package packaging
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+
+	"github.com/iwvelando/imessage-archiver/internal/manifest"
+	"github.com/iwvelando/imessage-archiver/internal/verify"
+)
+
+// writeDay creates the day 2024-01-02 under localRoot with a manifest.
+func writeDay(t *testing.T, localRoot string) {
+	t.Helper()
+	dayDir := filepath.Join(localRoot, "2024", "01", "02")
+	for name, content := range map[string]string{
+		"+15555550123.txt":      "hello",
+		"attachments/photo.jpg": "jpeg",
+	} {
+		p := filepath.Join(dayDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := manifest.ScanFiles(dayDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.Write(dayDir, &manifest.Manifest{Date: "2024-01-02", Files: files}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPackageDay_RoundTrip(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		recipients []age.Recipient
+		identities []age.Identity
+		wantFile   string
+	}{
+		{name: "plain", wantFile: "2024-01-02.tar.zst"},
+		{
+			name:       "encrypted",
+			recipients: []age.Recipient{identity.Recipient()},
+			identities: []age.Identity{identity},
+			wantFile:   "2024-01-02.tar.zst.age",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			localRoot := t.TempDir()
+			writeDay(t, localRoot)
+
+			if err := PackageDay(localRoot, "2024-01-02", tt.recipients); err != nil {
+				t.Fatalf("PackageDay failed: %v", err)
+			}
+
+			// The day directory is replaced by the package and its manifest
+			monthDir := filepath.Join(localRoot, "2024", "01")
+			entries, _ := os.ReadDir(monthDir)
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			if strings.Join(names, ",") != "2024-01-02.manifest.json,"+tt.wantFile {
+				t.Fatalf("Expected only the package and its manifest, got %v", names)
+			}
+
+			m, err := manifest.ReadFile(filepath.Join(monthDir, "2024-01-02.manifest.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Packaging != TarZst || len(m.Files) != 1 || m.Files[0].Path != tt.wantFile {
+				t.Errorf("Unexpected public manifest: %+v", m)
+			}
+			if (tt.recipients != nil) != (m.Encryption != "") {
+				t.Errorf("Expected encryption %q to match recipients", m.Encryption)
+			}
+			size, sum, err := manifest.HashFile(filepath.Join(monthDir, tt.wantFile))
+			if err != nil || size != m.Files[0].Size || sum != m.Files[0].SHA256 {
+				t.Errorf("Expected the manifest to record the package checksum, got %v", err)
+			}
+
+			pkg, err := os.Open(filepath.Join(monthDir, tt.wantFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pkg.Close()
+
+			restored := t.TempDir()
+			if err := Extract(pkg, tt.wantFile, tt.identities, restored); err != nil {
+				t.Fatalf("Extract failed: %v", err)
+			}
+			if data, err := os.ReadFile(filepath.Join(restored, "+15555550123.txt")); err != nil || string(data) != "hello" {
+				t.Errorf("Expected restored message file, got %q, %v", data, err)
+			}
+			if result, err := verify.Day(restored, "2024-01-02"); err != nil || !result.OK() {
+				t.Errorf("Expected the extracted day to verify against its full manifest, got %+v, %v", result, err)
+			}
+		})
+	}
+}
+
+func TestExtract_Unsupported(t *testing.T) {
+	if err := Extract(bytes.NewReader(nil), "2024-01-02.zip", nil, t.TempDir()); err == nil {
+		t.Error("Expected an unsupported file name to be rejected")
+	}
+}
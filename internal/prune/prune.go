@@ -0,0 +1,275 @@
+// Package prune applies the retention policy to an archive destination.
+package prune
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/attachstore"
+	"github.com/iwvelando/imessage-archiver/internal/config"
+	"github.com/iwvelando/imessage-archiver/internal/manifest"
+	"github.com/iwvelando/imessage-archiver/internal/transport"
+)
+
+// Kind is what an action removes.
+type Kind int
+
+const (
+	// DeleteDay removes an archived day.
+	DeleteDay Kind = iota
+	// DeleteAttachments removes the attachments of a day and keeps its
+	// messages.
+	DeleteAttachments
+	// DeleteStored removes a file from the attachment store that no
+	// remaining day references.
+	DeleteStored
+)
+
+// Action is one change prune makes to the archive.
+type Action struct {
+	Kind Kind
+	// Day is the affected day (YYYY-MM-DD), empty for DeleteStored
+	Day string
+	// Paths are removed, in order, below the archive root
+	Paths []string
+	// Files is how many files the day loses with DeleteAttachments
+	Files int
+
+	// manifest replaces the one at manifestPath before Paths are removed
+	manifestPath string
+	manifest     *manifest.Manifest
+}
+
+func (a Action) String() string {
+	switch a.Kind {
+	case DeleteDay:
+		return "delete " + a.Day
+	case DeleteAttachments:
+		return fmt.Sprintf("delete %d attachments of %s", a.Files, a.Day)
+	default:
+		return "delete " + strings.Join(a.Paths, ", ")
+	}
+}
+
+// Result lists what retention removes from a destination.
+type Result struct {
+	Actions []Action
+	// Kept explains why days past the attachment retention keep theirs
+	Kept []string
+}
+
+// archivedDay is a day read from the destination.
+type archivedDay struct {
+	date string
+	// manifestPath is empty for days archived without a manifest
+	manifestPath string
+	manifest     *manifest.Manifest
+	packaged     bool
+}
+
+// Plan works out what policy removes from t, relative to the day of now.
+// Nothing is changed; see Apply.
+func Plan(ctx context.Context, t transport.Transport, policy config.RetentionConfig, now time.Time) (*Result, error) {
+	days, err := t.ListDays(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list archived days: %w", err)
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	deleteBefore := cutoff(today, policy.KeepDays)
+	stripBefore := cutoff(today, policy.KeepAttachmentsDays)
+
+	result := &Result{}
+	// Manifests of the days that remain, as they are after pruning
+	var remaining []*manifest.Manifest
+	// Stored attachments that pruned days referenced
+	released := make(map[string]bool)
+
+	for _, date := range days {
+		// Days are listed oldest first; younger ones are only read for
+		// their references to stored attachments
+		deleting := date < deleteBefore
+		stripping := date < stripBefore
+		if !deleting && !stripping && len(released) == 0 {
+			break
+		}
+
+		day, err := readDay(ctx, t, date)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case deleting:
+			result.Actions = append(result.Actions, deleteDay(day))
+			release(released, day.manifest)
+		case stripping:
+			action, kept, ok := deleteAttachments(day)
+			if kept != "" {
+				result.Kept = append(result.Kept, kept)
+			}
+			if ok {
+				result.Actions = append(result.Actions, action)
+				release(released, day.manifest)
+				remaining = append(remaining, action.manifest)
+			} else {
+				remaining = append(remaining, day.manifest)
+			}
+		default:
+			remaining = append(remaining, day.manifest)
+		}
+	}
+
+	// Stored attachments go once no remaining day references them
+	for _, m := range remaining {
+		if m == nil {
+			continue
+		}
+		for _, blob := range attachstore.Blobs(m) {
+			delete(released, blob)
+		}
+	}
+	blobs := make([]string, 0, len(released))
+	for blob := range released {
+		blobs = append(blobs, blob)
+	}
+	sort.Strings(blobs)
+	for _, blob := range blobs {
+		result.Actions = append(result.Actions, Action{Kind: DeleteStored, Paths: []string{blob}})
+	}
+
+	return result, nil
+}
+
+// Apply carries out an action planned for t. A replaced manifest is written
+// before anything is removed, so an interrupted prune never leaves a day
+// whose manifest lists files that are gone.
+func Apply(ctx context.Context, t transport.Transport, a Action) error {
+	if a.manifest != nil {
+		data, err := manifest.Marshal(a.manifest)
+		if err != nil {
+			return err
+		}
+		if err := t.WriteFile(ctx, a.manifestPath, data); err != nil {
+			return fmt.Errorf("failed to update manifest of %s: %w", a.Day, err)
+		}
+	}
+	for _, p := range a.Paths {
+		if err := t.Delete(ctx, p); err != nil {
+			return fmt.Errorf("failed to %s: %w", a, err)
+		}
+	}
+	return nil
+}
+
+// cutoff returns the oldest day (YYYY-MM-DD) kept with a retention of days,
+// or "" to keep everything.
+func cutoff(today time.Time, days int) string {
+	if days <= 0 {
+		return ""
+	}
+	return today.AddDate(0, 0, -days).Format("2006-01-02")
+}
+
+// readDay reads the manifest of date in either layout.
+func readDay(ctx context.Context, t transport.Transport, date string) (*archivedDay, error) {
+	day := &archivedDay{date: date, manifestPath: path.Join(transport.DayPath(date), manifest.FileName)}
+	data, err := t.ReadFile(ctx, day.manifestPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		day.manifestPath = transport.PackageManifestPath(date)
+		day.packaged = true
+		data, err = t.ReadFile(ctx, day.manifestPath)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		// Archived before manifests were written
+		return &archivedDay{date: date}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest for %s: %w", date, err)
+	}
+	if day.manifest, err = manifest.Parse(data); err != nil {
+		return nil, fmt.Errorf("manifest for %s: %w", date, err)
+	}
+	return day, nil
+}
+
+// deleteDay removes a day in its layout, the manifest first so the day is
+// no longer counted as archived once removal starts.
+func deleteDay(day *archivedDay) Action {
+	action := Action{Kind: DeleteDay, Day: day.date}
+	if !day.packaged {
+		action.Paths = []string{transport.DayPath(day.date)}
+		return action
+	}
+
+	monthDir := path.Dir(transport.DayPath(day.date))
+	action.Paths = []string{day.manifestPath}
+	for _, f := range day.manifest.Files {
+		action.Paths = append(action.Paths, path.Join(monthDir, f.Path))
+	}
+	return action
+}
+
+// deleteAttachments plans removing the attachments of day. It returns false
+// if there is nothing to remove, and a note if attachments are kept because
+// they are inside an encrypted tarball or a package.
+func deleteAttachments(day *archivedDay) (Action, string, bool) {
+	m := day.manifest
+	if m == nil || m.AttachmentsPruned {
+		return Action{}, "", false
+	}
+
+	pruned := *m
+	pruned.Attachments = nil
+	pruned.AttachmentsPruned = true
+	action := Action{
+		Kind:         DeleteAttachments,
+		Day:          day.date,
+		Files:        len(m.Attachments),
+		manifestPath: day.manifestPath,
+		manifest:     &pruned,
+	}
+
+	var kept string
+	if m.Packaging != "" || m.Encryption != "" {
+		// The tarball cannot be changed without downloading it
+		if len(m.Attachments) == 0 && m.Fingerprint != nil && m.Fingerprint.AttachmentCount > 0 {
+			kept = fmt.Sprintf("%s: attachments inside the tarball are kept", day.date)
+		}
+	} else {
+		pruned.Files = nil
+		inDay := 0
+		for _, f := range m.Files {
+			if strings.HasPrefix(f.Path, attachstore.Dir+"/") {
+				inDay++
+				continue
+			}
+			pruned.Files = append(pruned.Files, f)
+		}
+		if inDay > 0 {
+			action.Files += inDay
+			action.Paths = []string{path.Join(transport.DayPath(day.date), attachstore.Dir)}
+		}
+	}
+
+	if action.Files == 0 {
+		return Action{}, kept, false
+	}
+	return action, kept, true
+}
+
+// release records the stored attachments m references.
+func release(released map[string]bool, m *manifest.Manifest) {
+	if m == nil {
+		return
+	}
+	for _, blob := range attachstore.Blobs(m) {
+		released[blob] = true
+	}
+}
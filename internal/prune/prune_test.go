@@ -0,0 +1,207 @@
+package prune
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/attachstore"
+	"github.com/iwvelando/imessage-archiver/internal/chatdb"
+	"github.com/iwvelando/imessage-archiver/internal/config"
+	"github.com/iwvelando/imessage-archiver/internal/manifest"
+	"github.com/iwvelando/imessage-archiver/internal/transport"
+)
+
+var (
+	now    = time.Date(2024, 6, 30, 12, 0, 0, 0, time.UTC)
+	shared = manifest.Attachment{Path: "attachments/sticker.png", Size: 3, SHA256: strings.Repeat("ab", 32)}
+	single = manifest.Attachment{Path: "attachments/photo.jpg", Size: 4, SHA256: strings.Repeat("cd", 32)}
+)
+
+// writeManifest stores m at name on the destination.
+func writeManifest(t *testing.T, memory *transport.Memory, name string, m *manifest.Manifest) {
+	t.Helper()
+	data, err := manifest.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := memory.WriteFile(context.Background(), name, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newArchive builds a destination with a day in every layout:
+//
+//	2024-01-01  directory day with an attachment in the day
+//	2024-03-01  directory day referencing both stored attachments
+//	2024-04-01  packaged day with attachments inside the package
+//	2024-06-01  directory day referencing the shared stored attachment
+func newArchive(t *testing.T) *transport.Memory {
+	t.Helper()
+	memory := transport.NewMemory()
+	for name, content := range map[string]string{
+		"2024/01/01/chat.txt":          "jan",
+		"2024/01/01/attachments/a.jpg": "jpeg",
+		"2024/03/01/chat.txt":          "mar",
+		"2024/04/2024-04-01.tar.zst":   "package",
+		"2024/06/01/chat.txt":          "jun",
+		attachstore.Path(shared):       "png",
+		attachstore.Path(single):       "jpeg",
+	} {
+		if err := memory.WriteFile(context.Background(), name, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeManifest(t, memory, "2024/01/01/manifest.json", &manifest.Manifest{
+		Date:  "2024-01-01",
+		Files: []manifest.File{{Path: "attachments/a.jpg"}, {Path: "chat.txt"}},
+	})
+	writeManifest(t, memory, "2024/03/01/manifest.json", &manifest.Manifest{
+		Date:        "2024-03-01",
+		Files:       []manifest.File{{Path: "chat.txt"}},
+		Attachments: []manifest.Attachment{shared, single},
+	})
+	writeManifest(t, memory, transport.PackageManifestPath("2024-04-01"), &manifest.Manifest{
+		Date:        "2024-04-01",
+		Packaging:   "tar.zst",
+		Fingerprint: &chatdb.Fingerprint{AttachmentCount: 2},
+		Files:       []manifest.File{{Path: "2024-04-01.tar.zst"}},
+	})
+	writeManifest(t, memory, "2024/06/01/manifest.json", &manifest.Manifest{
+		Date:        "2024-06-01",
+		Files:       []manifest.File{{Path: "chat.txt"}},
+		Attachments: []manifest.Attachment{shared},
+	})
+	return memory
+}
+
+func TestPlan(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   config.RetentionConfig
+		expected []string
+		kept     int
+	}{
+		{name: "disabled"},
+		{
+			name:     "keep days",
+			policy:   config.RetentionConfig{KeepDays: 100},
+			expected: []string{"delete 2024-01-01", "delete 2024-03-01", "delete " + attachstore.Path(single)},
+		},
+		{
+			name:     "keep days removes packages",
+			policy:   config.RetentionConfig{KeepDays: 80},
+			expected: []string{"delete 2024-01-01", "delete 2024-03-01", "delete 2024-04-01", "delete " + attachstore.Path(single)},
+		},
+		{
+			name:   "keep attachments",
+			policy: config.RetentionConfig{KeepAttachmentsDays: 60},
+			expected: []string{
+				"delete 1 attachments of 2024-01-01",
+				"delete 2 attachments of 2024-03-01",
+				"delete " + attachstore.Path(single),
+			},
+			kept: 1,
+		},
+		{
+			name:     "both",
+			policy:   config.RetentionConfig{KeepDays: 150, KeepAttachmentsDays: 100},
+			expected: []string{"delete 2024-01-01", "delete 2 attachments of 2024-03-01", "delete " + attachstore.Path(single)},
+		},
+		{
+			name:     "everything",
+			policy:   config.RetentionConfig{KeepDays: 10},
+			expected: []string{"delete 2024-01-01", "delete 2024-03-01", "delete 2024-04-01", "delete 2024-06-01", "delete " + attachstore.Path(shared), "delete " + attachstore.Path(single)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory := newArchive(t)
+			before := memory.Files()
+
+			result, err := Plan(context.Background(), memory, tt.policy, now)
+			if err != nil {
+				t.Fatalf("Plan failed: %v", err)
+			}
+			var actions []string
+			for _, a := range result.Actions {
+				actions = append(actions, a.String())
+			}
+			if strings.Join(actions, "; ") != strings.Join(tt.expected, "; ") {
+				t.Errorf("Expected actions %v, got %v", tt.expected, actions)
+			}
+			if len(result.Kept) != tt.kept {
+				t.Errorf("Expected %d kept notes, got %v", tt.kept, result.Kept)
+			}
+			if strings.Join(memory.Files(), ",") != strings.Join(before, ",") {
+				t.Error("Expected Plan not to change the destination")
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	memory := newArchive(t)
+	result, err := Plan(context.Background(), memory, config.RetentionConfig{KeepDays: 100, KeepAttachmentsDays: 60}, now)
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	for _, a := range result.Actions {
+		if err := Apply(context.Background(), memory, a); err != nil {
+			t.Fatalf("Apply(%s) failed: %v", a, err)
+		}
+	}
+
+	days, err := memory.ListDays(context.Background())
+	if err != nil || strings.Join(days, ",") != "2024-04-01,2024-06-01" {
+		t.Errorf("Expected only the days inside keep_days, got %v, %v", days, err)
+	}
+	if _, err := memory.ReadFile(context.Background(), attachstore.Path(single)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected the unreferenced stored attachment to be removed, got %v", err)
+	}
+	if _, err := memory.ReadFile(context.Background(), attachstore.Path(shared)); err != nil {
+		t.Errorf("Expected the attachment still referenced by 2024-06-01 to be kept, got %v", err)
+	}
+
+	// Pruning again finds nothing new
+	result, err = Plan(context.Background(), memory, config.RetentionConfig{KeepDays: 100, KeepAttachmentsDays: 60}, now)
+	if err != nil || len(result.Actions) != 0 {
+		t.Errorf("Expected nothing left to prune, got %v, %v", result.Actions, err)
+	}
+}
+
+func TestApply_DeleteAttachments(t *testing.T) {
+	memory := newArchive(t)
+	result, err := Plan(context.Background(), memory, config.RetentionConfig{KeepAttachmentsDays: 170}, now)
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if len(result.Actions) != 1 {
+		t.Fatalf("Expected only 2024-01-01 to lose its attachments, got %v", result.Actions)
+	}
+	if err := Apply(context.Background(), memory, result.Actions[0]); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	if _, err := memory.ReadFile(context.Background(), "2024/01/01/attachments/a.jpg"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected the attachment to be removed, got %v", err)
+	}
+	if data, err := memory.ReadFile(context.Background(), "2024/01/01/chat.txt"); err != nil || string(data) != "jan" {
+		t.Errorf("Expected the messages to be kept, got %q, %v", data, err)
+	}
+	data, err := memory.ReadFile(context.Background(), "2024/01/01/manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := manifest.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.AttachmentsPruned || len(m.Files) != 1 || m.Files[0].Path != "chat.txt" {
+		t.Errorf("Expected the manifest to list only the messages, got %+v", m)
+	}
+}
@@ -0,0 +1,194 @@
+// Package restore reads archived days back from a destination.
+package restore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+
+	"github.com/iwvelando/imessage-archiver/internal/attachstore"
+	"github.com/iwvelando/imessage-archiver/internal/encryption"
+	"github.com/iwvelando/imessage-archiver/internal/manifest"
+	"github.com/iwvelando/imessage-archiver/internal/packaging"
+	"github.com/iwvelando/imessage-archiver/internal/transport"
+	"github.com/iwvelando/imessage-archiver/internal/verify"
+)
+
+// Day downloads the archived day date (YYYY-MM-DD) from t into dstDir,
+// extracting it if it was packaged and decrypting it with identities if it
+// was encrypted, and checks the result against the day's manifest.
+func Day(ctx context.Context, t transport.Transport, date, dstDir string, identities []age.Identity) error {
+	dayPath := transport.DayPath(date)
+
+	// The files of a packaged day are listed relative to its month directory
+	dir := dayPath
+	data, err := t.ReadFile(ctx, path.Join(dayPath, manifest.FileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		dir = path.Dir(dayPath)
+		data, err = t.ReadFile(ctx, transport.PackageManifestPath(date))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read manifest for %s: %w", date, err)
+	}
+	m, err := manifest.Parse(data)
+	if err != nil {
+		return fmt.Errorf("manifest for %s: %w", date, err)
+	}
+	if len(m.Files) == 0 {
+		return fmt.Errorf("manifest for %s lists no files (archived before checksums were recorded)", date)
+	}
+
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		return err
+	}
+
+	switch {
+	case m.Packaging != "" && m.Packaging != packaging.TarZst:
+		return fmt.Errorf("%s uses unsupported packaging %q", date, m.Packaging)
+	case m.Encryption != "" && m.Encryption != encryption.Method:
+		return fmt.Errorf("%s uses unsupported encryption %q", date, m.Encryption)
+	case m.Encryption != "" && len(identities) == 0:
+		return fmt.Errorf("%s is encrypted, an identity or passphrase is required", date)
+	case m.Packaging == "" && m.Encryption == "":
+		for _, f := range m.Files {
+			if err := download(ctx, t, dir, f, dstDir); err != nil {
+				return fmt.Errorf("failed to restore %s: %w", date, err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dstDir, manifest.FileName), data, 0644); err != nil {
+			return err
+		}
+	default:
+		// One tarball that holds the full manifest
+		if err := extract(ctx, t, dir, m.Files[0], identities, dstDir); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", date, err)
+		}
+	}
+
+	for _, a := range m.Attachments {
+		if err := fetchAttachment(ctx, t, a, dstDir); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", date, err)
+		}
+	}
+
+	result, err := verify.Day(dstDir, date)
+	if err != nil {
+		return err
+	}
+	if !result.OK() {
+		return fmt.Errorf("restored %s does not match its manifest (missing %v, extra %v, corrupted %v)",
+			date, result.Missing, result.Extra, result.Corrupted)
+	}
+	return nil
+}
+
+// extract streams a packaged or encrypted day into dstDir without holding it
+// in memory, and checks the stream against its manifest entry.
+func extract(ctx context.Context, t transport.Transport, dir string, f manifest.File, identities []age.Identity, dstDir string) error {
+	rc, err := t.Open(ctx, path.Join(dir, f.Path))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	cr := &checkedReader{r: rc, h: sha256.New()}
+	if err := packaging.Extract(cr, f.Path, identities, dstDir); err != nil {
+		return err
+	}
+	// Read past the end of the tarball so the whole file is checked
+	if _, err := io.Copy(io.Discard, cr); err != nil {
+		return err
+	}
+	if cr.n != f.Size || !strings.EqualFold(hex.EncodeToString(cr.h.Sum(nil)), f.SHA256) {
+		return fmt.Errorf("%s does not match its checksum", f.Path)
+	}
+	return nil
+}
+
+// fetchAttachment streams an attachment from the store to the place in the
+// day where the export references it.
+func fetchAttachment(ctx context.Context, t transport.Transport, a manifest.Attachment, dstDir string) error {
+	if !attachstore.Valid(a) {
+		return fmt.Errorf("invalid attachment in manifest: %s", a.Path)
+	}
+	rc, err := t.Open(ctx, attachstore.Path(a))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	target := filepath.Join(dstDir, filepath.FromSlash(a.Path))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	cr := &checkedReader{r: rc, h: sha256.New()}
+	if _, err := io.Copy(out, cr); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if cr.n != a.Size || !strings.EqualFold(hex.EncodeToString(cr.h.Sum(nil)), a.SHA256) {
+		return fmt.Errorf("%s does not match its checksum", a.Path)
+	}
+	return nil
+}
+
+// checkedReader hashes and counts what is read through it.
+type checkedReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+func (c *checkedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	c.n += int64(n)
+	return n, err
+}
+
+// fetch reads one file of the day and checks it against its manifest entry.
+func fetch(ctx context.Context, t transport.Transport, dayPath string, f manifest.File) ([]byte, error) {
+	data, err := t.ReadFile(ctx, path.Join(dayPath, f.Path))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	if int64(len(data)) != f.Size || !strings.EqualFold(hex.EncodeToString(sum[:]), f.SHA256) {
+		return nil, fmt.Errorf("%s does not match its checksum", f.Path)
+	}
+	return data, nil
+}
+
+func download(ctx context.Context, t transport.Transport, dayPath string, f manifest.File, dstDir string) error {
+	data, err := fetch(ctx, t, dayPath, f)
+	if err != nil {
+		return err
+	}
+	name := path.Clean(f.Path)
+	if !fs.ValidPath(name) || name == manifest.FileName {
+		return fmt.Errorf("invalid path in manifest: %s", f.Path)
+	}
+	target := filepath.Join(dstDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(target, data, 0644)
+}
@@ -0,0 +1,147 @@
+package restore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+
+	"github.com/iwvelando/imessage-archiver/internal/attachstore"
+	"github.com/iwvelando/imessage-archiver/internal/encryption"
+	"github.com/iwvelando/imessage-archiver/internal/manifest"
+	"github.com/iwvelando/imessage-archiver/internal/packaging"
+	"github.com/iwvelando/imessage-archiver/internal/transport"
+)
+
+// archiveDay exports a small day under localRoot, optionally with its
+// attachments in the store and packaged or sealed, and uploads it to a memory
+// transport.
+func archiveDay(t *testing.T, recipient age.Recipient, packaged, deduped bool) *transport.Memory {
+	t.Helper()
+	localRoot := t.TempDir()
+	dayDir := filepath.Join(localRoot, "2024", "01", "01")
+	if err := os.MkdirAll(filepath.Join(dayDir, "attachments"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dayDir, "chat.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dayDir, "attachments", "a.jpg"), []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := manifest.ScanFiles(dayDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.Write(dayDir, &manifest.Manifest{Date: "2024-01-01", Files: files}); err != nil {
+		t.Fatal(err)
+	}
+	if deduped {
+		if err := attachstore.Collect(localRoot, dayDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var recipients []age.Recipient
+	if recipient != nil {
+		recipients = []age.Recipient{recipient}
+	}
+	if packaged {
+		if err := packaging.PackageDay(localRoot, "2024-01-01", recipients); err != nil {
+			t.Fatal(err)
+		}
+	} else if recipients != nil {
+		if err := encryption.SealDay(dayDir, recipients); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	memory := transport.NewMemory()
+	if deduped {
+		if err := memory.UploadBlobs(context.Background(), localRoot, []string{blobPath}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := memory.Upload(context.Background(), localRoot, []string{"2024-01-01"}); err != nil {
+		t.Fatal(err)
+	}
+	return memory
+}
+
+// blobPath is where the store keeps attachments/a.jpg of the test day.
+var blobPath = attachstore.Path(manifest.Attachment{
+	Path:   "attachments/a.jpg",
+	SHA256: "41e5787e9f28562d07b891b1816b492309d646c0f2829743fa4963a9f9cc1d61",
+})
+
+func TestDay(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := age.GenerateX25519Identity()
+
+	tests := []struct {
+		name       string
+		recipient  age.Recipient
+		identities []age.Identity
+		packaged   bool
+		deduped    bool
+		tamper     string
+		wantErr    bool
+	}{
+		{name: "plain"},
+		{name: "plain tampered", tamper: "2024/01/01/chat.txt", wantErr: true},
+		{name: "encrypted", recipient: identity.Recipient(), identities: []age.Identity{identity}},
+		{name: "encrypted without identity", recipient: identity.Recipient(), wantErr: true},
+		{name: "encrypted wrong identity", recipient: identity.Recipient(), identities: []age.Identity{other}, wantErr: true},
+		{name: "encrypted tampered", recipient: identity.Recipient(), identities: []age.Identity{identity}, tamper: "2024/01/01/" + encryption.FileName, wantErr: true},
+		{name: "packaged", packaged: true},
+		{name: "packaged tampered", packaged: true, tamper: "2024/01/2024-01-01.tar.zst", wantErr: true},
+		{name: "packaged encrypted", packaged: true, recipient: identity.Recipient(), identities: []age.Identity{identity}},
+		{name: "packaged encrypted without identity", packaged: true, recipient: identity.Recipient(), wantErr: true},
+		{name: "deduped", deduped: true},
+		{name: "deduped tampered", deduped: true, tamper: blobPath, wantErr: true},
+		{name: "deduped packaged", deduped: true, packaged: true},
+		{name: "packaged encrypted tampered", packaged: true, recipient: identity.Recipient(), identities: []age.Identity{identity}, tamper: "2024/01/2024-01-01.tar.zst.age", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory := archiveDay(t, tt.recipient, tt.packaged, tt.deduped)
+			if tt.tamper != "" {
+				data, err := memory.ReadFile(context.Background(), tt.tamper)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data[len(data)-1] ^= 0xff
+				_ = memory.WriteFile(context.Background(), tt.tamper, data)
+			}
+
+			dst := t.TempDir()
+			err := Day(context.Background(), memory, "2024-01-01", dst, tt.identities)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected restore to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Restore failed: %v", err)
+			}
+			for name, want := range map[string]string{"chat.txt": "hello", "attachments/a.jpg": "jpeg"} {
+				data, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+				if err != nil || string(data) != want {
+					t.Errorf("Expected %s to contain %q, got %q, %v", name, want, data, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDay_Missing(t *testing.T) {
+	if err := Day(context.Background(), transport.NewMemory(), "2024-01-01", t.TempDir(), nil); err == nil {
+		t.Error("Expected an error for a day that is not archived")
+	}
+}
@@ -0,0 +1,136 @@
+package runlock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+)
+
+// RemoteFile is the lock file of a destination, relative to its archive
+// root. Gap detection, verify and prune only look at day paths, so they
+// ignore it.
+const RemoteFile = ".lock.json"
+
+// RemoteStaleAfter is how long a destination lock may go without being
+// renewed before another run takes it over. Runs renew their locks before
+// each upload, and a run on the same Mac takes over the lock of a process
+// that is gone right away.
+const RemoteStaleAfter = 12 * time.Hour
+
+// Files is the part of a transport a destination lock needs.
+type Files interface {
+	ReadFile(ctx context.Context, name string) ([]byte, error)
+	WriteFile(ctx context.Context, name string, data []byte) error
+	CreateFile(ctx context.Context, name string, data []byte) error
+	Delete(ctx context.Context, name string) error
+}
+
+// RemoteLock is the lock file of a destination.
+type RemoteLock struct {
+	files Files
+	name  string
+	owner Owner
+}
+
+// AcquireRemote takes the lock of the destination files belong to, named
+// name in logs, waiting up to timeout for another run to release it.
+func AcquireRemote(ctx context.Context, files Files, name string, owner Owner, timeout time.Duration, log *logger.Logger) (*RemoteLock, error) {
+	data, err := json.MarshalIndent(owner, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	err = wait(ctx, timeout, "the lock of "+name, log, func() (*Owner, error) {
+		err := files.CreateFile(ctx, RemoteFile, data)
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+
+		holder, err := readRemoteOwner(ctx, files)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			// Released in the meantime
+			return nil, ErrLocked
+		case err != nil:
+			return nil, fmt.Errorf("failed to read the lock of %s: %w", name, err)
+		case holder.RunID == owner.RunID:
+			// Created by an earlier attempt whose reply was lost
+			return nil, nil
+		case !stale(holder):
+			return holder, ErrLocked
+		}
+
+		log.Warn(fmt.Sprintf("Taking over the lock of %s, its run is gone (%s)", name, holder))
+		if err := files.Delete(ctx, RemoteFile); err != nil {
+			return nil, fmt.Errorf("failed to remove the stale lock of %s: %w", name, err)
+		}
+		if err := files.CreateFile(ctx, RemoteFile, data); errors.Is(err, fs.ErrExist) {
+			// Another run took it over first
+			return nil, ErrLocked
+		} else if err != nil {
+			return nil, err
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteLock{files: files, name: name, owner: owner}, nil
+}
+
+// stale reports whether the run holding a destination lock is gone: it ran
+// on this Mac and its process no longer exists, or it stopped renewing the
+// lock long ago.
+func stale(holder *Owner) bool {
+	if holder.onThisHost() && !processRunning(holder.PID) {
+		return true
+	}
+	return time.Since(holder.Updated) > RemoteStaleAfter
+}
+
+// Renew records that the run still holds the lock, so other runs do not
+// take it over. It fails if another run took it over already.
+func (l *RemoteLock) Renew(ctx context.Context) error {
+	holder, err := readRemoteOwner(ctx, l.files)
+	if err != nil {
+		return fmt.Errorf("failed to renew the lock of %s: %w", l.name, err)
+	}
+	if holder.RunID != l.owner.RunID {
+		return fmt.Errorf("lost the lock of %s to another run (%s)", l.name, holder)
+	}
+
+	l.owner.Updated = time.Now().UTC()
+	data, err := json.MarshalIndent(l.owner, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := l.files.WriteFile(ctx, RemoteFile, data); err != nil {
+		return fmt.Errorf("failed to renew the lock of %s: %w", l.name, err)
+	}
+	return nil
+}
+
+// Release removes the lock, unless another run took it over.
+func (l *RemoteLock) Release(ctx context.Context) error {
+	holder, err := readRemoteOwner(ctx, l.files)
+	if err != nil || holder.RunID != l.owner.RunID {
+		return nil
+	}
+	if err := l.files.Delete(ctx, RemoteFile); err != nil {
+		return fmt.Errorf("failed to release the lock of %s: %w", l.name, err)
+	}
+	return nil
+}
+
+func readRemoteOwner(ctx context.Context, files Files) (*Owner, error) {
+	data, err := files.ReadFile(ctx, RemoteFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseOwner(data)
+}
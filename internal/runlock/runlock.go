@@ -0,0 +1,213 @@
+// Package runlock keeps archiver runs from overlapping. A lock file in a
+// local directory guards against runs on the same Mac, such as the launch
+// agent and a manual run, and a lock file at each destination guards against
+// runs from other Macs archiving to it. The locks are advisory: they only
+// keep out other archiver runs.
+package runlock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+)
+
+// ErrLocked is returned when another run still holds a lock once the
+// timeout passed.
+var ErrLocked = errors.New("another run holds the lock")
+
+// pollInterval is how often a waiting run checks the lock again.
+var pollInterval = 2 * time.Second
+
+// Owner identifies the run holding a lock.
+type Owner struct {
+	Host    string    `json:"host"`
+	PID     int       `json:"pid"`
+	RunID   string    `json:"run_id"`
+	Started time.Time `json:"started"`
+	// Updated is when the run last renewed the lock
+	Updated time.Time `json:"updated"`
+}
+
+// NewOwner describes the current process.
+func NewOwner() Owner {
+	host, _ := os.Hostname()
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	now := time.Now().UTC()
+	return Owner{Host: host, PID: os.Getpid(), RunID: hex.EncodeToString(b[:]), Started: now, Updated: now}
+}
+
+func (o Owner) String() string {
+	return fmt.Sprintf("pid %d on %s, started %s", o.PID, o.Host, o.Started.Local().Format(time.RFC3339))
+}
+
+// onThisHost reports whether o runs on this machine.
+func (o Owner) onThisHost() bool {
+	host, err := os.Hostname()
+	return err == nil && host == o.Host
+}
+
+// processRunning reports whether a process with pid exists. A process we
+// may not signal still exists.
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// wait polls acquire until it succeeds, fails with an error other than
+// ErrLocked, or timeout passes. A timeout of zero tries once. acquire
+// returns ErrLocked with the holder of the lock, or without one if the lock
+// was released while it looked, in which case it is tried again at once.
+func wait(ctx context.Context, timeout time.Duration, what string, log *logger.Logger, acquire func() (*Owner, error)) error {
+	deadline := time.Now().Add(timeout)
+	logged := false
+	for {
+		holder, err := acquire()
+		if !errors.Is(err, ErrLocked) {
+			return err
+		}
+		if !time.Now().Before(deadline) {
+			if holder == nil {
+				return fmt.Errorf("%s: %w", what, ErrLocked)
+			}
+			return fmt.Errorf("%s: %w (%s)", what, ErrLocked, holder)
+		}
+		if holder == nil {
+			continue
+		}
+		if !logged {
+			log.Info(fmt.Sprintf("Waiting up to %s for the run holding %s to finish (%s)", timeout, what, holder))
+			logged = true
+		}
+		select {
+		case <-time.After(min(pollInterval, time.Until(deadline))):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Lock is a lock file in a local directory.
+type Lock struct {
+	path  string
+	owner Owner
+}
+
+// Acquire takes the lock file at path for owner, waiting up to timeout for
+// another run to release it. A lock whose process no longer runs, such as
+// one left by a run that was killed, is taken over.
+func Acquire(ctx context.Context, path string, owner Owner, timeout time.Duration, log *logger.Logger) (*Lock, error) {
+	data, err := json.MarshalIndent(owner, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	err = wait(ctx, timeout, path, log, func() (*Owner, error) {
+		err := createFile(path, data)
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+
+		holder, err := readOwner(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Released in the meantime
+			return nil, ErrLocked
+		}
+		if err == nil && processRunning(holder.PID) {
+			return holder, ErrLocked
+		}
+		if err == nil {
+			log.Warn(fmt.Sprintf("Taking over the lock %s, its run is gone (%s)", path, holder))
+		} else {
+			log.Warn(fmt.Sprintf("Taking over the unreadable lock %s: %v", path, err))
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove stale lock: %w", err)
+		}
+		if err := createFile(path, data); errors.Is(err, fs.ErrExist) {
+			// Another run took it over first
+			return nil, ErrLocked
+		} else if err != nil {
+			return nil, err
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Lock{path: path, owner: owner}, nil
+}
+
+// Release removes the lock file, unless another run took it over.
+func (l *Lock) Release() error {
+	holder, err := readOwner(l.path)
+	if err != nil || holder.RunID != l.owner.RunID {
+		return nil
+	}
+	if err := os.Remove(l.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to release lock: %w", err)
+	}
+	return nil
+}
+
+// createFile writes data to a temporary file and links it to path, so the
+// lock appears complete or not at all. It fails with fs.ErrExist if path
+// exists.
+func createFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create lock: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write lock: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write lock: %w", err)
+	}
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		return fmt.Errorf("failed to create lock: %w", err)
+	}
+	return nil
+}
+
+func readOwner(path string) (*Owner, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseOwner(data)
+}
+
+func parseOwner(data []byte) (*Owner, error) {
+	var o Owner
+	if err := json.Unmarshal(data, &o); err != nil {
+		return nil, fmt.Errorf("failed to parse lock: %w", err)
+	}
+	return &o, nil
+}
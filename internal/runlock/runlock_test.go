@@ -0,0 +1,182 @@
+package runlock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+	"github.com/iwvelando/imessage-archiver/internal/transport"
+)
+
+// goneOwner is a run on this host whose process no longer exists.
+func goneOwner(t *testing.T) Owner {
+	t.Helper()
+	owner := NewOwner()
+	owner.PID = 1 << 22 // Above the PID limit of macOS and Linux
+	if processRunning(owner.PID) {
+		t.Skip("PID in use")
+	}
+	return owner
+}
+
+func writeOwner(t *testing.T, path string, owner Owner) {
+	t.Helper()
+	data, err := json.Marshal(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	log := logger.New("debug")
+	path := filepath.Join(t.TempDir(), "run.lock")
+
+	first, err := Acquire(context.Background(), path, NewOwner(), 0, log)
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	// This process is running, so a second run waits and gives up
+	pollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { pollInterval = 2 * time.Second })
+	if _, err := Acquire(context.Background(), path, NewOwner(), 50*time.Millisecond, log); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected ErrLocked while the lock is held, got %v", err)
+	}
+
+	// A waiting run gets the lock once it is released
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = first.Release()
+	}()
+	second, err := Acquire(context.Background(), path, NewOwner(), time.Second, log)
+	if err != nil {
+		t.Fatalf("Expected the lock after it was released, got %v", err)
+	}
+	if err := second.Release(); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the lock file to be removed, got %v", err)
+	}
+}
+
+func TestAcquire_Stale(t *testing.T) {
+	log := logger.New("debug")
+	path := filepath.Join(t.TempDir(), "run.lock")
+
+	// The lock of a run that was killed is taken over at once
+	writeOwner(t, path, goneOwner(t))
+	lock, err := Acquire(context.Background(), path, NewOwner(), 0, log)
+	if err != nil {
+		t.Fatalf("Expected the stale lock to be taken over, got %v", err)
+	}
+
+	// A lock taken over is not removed by its former holder
+	stale := &Lock{path: path, owner: goneOwner(t)}
+	if err := stale.Release(); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected the current lock to remain, got %v", err)
+	}
+	_ = lock.Release()
+}
+
+func TestAcquire_Cancelled(t *testing.T) {
+	log := logger.New("debug")
+	path := filepath.Join(t.TempDir(), "run.lock")
+	if _, err := Acquire(context.Background(), path, NewOwner(), 0, log); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Acquire(ctx, path, NewOwner(), time.Minute, log); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected waiting to stop with the context, got %v", err)
+	}
+}
+
+func TestAcquireRemote(t *testing.T) {
+	log := logger.New("debug")
+	memory := transport.NewMemory()
+
+	first, err := AcquireRemote(context.Background(), memory, "memory", NewOwner(), 0, log)
+	if err != nil {
+		t.Fatalf("AcquireRemote failed: %v", err)
+	}
+	if _, err := AcquireRemote(context.Background(), memory, "memory", NewOwner(), 0, log); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected ErrLocked while the lock is held, got %v", err)
+	}
+	if err := first.Renew(context.Background()); err != nil {
+		t.Fatalf("Renew failed: %v", err)
+	}
+	if err := first.Release(context.Background()); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if _, err := memory.ReadFile(context.Background(), RemoteFile); err == nil {
+		t.Error("Expected the lock file to be removed")
+	}
+}
+
+func TestAcquireRemote_Stale(t *testing.T) {
+	log := logger.New("debug")
+
+	tests := []struct {
+		name  string
+		owner func(t *testing.T) Owner
+		stale bool
+	}{
+		{name: "running here", owner: func(*testing.T) Owner { return NewOwner() }},
+		{name: "gone here", owner: goneOwner, stale: true},
+		{name: "other host", owner: func(*testing.T) Owner {
+			o := NewOwner()
+			o.Host = "another-mac"
+			return o
+		}},
+		{name: "other host, abandoned", owner: func(*testing.T) Owner {
+			o := NewOwner()
+			o.Host = "another-mac"
+			o.Updated = time.Now().Add(-RemoteStaleAfter - time.Minute)
+			return o
+		}, stale: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory := transport.NewMemory()
+			holder := tt.owner(t)
+			data, _ := json.Marshal(holder)
+			if err := memory.WriteFile(context.Background(), RemoteFile, data); err != nil {
+				t.Fatal(err)
+			}
+
+			lock, err := AcquireRemote(context.Background(), memory, "memory", NewOwner(), 0, log)
+			if tt.stale {
+				if err != nil {
+					t.Fatalf("Expected the lock to be taken over, got %v", err)
+				}
+				// The former holder can neither renew nor release it
+				old := &RemoteLock{files: memory, name: "memory", owner: holder}
+				if err := old.Renew(context.Background()); err == nil {
+					t.Error("Expected renewing a lost lock to fail")
+				}
+				_ = old.Release(context.Background())
+				if err := lock.Renew(context.Background()); err != nil {
+					t.Errorf("Expected the new holder to keep the lock, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrLocked) {
+				t.Errorf("Expected ErrLocked, got %v", err)
+			}
+		})
+	}
+}
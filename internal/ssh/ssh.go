@@ -1,11 +1,20 @@
 package ssh
 
 import (
+	"context"
 	"fmt"
 	"os/exec"
 	"path/filepath"
+	"strings"
 )
 
+// connectionOptions make unreachable hosts fail fast and keep long transfers alive.
+var connectionOptions = []string{
+	"-o", "ConnectTimeout=30",
+	"-o", "ServerAliveInterval=60",
+	"-o", "ServerAliveCountMax=3",
+}
+
 // SSHConfig holds the configuration for SSH connections.
 type SSHConfig struct {
 	User       string
@@ -24,10 +33,27 @@ func NewSSHConfig(user, privateKey, remoteHost, remotePath string) *SSHConfig {
 	}
 }
 
+// Destination returns the user@host string used to reach the server.
+func (config *SSHConfig) Destination() string {
+	return fmt.Sprintf("%s@%s", config.User, config.RemoteHost)
+}
+
+// CommandContext returns an unstarted command that runs command on the
+// remote server and is killed once ctx is done.
+func (config *SSHConfig) CommandContext(ctx context.Context, command string) *exec.Cmd {
+	args := append([]string{"-i", config.PrivateKey}, connectionOptions...)
+	args = append(args, config.Destination(), command)
+	return exec.CommandContext(ctx, "ssh", args...)
+}
+
+// RsyncShell returns the remote shell rsync should use (its -e argument).
+func (config *SSHConfig) RsyncShell() string {
+	return "ssh -i " + config.PrivateKey + " " + strings.Join(connectionOptions, " ")
+}
+
 // ExecuteCommand executes a command on the remote server via SSH.
-func (config *SSHConfig) ExecuteCommand(command string) error {
-	cmd := exec.Command("ssh", "-i", config.PrivateKey, fmt.Sprintf("%s@%s", config.User, config.RemoteHost), command)
-	output, err := cmd.CombinedOutput()
+func (config *SSHConfig) ExecuteCommand(ctx context.Context, command string) error {
+	output, err := config.CommandContext(ctx, command).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("failed to execute command: %s, output: %s", err, output)
 	}
@@ -35,9 +61,9 @@ func (config *SSHConfig) ExecuteCommand(command string) error {
 }
 
 // Rsync transfers files to the remote server using rsync.
-func (config *SSHConfig) Rsync(localPath string) error {
+func (config *SSHConfig) Rsync(ctx context.Context, localPath string) error {
 	remotePath := filepath.Join(config.RemotePath, localPath)
-	cmd := exec.Command("rsync", "-avz", "-e", fmt.Sprintf("ssh -i %s", config.PrivateKey), localPath, fmt.Sprintf("%s@%s:%s", config.User, config.RemoteHost, remotePath))
+	cmd := exec.CommandContext(ctx, "rsync", "-avz", "-e", config.RsyncShell(), localPath, fmt.Sprintf("%s:%s", config.Destination(), remotePath))
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("failed to rsync files: %s, output: %s", err, output)
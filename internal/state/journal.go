@@ -0,0 +1,127 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/chatdb"
+)
+
+const journalFile = "journal.json"
+
+// Stages a day goes through in the work directory of a run.
+const (
+	// DayEmpty means the day had no messages to archive.
+	DayEmpty = "empty"
+	// DayExported means the export and its manifest are complete.
+	DayExported = "exported"
+	// DayPreparing means the preparation of the day started. It moves and
+	// replaces files in place, so an interrupted preparation is redone from
+	// a fresh export.
+	DayPreparing = "preparing"
+	// DayPrepared means the day is in the form it is uploaded in: its
+	// attachments are in the store and it is packaged or encrypted as
+	// configured.
+	DayPrepared = "prepared"
+)
+
+// Journal records the progress of a run, so that a run that was killed or
+// failed can be resumed from its work directory instead of exporting
+// everything again. It is removed once a run completes.
+type Journal struct {
+	StartedAt time.Time `json:"started_at"`
+	// WorkDir holds the exported days of the run
+	WorkDir string `json:"work_dir"`
+	// Settings describes the configuration the days were exported and
+	// prepared with; the work of a run with other settings is not reused
+	Settings string `json:"settings"`
+	// RunID names the staging directories the run uploads into, so a
+	// resumed run continues the uploads it staged
+	RunID string `json:"run_id,omitempty"`
+	// Days maps each day (YYYY-MM-DD) the run handled to its progress
+	Days map[string]*JournalDay `json:"days"`
+}
+
+// JournalDay is the progress of one day.
+type JournalDay struct {
+	Stage string `json:"stage"`
+	// Fingerprint is the chat.db content the day was exported from
+	Fingerprint *chatdb.Fingerprint `json:"fingerprint,omitempty"`
+	// Uploaded lists the destinations the day was uploaded to; transports
+	// verify every file before publishing it
+	Uploaded []string `json:"uploaded,omitempty"`
+}
+
+// NewJournal starts the journal of a run working in workDir.
+func NewJournal(workDir, settings string) *Journal {
+	return &Journal{
+		StartedAt: time.Now().UTC(),
+		WorkDir:   workDir,
+		Settings:  settings,
+		Days:      make(map[string]*JournalDay),
+	}
+}
+
+// LoadJournal reads the journal of an unfinished run from dir. It returns
+// nil without an error if the last run completed.
+func LoadJournal(dir string) (*Journal, error) {
+	var j Journal
+	found, err := readJSON(filepath.Join(dir, journalFile), &j)
+	if err != nil || !found {
+		return nil, err
+	}
+	if j.Days == nil {
+		j.Days = make(map[string]*JournalDay)
+	}
+	return &j, nil
+}
+
+// SaveJournal atomically writes j to dir, creating dir if needed.
+func SaveJournal(dir string, j *Journal) error {
+	return writeJSON(filepath.Join(dir, journalFile), j)
+}
+
+// RemoveJournal removes the journal from dir once its run completed.
+func RemoveJournal(dir string) error {
+	err := os.Remove(filepath.Join(dir, journalFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove journal: %w", err)
+	}
+	return nil
+}
+
+// Day returns the progress of day, or nil if the run has not handled it.
+func (j *Journal) Day(day string) *JournalDay {
+	return j.Days[day]
+}
+
+// SetStage records that day reached stage, from content with fingerprint.
+func (j *Journal) SetStage(day, stage string, fingerprint *chatdb.Fingerprint) {
+	d := j.Days[day]
+	if d == nil {
+		d = &JournalDay{}
+		j.Days[day] = d
+	}
+	d.Stage = stage
+	if fingerprint != nil {
+		d.Fingerprint = fingerprint
+	}
+}
+
+// MarkUploaded records that days were uploaded to destination.
+func (j *Journal) MarkUploaded(destination string, days []string) {
+	for _, day := range days {
+		if d := j.Days[day]; d != nil && !slices.Contains(d.Uploaded, destination) {
+			d.Uploaded = append(d.Uploaded, destination)
+		}
+	}
+}
+
+// Forget drops day from the journal, e.g. because it is exported again.
+func (j *Journal) Forget(day string) {
+	delete(j.Days, day)
+}
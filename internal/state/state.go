@@ -0,0 +1,85 @@
+// Package state persists archiver bookkeeping between runs in a local state
+// directory.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const watermarkFile = "watermark.json"
+
+// Watermark records the newest chat.db message that has been archived. Any
+// message with a higher ROWID arrived after the last successful run.
+type Watermark struct {
+	MaxROWID  int64     `json:"max_rowid"`
+	MaxDate   time.Time `json:"max_date"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// LoadWatermark reads the watermark from dir. It returns nil without an
+// error if no watermark has been saved yet.
+func LoadWatermark(dir string) (*Watermark, error) {
+	var w Watermark
+	found, err := readJSON(filepath.Join(dir, watermarkFile), &w)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// SaveWatermark atomically writes w to dir, creating dir if needed.
+func SaveWatermark(dir string, w *Watermark) error {
+	return writeJSON(filepath.Join(dir, watermarkFile), w)
+}
+
+// readJSON decodes the file at path into v and reports whether it existed.
+func readJSON(path string, v interface{}) (bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// writeJSON writes v to path via a temporary file and rename so readers
+// never observe a partially written file.
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", filepath.Base(path), err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %w", err)
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to close %s: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/chatdb"
+)
+
+func TestLoadWatermark_Missing(t *testing.T) {
+	w, err := LoadWatermark(t.TempDir())
+	if err != nil {
+		t.Fatalf("Expected no error for missing watermark, got: %v", err)
+	}
+	if w != nil {
+		t.Errorf("Expected nil watermark, got: %+v", w)
+	}
+}
+
+func TestSaveWatermark_RoundTrip(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "nested", "state")
+	saved := &Watermark{
+		MaxROWID:  42,
+		MaxDate:   time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		UpdatedAt: time.Date(2024, 1, 2, 16, 0, 0, 0, time.UTC),
+	}
+
+	if err := SaveWatermark(dir, saved); err != nil {
+		t.Fatalf("SaveWatermark failed: %v", err)
+	}
+
+	loaded, err := LoadWatermark(dir)
+	if err != nil {
+		t.Fatalf("LoadWatermark failed: %v", err)
+	}
+	if loaded == nil {
+		t.Fatal("Expected watermark to be loaded, got nil")
+	}
+	if loaded.MaxROWID != saved.MaxROWID || !loaded.MaxDate.Equal(saved.MaxDate) {
+		t.Errorf("Expected %+v, got %+v", saved, loaded)
+	}
+
+	// No temporary files should be left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read state directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only %s in state directory, found %d entries", watermarkFile, len(entries))
+	}
+}
+
+func TestLoadWatermark_Corrupt(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, watermarkFile), []byte("{not json"), 0600); err != nil {
+		t.Fatalf("Failed to write corrupt watermark: %v", err)
+	}
+
+	if _, err := LoadWatermark(dir); err == nil {
+		t.Error("Expected error for corrupt watermark, got nil")
+	}
+}
+
+func TestJournal_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	if j, err := LoadJournal(dir); err != nil || j != nil {
+		t.Fatalf("Expected no journal before a run, got %+v, %v", j, err)
+	}
+
+	saved := NewJournal("/tmp/work", "exporter=native")
+	saved.SetStage("2024-01-01", DayExported, &chatdb.Fingerprint{MessageCount: 3})
+	saved.SetStage("2024-01-01", DayPrepared, nil)
+	saved.SetStage("2024-01-02", DayEmpty, nil)
+	saved.MarkUploaded("nas", []string{"2024-01-01"})
+	saved.MarkUploaded("nas", []string{"2024-01-01"})
+	if err := SaveJournal(dir, saved); err != nil {
+		t.Fatalf("SaveJournal failed: %v", err)
+	}
+
+	loaded, err := LoadJournal(dir)
+	if err != nil || loaded == nil {
+		t.Fatalf("LoadJournal failed: %+v, %v", loaded, err)
+	}
+	if loaded.WorkDir != saved.WorkDir || loaded.Settings != saved.Settings {
+		t.Errorf("Expected %+v, got %+v", saved, loaded)
+	}
+	day := loaded.Day("2024-01-01")
+	if day == nil || day.Stage != DayPrepared || day.Fingerprint == nil || day.Fingerprint.MessageCount != 3 {
+		t.Errorf("Expected the prepared day to keep its fingerprint, got %+v", day)
+	}
+	if day != nil && (len(day.Uploaded) != 1 || day.Uploaded[0] != "nas") {
+		t.Errorf("Expected the day to be uploaded to nas once, got %v", day.Uploaded)
+	}
+
+	loaded.Forget("2024-01-02")
+	if loaded.Day("2024-01-02") != nil {
+		t.Error("Expected the forgotten day to be dropped")
+	}
+
+	if err := RemoveJournal(dir); err != nil {
+		t.Fatalf("RemoveJournal failed: %v", err)
+	}
+	if j, err := LoadJournal(dir); err != nil || j != nil {
+		t.Errorf("Expected the journal to be removed, got %+v, %v", j, err)
+	}
+	if err := RemoveJournal(dir); err != nil {
+		t.Errorf("Expected removing a missing journal to succeed, got %v", err)
+	}
+}
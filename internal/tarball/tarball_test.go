@@ -0,0 +1,140 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// buildArchive returns a tar stream holding the given headers, with each
+// regular file's content set to its name.
+func buildArchive(t *testing.T, headers ...*tar.Header) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range headers {
+		var content []byte
+		if hdr.Typeflag == tar.TypeReg {
+			content = []byte(hdr.Name)
+			hdr.Size = int64(len(content))
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestWriteExtract_RoundTrip(t *testing.T) {
+	src := t.TempDir()
+	for name, content := range map[string]string{
+		"+15555550123.txt":      "hello",
+		"attachments/photo.jpg": "jpeg",
+	} {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Links are left out of the stream
+	if err := os.Symlink("/etc/passwd", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, src); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	dst := t.TempDir()
+	if err := Extract(&buf, dst); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+
+	for name, content := range map[string]string{
+		"+15555550123.txt":      "hello",
+		"attachments/photo.jpg": "jpeg",
+	} {
+		data, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+		if err != nil || string(data) != content {
+			t.Errorf("Expected %s to hold %q, got %q (%v)", name, content, data, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "link")); !os.IsNotExist(err) {
+		t.Errorf("Expected the symlink not to be archived, got %v", err)
+	}
+}
+
+func TestExtract_RejectsPathsOutsideDestination(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry string
+	}{
+		{name: "parent", entry: "../escape.txt"},
+		{name: "nested parent", entry: "attachments/../../escape.txt"},
+		{name: "absolute", entry: "/tmp/escape.txt"},
+		{name: "destination itself", entry: "."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dst := filepath.Join(parent, "day")
+			archive := buildArchive(t, &tar.Header{Name: tt.entry, Typeflag: tar.TypeReg})
+
+			if err := Extract(archive, dst); err == nil {
+				t.Fatalf("Expected %q to be rejected", tt.entry)
+			}
+			if _, err := os.Stat(filepath.Join(parent, "escape.txt")); !os.IsNotExist(err) {
+				t.Errorf("Expected nothing to be written outside the destination, got %v", err)
+			}
+		})
+	}
+}
+
+func TestExtract_SkipsLinks(t *testing.T) {
+	parent := t.TempDir()
+	outside := filepath.Join(parent, "outside.txt")
+	if err := os.WriteFile(outside, []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(parent, "day")
+
+	archive := buildArchive(t,
+		&tar.Header{Name: "symlink", Typeflag: tar.TypeSymlink, Linkname: "../outside.txt"},
+		&tar.Header{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: outside},
+		&tar.Header{Name: "chat.txt", Typeflag: tar.TypeReg},
+		// A file written through the skipped link would land outside
+		&tar.Header{Name: "symlink", Typeflag: tar.TypeReg},
+	)
+	if err := Extract(archive, dst); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dst, "hardlink")); !os.IsNotExist(err) {
+		t.Errorf("Expected the hard link not to be extracted, got %v", err)
+	}
+	if info, err := os.Lstat(filepath.Join(dst, "symlink")); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("Expected the symlink entry to be skipped, got %v (%v)", info, err)
+	}
+	data, err := os.ReadFile(outside)
+	if err != nil || string(data) != "outside" {
+		t.Errorf("Expected the file outside the destination to be untouched, got %q (%v)", data, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, "chat.txt")); err != nil || string(data) != "chat.txt" {
+		t.Errorf("Expected regular files to be extracted, got %q (%v)", data, err)
+	}
+}
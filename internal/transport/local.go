@@ -0,0 +1,435 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+	"github.com/iwvelando/imessage-archiver/internal/manifest"
+)
+
+// Local writes the archive to a directory on this machine, such as a mounted
+// NAS volume or an external drive.
+type Local struct {
+	root   string
+	runID  string
+	logger *logger.Logger
+}
+
+// NewLocal returns a transport rooted at root. The root must already exist,
+// so an unmounted volume is reported instead of silently filling the
+// mount point on the boot disk.
+func NewLocal(root string, log *logger.Logger) *Local {
+	return &Local{
+		root:   root,
+		runID:  NewRunID(),
+		logger: log,
+	}
+}
+
+func (l *Local) Name() string {
+	return "local"
+}
+
+// SetRunID stages the following uploads under runID.
+func (l *Local) SetRunID(runID string) {
+	l.runID = runID
+}
+
+func (l *Local) checkRoot() error {
+	info, err := os.Stat(l.root)
+	if err != nil {
+		return fmt.Errorf("archive directory %s is not available (is the volume mounted?): %w", l.root, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("archive directory %s is not a directory", l.root)
+	}
+	return nil
+}
+
+func (l *Local) ListDays(ctx context.Context) ([]string, error) {
+	if err := l.checkRoot(); err != nil {
+		return nil, err
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(l.root, "[0-9][0-9][0-9][0-9]", "[0-9][0-9]", "[0-9][0-9]"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list archived days: %w", err)
+	}
+
+	var days []string
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) == 0 {
+			continue
+		}
+		rel, err := filepath.Rel(l.root, dir)
+		if err != nil {
+			return nil, err
+		}
+		if day, ok := ParseDayPath(filepath.ToSlash(rel)); ok {
+			days = append(days, day)
+		}
+	}
+
+	manifests, err := filepath.Glob(filepath.Join(l.root, "[0-9][0-9][0-9][0-9]", "[0-9][0-9]", "*"+PackageManifestSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list packaged days: %w", err)
+	}
+	for _, p := range manifests {
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return nil, err
+		}
+		if day, ok := ParsePackageManifestPath(filepath.ToSlash(rel)); ok && !slices.Contains(days, day) {
+			days = append(days, day)
+		}
+	}
+
+	sort.Strings(days)
+	return days, nil
+}
+
+// Upload copies each day into this run's staging directory, checks every
+// copied file against the source, and then renames the day's entries into
+// place.
+func (l *Local) Upload(ctx context.Context, localRoot string, days []string) error {
+	if err := l.checkRoot(); err != nil {
+		return err
+	}
+
+	stagingRoot := filepath.Join(l.root, StagingDir)
+	staging := filepath.Join(stagingRoot, l.runID)
+	if err := l.collectStaging(stagingRoot); err != nil {
+		return err
+	}
+	defer func() {
+		os.RemoveAll(staging)
+		// Only succeeds once no run is staging anymore
+		os.Remove(stagingRoot)
+	}()
+
+	for _, day := range days {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := l.uploadDay(localRoot, staging, day); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", day, err)
+		}
+		l.logger.Debug(fmt.Sprintf("Copied %s to %s", day, l.root))
+	}
+	return nil
+}
+
+func (l *Local) uploadDay(localRoot, staging, day string) error {
+	entries, err := dayEntries(localRoot, day)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		e := filepath.FromSlash(entry)
+		if err := l.uploadEntry(localRoot, entry, filepath.Join(staging, e), filepath.Join(l.root, e)); err != nil {
+			return err
+		}
+	}
+
+	// Drop the day's previous layout, e.g. its directory once it is packaged
+	monthDir := filepath.Join(l.root, filepath.FromSlash(path.Dir(DayPath(day))))
+	names, err := readDirNames(monthDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range otherEntries(day, names, entries) {
+		if err := os.RemoveAll(filepath.Join(l.root, filepath.FromSlash(entry))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names, nil
+}
+
+// collectStaging removes the staging directories other runs left more than
+// StagingStaleAfter ago.
+func (l *Local) collectStaging(stagingRoot string) error {
+	entries, err := os.ReadDir(stagingRoot)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read staging directory: %w", err)
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.Name() == l.runID || !staleStaging(entry.Name(), now) {
+			continue
+		}
+		l.logger.Info(fmt.Sprintf("Removing stale staging directory %s", entry.Name()))
+		if err := os.RemoveAll(filepath.Join(stagingRoot, entry.Name())); err != nil {
+			return fmt.Errorf("failed to remove stale staging directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// uploadEntry copies a day directory or package file to stagedPath,
+// verifies the copy and swaps it in at dstPath.
+func (l *Local) uploadEntry(localRoot, entry, stagedPath, dstPath string) error {
+	files, err := scanLocalEntry(localRoot, entry)
+	if err != nil {
+		return err
+	}
+
+	srcPath := filepath.Join(localRoot, filepath.FromSlash(entry))
+	if err := os.MkdirAll(filepath.Dir(stagedPath), 0755); err != nil {
+		return err
+	}
+	if info, err := os.Stat(srcPath); err == nil && info.IsDir() {
+		if err := os.MkdirAll(stagedPath, 0755); err != nil {
+			return err
+		}
+		err = copyTree(srcPath, stagedPath)
+	} else {
+		err = copyFile(srcPath, stagedPath)
+	}
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		_, sum, err := manifest.HashFile(filepath.Join(stagedPath, filepath.FromSlash(f.rel)))
+		if err != nil {
+			return err
+		}
+		if sum != f.sha256 {
+			return fmt.Errorf("%w: %s", errChecksumMismatch, path.Join(entry, f.rel))
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return err
+	}
+
+	// Move any previous copy aside, swap in the new one, then drop the old
+	oldPath := stagedPath + ".old"
+	if err := os.Rename(dstPath, oldPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(stagedPath, dstPath); err != nil {
+		// Put the previous copy back rather than leaving the day missing
+		_ = os.Rename(oldPath, dstPath)
+		return err
+	}
+	return os.RemoveAll(oldPath)
+}
+
+// UploadBlobs copies each file the archive does not have yet through a
+// temporary file next to its target, and renames the copy into place once it
+// matches the source.
+func (l *Local) UploadBlobs(ctx context.Context, localRoot string, names []string) error {
+	if err := l.checkRoot(); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := l.uploadBlob(localRoot, name); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (l *Local) uploadBlob(localRoot, name string) error {
+	name, err := cleanPath(name)
+	if err != nil {
+		return err
+	}
+	files, err := scanLocalEntry(localRoot, name)
+	if err != nil {
+		return err
+	}
+
+	dst := filepath.Join(l.root, filepath.FromSlash(name))
+	if info, err := os.Stat(dst); err == nil && info.Size() == files[0].size {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	tmp := dst + ".tmp-" + l.runID
+	defer os.Remove(tmp)
+	if err := copyFile(filepath.Join(localRoot, filepath.FromSlash(name)), tmp); err != nil {
+		return err
+	}
+	if _, sum, err := manifest.HashFile(tmp); err != nil {
+		return err
+	} else if sum != files[0].sha256 {
+		return errChecksumMismatch
+	}
+	return os.Rename(tmp, dst)
+}
+
+func (l *Local) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	name, err := cleanPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(l.root, filepath.FromSlash(name)))
+}
+
+func (l *Local) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	name, err := cleanPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(l.root, filepath.FromSlash(name)))
+}
+
+// WriteFile writes to a temporary file and renames it into place.
+func (l *Local) WriteFile(ctx context.Context, name string, data []byte) error {
+	name, err := cleanPath(name)
+	if err != nil {
+		return err
+	}
+	if err := l.checkRoot(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(l.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// CreateFile writes data to a temporary file and links it into place, which
+// fails if name already exists.
+func (l *Local) CreateFile(ctx context.Context, name string, data []byte) error {
+	name, err := cleanPath(name)
+	if err != nil {
+		return err
+	}
+	if err := l.checkRoot(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(l.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("%s: %w", name, fs.ErrExist)
+		}
+		return err
+	}
+	return nil
+}
+
+func (l *Local) Delete(ctx context.Context, name string) error {
+	name, err := cleanPath(name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(l.root, filepath.FromSlash(name)))
+}
+
+// copyTree copies the regular files under src into dst, which must exist.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	// Flush to disk before the directory is renamed into place
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,155 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+)
+
+func writeLocalDay(t *testing.T, root, day string, files map[string]string) {
+	t.Helper()
+	for rel, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(DayPath(day)), filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", rel, err)
+		}
+	}
+}
+
+func TestLocal_Upload(t *testing.T) {
+	archiveRoot := t.TempDir()
+	localRoot := t.TempDir()
+	l := NewLocal(archiveRoot, logger.New("debug"))
+
+	// Existing copy of the day with a file the new export no longer has
+	writeLocalDay(t, archiveRoot, "2024-01-01", map[string]string{"stale.txt": "old", "messages.jsonl": "v1"})
+	writeLocalDay(t, archiveRoot, "2024-01-02", map[string]string{"messages.jsonl": "keep"})
+	writeLocalDay(t, localRoot, "2024-01-01", map[string]string{"messages.jsonl": "v2", "attachments/a.jpg": "jpg"})
+
+	if err := l.Upload(context.Background(), localRoot, []string{"2024-01-01"}); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	data, err := l.ReadFile(context.Background(), "2024/01/01/messages.jsonl")
+	if err != nil || string(data) != "v2" {
+		t.Errorf("Expected uploaded messages.jsonl with v2, got %q (%v)", data, err)
+	}
+	if _, err := l.ReadFile(context.Background(), "2024/01/01/attachments/a.jpg"); err != nil {
+		t.Errorf("Expected attachment to be uploaded: %v", err)
+	}
+	if _, err := l.ReadFile(context.Background(), "2024/01/01/stale.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected stale file to be replaced, got %v", err)
+	}
+	if data, _ := l.ReadFile(context.Background(), "2024/01/02/messages.jsonl"); string(data) != "keep" {
+		t.Errorf("Expected other days to be untouched, got %q", data)
+	}
+
+	// No staging directories are left behind
+	entries, err := os.ReadDir(filepath.Join(archiveRoot, "2024", "01"))
+	if err != nil {
+		t.Fatalf("Failed to read month directory: %v", err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			t.Errorf("Unexpected leftover staging entry %s", entry.Name())
+		}
+	}
+
+	days, err := l.ListDays(context.Background())
+	if err != nil {
+		t.Fatalf("ListDays failed: %v", err)
+	}
+	if strings.Join(days, ",") != "2024-01-01,2024-01-02" {
+		t.Errorf("Expected both days to be listed, got %v", days)
+	}
+}
+
+func TestLocal_Upload_RemovesStaleStaging(t *testing.T) {
+	archiveRoot := t.TempDir()
+	localRoot := t.TempDir()
+	l := NewLocal(archiveRoot, logger.New("debug"))
+
+	// A half-copied day from an interrupted run must not count as archived
+	stale := filepath.Join(archiveRoot, StagingDir, "20240101T000000Z-0000")
+	writeLocalDay(t, stale, "2024-01-03", map[string]string{"messages.jsonl": "partial"})
+	// Another run may still be uploading into this one
+	live := filepath.Join(archiveRoot, StagingDir, time.Now().UTC().Format(runIDTime)+"-0000")
+	writeLocalDay(t, live, "2024-01-04", map[string]string{"messages.jsonl": "other"})
+	if days, _ := l.ListDays(context.Background()); len(days) != 0 {
+		t.Errorf("Expected staged days not to be listed, got %v", days)
+	}
+
+	writeLocalDay(t, localRoot, "2024-01-01", map[string]string{"messages.jsonl": "v1"})
+	if err := l.Upload(context.Background(), localRoot, []string{"2024-01-01"}); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Expected stale staging directory to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(live, "2024", "01", "04", "messages.jsonl")); err != nil {
+		t.Errorf("Expected the other run's staging to be kept, got %v", err)
+	}
+	if days, _ := l.ListDays(context.Background()); strings.Join(days, ",") != "2024-01-01" {
+		t.Errorf("Expected only the uploaded day, got %v", days)
+	}
+}
+
+func TestLocal_ListDays_SkipsEmptyDays(t *testing.T) {
+	archiveRoot := t.TempDir()
+	l := NewLocal(archiveRoot, logger.New("debug"))
+
+	if err := os.MkdirAll(filepath.Join(archiveRoot, "2024", "01", "03"), 0755); err != nil {
+		t.Fatalf("Failed to create empty day: %v", err)
+	}
+
+	days, err := l.ListDays(context.Background())
+	if err != nil {
+		t.Fatalf("ListDays failed: %v", err)
+	}
+	if len(days) != 0 {
+		t.Errorf("Expected empty day directories to be ignored, got %v", days)
+	}
+}
+
+func TestLocal_MissingRoot(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "Volumes", "NAS")
+	l := NewLocal(missing, logger.New("debug"))
+
+	if _, err := l.ListDays(context.Background()); err == nil {
+		t.Error("Expected ListDays to fail when the archive directory is missing")
+	}
+	if err := l.WriteFile(context.Background(), "lock", []byte("x")); err == nil {
+		t.Error("Expected WriteFile to fail when the archive directory is missing")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Error("Expected the missing archive directory not to be created")
+	}
+}
+
+func TestLocal_WriteReadDelete(t *testing.T) {
+	l := NewLocal(t.TempDir(), logger.New("debug"))
+
+	if err := l.WriteFile(context.Background(), "meta/state.json", []byte("{}")); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if data, err := l.ReadFile(context.Background(), "meta/state.json"); err != nil || string(data) != "{}" {
+		t.Errorf("Expected to read back written file, got %q (%v)", data, err)
+	}
+	if err := l.Delete(context.Background(), "meta"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := l.ReadFile(context.Background(), "meta/state.json"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist after delete, got %v", err)
+	}
+}
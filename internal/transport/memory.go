@@ -0,0 +1,209 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Memory keeps the archive in memory. It is meant for tests that need a
+// destination without ssh or network access.
+type Memory struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// NewMemory returns an empty in-memory transport.
+func NewMemory() *Memory {
+	return &Memory{files: make(map[string][]byte)}
+}
+
+func (m *Memory) Name() string {
+	return "memory"
+}
+
+func (m *Memory) ListDays(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for name := range m.files {
+		if day, ok := ParsePackageManifestPath(name); ok {
+			seen[day] = true
+			continue
+		}
+		parts := strings.SplitN(name, "/", 4)
+		if len(parts) < 4 {
+			continue
+		}
+		if day, ok := ParseDayPath(strings.Join(parts[:3], "/")); ok {
+			seen[day] = true
+		}
+	}
+
+	days := make([]string, 0, len(seen))
+	for day := range seen {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+func (m *Memory) Upload(ctx context.Context, localRoot string, days []string) error {
+	for _, day := range days {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entries, err := dayEntries(localRoot, day)
+		if err != nil {
+			return err
+		}
+
+		files := make(map[string][]byte)
+		for _, entry := range entries {
+			local := filepath.Join(localRoot, filepath.FromSlash(entry))
+			err := filepath.WalkDir(local, func(p string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(local, p)
+				if err != nil {
+					return err
+				}
+				data, err := os.ReadFile(p)
+				if err != nil {
+					return err
+				}
+				files[path.Join(entry, filepath.ToSlash(rel))] = data
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("failed to upload %s: %w", day, err)
+			}
+		}
+
+		// Replace the day in either layout
+		m.mu.Lock()
+		dayPath := DayPath(day)
+		for name := range m.files {
+			if strings.HasPrefix(name, dayPath+"/") || strings.HasPrefix(name, path.Dir(dayPath)+"/"+day+".") {
+				delete(m.files, name)
+			}
+		}
+		for name, data := range files {
+			m.files[name] = data
+		}
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+func (m *Memory) UploadBlobs(ctx context.Context, localRoot string, names []string) error {
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		_, ok := m.files[name]
+		m.mu.Unlock()
+		if ok {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(localRoot, filepath.FromSlash(name)))
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %w", name, err)
+		}
+		if err := m.WriteFile(ctx, name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	name, err := cleanPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[name]
+	if !ok {
+		return nil, fmt.Errorf("file %s: %w", name, fs.ErrNotExist)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (m *Memory) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	data, err := m.ReadFile(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *Memory) WriteFile(ctx context.Context, name string, data []byte) error {
+	name, err := cleanPath(name)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *Memory) CreateFile(ctx context.Context, name string, data []byte) error {
+	name, err := cleanPath(name)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; ok {
+		return fmt.Errorf("%s: %w", name, fs.ErrExist)
+	}
+	m.files[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *Memory) Delete(ctx context.Context, name string) error {
+	name, err := cleanPath(name)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for existing := range m.files {
+		if existing == name || strings.HasPrefix(existing, name+"/") {
+			delete(m.files, existing)
+		}
+	}
+	return nil
+}
+
+// Files returns the paths of all stored files, sorted.
+func (m *Memory) Files() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.files))
+	for name := range m.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,57 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMemory_UploadReplacesDay(t *testing.T) {
+	m := NewMemory()
+	if err := m.WriteFile(context.Background(), "2024/01/01/stale.txt", []byte("old")); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := m.WriteFile(context.Background(), "2024/01/02/other.txt", []byte("keep")); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	localRoot := t.TempDir()
+	dayDir := filepath.Join(localRoot, "2024", "01", "01", "attachments")
+	if err := os.MkdirAll(dayDir, 0755); err != nil {
+		t.Fatalf("Failed to create day directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dayDir, "a.jpg"), []byte("jpg"), 0644); err != nil {
+		t.Fatalf("Failed to write attachment: %v", err)
+	}
+
+	if err := m.Upload(context.Background(), localRoot, []string{"2024-01-01"}); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	expected := []string{"2024/01/01/attachments/a.jpg", "2024/01/02/other.txt"}
+	if files := m.Files(); strings.Join(files, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected files %v, got %v", expected, files)
+	}
+
+	days, err := m.ListDays(context.Background())
+	if err != nil {
+		t.Fatalf("ListDays failed: %v", err)
+	}
+	if strings.Join(days, ",") != "2024-01-01,2024-01-02" {
+		t.Errorf("Expected both days to be listed, got %v", days)
+	}
+}
+
+func TestMemory_ReadFileNotExist(t *testing.T) {
+	m := NewMemory()
+	if _, err := m.ReadFile(context.Background(), "2024/01/01/manifest.json"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, got %v", err)
+	}
+	if err := m.Delete(context.Background(), "2024/01/01"); err != nil {
+		t.Errorf("Expected deleting a missing path to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,465 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os/exec"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+	"github.com/iwvelando/imessage-archiver/internal/ssh"
+)
+
+// exitNotExist is the exit status the remote ReadFile script uses for a
+// missing file, chosen to be distinct from ssh's own 255 and cat's 1.
+const exitNotExist = 44
+
+// runIDPattern is a shell pattern matching the run IDs that name staging
+// directories.
+const runIDPattern = "[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9]T[0-9][0-9][0-9][0-9][0-9][0-9]Z-*"
+
+// exitExist is the exit status the remote CreateFile script uses for a file
+// that already exists.
+const exitExist = 45
+
+// Rsync uploads with rsync over ssh and runs plain shell commands for
+// everything else.
+type Rsync struct {
+	ssh    *ssh.SSHConfig
+	runID  string
+	logger *logger.Logger
+}
+
+// NewRsync returns an rsync-over-ssh transport rooted at cfg.RemotePath.
+func NewRsync(cfg *ssh.SSHConfig, log *logger.Logger) *Rsync {
+	return &Rsync{
+		ssh:    cfg,
+		runID:  NewRunID(),
+		logger: log,
+	}
+}
+
+func (r *Rsync) Name() string {
+	return "rsync"
+}
+
+// SetRunID stages the following uploads under runID.
+func (r *Rsync) SetRunID(runID string) {
+	r.runID = runID
+}
+
+// ListDays retrieves the entire remote directory structure in a single SSH command
+func (r *Rsync) ListDays(ctx context.Context) ([]string, error) {
+	// Find all directories 3 levels deep (year/month/day) that are not empty,
+	// then the manifests of packaged days in the month directories
+	root := shellQuote(r.ssh.RemotePath)
+	cmd := r.ssh.CommandContext(ctx, fmt.Sprintf("find %s -type d -mindepth 3 -maxdepth 3 -path '*/[0-9][0-9][0-9][0-9]/[0-9][0-9]/[0-9][0-9]' 2>/dev/null | while read dir; do if [ -n \"$(ls -A \"$dir\" 2>/dev/null)\" ]; then echo \"$dir\"; fi; done; "+
+		"find %s -type f -mindepth 3 -maxdepth 3 -path '*/[0-9][0-9][0-9][0-9]/[0-9][0-9]/*%s' 2>/dev/null || true",
+		root, root, PackageManifestSuffix))
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		r.logger.Debug(fmt.Sprintf("Remote structure query output: %s", string(output)))
+		return nil, fmt.Errorf("failed to query remote archive structure: %w", err)
+	}
+
+	return parseDays(string(output)), nil
+}
+
+// parseDays extracts YYYY-MM-DD days from remote day directories like
+// /backups/imessages/2024/06/07 and package manifests like
+// /backups/imessages/2024/06/2024-06-07.manifest.json.
+func parseDays(output string) []string {
+	var days []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		// Keep only the trailing year/month/day; the prefix may differ from
+		// the configured path, e.g. when it starts with ~/
+		parts := strings.Split(line, "/")
+		if len(parts) < 3 {
+			continue
+		}
+		tail := strings.Join(parts[len(parts)-3:], "/")
+		if day, ok := ParseDayPath(tail); ok {
+			days = append(days, day)
+		} else if day, ok := ParsePackageManifestPath(tail); ok {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return slices.Compact(days)
+}
+
+// Upload rsyncs the given days into this run's staging directory, checks
+// every file with sha256sum on the server and then moves each day into
+// place. What an interrupted upload under the same run ID already staged
+// is kept, so rsync only sends what is missing from it.
+func (r *Rsync) Upload(ctx context.Context, localRoot string, days []string) error {
+	r.logger.Debug(fmt.Sprintf("Uploading %d days with rsync", len(days)))
+
+	if len(days) == 0 {
+		// Nothing to stage, but still clear out what other runs left behind
+		return r.run(ctx, "staging cleanup", r.stagingScript(true), nil)
+	}
+	if err := r.run(ctx, "staging setup", r.stagingScript(false), nil); err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, "rsync", r.uploadArgs(localRoot, days)...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		r.logger.Debug(fmt.Sprintf("Rsync output: %s", string(output)))
+		return fmt.Errorf("batch rsync failed: %w", err)
+	}
+
+	entries := make(map[string][]string, len(days))
+	for _, day := range days {
+		if entries[day], err = dayEntries(localRoot, day); err != nil {
+			return err
+		}
+	}
+	checksums, err := checksumList(localRoot, entries)
+	if err != nil {
+		return err
+	}
+	if err := r.run(ctx, "checksum verification", r.verifyScript(), checksums); err != nil {
+		return err
+	}
+	return r.run(ctx, "publish", r.publishScript(days, entries), nil)
+}
+
+// run executes script on the server with stdin as its input.
+func (r *Rsync) run(ctx context.Context, step, script string, stdin []byte) error {
+	cmd := r.ssh.CommandContext(ctx, script)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("remote %s failed: %w: %s", step, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (r *Rsync) stagingPath() string {
+	return path.Join(r.ssh.RemotePath, StagingDir, r.runID)
+}
+
+// stagingScript removes the staging directories that other runs left more
+// than StagingStaleAfter ago; run IDs sort by time, so that is every one
+// named before the cutoff. With removeRoot, the staging root goes too once
+// no run is staging anymore.
+func (r *Rsync) stagingScript(removeRoot bool) string {
+	stagingRoot := shellQuote(path.Join(r.ssh.RemotePath, StagingDir))
+	script := fmt.Sprintf(`mkdir -p %s && cd %s && for d in *; do [ -e "$d" ] && [ "$d" != %s ] || continue; `+
+		`case "$d" in %s) ;; *) continue ;; esac; expr "$d" \< %s >/dev/null || continue; rm -rf "$d"; done`,
+		stagingRoot, stagingRoot, shellQuote(r.runID), runIDPattern, stagingCutoff(time.Now()))
+	if removeRoot {
+		script += " && cd .. && { rmdir " + StagingDir + " 2>/dev/null || true; }"
+	}
+	return script
+}
+
+// verifyScript checks the staged files against a sha256sum list on stdin.
+func (r *Rsync) verifyScript() string {
+	return checkScript(r.stagingPath())
+}
+
+// checkScript checks the files below dir against a sha256sum list on stdin,
+// using shasum where sha256sum is not installed (macOS, BSD).
+func checkScript(dir string) string {
+	return fmt.Sprintf(`cd %s && if command -v sha256sum >/dev/null 2>&1; then sha256sum -c --quiet -; else shasum -a 256 -c --quiet -; fi`,
+		shellQuote(dir))
+}
+
+// publishScript moves the staged entries of each day into place, keeping the
+// previous copy until the new one is in, removes what is left of the day in
+// the other layout and then removes the staging directory.
+func (r *Rsync) publishScript(days []string, entries map[string][]string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "set -e; cd %s; s=%s\n", shellQuote(r.ssh.RemotePath), shellQuote(path.Join(StagingDir, r.runID)))
+	for _, day := range days {
+		d := DayPath(day)
+		month := path.Dir(d)
+		fmt.Fprintf(&b, "mkdir -p %s\n", month)
+		quoted := make([]string, len(entries[day]))
+		for i, e := range entries[day] {
+			quoted[i] = shellQuote(e)
+			fmt.Fprintf(&b, `rm -rf "$s/%[1]s.old"; if [ -e %[1]s ]; then mv %[1]s "$s/%[1]s.old"; fi; mv "$s/%[1]s" %[1]s || { mv "$s/%[1]s.old" %[1]s; exit 1; }`+"\n", e)
+		}
+		fmt.Fprintf(&b, `for f in %[1]s %[2]s/%[3]s.*; do [ -e "$f" ] || continue; case "$f" in %[4]s) ;; *) rm -rf "$f" ;; esac; done`+"\n",
+			d, month, day, strings.Join(quoted, "|"))
+	}
+	b.WriteString(`rm -rf "$s"; rmdir ` + StagingDir + " 2>/dev/null || true\n")
+	return b.String()
+}
+
+// checksumList returns the sha256sum check list of the given day entries,
+// with paths relative to the staging directory.
+func checksumList(localRoot string, entries map[string][]string) ([]byte, error) {
+	days := make([]string, 0, len(entries))
+	for day := range entries {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+
+	var b bytes.Buffer
+	for _, day := range days {
+		for _, entry := range entries[day] {
+			files, err := scanLocalEntry(localRoot, entry)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range files {
+				fmt.Fprintf(&b, "%s  %s\n", f.sha256, path.Join(entry, f.rel))
+			}
+		}
+	}
+	return b.Bytes(), nil
+}
+
+func (r *Rsync) uploadArgs(localRoot string, days []string) []string {
+	args := []string{
+		"-avz",
+		"--delete",
+		"--timeout=300",
+		"-e", r.ssh.RsyncShell(),
+	}
+
+	// Include each day's parents non-recursively so other days on the
+	// remote side are excluded and therefore protected from --delete
+	included := make(map[string]bool)
+	for _, day := range days {
+		dayPath := DayPath(day)
+		year, month := path.Dir(path.Dir(dayPath)), path.Dir(dayPath)
+		for _, dir := range []string{year, month} {
+			if !included[dir] {
+				included[dir] = true
+				args = append(args, fmt.Sprintf("--include=/%s/", dir))
+			}
+		}
+		args = append(args,
+			fmt.Sprintf("--include=/%s/***", dayPath),
+			fmt.Sprintf("--include=/%s/%s.*", path.Dir(dayPath), day))
+	}
+	args = append(args, "--exclude=*")
+
+	return append(args,
+		strings.TrimSuffix(localRoot, "/")+"/",
+		fmt.Sprintf("%s:%s/", r.ssh.Destination(), r.stagingPath()),
+	)
+}
+
+// UploadBlobs rsyncs the files the server does not have yet straight into
+// place; rsync writes each to a temporary file and renames it once it is
+// complete. Every listed file is then checked with sha256sum on the server.
+func (r *Rsync) UploadBlobs(ctx context.Context, localRoot string, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	var list, checksums bytes.Buffer
+	for _, name := range names {
+		name, err := cleanPath(name)
+		if err != nil {
+			return err
+		}
+		files, err := scanLocalEntry(localRoot, name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&list, "%s\n", name)
+		fmt.Fprintf(&checksums, "%s  %s\n", files[0].sha256, name)
+	}
+
+	cmd := exec.CommandContext(ctx, "rsync", r.blobArgs(localRoot)...)
+	cmd.Stdin = &list
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		r.logger.Debug(fmt.Sprintf("Rsync output: %s", string(output)))
+		return fmt.Errorf("blob rsync failed: %w", err)
+	}
+	return r.run(ctx, "blob verification", checkScript(r.ssh.RemotePath), checksums.Bytes())
+}
+
+// blobArgs uploads the files listed on stdin, skipping those the server
+// already has.
+func (r *Rsync) blobArgs(localRoot string) []string {
+	return []string{
+		"-avz",
+		"--ignore-existing",
+		"--files-from=-",
+		"--timeout=300",
+		"-e", r.ssh.RsyncShell(),
+		strings.TrimSuffix(localRoot, "/") + "/",
+		fmt.Sprintf("%s:%s/", r.ssh.Destination(), r.ssh.RemotePath),
+	}
+}
+
+func (r *Rsync) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	name, err := cleanPath(name)
+	if err != nil {
+		return nil, err
+	}
+	remotePath := shellQuote(path.Join(r.ssh.RemotePath, name))
+
+	cmd := r.ssh.CommandContext(ctx, fmt.Sprintf("if [ -f %s ]; then cat %s; else exit %d; fi", remotePath, remotePath, exitNotExist))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == exitNotExist {
+			return nil, fmt.Errorf("remote file %s: %w", name, fs.ErrNotExist)
+		}
+		return nil, fmt.Errorf("failed to read remote file %s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// Open streams the file with cat over ssh. A missing file is only reported
+// once reading starts.
+func (r *Rsync) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	name, err := cleanPath(name)
+	if err != nil {
+		return nil, err
+	}
+	remotePath := shellQuote(path.Join(r.ssh.RemotePath, name))
+
+	cmd := r.ssh.CommandContext(ctx, fmt.Sprintf("if [ -f %s ]; then exec cat %s; else exit %d; fi", remotePath, remotePath, exitNotExist))
+	rc := &remoteReader{cmd: cmd, name: name}
+	cmd.Stderr = &rc.stderr
+	if rc.stdout, err = cmd.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to read remote file %s: %w", name, err)
+	}
+	return rc, nil
+}
+
+// remoteReader reads the output of a remote cat and reports how the command
+// ended once the output is exhausted.
+type remoteReader struct {
+	cmd    *exec.Cmd
+	name   string
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	done   bool
+}
+
+func (rr *remoteReader) Read(p []byte) (int, error) {
+	n, err := rr.stdout.Read(p)
+	if err == io.EOF && !rr.done {
+		rr.done = true
+		if werr := rr.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (rr *remoteReader) wait() error {
+	err := rr.cmd.Wait()
+	if err == nil {
+		return nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == exitNotExist {
+		return fmt.Errorf("remote file %s: %w", rr.name, fs.ErrNotExist)
+	}
+	return fmt.Errorf("failed to read remote file %s: %w: %s", rr.name, err, strings.TrimSpace(rr.stderr.String()))
+}
+
+// Close stops the command if the file was not read to the end.
+func (rr *remoteReader) Close() error {
+	if rr.done {
+		return nil
+	}
+	rr.done = true
+	_ = rr.cmd.Process.Kill()
+	_ = rr.cmd.Wait()
+	return nil
+}
+
+// WriteFile streams data to a temporary file and renames it into place so a
+// partially written file is never observed.
+func (r *Rsync) WriteFile(ctx context.Context, name string, data []byte) error {
+	name, err := cleanPath(name)
+	if err != nil {
+		return err
+	}
+	remotePath := path.Join(r.ssh.RemotePath, name)
+	tmpPath := remotePath + ".tmp"
+
+	cmd := r.ssh.CommandContext(ctx, fmt.Sprintf("mkdir -p %s && cat > %s && mv -f %s %s",
+		shellQuote(path.Dir(remotePath)), shellQuote(tmpPath), shellQuote(tmpPath), shellQuote(remotePath)))
+	cmd.Stdin = bytes.NewReader(data)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to write remote file %s: %w: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// CreateFile streams data to a temporary file and hard-links it into place,
+// which fails if the file already exists.
+func (r *Rsync) CreateFile(ctx context.Context, name string, data []byte) error {
+	name, err := cleanPath(name)
+	if err != nil {
+		return err
+	}
+
+	cmd := r.ssh.CommandContext(ctx, r.createScript(name))
+	cmd.Stdin = bytes.NewReader(data)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == exitExist {
+			return fmt.Errorf("remote file %s: %w", name, fs.ErrExist)
+		}
+		return fmt.Errorf("failed to create remote file %s: %w: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// createScript writes stdin to name unless it exists. The temporary file is
+// named after the shell's PID, so two machines creating name at once do not
+// write to the same one.
+func (r *Rsync) createScript(name string) string {
+	remotePath := shellQuote(path.Join(r.ssh.RemotePath, name))
+	return fmt.Sprintf(`mkdir -p %s && t=%s.tmp.$$ && cat > "$t" && { ln "$t" %s 2>/dev/null; rc=$?; rm -f "$t"; `+
+		`[ $rc -eq 0 ] || { [ -e %s ] && exit %d; exit $rc; }; }`,
+		shellQuote(path.Dir(path.Join(r.ssh.RemotePath, name))), remotePath, remotePath, remotePath, exitExist)
+}
+
+func (r *Rsync) Delete(ctx context.Context, name string) error {
+	name, err := cleanPath(name)
+	if err != nil {
+		return err
+	}
+
+	if err := r.ssh.ExecuteCommand(ctx, "rm -rf "+shellQuote(path.Join(r.ssh.RemotePath, name))); err != nil {
+		return fmt.Errorf("failed to delete remote path %s: %w", name, err)
+	}
+	return nil
+}
+
+// shellQuote quotes s for a POSIX shell on the remote side. A leading ~/ is
+// left unquoted so paths relative to the remote home keep working.
+func shellQuote(s string) string {
+	if rest, ok := strings.CutPrefix(s, "~/"); ok {
+		return "~/" + shellQuote(rest)
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
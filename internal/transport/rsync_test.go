@@ -0,0 +1,283 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+	"github.com/iwvelando/imessage-archiver/internal/ssh"
+)
+
+func TestRsync_uploadArgs(t *testing.T) {
+	r := NewRsync(ssh.NewSSHConfig("user", "/key", "host", "/backups/imessages"), logger.New("debug"))
+	r.runID = "run"
+
+	args := r.uploadArgs("/tmp/export/", []string{"2024-01-01", "2024-01-02", "2024-02-01"})
+
+	expectedFilters := []string{
+		"--include=/2024/",
+		"--include=/2024/01/",
+		"--include=/2024/01/01/***",
+		"--include=/2024/01/2024-01-01.*",
+		"--include=/2024/01/02/***",
+		"--include=/2024/01/2024-01-02.*",
+		"--include=/2024/02/",
+		"--include=/2024/02/01/***",
+		"--include=/2024/02/2024-02-01.*",
+		"--exclude=*",
+	}
+	var filters []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--include=") || strings.HasPrefix(arg, "--exclude=") {
+			filters = append(filters, arg)
+		}
+	}
+	if strings.Join(filters, " ") != strings.Join(expectedFilters, " ") {
+		t.Errorf("Expected filters %v, got %v", expectedFilters, filters)
+	}
+
+	if !contains(args, "--delete") {
+		t.Error("Expected uploads to replace remote days with --delete")
+	}
+
+	n := len(args)
+	if args[n-2] != "/tmp/export/" || args[n-1] != "user@host:/backups/imessages/.incoming/run/" {
+		t.Errorf("Unexpected source and destination: %v", args[n-2:])
+	}
+}
+
+// TestRsync_StagingScripts runs the remote staging, verification and publish
+// scripts with a local shell against a temporary archive.
+func TestRsync_blobArgs(t *testing.T) {
+	r := NewRsync(ssh.NewSSHConfig("user", "/key", "host", "/backups/imessages"), logger.New("debug"))
+
+	args := r.blobArgs("/tmp/export")
+
+	for _, want := range []string{"--ignore-existing", "--files-from=-"} {
+		if !contains(args, want) {
+			t.Errorf("Expected %s in %v", want, args)
+		}
+	}
+	if contains(args, "--delete") {
+		t.Error("Expected blob uploads never to delete remote files")
+	}
+	n := len(args)
+	if args[n-2] != "/tmp/export/" || args[n-1] != "user@host:/backups/imessages/" {
+		t.Errorf("Unexpected source and destination: %v", args[n-2:])
+	}
+}
+
+func TestRsync_StagingScripts(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no POSIX shell available")
+	}
+	root := t.TempDir()
+	local := t.TempDir()
+	r := NewRsync(ssh.NewSSHConfig("user", "/key", "host", root), logger.New("debug"))
+	r.runID = "current"
+
+	sh := func(script string, stdin []byte) error {
+		cmd := exec.Command("sh", "-c", script)
+		if stdin != nil {
+			cmd.Stdin = bytes.NewReader(stdin)
+		}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+		return nil
+	}
+	write := func(dir, name, content string) {
+		t.Helper()
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(filepath.Join(root, "2024", "01", "01"), "old.txt", "old")
+	// Staging of a run long gone, of one that may still be uploading, and
+	// something that is not a run's
+	stale := "20240101T000000Z-00000000"
+	live := time.Now().UTC().Add(-time.Hour).Format(runIDTime) + "-00000000"
+	write(filepath.Join(root, StagingDir, stale, "2024", "01", "01"), "chat.txt", "partial")
+	write(filepath.Join(root, StagingDir, live, "2024", "01", "01"), "chat.txt", "other")
+	write(filepath.Join(root, StagingDir, "junk"), "junk", "junk")
+	write(filepath.Join(local, "2024", "01", "01"), "chat.txt", "new")
+
+	// A day that was a directory on the remote side and is now packaged
+	write(filepath.Join(root, "2024", "01", "02"), "chat.txt", "unpackaged")
+	write(filepath.Join(local, "2024", "01"), "2024-01-02.tar.zst", "packaged")
+	write(filepath.Join(local, "2024", "01"), "2024-01-02.manifest.json", "{}")
+
+	// Only the stale run's staging is removed, and none is taken over
+	if err := sh(r.stagingScript(false), nil); err != nil {
+		t.Fatalf("staging setup failed: %v", err)
+	}
+	var names []string
+	entries, _ := os.ReadDir(filepath.Join(root, StagingDir))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if strings.Join(names, ",") != live+",junk" {
+		t.Fatalf("Expected the staging of %s and junk to be kept, got %v", live, names)
+	}
+	write(filepath.Join(root, StagingDir, "current", "2024", "01", "01"), "chat.txt", "partial")
+
+	days := []string{"2024-01-01", "2024-01-02"}
+	dayFiles := make(map[string][]string)
+	for _, day := range days {
+		e, err := dayEntries(local, day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dayFiles[day] = e
+	}
+	checksums, err := checksumList(local, dayFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sh(r.verifyScript(), checksums); err == nil {
+		t.Fatal("Expected verification to fail for a partial staged file")
+	}
+
+	// Stand in for rsync
+	write(filepath.Join(root, StagingDir, "current", "2024", "01", "01"), "chat.txt", "new")
+	write(filepath.Join(root, StagingDir, "current", "2024", "01"), "2024-01-02.tar.zst", "packaged")
+	write(filepath.Join(root, StagingDir, "current", "2024", "01"), "2024-01-02.manifest.json", "{}")
+	if err := sh(r.verifyScript(), checksums); err != nil {
+		t.Fatalf("verification failed: %v", err)
+	}
+	if err := sh(r.publishScript(days, dayFiles), nil); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(root, "2024", "01", "01", "chat.txt")); err != nil || string(data) != "new" {
+		t.Errorf("Expected published chat.txt, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "2024", "01", "01", "old.txt")); !os.IsNotExist(err) {
+		t.Error("Expected the previous copy of the day to be replaced")
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "2024", "01", "2024-01-02.tar.zst")); err != nil || string(data) != "packaged" {
+		t.Errorf("Expected the published package, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "2024", "01", "02")); !os.IsNotExist(err) {
+		t.Error("Expected the unpackaged copy of the day to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(root, StagingDir, "current")); !os.IsNotExist(err) {
+		t.Error("Expected the staging directory to be removed after publishing")
+	}
+	if data, err := os.ReadFile(filepath.Join(root, StagingDir, live, "2024", "01", "01", "chat.txt")); err != nil || string(data) != "other" {
+		t.Errorf("Expected the other run's staging to be left alone, got %q, %v", data, err)
+	}
+}
+
+func TestRsync_CreateScript(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no POSIX shell available")
+	}
+	root := t.TempDir()
+	r := NewRsync(ssh.NewSSHConfig("user", "/key", "host", root), logger.New("debug"))
+
+	create := func(content string) error {
+		cmd := exec.Command("sh", "-c", r.createScript(".lock/owner.json"))
+		cmd.Stdin = strings.NewReader(content)
+		return cmd.Run()
+	}
+	if err := create("first"); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	var exitErr *exec.ExitError
+	if err := create("second"); !errors.As(err, &exitErr) || exitErr.ExitCode() != exitExist {
+		t.Errorf("Expected exit status %d for an existing file, got %v", exitExist, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, ".lock", "owner.json")); err != nil || string(data) != "first" {
+		t.Errorf("Expected the first content to be kept, got %q, %v", data, err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(root, ".lock"))
+	if len(entries) != 1 {
+		t.Errorf("Expected no temporary files to be left, got %v", entries)
+	}
+}
+
+func TestParseDays(t *testing.T) {
+	output := "/backups/imessages/2024/06/07\n" +
+		"/home/user/backups/2023/12/31\n" +
+		"/backups/imessages/2024/13/01\n" +
+		"/backups/imessages/2024/02/2024-02-03.manifest.json\n" +
+		"/backups/imessages/2024/06/2024-06-07.manifest.json\n" +
+		"/backups/imessages/2024/02/2024-03-01.manifest.json\n" +
+		"\n" +
+		"garbage\n"
+
+	days := parseDays(output)
+
+	expected := []string{"2023-12-31", "2024-02-03", "2024-06-07"}
+	if strings.Join(days, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, days)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"/backups/imessages", "'/backups/imessages'"},
+		{"/backups/it's here", `'/backups/it'\''s here'`},
+		{"~/backups", "~/'backups'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if got := shellQuote(tt.input); got != tt.expected {
+				t.Errorf("shellQuote(%q) = %s, expected %s", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"2024/01/01/manifest.json", "2024/01/01/manifest.json", false},
+		{"2024/01/../01", "2024/01", false},
+		{"", "", true},
+		{".", "", true},
+		{"/etc/passwd", "", true},
+		{"../outside", "", true},
+		{"2024/../..", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := cleanPath(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("cleanPath(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("cleanPath(%q) = %q, expected %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func contains(slice []string, item string) bool {
+	for _, s := range slice {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
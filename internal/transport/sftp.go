@@ -0,0 +1,947 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+	"github.com/iwvelando/imessage-archiver/internal/ssh"
+)
+
+const (
+	sftpDialTimeout = 30 * time.Second
+	sftpMaxAttempts = 3
+	sftpListWorkers = 8
+	sftpPartSuffix  = ".part"
+	sftpCopyBuffer  = 1 << 20 // Large reads are split into concurrent requests
+)
+
+// Status codes from later SFTP drafts that some servers send regardless of
+// the negotiated version. pkg/sftp has no names for them.
+const (
+	sftpNoSpaceOnFilesystem = 14
+	sftpQuotaExceeded       = 15
+)
+
+// SFTP talks to the server with pkg/sftp over an in-process ssh connection,
+// so neither ssh, rsync nor a shell is needed on either side. Uploads are
+// resumable: an interrupted file is continued from where it stopped by the
+// retry after a dropped connection, or by a run resumed from the journal of
+// the interrupted one, which stages under the same run ID (see Resumable).
+type SFTP struct {
+	ssh            *ssh.SSHConfig
+	knownHostsPath string
+	root           string
+	runID          string
+	logger         *logger.Logger
+	retryDelay     time.Duration
+
+	mu     sync.Mutex
+	conn   *gossh.Client
+	client *sftp.Client
+}
+
+// NewSFTP returns a transport for the server in cfg. The server's host key
+// must be listed in knownHostsPath. It connects on first use.
+func NewSFTP(cfg *ssh.SSHConfig, knownHostsPath string, log *logger.Logger) *SFTP {
+	// SFTP paths are relative to the login directory, which is what "~/"
+	// means in the config
+	root := cfg.RemotePath
+	if root == "~" {
+		root = "."
+	}
+	root = strings.TrimPrefix(root, "~/")
+
+	return &SFTP{
+		ssh:            cfg,
+		knownHostsPath: knownHostsPath,
+		root:           root,
+		runID:          NewRunID(),
+		logger:         log,
+		retryDelay:     5 * time.Second,
+	}
+}
+
+func (s *SFTP) Name() string {
+	return "sftp"
+}
+
+// SetRunID stages the following uploads under runID.
+func (s *SFTP) SetRunID(runID string) {
+	s.runID = runID
+}
+
+// Close drops the connection. The next call reconnects.
+func (s *SFTP) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.client != nil {
+		s.client.Close()
+		s.client = nil
+	}
+	if s.conn != nil {
+		err = s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *SFTP) connect(ctx context.Context) (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	keyData, err := os.ReadFile(s.ssh.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ssh private key: %w", err)
+	}
+	signer, err := gossh.ParsePrivateKey(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ssh private key %s: %w", s.ssh.PrivateKey, err)
+	}
+	hostKeyCallback, err := knownhosts.New(s.knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known_hosts: %w", err)
+	}
+
+	addr := s.ssh.RemoteHost
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	clientConfig := &gossh.ClientConfig{
+		User:              s.ssh.User,
+		Auth:              []gossh.AuthMethod{gossh.PublicKeys(signer)},
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: knownHostKeyAlgorithms(hostKeyCallback, addr),
+		Timeout:           sftpDialTimeout,
+	}
+
+	dialer := net.Dialer{Timeout: sftpDialTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	// Bound the handshake as well as the dial
+	netConn.SetDeadline(time.Now().Add(sftpDialTimeout))
+	sshConn, chans, reqs, err := gossh.NewClientConn(netConn, addr, clientConfig)
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("ssh connection to %s failed: %w", s.ssh.Destination(), err)
+	}
+	netConn.SetDeadline(time.Time{})
+	conn := gossh.NewClient(sshConn, chans, reqs)
+
+	client, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start sftp session: %w", err)
+	}
+
+	s.logger.Debug(fmt.Sprintf("Connected to %s over sftp", s.ssh.Destination()))
+	s.conn = conn
+	s.client = client
+	return client, nil
+}
+
+// knownHostKeyAlgorithms returns the host key algorithms recorded for addr,
+// so the server presents the key known_hosts can verify rather than its
+// preferred one. It returns nil when the host is unknown.
+func knownHostKeyAlgorithms(callback gossh.HostKeyCallback, addr string) []string {
+	probe, err := gossh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(callback(addr, &net.TCPAddr{}, probe), &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+	seen := make(map[string]bool)
+	add := func(algorithm string) {
+		if !seen[algorithm] {
+			seen[algorithm] = true
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	for _, known := range keyErr.Want {
+		if known.Key.Type() == gossh.KeyAlgoRSA {
+			// An RSA key can be used with any of its signature algorithms
+			add(gossh.KeyAlgoRSASHA512)
+			add(gossh.KeyAlgoRSASHA256)
+		}
+		add(known.Key.Type())
+	}
+	return algorithms
+}
+
+// withRetry runs fn with a connected client, reconnecting and trying again
+// when the connection fails. Other errors are returned right away.
+// Cancelling ctx drops the connection, which makes a call in progress fail,
+// and returns the context's error.
+func (s *SFTP) withRetry(ctx context.Context, op string, fn func(c *sftp.Client) error) error {
+	stop := context.AfterFunc(ctx, func() { s.Close() })
+	defer stop()
+
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c, err := s.connect(ctx)
+		if err == nil {
+			err = fn(c)
+		}
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = classifySFTPError(err)
+		if err == nil || !errors.Is(err, ErrNetwork) || attempt == sftpMaxAttempts {
+			return err
+		}
+
+		s.logger.Warn(fmt.Sprintf("SFTP %s failed (attempt %d of %d), reconnecting: %v", op, attempt, sftpMaxAttempts, err))
+		s.Close()
+		select {
+		case <-time.After(s.retryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// classifySFTPError wraps err with the transport error class it belongs to.
+func classifySFTPError(err error) error {
+	if err == nil || errors.Is(err, ErrAuth) || errors.Is(err, ErrHostKey) || errors.Is(err, ErrNetwork) || errors.Is(err, ErrDiskFull) {
+		return err
+	}
+
+	var keyErr *knownhosts.KeyError
+	var revokedErr *knownhosts.RevokedError
+	if errors.As(err, &keyErr) || errors.As(err, &revokedErr) {
+		return fmt.Errorf("%w: %w", ErrHostKey, err)
+	}
+	if strings.Contains(err.Error(), "unable to authenticate") {
+		return fmt.Errorf("%w: %w", ErrAuth, err)
+	}
+
+	var statusErr *sftp.StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.Code {
+		case sftpNoSpaceOnFilesystem, sftpQuotaExceeded:
+			return fmt.Errorf("%w: %w", ErrDiskFull, err)
+		case uint32(sftp.ErrSSHFxNoConnection), uint32(sftp.ErrSSHFxConnectionLost):
+			return fmt.Errorf("%w: %w", ErrNetwork, err)
+		}
+		return err
+	}
+
+	var netErr net.Error
+	if errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, sftp.ErrSSHFxNoConnection) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) {
+		return fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+	return err
+}
+
+func (s *SFTP) remotePath(name string) string {
+	return path.Join(s.root, name)
+}
+
+func (s *SFTP) ListDays(ctx context.Context) ([]string, error) {
+	var days []string
+	err := s.withRetry(ctx, "list", func(c *sftp.Client) error {
+		days = nil
+
+		years, err := s.list(c, []string{""}, digitDir(4))
+		if errors.Is(err, fs.ErrNotExist) {
+			// Nothing has been archived yet
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		months, err := s.list(c, years, digitDir(2))
+		if err != nil {
+			return err
+		}
+		// Day directories and the manifests of packaged days
+		children, err := s.list(c, months, func(e fs.FileInfo) bool {
+			return digitDir(2)(e) || (!e.IsDir() && strings.HasSuffix(e.Name(), PackageManifestSuffix))
+		})
+		if err != nil {
+			return err
+		}
+
+		var dayDirs []string
+		for _, child := range children {
+			if _, ok := ParseDayPath(child); ok {
+				dayDirs = append(dayDirs, child)
+			} else if day, ok := ParsePackageManifestPath(child); ok {
+				days = append(days, day)
+			}
+		}
+
+		// Like the other transports, only count day directories with files,
+		// not empty ones left behind
+		contents, err := s.list(c, dayDirs, func(fs.FileInfo) bool { return true })
+		if err != nil {
+			return err
+		}
+		for _, entry := range contents {
+			if day, ok := ParseDayPath(path.Dir(entry)); ok {
+				days = append(days, day)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list archived days: %w", err)
+	}
+	sort.Strings(days)
+	return slices.Compact(days), nil
+}
+
+// digitDir matches subdirectories whose names are n digits.
+func digitDir(n int) func(fs.FileInfo) bool {
+	return func(e fs.FileInfo) bool {
+		return e.IsDir() && isDigits(e.Name(), n)
+	}
+}
+
+// list reads the given directories in parallel and returns the paths of
+// their entries that match.
+func (s *SFTP) list(c *sftp.Client, dirs []string, match func(fs.FileInfo) bool) ([]string, error) {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		children []string
+		firstErr error
+	)
+	work := make(chan string)
+
+	for i := 0; i < sftpListWorkers && i < len(dirs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dir := range work {
+				entries, err := c.ReadDir(s.remotePath(dir))
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				for _, entry := range entries {
+					if match(entry) {
+						children = append(children, path.Join(dir, entry.Name()))
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, dir := range dirs {
+		work <- dir
+	}
+	close(work)
+	wg.Wait()
+
+	return children, firstErr
+}
+
+func isDigits(name string, n int) bool {
+	if len(name) != n {
+		return false
+	}
+	for _, r := range name {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Upload writes each day into this run's staging directory and renames it
+// into place once every file has been written and checksummed. Files
+// already staged under the run ID are kept and partial ones continued.
+func (s *SFTP) Upload(ctx context.Context, localRoot string, days []string) error {
+	stagingRoot := s.remotePath(StagingDir)
+	staging := path.Join(stagingRoot, s.runID)
+
+	err := s.withRetry(ctx, "staging cleanup", func(c *sftp.Client) error {
+		entries, err := c.ReadDir(stagingRoot)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, entry := range entries {
+			if entry.Name() == s.runID || !staleStaging(entry.Name(), now) {
+				continue
+			}
+			s.logger.Info(fmt.Sprintf("Removing stale staging directory %s", entry.Name()))
+			if err := removeAll(c, path.Join(stagingRoot, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove stale staging directories: %w", err)
+	}
+
+	for _, day := range days {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := s.withRetry(ctx, "upload of "+day, func(c *sftp.Client) error {
+			return s.uploadDay(c, localRoot, staging, day)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %w", day, err)
+		}
+		s.logger.Debug(fmt.Sprintf("Uploaded %s to %s", day, s.ssh.Destination()))
+	}
+
+	return s.withRetry(ctx, "staging cleanup", func(c *sftp.Client) error {
+		if err := removeAll(c, staging); err != nil {
+			return err
+		}
+		// Only succeeds once no run is staging anymore
+		_ = c.RemoveDirectory(stagingRoot)
+		return nil
+	})
+}
+
+func (s *SFTP) uploadDay(c *sftp.Client, localRoot, staging, day string) error {
+	entries, err := dayEntries(localRoot, day)
+	if err != nil {
+		return err
+	}
+	files := make([][]localFile, len(entries))
+	var total int64
+	for i, entry := range entries {
+		if files[i], err = scanLocalEntry(localRoot, entry); err != nil {
+			return err
+		}
+		for _, f := range files[i] {
+			total += f.size
+		}
+	}
+	if err := s.checkSpace(c, total); err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		if err := s.stageEntry(c, localRoot, staging, entry, files[i]); err != nil {
+			return err
+		}
+	}
+	for _, entry := range entries {
+		if err := s.publishEntry(c, staging, entry); err != nil {
+			return err
+		}
+	}
+
+	// Drop the day's previous layout, e.g. its directory once it is packaged
+	monthEntries, err := c.ReadDir(s.remotePath(path.Dir(DayPath(day))))
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(monthEntries))
+	for i, e := range monthEntries {
+		names[i] = e.Name()
+	}
+	for _, other := range otherEntries(day, names, entries) {
+		if err := removeAll(c, s.remotePath(other)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stageEntry uploads a day directory or package file below staging.
+func (s *SFTP) stageEntry(c *sftp.Client, localRoot, staging, entry string, files []localFile) error {
+	local := filepath.Join(localRoot, filepath.FromSlash(entry))
+	staged := path.Join(staging, entry)
+
+	if err := mkdirAll(c, path.Dir(staged)); err != nil {
+		return err
+	}
+	if info, err := os.Stat(local); err == nil && !info.IsDir() {
+		if err := s.uploadFile(c, local, staged, files[0]); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", path.Base(entry), err)
+		}
+		return nil
+	}
+
+	if err := mkdirAll(c, staged); err != nil {
+		return err
+	}
+
+	keep := make(map[string]bool)
+	for _, f := range files {
+		remote := path.Join(staged, f.rel)
+		if err := mkdirAll(c, path.Dir(remote)); err != nil {
+			return err
+		}
+		if err := s.uploadFile(c, filepath.Join(local, filepath.FromSlash(f.rel)), remote, f); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", f.rel, err)
+		}
+		keep[f.rel] = true
+	}
+
+	// Drop leftovers of an earlier attempt with different content
+	leftovers, err := walkFiles(c, staged)
+	if err != nil {
+		return err
+	}
+	for _, rel := range leftovers {
+		if !keep[rel] {
+			if err := c.Remove(path.Join(staged, rel)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// publishEntry renames a staged entry into place.
+func (s *SFTP) publishEntry(c *sftp.Client, staging, entry string) error {
+	final := s.remotePath(entry)
+	staged := path.Join(staging, entry)
+	old := staged + ".old"
+
+	// Move any previous copy aside, swap in the new one, then drop the old
+	if err := removeAll(c, old); err != nil {
+		return err
+	}
+	if err := rename(c, final, old); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := mkdirAll(c, path.Dir(final)); err != nil {
+		return err
+	}
+	if err := rename(c, staged, final); err != nil {
+		// Put the previous copy back rather than leaving the day missing
+		_ = rename(c, old, final)
+		return err
+	}
+	return removeAll(c, old)
+}
+
+// checkSpace fails early when the server reports less free space than the
+// upload needs. Servers without the statvfs extension are not checked.
+func (s *SFTP) checkSpace(c *sftp.Client, need int64) error {
+	available, ok, err := availableBytes(c, s.root)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		s.logger.Debug(fmt.Sprintf("Could not check free space on %s: %v", s.ssh.Destination(), err))
+		return nil
+	}
+	if ok && available < uint64(need) {
+		return fmt.Errorf("%w: %d bytes needed, %d available", ErrDiskFull, need, available)
+	}
+	return nil
+}
+
+// availableBytes reports the free space available to the user at p, and
+// false if the server does not support the statvfs extension.
+func availableBytes(c *sftp.Client, p string) (uint64, bool, error) {
+	if _, ok := c.HasExtension("statvfs@openssh.com"); !ok {
+		return 0, false, nil
+	}
+	vfs, err := c.StatVFS(p)
+	if err != nil {
+		return 0, false, err
+	}
+	return vfs.Frsize * vfs.Bavail, true, nil
+}
+
+// rename moves oldPath to newPath, replacing an existing file when the
+// server supports posix-rename. Plain SFTP v3 rename fails if newPath exists.
+func rename(c *sftp.Client, oldPath, newPath string) error {
+	if _, ok := c.HasExtension("posix-rename@openssh.com"); ok {
+		return c.PosixRename(oldPath, newPath)
+	}
+	return c.Rename(oldPath, newPath)
+}
+
+// uploadFile writes local to remote through remote+".part", continuing a
+// partial upload whose content matches the start of the local file. The
+// written file must match the local size and checksum before it is renamed
+// into place.
+func (s *SFTP) uploadFile(c *sftp.Client, local, remote string, f localFile) error {
+	// Already completed by an interrupted earlier attempt
+	if info, err := c.Stat(remote); err == nil && info.Size() == f.size {
+		sum, err := remoteSHA256(c, remote, f.size)
+		if err != nil || sum == f.sha256 {
+			return err
+		}
+	}
+
+	in, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	part := remote + sftpPartSuffix
+	var offset int64
+	if info, err := c.Stat(part); err == nil && info.Size() > 0 && info.Size() <= f.size {
+		same, err := prefixMatches(c, part, in, info.Size())
+		if err != nil {
+			return err
+		}
+		if same {
+			offset = info.Size()
+			s.logger.Debug(fmt.Sprintf("Resuming upload of %s at %d of %d bytes", remote, offset, f.size))
+		}
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	out, err := c.OpenFile(part, flags)
+	if err != nil {
+		return err
+	}
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		out.Close()
+		return err
+	}
+	if err := writeRemote(out, io.LimitReader(in, f.size-offset)); err != nil {
+		out.Close()
+		return s.writeError(c, err, f.size-offset)
+	}
+	info, err := out.Stat()
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() != f.size {
+		return fmt.Errorf("size mismatch after upload: remote has %d bytes, local has %d", info.Size(), f.size)
+	}
+
+	sum, err := remoteSHA256(c, part, f.size)
+	if err != nil {
+		return err
+	}
+	if sum != f.sha256 {
+		// Start over on the next attempt instead of resuming bad content
+		_ = c.Remove(part)
+		return errChecksumMismatch
+	}
+	return rename(c, part, remote)
+}
+
+// writeRemote copies r to the remote file. It writes through Write, which
+// sends large buffers as concurrent requests, rather than ReadFrom, which
+// drops the error of a short last write.
+func writeRemote(f *sftp.File, r io.Reader) error {
+	_, err := io.CopyBuffer(struct{ io.Writer }{f}, r, make([]byte, sftpCopyBuffer))
+	return err
+}
+
+// writeError classifies a failed write. Many servers report a full disk as
+// a generic failure, so the free space is checked before giving up on it.
+func (s *SFTP) writeError(c *sftp.Client, err error, remaining int64) error {
+	var statusErr *sftp.StatusError
+	if errors.As(err, &statusErr) && statusErr.FxCode() == sftp.ErrSSHFxFailure {
+		if available, ok, statErr := availableBytes(c, s.root); statErr == nil && ok && available < uint64(remaining) {
+			return fmt.Errorf("%w: %w", ErrDiskFull, err)
+		}
+	}
+	return err
+}
+
+// prefixMatches reports whether the first n bytes of the remote file equal
+// those of the local file.
+func prefixMatches(c *sftp.Client, remote string, local io.ReadSeeker, n int64) (bool, error) {
+	if _, err := local.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	h := sha256.New()
+	if _, err := io.CopyN(h, local, n); err != nil {
+		return false, err
+	}
+
+	sum, err := remoteSHA256(c, remote, n)
+	if err != nil {
+		return false, err
+	}
+	return sum == hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// remoteSHA256 reads back the first n bytes of the remote file and returns
+// their SHA-256 as a hex string.
+func remoteSHA256(c *sftp.Client, remote string, n int64) (string, error) {
+	f, err := c.Open(remote)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.CopyBuffer(h, io.LimitReader(f, n), make([]byte, sftpCopyBuffer)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *SFTP) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	name, err := cleanPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	err = s.withRetry(ctx, "read", func(c *sftp.Client) error {
+		f, err := c.Open(s.remotePath(name))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var b bytes.Buffer
+		if _, err := f.WriteTo(&b); err != nil {
+			return err
+		}
+		data = b.Bytes()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return data, nil
+}
+
+// UploadBlobs writes each file the server does not have yet through a .part
+// file that is checked and renamed into place, resuming partial uploads.
+func (s *SFTP) UploadBlobs(ctx context.Context, localRoot string, names []string) error {
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name, err := cleanPath(name)
+		if err != nil {
+			return err
+		}
+		files, err := scanLocalEntry(localRoot, name)
+		if err != nil {
+			return err
+		}
+		f := files[0]
+
+		remote := s.remotePath(name)
+		err = s.withRetry(ctx, "upload of "+name, func(c *sftp.Client) error {
+			if info, err := c.Stat(remote); err == nil && info.Size() == f.size {
+				return nil
+			}
+			if err := mkdirAll(c, path.Dir(remote)); err != nil {
+				return err
+			}
+			return s.uploadFile(c, filepath.Join(localRoot, filepath.FromSlash(name)), remote, f)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Open returns the remote file, which reads ahead with several requests in
+// flight.
+func (s *SFTP) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	name, err := cleanPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var f *sftp.File
+	err = s.withRetry(ctx, "open", func(c *sftp.Client) error {
+		f, err = c.Open(s.remotePath(name))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	return f, nil
+}
+
+// WriteFile writes to a temporary file and renames it into place.
+func (s *SFTP) WriteFile(ctx context.Context, name string, data []byte) error {
+	name, err := cleanPath(name)
+	if err != nil {
+		return err
+	}
+
+	target := s.remotePath(name)
+	tmp := path.Join(path.Dir(target), "."+path.Base(target)+".tmp")
+	return s.withRetry(ctx, "write", func(c *sftp.Client) error {
+		if err := mkdirAll(c, path.Dir(target)); err != nil {
+			return err
+		}
+		f, err := c.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return s.writeError(c, err, int64(len(data)))
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return rename(c, tmp, target)
+	})
+}
+
+// CreateFile opens name for exclusive creation, which fails if it exists.
+// Servers report that as a generic failure, so it is told apart by looking
+// for the file afterwards.
+func (s *SFTP) CreateFile(ctx context.Context, name string, data []byte) error {
+	name, err := cleanPath(name)
+	if err != nil {
+		return err
+	}
+
+	target := s.remotePath(name)
+	return s.withRetry(ctx, "create", func(c *sftp.Client) error {
+		if err := mkdirAll(c, path.Dir(target)); err != nil {
+			return err
+		}
+		f, err := c.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+		if err != nil {
+			if _, statErr := c.Stat(target); statErr == nil {
+				return fmt.Errorf("remote file %s: %w", name, fs.ErrExist)
+			}
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return s.writeError(c, err, int64(len(data)))
+		}
+		return f.Close()
+	})
+}
+
+func (s *SFTP) Delete(ctx context.Context, name string) error {
+	name, err := cleanPath(name)
+	if err != nil {
+		return err
+	}
+	return s.withRetry(ctx, "delete", func(c *sftp.Client) error {
+		return removeAll(c, s.remotePath(name))
+	})
+}
+
+// mkdirAll creates dir and any missing parents.
+func mkdirAll(c *sftp.Client, dir string) error {
+	info, err := c.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s exists and is not a directory", dir)
+		}
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if parent := path.Dir(dir); parent != dir && parent != "." && parent != "/" {
+		if err := mkdirAll(c, parent); err != nil {
+			return err
+		}
+	}
+	if err := c.Mkdir(dir); err != nil {
+		// Another request may have created it in the meantime
+		if info, statErr := c.Stat(dir); statErr == nil && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// removeAll deletes p and everything below it. A missing p is not an error.
+func removeAll(c *sftp.Client, p string) error {
+	info, err := c.Lstat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return c.Remove(p)
+	}
+
+	entries, err := c.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := removeAll(c, path.Join(p, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return c.RemoveDirectory(p)
+}
+
+// walkFiles returns the paths of all non-directory entries below dir,
+// relative to dir.
+func walkFiles(c *sftp.Client, dir string) ([]string, error) {
+	entries, err := c.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			files = append(files, entry.Name())
+			continue
+		}
+		nested, err := walkFiles(c, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, rel := range nested {
+			files = append(files, path.Join(entry.Name(), rel))
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,535 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+	"github.com/iwvelando/imessage-archiver/internal/ssh"
+)
+
+// sftpTestServer is an in-process ssh server offering SFTP through
+// pkg/sftp, backed by a temporary home directory.
+type sftpTestServer struct {
+	addr       string
+	home       string
+	keyPath    string // Client key accepted by the server
+	knownHosts string // known_hosts listing the server's host key
+
+	writeErr     error  // When set, WRITE requests fail with it
+	corrupt      bool   // When set, WRITE requests store altered data
+	freeBytes    uint64 // Reported by statvfs
+	bytesWritten atomic.Int64
+}
+
+func newSFTPTestServer(t *testing.T) *sftpTestServer {
+	t.Helper()
+	dir := t.TempDir()
+	s := &sftpTestServer{
+		home:      filepath.Join(dir, "home"),
+		keyPath:   filepath.Join(dir, "id_ed25519"),
+		freeBytes: 1 << 40,
+	}
+	if err := os.Mkdir(s.home, 0755); err != nil {
+		t.Fatalf("Failed to create home: %v", err)
+	}
+
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := gossh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("Failed to create host key: %v", err)
+	}
+	clientPub, clientKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeTestPrivateKey(t, s.keyPath, clientKey)
+	authorized, _ := gossh.NewPublicKey(clientPub)
+
+	serverConfig := &gossh.ServerConfig{
+		PublicKeyCallback: func(_ gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	s.addr = listener.Addr().String()
+
+	s.knownHosts = filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{s.addr}, hostSigner.PublicKey())
+	if err := os.WriteFile(s.knownHosts, []byte(line+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveConn(conn, serverConfig)
+		}
+	}()
+	return s
+}
+
+func writeTestPrivateKey(t *testing.T, path string, key ed25519.PrivateKey) {
+	t.Helper()
+	block, err := gossh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+}
+
+// transport returns an SFTP transport for this server archiving to
+// ~/archive.
+func (s *sftpTestServer) transport() *SFTP {
+	cfg := ssh.NewSSHConfig("backup", s.keyPath, s.addr, "~/archive")
+	transport := NewSFTP(cfg, s.knownHosts, logger.New("debug"))
+	transport.retryDelay = 0
+	return transport
+}
+
+func (s *sftpTestServer) serveConn(conn net.Conn, config *gossh.ServerConfig) {
+	_, chans, reqs, err := gossh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(gossh.UnknownChannelType, "unsupported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						handlers := sftp.Handlers{FileGet: s, FilePut: s, FileCmd: s, FileList: s}
+						server := sftp.NewRequestServer(channel, handlers, sftp.WithStartDirectory(s.home))
+						server.Serve()
+						server.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+// The server serves the home directory through pkg/sftp's request server,
+// so the faults below can be injected.
+
+func (s *sftpTestServer) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return os.Open(r.Filepath)
+}
+
+func (s *sftpTestServer) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	pflags := r.Pflags()
+	flags := os.O_WRONLY
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(r.Filepath, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpTestWriter{File: f, server: s}, nil
+}
+
+// sftpTestWriter applies the server's write faults.
+type sftpTestWriter struct {
+	*os.File
+	server *sftpTestServer
+}
+
+func (w *sftpTestWriter) WriteAt(b []byte, off int64) (int, error) {
+	if w.server.writeErr != nil {
+		return 0, w.server.writeErr
+	}
+	if w.server.corrupt {
+		b = bytes.ToUpper(b)
+	}
+	w.server.bytesWritten.Add(int64(len(b)))
+	return w.File.WriteAt(b, off)
+}
+
+func (s *sftpTestServer) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		return nil
+	case "Rename":
+		// Plain SFTP rename does not replace an existing target
+		if _, err := os.Lstat(r.Target); err == nil {
+			return errors.New("target exists")
+		}
+		return os.Rename(r.Filepath, r.Target)
+	case "Mkdir":
+		return os.Mkdir(r.Filepath, 0755)
+	case "Rmdir", "Remove":
+		return os.Remove(r.Filepath)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (s *sftpTestServer) PosixRename(r *sftp.Request) error {
+	return os.Rename(r.Filepath, r.Target)
+}
+
+func (s *sftpTestServer) StatVFS(*sftp.Request) (*sftp.StatVFS, error) {
+	return &sftp.StatVFS{Bsize: 4096, Frsize: 1, Blocks: 1 << 30, Bfree: s.freeBytes, Bavail: s.freeBytes, Namemax: 255}, nil
+}
+
+func (s *sftpTestServer) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		entries, err := os.ReadDir(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		var infos sftpTestListing
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil {
+				infos = append(infos, info)
+			}
+		}
+		return infos, nil
+	case "Stat":
+		info, err := os.Stat(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return sftpTestListing{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (s *sftpTestServer) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	info, err := os.Lstat(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return sftpTestListing{info}, nil
+}
+
+type sftpTestListing []fs.FileInfo
+
+func (l sftpTestListing) ListAt(infos []fs.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestSFTP_UploadListRead(t *testing.T) {
+	server := newSFTPTestServer(t)
+	localRoot := t.TempDir()
+	s := server.transport()
+	defer s.Close()
+
+	days, err := s.ListDays(context.Background())
+	if err != nil || len(days) != 0 {
+		t.Fatalf("Expected no days before the first upload, got %v (%v)", days, err)
+	}
+
+	writeLocalDay(t, localRoot, "2024-01-01", map[string]string{"messages.jsonl": "v1", "stale.txt": "old"})
+	writeLocalDay(t, localRoot, "2024-02-03", map[string]string{"messages.jsonl": "feb", "attachments/a.jpg": "jpg"})
+	if err := s.Upload(context.Background(), localRoot, []string{"2024-01-01", "2024-02-03"}); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	// Upload again with changed content to exercise the replace path
+	if err := os.RemoveAll(filepath.Join(localRoot, "2024", "01", "01", "stale.txt")); err != nil {
+		t.Fatal(err)
+	}
+	writeLocalDay(t, localRoot, "2024-01-01", map[string]string{"messages.jsonl": "v2"})
+	if err := s.Upload(context.Background(), localRoot, []string{"2024-01-01"}); err != nil {
+		t.Fatalf("Second upload failed: %v", err)
+	}
+
+	// An empty day directory left behind does not count as archived
+	if err := os.MkdirAll(filepath.Join(server.home, "archive", "2024", "03", "05"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	days, err = s.ListDays(context.Background())
+	if err != nil {
+		t.Fatalf("ListDays failed: %v", err)
+	}
+	if strings.Join(days, ",") != "2024-01-01,2024-02-03" {
+		t.Errorf("Expected both days to be listed, got %v", days)
+	}
+
+	if data, err := s.ReadFile(context.Background(), "2024/01/01/messages.jsonl"); err != nil || string(data) != "v2" {
+		t.Errorf("Expected replaced messages.jsonl with v2, got %q (%v)", data, err)
+	}
+	if data, err := s.ReadFile(context.Background(), "2024/02/03/attachments/a.jpg"); err != nil || string(data) != "jpg" {
+		t.Errorf("Expected attachment to be uploaded, got %q (%v)", data, err)
+	}
+	if _, err := s.ReadFile(context.Background(), "2024/01/01/stale.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected stale file to be replaced, got %v", err)
+	}
+
+	// No staging directories are left behind
+	if entries, _ := os.ReadDir(filepath.Join(server.home, "archive")); len(entries) != 1 || entries[0].Name() != "2024" {
+		t.Errorf("Expected only the year directory in the archive root, got %v", entries)
+	}
+
+	if err := s.WriteFile(context.Background(), "state/marker.json", []byte("{}")); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if data, err := s.ReadFile(context.Background(), "state/marker.json"); err != nil || string(data) != "{}" {
+		t.Errorf("Expected written file to be readable, got %q (%v)", data, err)
+	}
+	if err := s.Delete(context.Background(), "2024/02"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := s.Delete(context.Background(), "2024/02"); err != nil {
+		t.Errorf("Expected deleting a missing path to succeed, got %v", err)
+	}
+	if days, _ := s.ListDays(context.Background()); strings.Join(days, ",") != "2024-01-01" {
+		t.Errorf("Expected only 2024-01-01 after delete, got %v", days)
+	}
+}
+
+func TestSFTP_ResumesPartialUpload(t *testing.T) {
+	server := newSFTPTestServer(t)
+	localRoot := t.TempDir()
+	s := server.transport()
+	defer s.Close()
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	writeLocalDay(t, localRoot, "2024-01-01", map[string]string{"video.mov": string(content), "messages.jsonl": "hi"})
+
+	tests := []struct {
+		name        string
+		part        []byte
+		wantWritten int64
+	}{
+		{"matching partial is continued", content[:200000], int64(len(content) - 200000 + 2)},
+		{"diverging partial is restarted", append(bytes.Repeat([]byte("x"), 1000), content[1000:200000]...), int64(len(content) + 2)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Left behind by an attempt whose connection dropped
+			staging := filepath.Join(server.home, "archive", StagingDir, s.runID, "2024", "01", "01")
+			if err := os.MkdirAll(staging, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(staging, "video.mov.part"), tt.part, 0644); err != nil {
+				t.Fatal(err)
+			}
+			server.bytesWritten.Store(0)
+
+			if err := s.Upload(context.Background(), localRoot, []string{"2024-01-01"}); err != nil {
+				t.Fatalf("Upload failed: %v", err)
+			}
+
+			got, err := os.ReadFile(filepath.Join(server.home, "archive", "2024", "01", "01", "video.mov"))
+			if err != nil || !bytes.Equal(got, content) {
+				t.Fatalf("Uploaded file does not match (%d bytes, %v)", len(got), err)
+			}
+			if written := server.bytesWritten.Load(); written != tt.wantWritten {
+				t.Errorf("Expected %d bytes to be sent, got %d", tt.wantWritten, written)
+			}
+			if _, err := os.Stat(filepath.Join(server.home, "archive", StagingDir)); !os.IsNotExist(err) {
+				t.Errorf("Expected staging to be cleaned up, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSFTP_LeavesOtherRunsStaging(t *testing.T) {
+	server := newSFTPTestServer(t)
+	localRoot := t.TempDir()
+	s := server.transport()
+	defer s.Close()
+	writeLocalDay(t, localRoot, "2024-01-01", map[string]string{"messages.jsonl": "hello"})
+
+	stale := "20240101T000000Z-00000000"
+	live := time.Now().UTC().Add(-time.Hour).Format(runIDTime) + "-00000000"
+	for _, run := range []string{stale, live} {
+		staging := filepath.Join(server.home, "archive", StagingDir, run, "2024", "01", "01")
+		if err := os.MkdirAll(staging, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(staging, "messages.jsonl"), []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Upload(context.Background(), localRoot, []string{"2024-01-01"}); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if written := server.bytesWritten.Load(); written != 5 {
+		t.Errorf("Expected the day to be sent rather than taken over, got %d bytes sent", written)
+	}
+	if _, err := os.Stat(filepath.Join(server.home, "archive", StagingDir, stale)); !os.IsNotExist(err) {
+		t.Errorf("Expected the stale staging directory to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(server.home, "archive", StagingDir, live, "2024", "01", "01", "messages.jsonl")); err != nil {
+		t.Errorf("Expected the staging of a run that may still be uploading to be kept, got %v", err)
+	}
+}
+
+func TestSFTP_ErrorClasses(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, server *sftpTestServer)
+		wantErr error
+	}{
+		{
+			name: "unknown client key",
+			setup: func(t *testing.T, server *sftpTestServer) {
+				_, key, _ := ed25519.GenerateKey(rand.Reader)
+				writeTestPrivateKey(t, server.keyPath, key)
+			},
+			wantErr: ErrAuth,
+		},
+		{
+			name: "host key mismatch",
+			setup: func(t *testing.T, server *sftpTestServer) {
+				other, _, _ := ed25519.GenerateKey(rand.Reader)
+				key, _ := gossh.NewPublicKey(other)
+				line := knownhosts.Line([]string{server.addr}, key)
+				if err := os.WriteFile(server.knownHosts, []byte(line+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: ErrHostKey,
+		},
+		{
+			name: "unknown host",
+			setup: func(t *testing.T, server *sftpTestServer) {
+				if err := os.WriteFile(server.knownHosts, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: ErrHostKey,
+		},
+		{
+			name: "connection refused",
+			setup: func(t *testing.T, server *sftpTestServer) {
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				server.addr = listener.Addr().String()
+				listener.Close()
+			},
+			wantErr: ErrNetwork,
+		},
+		{
+			name: "write reports no space",
+			setup: func(t *testing.T, server *sftpTestServer) {
+				server.writeErr = sftp.ErrSSHFxOk + sftpNoSpaceOnFilesystem
+			},
+			wantErr: ErrDiskFull,
+		},
+		{
+			name: "data corrupted in transit",
+			setup: func(t *testing.T, server *sftpTestServer) {
+				server.corrupt = true
+			},
+			wantErr: errChecksumMismatch,
+		},
+		{
+			name: "not enough free space",
+			setup: func(t *testing.T, server *sftpTestServer) {
+				server.freeBytes = 1
+			},
+			wantErr: ErrDiskFull,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newSFTPTestServer(t)
+			localRoot := t.TempDir()
+			writeLocalDay(t, localRoot, "2024-01-01", map[string]string{"messages.jsonl": "hello"})
+			tt.setup(t, server)
+
+			s := server.transport()
+			defer s.Close()
+			err := s.Upload(context.Background(), localRoot, []string{"2024-01-01"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Expected error wrapping %v, got %v", tt.wantErr, err)
+			}
+			if _, err := os.Stat(filepath.Join(server.home, "archive", "2024", "01", "01")); !os.IsNotExist(err) {
+				t.Errorf("Expected the day not to be published after a failed upload, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSFTP_CancelStopsRetrying(t *testing.T) {
+	server := newSFTPTestServer(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.addr = listener.Addr().String()
+	listener.Close()
+
+	s := server.transport()
+	s.retryDelay = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.ListDays(ctx)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected the cancelled context's error, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected cancelling to stop waiting for the next attempt")
+	}
+}
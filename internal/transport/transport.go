@@ -0,0 +1,334 @@
+// Package transport moves archived days between the local work directory and
+// an archive destination.
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/config"
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+	"github.com/iwvelando/imessage-archiver/internal/manifest"
+	"github.com/iwvelando/imessage-archiver/internal/ssh"
+)
+
+// Transport is an archive destination laid out as year/month/day directories,
+// or as packaged days in year/month directories (see PackageManifestPath).
+// All paths are slash-separated and relative to the archive root.
+//
+// Every method that reaches the destination takes a context; cancelling it
+// stops the operation and kills running commands.
+type Transport interface {
+	// Name identifies the destination in logs.
+	Name() string
+
+	// ListDays returns the archived days (YYYY-MM-DD) that contain at least
+	// one file or have a package manifest, oldest first. Destinations that
+	// publish a day file by file, like S3, only count it once its
+	// manifest.json exists.
+	ListDays(ctx context.Context) ([]string, error)
+
+	// Upload copies each given day (YYYY-MM-DD) from localRoot/YYYY/MM/DD,
+	// or the files of the packaged day, to the destination, replacing
+	// whatever the destination held for that day in either layout.
+	// Days not listed are left untouched. Files are staged below StagingDir
+	// and a day is published only once all of its files arrived intact, so
+	// an interrupted upload never leaves a partial day behind. Staging that
+	// other runs left is never reused, and removed once it is older than
+	// StagingStaleAfter. Cancelling ctx stops the upload
+	// before the next day or file and kills running commands; days already
+	// published stay.
+	Upload(ctx context.Context, localRoot string, days []string) error
+
+	// UploadBlobs copies the given files from localRoot to the same paths
+	// at the destination. The files are named after their content, so one
+	// the destination already has is not uploaded again. Each file becomes
+	// visible only once it arrived intact. Cancelling ctx stops the upload
+	// like it does for Upload.
+	UploadBlobs(ctx context.Context, localRoot string, names []string) error
+
+	// ReadFile returns the content of a small file such as a manifest. The
+	// error wraps fs.ErrNotExist if the file does not exist.
+	ReadFile(ctx context.Context, name string) ([]byte, error)
+
+	// Open streams a file of any size, such as a packaged day. The error
+	// wraps fs.ErrNotExist if the file does not exist; some transports
+	// only report that once reading starts.
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// WriteFile stores a small file, creating parent directories as needed.
+	WriteFile(ctx context.Context, name string, data []byte) error
+
+	// CreateFile stores a small file like WriteFile, but only if name does
+	// not exist yet; the error wraps fs.ErrExist if it does. Where the
+	// destination allows it, checking and creating are one atomic step, so
+	// the file can serve as a lock between machines.
+	CreateFile(ctx context.Context, name string, data []byte) error
+
+	// Delete removes a file or directory tree. Deleting a path that does not
+	// exist is not an error.
+	Delete(ctx context.Context, name string) error
+}
+
+// Errors that transports wrap so callers can tell failure classes apart with
+// errors.Is.
+var (
+	// ErrAuth means the destination rejected our credentials.
+	ErrAuth = errors.New("authentication failed")
+	// ErrHostKey means the server's host key is unknown or does not match
+	// known_hosts.
+	ErrHostKey = errors.New("host key verification failed")
+	// ErrNetwork means the destination could not be reached or the
+	// connection dropped. Retrying later may succeed.
+	ErrNetwork = errors.New("network error")
+	// ErrDiskFull means the destination ran out of space or quota.
+	ErrDiskFull = errors.New("destination is out of space")
+)
+
+// StagingDir is the directory below the archive root that holds uploads in
+// progress, one subdirectory per run. It is never listed as a day.
+const StagingDir = ".incoming"
+
+// StagingStaleAfter is how old the staging directory of another run must be
+// before an upload removes it. It matches how long a destination lock may go
+// without being renewed (runlock.RemoteStaleAfter), so a run that is still
+// uploading, even without the lock, keeps its staging.
+const StagingStaleAfter = 12 * time.Hour
+
+// runIDTime is the layout of the time a run ID starts with.
+const runIDTime = "20060102T150405Z"
+
+// errChecksumMismatch is returned when a staged file does not match the
+// local file it was uploaded from.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// Resumable is implemented by transports that stage uploads below
+// StagingDir/<run ID>. A run resumed from the journal of an interrupted one
+// sets the run ID that one staged under, so it continues those uploads
+// instead of starting over.
+type Resumable interface {
+	SetRunID(runID string)
+}
+
+// NewRunID returns a unique, time-ordered name for a run's staging
+// directory.
+func NewRunID() string {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return time.Now().UTC().Format(runIDTime) + "-" + hex.EncodeToString(b[:])
+}
+
+// staleStaging reports whether the staging directory name of another run
+// was started more than StagingStaleAfter before now. Names that are not
+// run IDs are left alone.
+func staleStaging(name string, now time.Time) bool {
+	stamp, _, ok := strings.Cut(name, "-")
+	started, err := time.Parse(runIDTime, stamp)
+	return ok && err == nil && now.Sub(started) > StagingStaleAfter
+}
+
+// stagingCutoff returns the run ID prefix that the staging directories
+// staleStaging reports for now sort before.
+func stagingCutoff(now time.Time) string {
+	return now.UTC().Add(-StagingStaleAfter).Format(runIDTime)
+}
+
+// localFile is a file of an exported day, relative to the entry it belongs
+// to. The rel of a packaged day's file is empty; it is the entry itself.
+type localFile struct {
+	rel    string
+	size   int64
+	sha256 string
+}
+
+// scanLocalDay returns the regular files below dir with their checksums.
+func scanLocalDay(dir string) ([]localFile, error) {
+	var files []localFile
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		size, sum, err := manifest.HashFile(p)
+		if err != nil {
+			return err
+		}
+		files = append(files, localFile{rel: filepath.ToSlash(rel), size: size, sha256: sum})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", dir, err)
+	}
+	return files, nil
+}
+
+// scanLocalEntry returns the files of the day entry below root with their
+// checksums.
+func scanLocalEntry(root, entry string) ([]localFile, error) {
+	p := filepath.Join(root, filepath.FromSlash(entry))
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return scanLocalDay(p)
+	}
+	size, sum, err := manifest.HashFile(p)
+	if err != nil {
+		return nil, err
+	}
+	return []localFile{{size: size, sha256: sum}}, nil
+}
+
+// dayEntries returns the paths below the local directory root that hold
+// day: its YYYY/MM/DD directory, or the files of the packaged day with the
+// manifest last.
+func dayEntries(root, day string) ([]string, error) {
+	dayPath := DayPath(day)
+	if info, err := os.Stat(filepath.Join(root, filepath.FromSlash(dayPath))); err == nil && info.IsDir() {
+		return []string{dayPath}, nil
+	}
+
+	monthDir := path.Dir(dayPath)
+	matches, err := filepath.Glob(filepath.Join(root, filepath.FromSlash(monthDir), day+".*"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	for _, match := range matches {
+		entries = append(entries, path.Join(monthDir, filepath.Base(match)))
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s not found in %s", day, root)
+	}
+	sortManifestLast(entries)
+	return entries, nil
+}
+
+// otherEntries returns the entries of day found among the names in its
+// month directory that are not in keep, i.e. what is left of a previous
+// upload of the day in the other layout or with other package files.
+func otherEntries(day string, monthNames, keep []string) []string {
+	dayPath := DayPath(day)
+	monthDir := path.Dir(dayPath)
+
+	var other []string
+	for _, name := range monthNames {
+		entry := path.Join(monthDir, name)
+		if entry != dayPath && !strings.HasPrefix(name, day+".") {
+			continue
+		}
+		if !slices.Contains(keep, entry) {
+			other = append(other, entry)
+		}
+	}
+	return other
+}
+
+// isManifest reports whether p is a day manifest or a package manifest.
+func isManifest(p string) bool {
+	return path.Base(p) == manifest.FileName || strings.HasSuffix(p, PackageManifestSuffix)
+}
+
+// sortManifestLast sorts paths with manifests last, so a listed manifest
+// implies the rest of its day is present.
+func sortManifestLast(paths []string) {
+	sort.Slice(paths, func(i, j int) bool {
+		if isManifest(paths[i]) != isManifest(paths[j]) {
+			return isManifest(paths[j])
+		}
+		return paths[i] < paths[j]
+	})
+}
+
+// New returns the transport for destination d.
+func New(d config.Destination, log *logger.Logger) Transport {
+	switch d.Type {
+	case config.DestinationLocal:
+		return NewLocal(d.RemoteArchivePath, log)
+	case config.DestinationS3:
+		return NewS3(d.S3, log)
+	case config.DestinationSFTP:
+		return NewSFTP(ssh.NewSSHConfig(d.RemoteUser, d.SSHPrivateKeyPath, d.RemoteHost, d.RemoteArchivePath), d.KnownHostsPath, log)
+	default:
+		return NewRsync(ssh.NewSSHConfig(d.RemoteUser, d.SSHPrivateKeyPath, d.RemoteHost, d.RemoteArchivePath), log)
+	}
+}
+
+// DayPath converts a YYYY-MM-DD day into its YYYY/MM/DD directory.
+func DayPath(day string) string {
+	return strings.ReplaceAll(day, "-", "/")
+}
+
+// ParseDayPath converts a YYYY/MM/DD directory into its YYYY-MM-DD day, or
+// returns false if dir is not a calendar day.
+func ParseDayPath(dir string) (string, bool) {
+	date, err := time.Parse("2006/01/02", dir)
+	if err != nil {
+		return "", false
+	}
+	return date.Format("2006-01-02"), true
+}
+
+// PackageManifestSuffix ends the name of a packaged day's manifest. A
+// packaged day is stored as files named after the day in its month
+// directory, such as 2024/01/2024-01-02.tar.zst, and its manifest
+// 2024/01/2024-01-02.manifest.json, which is written last.
+const PackageManifestSuffix = ".manifest.json"
+
+// PackagePath returns the path of the packaged day's file with the given
+// extension, e.g. 2024/01/2024-01-02.tar.zst for "tar.zst".
+func PackagePath(day, ext string) string {
+	return path.Join(path.Dir(DayPath(day)), day+"."+ext)
+}
+
+// PackageManifestPath returns the path of the packaged day's manifest.
+func PackageManifestPath(day string) string {
+	return path.Join(path.Dir(DayPath(day)), day+PackageManifestSuffix)
+}
+
+// ParsePackageManifestPath converts the path of a package manifest into its
+// YYYY-MM-DD day, or returns false if p is not one.
+func ParsePackageManifestPath(p string) (string, bool) {
+	day, ok := strings.CutSuffix(p, PackageManifestSuffix)
+	if !ok {
+		return "", false
+	}
+	date, err := time.Parse("2006/01/2006-01-02", day)
+	if err != nil {
+		return "", false
+	}
+	// The month directory must match the day, which the layout cannot check
+	if PackageManifestPath(date.Format("2006-01-02")) != p {
+		return "", false
+	}
+	return date.Format("2006-01-02"), true
+}
+
+// cleanPath validates a path relative to the archive root so that a bad
+// argument can never address the root itself or escape it.
+func cleanPath(name string) (string, error) {
+	cleaned := path.Clean(name)
+	if name == "" || path.IsAbs(name) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("invalid archive path %q", name)
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,279 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/iwvelando/imessage-archiver/internal/logger"
+)
+
+// TestUpload_PackagedDay switches a day from a directory to a package and
+// back on every transport that can run without external services.
+func TestUpload_PackagedDay(t *testing.T) {
+	tests := []struct {
+		name string
+		new  func(t *testing.T) Transport
+	}{
+		{name: "local", new: func(t *testing.T) Transport { return NewLocal(t.TempDir(), logger.New("debug")) }},
+		{name: "memory", new: func(t *testing.T) Transport { return NewMemory() }},
+		{name: "s3", new: func(t *testing.T) Transport {
+			_, server := newFakeS3(t, "archive")
+			return newTestS3(server, "imessages")
+		}},
+		{name: "sftp", new: func(t *testing.T) Transport {
+			s := newSFTPTestServer(t).transport()
+			t.Cleanup(func() { s.Close() })
+			return s
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := tt.new(t)
+
+			dirRoot := t.TempDir()
+			writeLocalDay(t, dirRoot, "2024-01-02", map[string]string{"manifest.json": "{}", "chat.txt": "hi"})
+			writeLocalDay(t, dirRoot, "2024-01-03", map[string]string{"manifest.json": "{}", "chat.txt": "keep"})
+			if err := tr.Upload(context.Background(), dirRoot, []string{"2024-01-02", "2024-01-03"}); err != nil {
+				t.Fatalf("Upload failed: %v", err)
+			}
+
+			pkgRoot := t.TempDir()
+			monthDir := filepath.Join(pkgRoot, "2024", "01")
+			if err := os.MkdirAll(monthDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range map[string]string{"2024-01-02.tar.zst": "package", "2024-01-02.manifest.json": "{}"} {
+				if err := os.WriteFile(filepath.Join(monthDir, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tr.Upload(context.Background(), pkgRoot, []string{"2024-01-02"}); err != nil {
+				t.Fatalf("Upload of the packaged day failed: %v", err)
+			}
+
+			if _, err := tr.ReadFile(context.Background(), "2024/01/02/chat.txt"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Expected the day directory to be replaced by the package, got %v", err)
+			}
+			if data, err := tr.ReadFile(context.Background(), "2024/01/03/chat.txt"); err != nil || string(data) != "keep" {
+				t.Errorf("Expected other days to be untouched, got %q, %v", data, err)
+			}
+			rc, err := tr.Open(context.Background(), PackagePath("2024-01-02", "tar.zst"))
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || string(data) != "package" {
+				t.Errorf("Expected to stream the package, got %q, %v", data, err)
+			}
+			days, err := tr.ListDays(context.Background())
+			if err != nil || strings.Join(days, ",") != "2024-01-02,2024-01-03" {
+				t.Errorf("Expected the packaged day to be listed once, got %v, %v", days, err)
+			}
+
+			// Back to a directory removes the package files
+			if err := tr.Upload(context.Background(), dirRoot, []string{"2024-01-02"}); err != nil {
+				t.Fatalf("Upload failed: %v", err)
+			}
+			for _, name := range []string{PackagePath("2024-01-02", "tar.zst"), PackageManifestPath("2024-01-02")} {
+				if _, err := tr.ReadFile(context.Background(), name); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("Expected %s to be removed, got %v", name, err)
+				}
+			}
+			if data, err := tr.ReadFile(context.Background(), "2024/01/02/chat.txt"); err != nil || string(data) != "hi" {
+				t.Errorf("Expected the day directory back, got %q, %v", data, err)
+			}
+		})
+	}
+}
+
+// TestUploadBlobs uploads new store files and leaves those the destination
+// already has alone on every transport that can run without external
+// services.
+func TestUploadBlobs(t *testing.T) {
+	tests := []struct {
+		name string
+		new  func(t *testing.T) Transport
+	}{
+		{name: "local", new: func(t *testing.T) Transport { return NewLocal(t.TempDir(), logger.New("debug")) }},
+		{name: "memory", new: func(t *testing.T) Transport { return NewMemory() }},
+		{name: "s3", new: func(t *testing.T) Transport {
+			_, server := newFakeS3(t, "archive")
+			return newTestS3(server, "imessages")
+		}},
+		{name: "sftp", new: func(t *testing.T) Transport {
+			s := newSFTPTestServer(t).transport()
+			t.Cleanup(func() { s.Close() })
+			return s
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := tt.new(t)
+			const stored = "attachments/ab/cd/abcd.jpg"
+			const added = "attachments/01/23/0123.png"
+			if err := tr.WriteFile(context.Background(), stored, []byte("remote")); err != nil {
+				t.Fatal(err)
+			}
+
+			localRoot := t.TempDir()
+			for name, content := range map[string]string{stored: "local!", added: "png"} {
+				p := filepath.Join(localRoot, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := tr.UploadBlobs(context.Background(), localRoot, []string{added, stored}); err != nil {
+				t.Fatalf("UploadBlobs failed: %v", err)
+			}
+			if data, err := tr.ReadFile(context.Background(), added); err != nil || string(data) != "png" {
+				t.Errorf("Expected the new file to be uploaded, got %q, %v", data, err)
+			}
+			if data, err := tr.ReadFile(context.Background(), stored); err != nil || string(data) != "remote" {
+				t.Errorf("Expected the stored file not to be uploaded again, got %q, %v", data, err)
+			}
+			days, err := tr.ListDays(context.Background())
+			if err != nil || len(days) != 0 {
+				t.Errorf("Expected the store not to be listed as days, got %v, %v", days, err)
+			}
+		})
+	}
+}
+
+func TestUpload_Cancelled(t *testing.T) {
+	tests := []struct {
+		name string
+		new  func(t *testing.T) Transport
+	}{
+		{name: "local", new: func(t *testing.T) Transport { return NewLocal(t.TempDir(), logger.New("debug")) }},
+		{name: "memory", new: func(t *testing.T) Transport { return NewMemory() }},
+		{name: "s3", new: func(t *testing.T) Transport {
+			_, server := newFakeS3(t, "archive")
+			return newTestS3(server, "imessages")
+		}},
+		{name: "sftp", new: func(t *testing.T) Transport {
+			s := newSFTPTestServer(t).transport()
+			t.Cleanup(func() { s.Close() })
+			return s
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := tt.new(t)
+			localRoot := t.TempDir()
+			writeLocalDay(t, localRoot, "2024-01-02", map[string]string{"manifest.json": "{}", "chat.txt": "hi"})
+			const blob = "attachments/01/23/0123.png"
+			p := filepath.Join(localRoot, filepath.FromSlash(blob))
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, []byte("png"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if err := tr.UploadBlobs(ctx, localRoot, []string{blob}); !errors.Is(err, context.Canceled) {
+				t.Errorf("Expected UploadBlobs to be cancelled, got %v", err)
+			}
+			if err := tr.Upload(ctx, localRoot, []string{"2024-01-02"}); !errors.Is(err, context.Canceled) {
+				t.Errorf("Expected Upload to be cancelled, got %v", err)
+			}
+			if _, err := tr.ReadFile(context.Background(), blob); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Expected nothing to be uploaded, got %v", err)
+			}
+			days, err := tr.ListDays(context.Background())
+			if err != nil || len(days) != 0 {
+				t.Errorf("Expected nothing to be published, got %v, %v", days, err)
+			}
+		})
+	}
+}
+
+func TestCreateFile(t *testing.T) {
+	tests := []struct {
+		name string
+		new  func(t *testing.T) Transport
+	}{
+		{name: "local", new: func(t *testing.T) Transport { return NewLocal(t.TempDir(), logger.New("debug")) }},
+		{name: "memory", new: func(t *testing.T) Transport { return NewMemory() }},
+		{name: "s3", new: func(t *testing.T) Transport {
+			_, server := newFakeS3(t, "archive")
+			return newTestS3(server, "imessages")
+		}},
+		{name: "sftp", new: func(t *testing.T) Transport {
+			s := newSFTPTestServer(t).transport()
+			t.Cleanup(func() { s.Close() })
+			return s
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := tt.new(t)
+			if err := tr.CreateFile(context.Background(), ".lock/owner.json", []byte("first")); err != nil {
+				t.Fatalf("CreateFile failed: %v", err)
+			}
+			if err := tr.CreateFile(context.Background(), ".lock/owner.json", []byte("second")); !errors.Is(err, fs.ErrExist) {
+				t.Errorf("Expected fs.ErrExist for an existing file, got %v", err)
+			}
+			if data, err := tr.ReadFile(context.Background(), ".lock/owner.json"); err != nil || string(data) != "first" {
+				t.Errorf("Expected the first content to be kept, got %q, %v", data, err)
+			}
+
+			// Once deleted, the file can be created again
+			if err := tr.Delete(context.Background(), ".lock/owner.json"); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			if err := tr.CreateFile(context.Background(), ".lock/owner.json", []byte("third")); err != nil {
+				t.Errorf("Expected to create the file again, got %v", err)
+			}
+		})
+	}
+}
+
+func TestOpen_NotExist(t *testing.T) {
+	tr := NewLocal(t.TempDir(), logger.New("debug"))
+	if _, err := tr.Open(context.Background(), "2024/01/2024-01-02.tar.zst"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, got %v", err)
+	}
+	if _, err := NewMemory().Open(context.Background(), "2024/01/2024-01-02.tar.zst"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestParsePackageManifestPath(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		ok    bool
+	}{
+		{"2024/01/2024-01-02.manifest.json", "2024-01-02", true},
+		{"2024/02/2024-01-02.manifest.json", "", false},
+		{"2024/01/2024-01-32.manifest.json", "", false},
+		{"2024/01/2024-01-02.tar.zst", "", false},
+		{"2024/01/02/manifest.json", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, ok := ParsePackageManifestPath(tt.input)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("ParsePackageManifestPath(%q) = %q, %v; expected %q, %v", tt.input, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
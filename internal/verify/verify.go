@@ -0,0 +1,326 @@
+// Package verify audits an archive directory tree against the manifest
+// stored in each archived day.
+package verify
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iwvelando/imessage-archiver/internal/attachstore"
+	"github.com/iwvelando/imessage-archiver/internal/manifest"
+	"github.com/iwvelando/imessage-archiver/internal/transport"
+)
+
+// DayResult holds the problems found in one archived day.
+type DayResult struct {
+	Date string // YYYY-MM-DD
+
+	// Unmanifested is set when the day has no manifest, or one written before
+	// checksums were recorded, so its content cannot be verified.
+	Unmanifested bool
+	// Missing lists files recorded in the manifest that no longer exist.
+	Missing []string
+	// Extra lists files present on disk but absent from the manifest.
+	Extra []string
+	// Corrupted lists files whose size or checksum differs from the manifest,
+	// or the manifest itself if it cannot be parsed.
+	Corrupted []string
+}
+
+// OK reports whether the day verified cleanly.
+func (d DayResult) OK() bool {
+	return !d.Unmanifested && len(d.Missing) == 0 && len(d.Extra) == 0 && len(d.Corrupted) == 0
+}
+
+// Report is the outcome of verifying an archive.
+type Report struct {
+	Root string
+	Days []DayResult
+	// MissingDays lists the dates (YYYY-MM-DD) between the first and the
+	// last archived day that have no archived day.
+	MissingDays []string
+}
+
+// OK reports whether every day verified cleanly and none is missing.
+func (r *Report) OK() bool {
+	return len(r.Problems()) == 0 && len(r.MissingDays) == 0
+}
+
+// Problems returns the days that did not verify cleanly.
+func (r *Report) Problems() []DayResult {
+	var problems []DayResult
+	for _, day := range r.Days {
+		if !day.OK() {
+			problems = append(problems, day)
+		}
+	}
+	return problems
+}
+
+// WriteSummary prints a human-readable summary of the report to w.
+func (r *Report) WriteSummary(w io.Writer) {
+	var missing, extra, corrupted, unmanifested int
+	for _, date := range r.MissingDays {
+		fmt.Fprintf(w, "%s: missing day\n", date)
+	}
+	for _, day := range r.Days {
+		if day.Unmanifested {
+			unmanifested++
+			fmt.Fprintf(w, "%s: unmanifested\n", day.Date)
+		}
+		for _, path := range day.Missing {
+			fmt.Fprintf(w, "%s: missing %s\n", day.Date, path)
+		}
+		for _, path := range day.Extra {
+			fmt.Fprintf(w, "%s: extra %s\n", day.Date, path)
+		}
+		for _, path := range day.Corrupted {
+			fmt.Fprintf(w, "%s: corrupted %s\n", day.Date, path)
+		}
+		if len(day.Missing) > 0 {
+			missing++
+		}
+		if len(day.Extra) > 0 {
+			extra++
+		}
+		if len(day.Corrupted) > 0 {
+			corrupted++
+		}
+	}
+
+	fmt.Fprintf(w, "Verified %d days in %s: %d ok, %d with missing files, %d with extra files, %d corrupted, %d unmanifested, %d days missing\n",
+		len(r.Days), r.Root, len(r.Days)-len(r.Problems()), missing, extra, corrupted, unmanifested, len(r.MissingDays))
+}
+
+// Archive verifies every year/month/day directory and packaged day under
+// root, and lists the dates missing between the first and the last of them.
+func Archive(root string) (*Report, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access archive root: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("archive root %s is not a directory", root)
+	}
+
+	dayDirs, err := filepath.Glob(filepath.Join(root, "[0-9][0-9][0-9][0-9]", "[0-9][0-9]", "[0-9][0-9]"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list archived days: %w", err)
+	}
+	sort.Strings(dayDirs)
+
+	report := &Report{Root: root}
+	// Checked attachment store files and whether they are intact
+	stored := make(map[string]bool)
+	for _, dayDir := range dayDirs {
+		rel, err := filepath.Rel(root, dayDir)
+		if err != nil {
+			return nil, err
+		}
+		date, err := time.Parse("2006/01/02", filepath.ToSlash(rel))
+		if err != nil {
+			// Not a calendar day, e.g. 2024/13/45
+			continue
+		}
+		if info, err := os.Stat(dayDir); err != nil || !info.IsDir() {
+			continue
+		}
+
+		result, err := Day(dayDir, date.Format("2006-01-02"))
+		if err != nil {
+			return nil, err
+		}
+		if err := checkAttachments(root, filepath.Join(dayDir, manifest.FileName), &result, stored); err != nil {
+			return nil, err
+		}
+		report.Days = append(report.Days, result)
+	}
+
+	manifests, err := filepath.Glob(filepath.Join(root, "[0-9][0-9][0-9][0-9]", "[0-9][0-9]", "*"+transport.PackageManifestSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list packaged days: %w", err)
+	}
+	for _, manifestPath := range manifests {
+		rel, err := filepath.Rel(root, manifestPath)
+		if err != nil {
+			return nil, err
+		}
+		date, ok := transport.ParsePackageManifestPath(filepath.ToSlash(rel))
+		if !ok {
+			continue
+		}
+		result, err := Package(manifestPath, date)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkAttachments(root, manifestPath, &result, stored); err != nil {
+			return nil, err
+		}
+		report.Days = append(report.Days, result)
+	}
+	sort.SliceStable(report.Days, func(i, j int) bool { return report.Days[i].Date < report.Days[j].Date })
+	report.MissingDays = missingDays(report.Days)
+
+	return report, nil
+}
+
+// missingDays returns the dates between the first and the last of the
+// sorted days that none of them covers.
+func missingDays(days []DayResult) []string {
+	if len(days) == 0 {
+		return nil
+	}
+	archived := make(map[string]bool, len(days))
+	for _, day := range days {
+		archived[day.Date] = true
+	}
+
+	first, err := time.Parse("2006-01-02", days[0].Date)
+	if err != nil {
+		return nil
+	}
+	last, err := time.Parse("2006-01-02", days[len(days)-1].Date)
+	if err != nil {
+		return nil
+	}
+	var missing []string
+	for date := first; !date.After(last); date = date.AddDate(0, 0, 1) {
+		if day := date.Format("2006-01-02"); !archived[day] {
+			missing = append(missing, day)
+		}
+	}
+	return missing
+}
+
+// checkAttachments checks that the attachments listed in the manifest at
+// manifestPath are intact in the attachment store below root. Each stored
+// file is hashed once, however many days reference it.
+func checkAttachments(root, manifestPath string, result *DayResult, stored map[string]bool) error {
+	m, err := manifest.ReadFile(manifestPath)
+	if err != nil {
+		// Already reported by the day check
+		return nil
+	}
+
+	for _, a := range m.Attachments {
+		if !attachstore.Valid(a) {
+			result.Corrupted = append(result.Corrupted, filepath.Base(manifestPath))
+			continue
+		}
+		blob := attachstore.Path(a)
+		ok, checked := stored[blob]
+		if !checked {
+			size, sum, err := manifest.HashFile(filepath.Join(root, filepath.FromSlash(blob)))
+			if errors.Is(err, os.ErrNotExist) {
+				result.Missing = append(result.Missing, blob)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to verify %s: %w", blob, err)
+			}
+			ok = size == a.Size && strings.EqualFold(sum, a.SHA256)
+			stored[blob] = ok
+		}
+		if !ok {
+			result.Corrupted = append(result.Corrupted, blob)
+		}
+	}
+	return nil
+}
+
+// Package verifies the files of a packaged day against its manifest at
+// manifestPath. They are listed relative to the manifest's directory, which
+// holds other days too, so extra files cannot be detected.
+func Package(manifestPath, date string) (DayResult, error) {
+	result := DayResult{Date: date}
+
+	m, err := manifest.ReadFile(manifestPath)
+	if err != nil {
+		result.Corrupted = append(result.Corrupted, filepath.Base(manifestPath))
+		return result, nil
+	}
+	if len(m.Files) == 0 {
+		result.Unmanifested = true
+		return result, nil
+	}
+
+	for _, expected := range m.Files {
+		size, sum, err := manifest.HashFile(filepath.Join(filepath.Dir(manifestPath), filepath.FromSlash(expected.Path)))
+		if errors.Is(err, os.ErrNotExist) {
+			result.Missing = append(result.Missing, expected.Path)
+			continue
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to verify %s: %w", date, err)
+		}
+		if size != expected.Size || !strings.EqualFold(sum, expected.SHA256) {
+			result.Corrupted = append(result.Corrupted, expected.Path)
+		}
+	}
+	return result, nil
+}
+
+// Day verifies a single day directory against its manifest.
+func Day(dayDir, date string) (DayResult, error) {
+	result := DayResult{Date: date}
+
+	m, err := manifest.Read(dayDir)
+	if errors.Is(err, os.ErrNotExist) {
+		result.Unmanifested = true
+		return result, nil
+	}
+	if err != nil {
+		result.Corrupted = append(result.Corrupted, manifest.FileName)
+		return result, nil
+	}
+	if len(m.Files) == 0 {
+		// Written before checksums were recorded
+		result.Unmanifested = true
+		return result, nil
+	}
+
+	actual, err := manifest.ScanFiles(dayDir)
+	if err != nil {
+		return result, fmt.Errorf("failed to verify %s: %w", date, err)
+	}
+	onDisk := make(map[string]manifest.File, len(actual))
+	for _, f := range actual {
+		onDisk[f.Path] = f
+	}
+
+	for _, expected := range m.Files {
+		f, ok := onDisk[expected.Path]
+		if !ok {
+			result.Missing = append(result.Missing, expected.Path)
+			continue
+		}
+		delete(onDisk, expected.Path)
+		if f.Size != expected.Size || !strings.EqualFold(f.SHA256, expected.SHA256) {
+			result.Corrupted = append(result.Corrupted, expected.Path)
+		}
+	}
+	// Attachments live in the archive's store, but are back in the day
+	// directory once it is restored
+	for _, expected := range m.Attachments {
+		f, ok := onDisk[expected.Path]
+		if !ok {
+			continue
+		}
+		delete(onDisk, expected.Path)
+		if f.Size != expected.Size || !strings.EqualFold(f.SHA256, expected.SHA256) {
+			result.Corrupted = append(result.Corrupted, expected.Path)
+		}
+	}
+	for path := range onDisk {
+		result.Extra = append(result.Extra, path)
+	}
+	sort.Strings(result.Extra)
+
+	return result, nil
+}
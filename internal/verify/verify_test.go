@@ -0,0 +1,304 @@
+package verify
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/iwvelando/imessage-archiver/internal/attachstore"
+	"github.com/iwvelando/imessage-archiver/internal/manifest"
+)
+
+// writeDay creates root/<date path> with the given files and, if withManifest
+// is set, a manifest describing them.
+func writeDay(t *testing.T, root, date string, files map[string]string, withManifest bool) string {
+	t.Helper()
+	dayDir := filepath.Join(root, filepath.FromSlash(strings.ReplaceAll(date, "-", "/")))
+	for rel, content := range files {
+		path := filepath.Join(dayDir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", rel, err)
+		}
+	}
+	if withManifest {
+		scanned, err := manifest.ScanFiles(dayDir)
+		if err != nil {
+			t.Fatalf("ScanFiles failed: %v", err)
+		}
+		if err := manifest.Write(dayDir, &manifest.Manifest{Date: date, Files: scanned}); err != nil {
+			t.Fatalf("Failed to write manifest: %v", err)
+		}
+	}
+	return dayDir
+}
+
+func TestArchive(t *testing.T) {
+	root := t.TempDir()
+
+	writeDay(t, root, "2024-01-01", map[string]string{"messages.jsonl": "a", "attachments/x.jpg": "x"}, true)
+
+	missingDir := writeDay(t, root, "2024-01-02", map[string]string{"messages.jsonl": "b", "attachments/y.jpg": "y"}, true)
+	if err := os.Remove(filepath.Join(missingDir, "attachments", "y.jpg")); err != nil {
+		t.Fatalf("Failed to remove attachment: %v", err)
+	}
+
+	extraDir := writeDay(t, root, "2024-01-03", map[string]string{"messages.jsonl": "c"}, true)
+	if err := os.WriteFile(filepath.Join(extraDir, "stray.txt"), []byte("?"), 0644); err != nil {
+		t.Fatalf("Failed to write extra file: %v", err)
+	}
+
+	corruptDir := writeDay(t, root, "2024-01-04", map[string]string{"messages.jsonl": "d"}, true)
+	if err := os.WriteFile(filepath.Join(corruptDir, "messages.jsonl"), []byte("e"), 0644); err != nil {
+		t.Fatalf("Failed to corrupt file: %v", err)
+	}
+
+	writeDay(t, root, "2024-01-05", map[string]string{"chat.txt": "f"}, false)
+
+	// Directories that are not calendar days are ignored
+	if err := os.MkdirAll(filepath.Join(root, "2024", "13", "45"), 0755); err != nil {
+		t.Fatalf("Failed to create invalid day: %v", err)
+	}
+
+	report, err := Archive(root)
+	if err != nil {
+		t.Fatalf("Archive failed: %v", err)
+	}
+
+	if len(report.Days) != 5 {
+		t.Fatalf("Expected 5 days, got %+v", report.Days)
+	}
+
+	tests := []struct {
+		date  string
+		check func(DayResult) bool
+	}{
+		{"2024-01-01", func(d DayResult) bool { return d.OK() }},
+		{"2024-01-02", func(d DayResult) bool { return len(d.Missing) == 1 && d.Missing[0] == "attachments/y.jpg" }},
+		{"2024-01-03", func(d DayResult) bool { return len(d.Extra) == 1 && d.Extra[0] == "stray.txt" }},
+		{"2024-01-04", func(d DayResult) bool { return len(d.Corrupted) == 1 && d.Corrupted[0] == "messages.jsonl" }},
+		{"2024-01-05", func(d DayResult) bool { return d.Unmanifested }},
+	}
+	for i, tt := range tests {
+		t.Run(tt.date, func(t *testing.T) {
+			day := report.Days[i]
+			if day.Date != tt.date {
+				t.Fatalf("Expected day %s, got %s", tt.date, day.Date)
+			}
+			if !tt.check(day) {
+				t.Errorf("Unexpected result for %s: %+v", tt.date, day)
+			}
+		})
+	}
+
+	if report.OK() {
+		t.Error("Expected report with problems not to be OK")
+	}
+	if len(report.Problems()) != 4 {
+		t.Errorf("Expected 4 problem days, got %d", len(report.Problems()))
+	}
+
+	var out bytes.Buffer
+	report.WriteSummary(&out)
+	if !strings.Contains(out.String(), "2024-01-04: corrupted messages.jsonl") {
+		t.Errorf("Expected summary to list corrupted file, got:\n%s", out.String())
+	}
+}
+
+func TestDay_UnparseableManifest(t *testing.T) {
+	dayDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dayDir, manifest.FileName), []byte("{"), 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	result, err := Day(dayDir, "2024-01-01")
+	if err != nil {
+		t.Fatalf("Day failed: %v", err)
+	}
+	if len(result.Corrupted) != 1 || result.Corrupted[0] != manifest.FileName {
+		t.Errorf("Expected corrupted manifest, got %+v", result)
+	}
+}
+
+func TestDay_LegacyManifestWithoutFiles(t *testing.T) {
+	dayDir := t.TempDir()
+	if err := manifest.Write(dayDir, &manifest.Manifest{Date: "2024-01-01"}); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	result, err := Day(dayDir, "2024-01-01")
+	if err != nil {
+		t.Fatalf("Day failed: %v", err)
+	}
+	if !result.Unmanifested {
+		t.Errorf("Expected manifest without checksums to be reported as unmanifested, got %+v", result)
+	}
+}
+
+func TestArchive_PackagedDays(t *testing.T) {
+	root := t.TempDir()
+	monthDir := filepath.Join(root, "2024", "02")
+	if err := os.MkdirAll(monthDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, day := range []string{"2024-02-01", "2024-02-02", "2024-02-03"} {
+		pkg := filepath.Join(monthDir, day+".tar.zst")
+		if err := os.WriteFile(pkg, []byte(day), 0644); err != nil {
+			t.Fatal(err)
+		}
+		size, sum, err := manifest.HashFile(pkg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &manifest.Manifest{Date: day, Packaging: "tar.zst", Files: []manifest.File{{Path: day + ".tar.zst", Size: size, SHA256: sum}}}
+		if err := manifest.WriteFile(filepath.Join(monthDir, day+".manifest.json"), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(monthDir, "2024-02-02.tar.zst"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(monthDir, "2024-02-03.tar.zst")); err != nil {
+		t.Fatal(err)
+	}
+	writeDay(t, root, "2024-01-31", map[string]string{"chat.txt": "a"}, true)
+
+	report, err := Archive(root)
+	if err != nil {
+		t.Fatalf("Archive failed: %v", err)
+	}
+	var dates []string
+	for _, day := range report.Days {
+		dates = append(dates, day.Date)
+	}
+	if strings.Join(dates, ",") != "2024-01-31,2024-02-01,2024-02-02,2024-02-03" {
+		t.Fatalf("Expected directory and packaged days in order, got %v", dates)
+	}
+	if !report.Days[0].OK() || !report.Days[1].OK() {
+		t.Errorf("Expected intact days to verify, got %+v", report.Days[:2])
+	}
+	if len(report.Days[2].Corrupted) != 1 || report.Days[2].Corrupted[0] != "2024-02-02.tar.zst" {
+		t.Errorf("Expected a corrupted package, got %+v", report.Days[2])
+	}
+	if len(report.Days[3].Missing) != 1 {
+		t.Errorf("Expected a missing package, got %+v", report.Days[3])
+	}
+}
+
+func TestArchive_AttachmentStore(t *testing.T) {
+	root := t.TempDir()
+	attachments := map[string]string{"attachments/a.jpg": "jpeg", "attachments/b.png": "png", "attachments/c.gif": "gif"}
+	var stored []manifest.Attachment
+	for name, content := range attachments {
+		p := filepath.Join(root, "blob")
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		size, sum, err := manifest.HashFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := manifest.Attachment{Path: name, Size: size, SHA256: sum}
+		blob := filepath.Join(root, filepath.FromSlash(attachstore.Path(a)))
+		if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(p, blob); err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, a)
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].Path < stored[j].Path })
+
+	// Two days share a.jpg; b.png is damaged and c.gif is gone
+	for date, refs := range map[string][]manifest.Attachment{
+		"2024-01-01": {stored[0]},
+		"2024-01-02": {stored[0], stored[1], stored[2]},
+	} {
+		dayDir := writeDay(t, root, date, map[string]string{"chat.txt": date}, true)
+		m, err := manifest.Read(dayDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Attachments = refs
+		if err := manifest.Write(dayDir, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, filepath.FromSlash(attachstore.Path(stored[1]))), []byte("PNG"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, filepath.FromSlash(attachstore.Path(stored[2])))); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Archive(root)
+	if err != nil {
+		t.Fatalf("Archive failed: %v", err)
+	}
+	if len(report.Days) != 2 {
+		t.Fatalf("Expected the store not to be reported as days, got %+v", report.Days)
+	}
+	if !report.Days[0].OK() {
+		t.Errorf("Expected the first day to verify, got %+v", report.Days[0])
+	}
+	second := report.Days[1]
+	if len(second.Corrupted) != 1 || second.Corrupted[0] != attachstore.Path(stored[1]) {
+		t.Errorf("Expected the damaged attachment to be reported, got %+v", second)
+	}
+	if len(second.Missing) != 1 || second.Missing[0] != attachstore.Path(stored[2]) {
+		t.Errorf("Expected the missing attachment to be reported, got %+v", second)
+	}
+}
+
+func TestArchive_MissingDays(t *testing.T) {
+	root := t.TempDir()
+	for _, date := range []string{"2024-01-30", "2024-02-02", "2024-02-04"} {
+		writeDay(t, root, date, map[string]string{"chat.txt": date}, true)
+	}
+	// A packaged day fills the hole as much as a day directory does
+	monthDir := filepath.Join(root, "2024", "02")
+	pkg := filepath.Join(monthDir, "2024-02-03.tar.zst")
+	if err := os.WriteFile(pkg, []byte("tarball"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	size, sum, err := manifest.HashFile(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &manifest.Manifest{Date: "2024-02-03", Packaging: "tar.zst", Files: []manifest.File{{Path: "2024-02-03.tar.zst", Size: size, SHA256: sum}}}
+	if err := manifest.WriteFile(filepath.Join(monthDir, "2024-02-03.manifest.json"), m); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Archive(root)
+	if err != nil {
+		t.Fatalf("Archive failed: %v", err)
+	}
+	if len(report.Problems()) != 0 {
+		t.Errorf("Expected every archived day to verify, got %+v", report.Problems())
+	}
+	if got := strings.Join(report.MissingDays, ","); got != "2024-01-31,2024-02-01" {
+		t.Errorf("Expected the days in the hole to be missing, got %q", got)
+	}
+	if report.OK() {
+		t.Error("Expected report with missing days not to be OK")
+	}
+
+	var out bytes.Buffer
+	report.WriteSummary(&out)
+	if !strings.Contains(out.String(), "2024-01-31: missing day") || !strings.Contains(out.String(), "2 days missing") {
+		t.Errorf("Expected summary to list missing days, got:\n%s", out.String())
+	}
+}
+
+func TestArchive_MissingRoot(t *testing.T) {
+	if _, err := Archive(filepath.Join(t.TempDir(), "nope")); err == nil {
+		t.Error("Expected error for missing archive root")
+	}
+}
@@ -0,0 +1,6 @@
+// Package version exposes the archiver's build version.
+package version
+
+// Version is the archiver version, set at build time with
+// -ldflags "-X github.com/iwvelando/imessage-archiver/internal/version.Version=...".
+var Version = "dev"